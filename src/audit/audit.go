@@ -0,0 +1,205 @@
+// Package audit はリソースの変更履歴（監査ログ）に記録する、変更したユーザーとリクエストの情報を提供します
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"google.golang.org/api/idtoken"
+)
+
+// 監査ログの操作
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+// ActorSystem はリクエスト以外（ジョブなど）の変更のActor
+const ActorSystem = "system"
+
+// ActorAnonymous は認証情報もヘッダーもないリクエストのActor
+const ActorAnonymous = "anonymous"
+
+// Metadata は変更を行ったリクエストの情報
+type Metadata struct {
+	// Actor は変更したユーザー
+	Actor string
+	// RequestID はリクエストの識別子（X-Request-Id）
+	RequestID string
+}
+
+type metadataKey struct{}
+
+// WithMetadata はmdを設定したコンテキストを返します
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// FromContext はコンテキストのMetadataを返します
+// 設定されていない場合（ジョブなど）のActorはsystem
+func FromContext(ctx context.Context) Metadata {
+	md, ok := ctx.Value(metadataKey{}).(Metadata)
+	if !ok || md.Actor == "" {
+		md.Actor = ActorSystem
+	}
+	return md
+}
+
+// NewRequestID は新しいリクエストIDを返します
+func NewRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// リクエストの情報を取得するヘッダー（gRPCのメタデータも同じ名前）
+const (
+	// HeaderRequestID はリクエストID。ない場合は生成する
+	HeaderRequestID = "X-Request-Id"
+	// headerIAPAssertion はIdentity-Aware Proxyが署名したJWT
+	headerIAPAssertion = "X-Goog-IAP-JWT-Assertion"
+	// headerIAPUser はIdentity-Aware Proxyが認証したユーザー（accounts.google.com:user@example.com）
+	headerIAPUser = "X-Goog-Authenticated-User-Email"
+	// headerActor はゲートウェイなどが設定する変更したユーザー
+	headerActor = "X-Actor"
+)
+
+// iapIssuer はIAPが署名したJWTのiss
+const iapIssuer = "https://cloud.google.com/iap"
+
+// maxHeaderLength はActorとリクエストIDの最大長
+const maxHeaderLength = 128
+
+// Config は変更したユーザーを取得する際に信頼するリクエストの条件
+// どちらも設定しない場合、Actorは常にanonymous
+type Config struct {
+	// IAPAudience はX-Goog-IAP-JWT-Assertionの検証に使うaud（空の場合は検証しない）
+	// 例: /projects/PROJECT_NUMBER/global/backendServices/SERVICE_ID
+	IAPAudience string
+	// TrustedProxies はX-Goog-Authenticated-User-EmailとX-Actorを信頼する接続元のアドレス
+	// ヘッダーを上書きする前段のプロキシやゲートウェイのアドレスだけを指定する
+	TrustedProxies []netip.Prefix
+}
+
+// Resolver はリクエストからMetadataを作成します
+type Resolver struct {
+	config Config
+	// validate はIAPのJWTを検証してメールアドレスを返す（テストで置き換える）
+	validate func(ctx context.Context, token, audience string) (string, error)
+}
+
+// NewResolver は新しいResolverを作成します
+func NewResolver(cfg Config) *Resolver {
+	return &Resolver{config: cfg, validate: validateIAP}
+}
+
+// Metadata はリクエストのヘッダーと接続元のアドレスからMetadataを作成します
+// Actorは検証したIAPのJWT、信頼するプロキシからのX-Goog-Authenticated-User-Email、X-Actorの順に使用し、
+// どれもない場合はanonymous。クライアントが自由に設定できるヘッダーは信頼しない
+// X-Request-Idがない、または不正な場合は新しいリクエストIDを生成する
+func (r *Resolver) Metadata(ctx context.Context, remoteAddr string, get func(name string) string) Metadata {
+	md := Metadata{Actor: ActorAnonymous, RequestID: get(HeaderRequestID)}
+	if actor := r.actor(ctx, remoteAddr, get); actor != "" {
+		md.Actor = actor
+	}
+	if len(md.Actor) > maxHeaderLength {
+		md.Actor = md.Actor[:maxHeaderLength]
+	}
+	if !validRequestID(md.RequestID) {
+		md.RequestID = NewRequestID()
+	}
+	return md
+}
+
+// actor は信頼できる情報から変更したユーザーを返します。ない場合は空
+func (r *Resolver) actor(ctx context.Context, remoteAddr string, get func(name string) string) string {
+	if token := get(headerIAPAssertion); token != "" && r.config.IAPAudience != "" {
+		if email, err := r.validate(ctx, token, r.config.IAPAudience); err == nil {
+			return email
+		}
+	}
+	if !r.Trusted(remoteAddr) {
+		return ""
+	}
+	if user := get(headerIAPUser); user != "" {
+		return strings.TrimPrefix(user, "accounts.google.com:")
+	}
+	return get(headerActor)
+}
+
+// Trusted は接続元のアドレスがTrustedProxiesに含まれるかを返します
+// remoteAddrはhost:portまたはアドレスのみ
+func (r *Resolver) Trusted(remoteAddr string) bool {
+	if len(r.config.TrustedProxies) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range r.config.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTrustedProxies はCIDRまたはIPアドレスのリストを解析します
+func ParseTrustedProxies(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, v := range list {
+		if addr, err := netip.ParseAddr(v); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", v, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// validateIAP はIAPのJWTの署名・有効期限・aud・issを検証してメールアドレスを返します
+func validateIAP(ctx context.Context, token, audience string) (string, error) {
+	payload, err := idtoken.Validate(ctx, token, audience)
+	if err != nil {
+		return "", err
+	}
+	if payload.Issuer != iapIssuer {
+		return "", fmt.Errorf("unexpected IAP token issuer %q", payload.Issuer)
+	}
+	email, _ := payload.Claims["email"].(string)
+	if email == "" {
+		return "", fmt.Errorf("IAP token has no email")
+	}
+	return email, nil
+}
+
+// validRequestID はリクエストIDが英数字と-_.:のみで構成されているかを返します
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxHeaderLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', strings.ContainsRune("-_.:", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
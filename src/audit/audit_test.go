@@ -0,0 +1,121 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolverMetadata(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewResolver(Config{IAPAudience: "/projects/1/global/backendServices/2", TrustedProxies: proxies})
+	r.validate = func(ctx context.Context, token, audience string) (string, error) {
+		if token != "valid" || audience != r.config.IAPAudience {
+			return "", errors.New("invalid token")
+		}
+		return "iap@example.com", nil
+	}
+
+	const trusted, untrusted = "10.1.2.3:5000", "203.0.113.1:5000"
+	tests := []struct {
+		remoteAddr string
+		header     map[string]string
+		actor      string
+		requestID  string
+	}{
+		{untrusted, map[string]string{}, ActorAnonymous, ""},
+		{trusted, map[string]string{"X-Actor": "admin", "X-Request-Id": "req-1"}, "admin", "req-1"},
+		{"192.0.2.1:443", map[string]string{"X-Goog-Authenticated-User-Email": "accounts.google.com:taro@example.com", "X-Actor": "admin"}, "taro@example.com", ""},
+		{"[::ffff:10.0.0.1]:5000", map[string]string{"X-Actor": "admin"}, "admin", ""},
+		// 信頼しない接続元のヘッダーは無視する
+		{untrusted, map[string]string{"X-Actor": "admin"}, ActorAnonymous, ""},
+		{untrusted, map[string]string{"X-Goog-Authenticated-User-Email": "accounts.google.com:taro@example.com"}, ActorAnonymous, ""},
+		// 検証したIAPのJWTは接続元に関係なく使用し、ヘッダーより優先する
+		{untrusted, map[string]string{"X-Goog-IAP-JWT-Assertion": "valid"}, "iap@example.com", ""},
+		{trusted, map[string]string{"X-Goog-IAP-JWT-Assertion": "valid", "X-Actor": "admin"}, "iap@example.com", ""},
+		{untrusted, map[string]string{"X-Goog-IAP-JWT-Assertion": "forged", "X-Actor": "admin"}, ActorAnonymous, ""},
+		{trusted, map[string]string{"X-Actor": strings.Repeat("a", maxHeaderLength+1)}, strings.Repeat("a", maxHeaderLength), ""},
+		{untrusted, map[string]string{"X-Request-Id": "bad id\n"}, ActorAnonymous, ""},
+		{untrusted, map[string]string{"X-Request-Id": strings.Repeat("a", maxHeaderLength+1)}, ActorAnonymous, ""},
+	}
+	for _, tt := range tests {
+		md := r.Metadata(context.Background(), tt.remoteAddr, func(name string) string { return tt.header[name] })
+		if md.Actor != tt.actor {
+			t.Errorf("Actor = %q, want %q (%s, header %v)", md.Actor, tt.actor, tt.remoteAddr, tt.header)
+		}
+		// 空の場合は生成したリクエストIDを確認する
+		if tt.requestID != "" && md.RequestID != tt.requestID || tt.requestID == "" && (len(md.RequestID) != 32 || md.RequestID == tt.header[HeaderRequestID]) {
+			t.Errorf("RequestID = %q, want %q (header %v)", md.RequestID, tt.requestID, tt.header)
+		}
+	}
+}
+
+func TestResolverWithoutConfigIsAnonymous(t *testing.T) {
+	r := NewResolver(Config{})
+	header := map[string]string{
+		"X-Goog-IAP-JWT-Assertion":        "token",
+		"X-Goog-Authenticated-User-Email": "accounts.google.com:taro@example.com",
+		"X-Actor":                         "admin",
+	}
+	md := r.Metadata(context.Background(), "127.0.0.1:5000", func(name string) string { return header[name] })
+	if md.Actor != ActorAnonymous {
+		t.Fatalf("Actor = %q, want %q", md.Actor, ActorAnonymous)
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	got, err := ParseTrustedProxies([]string{"10.0.0.1/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::1/128")}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if _, err := ParseTrustedProxies([]string{"proxy.example.com"}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	if md := FromContext(context.Background()); md.Actor != ActorSystem || md.RequestID != "" {
+		t.Fatalf("FromContext = %+v, want system actor", md)
+	}
+	want := Metadata{Actor: "admin", RequestID: "req-1"}
+	if md := FromContext(WithMetadata(context.Background(), want)); md != want {
+		t.Fatalf("FromContext = %+v, want %+v", md, want)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	type user struct {
+		ID        uint      `json:"id"`
+		Name      string    `json:"name"`
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+	before := &user{ID: 1, Name: "Taro", UpdatedAt: time.Unix(1, 0)}
+	after := &user{ID: 1, Name: "Jiro", UpdatedAt: time.Unix(2, 0)}
+
+	tests := []struct {
+		before, after *user
+		want          map[string]Change
+	}{
+		{before, after, map[string]Change{"name": {From: "Taro", To: "Jiro"}}},
+		{before, before, map[string]Change{}},
+		{nil, before, map[string]Change{"id": {To: 1.0}, "name": {To: "Taro"}}},
+		{before, nil, map[string]Change{"id": {From: 1.0}, "name": {From: "Taro"}}},
+	}
+	for _, tt := range tests {
+		got, err := Diff(tt.before, tt.after)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Diff(%+v, %+v) = %v, %v; want %v", tt.before, tt.after, got, err, tt.want)
+		}
+	}
+}
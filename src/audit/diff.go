@@ -0,0 +1,64 @@
+package audit
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// Change はフィールドの変更前と変更後の値
+// 作成時のFrom、削除時のToはnil
+type Change struct {
+	From any `json:"from"`
+	To   any `json:"to"`
+}
+
+// ignoredFields は変更として記録しないフィールド
+var ignoredFields = map[string]bool{
+	"created_at": true,
+	"updated_at": true,
+}
+
+// Diff はbeforeとafterをJSONのフィールドごとに比較し、変更されたフィールドを返します
+// beforeまたはafterがnilの場合は、もう一方の全てのフィールドを変更として扱う
+func Diff(before, after any) (map[string]Change, error) {
+	from, err := fields(before)
+	if err != nil {
+		return nil, err
+	}
+	to, err := fields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := map[string]Change{}
+	for _, m := range []map[string]any{from, to} {
+		for name := range m {
+			if _, ok := changes[name]; ok || ignoredFields[name] {
+				continue
+			}
+			if !reflect.DeepEqual(from[name], to[name]) {
+				changes[name] = Change{From: from[name], To: to[name]}
+			}
+		}
+	}
+	return changes, nil
+}
+
+// fields はvをJSONのオブジェクトとしてフィールドの値を返します
+func fields(v any) (map[string]any, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Pointer && rv.IsNil() {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]any
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,228 @@
+// Package cache は読み込み用のキャッシュ（read-through）を提供します
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"otel-test/o11y"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+)
+
+// Backend はキャッシュの保存先
+// プロセス内のLRUのほか、Redis互換のサーバー（GET / SET PX / DEL）で実装できる
+type Backend interface {
+	// Get はkeyの値を返す（存在しない場合はok=false）
+	Get(ctx context.Context, key string) (value []byte, ok bool, err error)
+	// Set はkeyにvalueをttlの間保存する
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Delete はkeysを削除する
+	Delete(ctx context.Context, keys ...string) error
+}
+
+// Config はCacheの設定
+type Config struct {
+	// TTL は値を保存する期間
+	TTL time.Duration
+	// NegativeTTL は存在しないことを保存する期間（0の場合は保存しない）
+	NegativeTTL time.Duration
+}
+
+// Cache はBackendを使用するread-throughキャッシュ
+// 同じキーの同時の読み込みは1回にまとめる（キャッシュスタンピード対策）
+// Backendのエラーはログに記録し、キャッシュなしとして処理を続ける
+//
+// 読み込みを開始した後にDeleteしたキーには、読み込んだ値を保存しない（削除前の古い値をTTLの間返さないため）
+// 検知できるのは同じCacheのDeleteだけで、他のプロセスでの削除は検知しない
+type Cache struct {
+	name    string
+	backend Backend
+	config  Config
+	group   singleflight.Group
+	hits    metric.Int64Counter
+	misses  metric.Int64Counter
+	attrs   metric.MeasurementOption
+
+	mu      sync.Mutex
+	flights map[*flight]struct{} // 実行中の読み込み
+}
+
+// flight はFetchの1回の読み込み
+// 読み込み中にDeleteしたキーを記録する
+type flight struct {
+	deleted map[string]bool
+}
+
+type flightKey struct{}
+
+// New は新しいCacheを作成します
+// nameはメトリクスの属性（cache.name）に使用する
+func New(name string, backend Backend, config Config) *Cache {
+	if config.TTL <= 0 {
+		config.TTL = 5 * time.Minute
+	}
+
+	meter := otel.Meter("cache")
+	hits, _ := meter.Int64Counter("cache.hits",
+		metric.WithDescription("Number of cache lookups served from the cache"),
+		metric.WithUnit("{lookup}"),
+	)
+	misses, _ := meter.Int64Counter("cache.misses",
+		metric.WithDescription("Number of cache lookups that fell through to the loader"),
+		metric.WithUnit("{lookup}"),
+	)
+
+	return &Cache{
+		name:    name,
+		backend: backend,
+		config:  config,
+		hits:    hits,
+		misses:  misses,
+		attrs:   metric.WithAttributes(attribute.String("cache.name", name)),
+		flights: make(map[*flight]struct{}),
+	}
+}
+
+// Fetch はkeyの値を返します
+// キャッシュにない場合はloadで読み込んで保存する。loadがnilを返した場合は存在しないものとして
+// NegativeTTLの間保存し、nilを返す
+// 呼び出し元のスパンにはcache.hitを記録する
+func (c *Cache) Fetch(ctx context.Context, key string, load func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	span := trace.SpanFromContext(ctx)
+
+	value, ok, err := c.backend.Get(ctx, key)
+	if err != nil {
+		c.logError(ctx, "get", key, err)
+	}
+	if ok {
+		c.hits.Add(ctx, 1, c.attrs)
+		span.SetAttributes(attribute.Bool("cache.hit", true))
+		if len(value) == 0 {
+			return nil, nil
+		}
+		return value, nil
+	}
+
+	c.misses.Add(ctx, 1, c.attrs)
+	span.SetAttributes(attribute.Bool("cache.hit", false))
+
+	// 最初の呼び出し元がキャンセルしても他の呼び出し元に影響しないようにする
+	result, err, shared := c.group.Do(key, func() (any, error) {
+		f := c.begin()
+		defer c.end(f)
+		loadCtx := context.WithValue(context.WithoutCancel(ctx), flightKey{}, f)
+		value, err := load(loadCtx)
+		if err != nil {
+			return nil, err
+		}
+		ttl := c.config.TTL
+		if value == nil {
+			ttl = c.config.NegativeTTL
+		}
+		if ttl > 0 {
+			c.set(loadCtx, f, key, value, ttl)
+		}
+		return value, nil
+	})
+	span.SetAttributes(attribute.Bool("cache.shared", shared))
+	if err != nil {
+		return nil, err
+	}
+	return result.([]byte), nil
+}
+
+// Set はkeyに値を保存します
+// 読み込み時に関連する別のキーの値が分かった場合などに使用する
+// Fetchのloadの中で呼んだ場合は、読み込みを開始した後にDeleteしたキーには保存しない
+func (c *Cache) Set(ctx context.Context, key string, value []byte) {
+	f, _ := ctx.Value(flightKey{}).(*flight)
+	c.set(ctx, f, key, value, c.config.TTL)
+}
+
+// Delete はkeysをキャッシュから削除します
+// 実行中の読み込みには削除したことを記録し、削除前の値を保存しないようにする
+func (c *Cache) Delete(ctx context.Context, keys ...string) {
+	c.mu.Lock()
+	for f := range c.flights {
+		for _, key := range keys {
+			f.deleted[key] = true
+		}
+	}
+	c.mu.Unlock()
+
+	for _, key := range keys {
+		c.group.Forget(key)
+	}
+	if err := c.backend.Delete(ctx, keys...); err != nil {
+		c.logError(ctx, "delete", keys[0], err)
+	}
+}
+
+// set はkeyに値を保存します
+// fの読み込み中にkeyを削除していた場合は保存しない。保存中に削除した場合は保存した値を削除する
+func (c *Cache) set(ctx context.Context, f *flight, key string, value []byte, ttl time.Duration) {
+	if c.deleted(f, key) {
+		return
+	}
+	if err := c.backend.Set(ctx, key, value, ttl); err != nil {
+		c.logError(ctx, "set", key, err)
+		return
+	}
+	if c.deleted(f, key) {
+		if err := c.backend.Delete(ctx, key); err != nil {
+			c.logError(ctx, "delete", key, err)
+		}
+	}
+}
+
+// begin は読み込みを開始し、以降のDeleteを記録します
+func (c *Cache) begin() *flight {
+	f := &flight{deleted: make(map[string]bool)}
+	c.mu.Lock()
+	c.flights[f] = struct{}{}
+	c.mu.Unlock()
+	return f
+}
+
+// end は読み込みを終了します
+func (c *Cache) end(f *flight) {
+	c.mu.Lock()
+	delete(c.flights, f)
+	c.mu.Unlock()
+}
+
+// deleted はfの読み込み中にkeyを削除したかを返します
+func (c *Cache) deleted(f *flight, key string) bool {
+	if f == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return f.deleted[key]
+}
+
+// logError はBackendのエラーを記録します
+// キーにはメールアドレスなどの個人情報を含むことがあるため、ハッシュ値だけを出力する
+func (c *Cache) logError(ctx context.Context, op, key string, err error) {
+	trace.SpanFromContext(ctx).RecordError(err)
+	o11y.Logger("cache").WarnContext(ctx, "cache backend error",
+		slog.String("cache.name", c.name),
+		slog.String("cache.operation", op),
+		slog.String("cache.key_hash", hashKey(key)),
+		slog.Any("error", err),
+	)
+}
+
+// hashKey はキーのSHA-256の先頭8バイトを16進数で返します
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
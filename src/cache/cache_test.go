@@ -0,0 +1,219 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"otel-test/o11y/o11ytest"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	h := o11ytest.New(t)
+	ctx := context.Background()
+	c := NewLRU("test", 2)
+
+	_ = c.Set(ctx, "a", []byte("1"), time.Minute)
+	_ = c.Set(ctx, "b", []byte("2"), time.Minute)
+	// aを使用したのでbが最も古くなる
+	if _, ok, _ := c.Get(ctx, "a"); !ok {
+		t.Fatal("a not found")
+	}
+	_ = c.Set(ctx, "c", []byte("3"), time.Minute)
+
+	if _, ok, _ := c.Get(ctx, "b"); ok {
+		t.Fatal("b was not evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok, _ := c.Get(ctx, key); !ok {
+			t.Fatalf("%s was evicted", key)
+		}
+	}
+	h.Metric("cache.evictions").
+		WithAttrs(attribute.String("cache.name", "test"), attribute.String("cache.eviction.reason", "capacity")).
+		HasValue(1)
+}
+
+func TestLRUExpires(t *testing.T) {
+	h := o11ytest.New(t)
+	ctx := context.Background()
+	c := NewLRU("test", 10)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	_ = c.Set(ctx, "a", []byte("1"), time.Second)
+	now = now.Add(time.Second)
+	if _, ok, _ := c.Get(ctx, "a"); ok {
+		t.Fatal("expired entry returned")
+	}
+	if c.Len() != 0 {
+		t.Fatalf("len = %d, want 0", c.Len())
+	}
+	h.Metric("cache.evictions").
+		WithAttrs(attribute.String("cache.name", "test"), attribute.String("cache.eviction.reason", "expired")).
+		HasValue(1)
+}
+
+func TestFetchCachesValuesAndNotFound(t *testing.T) {
+	h := o11ytest.New(t)
+	c := New("test", NewLRU("test", 10), Config{TTL: time.Minute, NegativeTTL: time.Minute})
+
+	var loads atomic.Int32
+	load := func(value []byte) func(context.Context) ([]byte, error) {
+		return func(context.Context) ([]byte, error) {
+			loads.Add(1)
+			return value, nil
+		}
+	}
+
+	ctx, span := otel.Tracer("test").Start(context.Background(), "lookup")
+	for range 2 {
+		got, err := c.Fetch(ctx, "found", load([]byte("v")))
+		if err != nil || string(got) != "v" {
+			t.Fatalf("got %q, %v", got, err)
+		}
+		got, err = c.Fetch(ctx, "missing", load(nil))
+		if err != nil || got != nil {
+			t.Fatalf("got %q, %v", got, err)
+		}
+	}
+	span.End()
+
+	if loads.Load() != 2 {
+		t.Fatalf("loads = %d, want 2", loads.Load())
+	}
+	h.Metric("cache.hits").WithAttrs(attribute.String("cache.name", "test")).HasValue(2)
+	h.Metric("cache.misses").WithAttrs(attribute.String("cache.name", "test")).HasValue(2)
+	h.Span("lookup").HasAttr("cache.hit", true)
+
+	// 削除後は再度読み込む
+	c.Delete(context.Background(), "found")
+	if _, err := c.Fetch(context.Background(), "found", load([]byte("v"))); err != nil {
+		t.Fatal(err)
+	}
+	if loads.Load() != 3 {
+		t.Fatalf("loads = %d, want 3", loads.Load())
+	}
+}
+
+func TestFetchDoesNotCacheErrors(t *testing.T) {
+	o11ytest.New(t)
+	c := New("test", NewLRU("test", 10), Config{NegativeTTL: time.Minute})
+
+	boom := errors.New("boom")
+	if _, err := c.Fetch(context.Background(), "k", func(context.Context) ([]byte, error) { return nil, boom }); !errors.Is(err, boom) {
+		t.Fatalf("err = %v, want %v", err, boom)
+	}
+	got, err := c.Fetch(context.Background(), "k", func(context.Context) ([]byte, error) { return []byte("v"), nil })
+	if err != nil || string(got) != "v" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestFetchCoalescesConcurrentLoads(t *testing.T) {
+	o11ytest.New(t)
+	c := New("test", NewLRU("test", 10), Config{})
+
+	var loads atomic.Int32
+	release := make(chan struct{})
+	load := func(context.Context) ([]byte, error) {
+		loads.Add(1)
+		<-release
+		return []byte("v"), nil
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	var started sync.WaitGroup
+	started.Add(n)
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			started.Done()
+			if got, err := c.Fetch(context.Background(), "k", load); err != nil || string(got) != "v" {
+				t.Errorf("got %q, %v", got, err)
+			}
+		}()
+	}
+	started.Wait()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if loads.Load() != 1 {
+		t.Fatalf("loads = %d, want 1", loads.Load())
+	}
+}
+
+func TestFetchDoesNotSaveValueDeletedDuringLoad(t *testing.T) {
+	o11ytest.New(t)
+	c := New("test", NewLRU("test", 10), Config{TTL: time.Minute})
+	ctx := context.Background()
+
+	// 読み込み中に更新して削除した場合、読み込んだ更新前の値は保存しない
+	got, err := c.Fetch(ctx, "user:1", func(ctx context.Context) ([]byte, error) {
+		c.Delete(context.Background(), "user:1", "user:2")
+		c.Set(ctx, "user:2", []byte("old"))
+		c.Set(ctx, "user:3", []byte("v3"))
+		return []byte("old"), nil
+	})
+	if err != nil || string(got) != "old" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	for key, want := range map[string]bool{"user:1": false, "user:2": false, "user:3": true} {
+		if _, ok, _ := c.backend.Get(ctx, key); ok != want {
+			t.Errorf("%s cached = %v, want %v", key, ok, want)
+		}
+	}
+
+	// 削除後に開始した読み込みの値は保存する
+	if _, err := c.Fetch(ctx, "user:1", func(context.Context) ([]byte, error) { return []byte("new"), nil }); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok, _ := c.backend.Get(ctx, "user:1"); !ok || string(got) != "new" {
+		t.Fatalf("got %q, %v", got, ok)
+	}
+	if len(c.flights) != 0 {
+		t.Fatalf("flights = %d, want 0", len(c.flights))
+	}
+}
+
+// failingBackend は常に失敗するBackend
+type failingBackend struct{}
+
+func (failingBackend) Get(context.Context, string) ([]byte, bool, error) {
+	return nil, false, errors.New("connection refused")
+}
+func (failingBackend) Set(context.Context, string, []byte, time.Duration) error {
+	return errors.New("connection refused")
+}
+func (failingBackend) Delete(context.Context, ...string) error {
+	return errors.New("connection refused")
+}
+
+func TestBackendErrorLogDoesNotContainKey(t *testing.T) {
+	h := o11ytest.New(t)
+	c := New("test", failingBackend{}, Config{})
+	key := "user:acme:email:taro@example.com"
+
+	got, err := c.Fetch(context.Background(), key, func(context.Context) ([]byte, error) { return []byte("1"), nil })
+	if err != nil || string(got) != "1" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	logs := h.Logs().Containing("cache backend error").Len(2).WithAttr("cache.key_hash", hashKey(key)).Len(2)
+	for _, record := range logs.Records() {
+		for k, v := range record.Attrs {
+			if strings.Contains(v.String(), "taro@example.com") {
+				t.Errorf("%s contains the key: %s", k, v)
+			}
+		}
+	}
+}
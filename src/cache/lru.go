@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// 削除の理由（メトリクスの属性）
+const (
+	evictCapacity = "capacity"
+	evictExpired  = "expired"
+)
+
+// LRU はプロセス内のLRU+TTLのBackend
+type LRU struct {
+	mu        sync.Mutex
+	capacity  int
+	items     map[string]*list.Element
+	order     *list.List // 先頭が最近使用したもの
+	now       func() time.Time
+	evictions metric.Int64Counter
+	name      string
+}
+
+type lruEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+// NewLRU は最大capacity件を保持するLRUを作成します
+// nameはメトリクスの属性（cache.name）に使用する
+func NewLRU(name string, capacity int) *LRU {
+	if capacity <= 0 {
+		capacity = 10000
+	}
+	evictions, _ := otel.Meter("cache").Int64Counter("cache.evictions",
+		metric.WithDescription("Number of entries evicted from the in-process cache"),
+		metric.WithUnit("{entry}"),
+	)
+	return &LRU{
+		capacity:  capacity,
+		items:     make(map[string]*list.Element),
+		order:     list.New(),
+		now:       time.Now,
+		evictions: evictions,
+		name:      name,
+	}
+}
+
+func (c *LRU) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := elem.Value.(*lruEntry)
+	if !c.now().Before(entry.expiresAt) {
+		c.remove(elem)
+		c.evicted(ctx, evictExpired)
+		return nil, false, nil
+	}
+	c.order.MoveToFront(elem)
+	return entry.value, true, nil
+}
+
+func (c *LRU) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := c.now().Add(ttl)
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		entry.value = value
+		entry.expiresAt = expiresAt
+		c.order.MoveToFront(elem)
+		return nil
+	}
+
+	c.items[key] = c.order.PushFront(&lruEntry{key: key, value: value, expiresAt: expiresAt})
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+		c.evicted(ctx, evictCapacity)
+	}
+	return nil
+}
+
+func (c *LRU) Delete(ctx context.Context, keys ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		if elem, ok := c.items[key]; ok {
+			c.remove(elem)
+		}
+	}
+	return nil
+}
+
+// Len は保持している件数を返します（期限切れを含む）
+func (c *LRU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *LRU) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.items, elem.Value.(*lruEntry).key)
+}
+
+func (c *LRU) evicted(ctx context.Context, reason string) {
+	c.evictions.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("cache.name", c.name),
+		attribute.String("cache.eviction.reason", reason),
+	))
+}
@@ -0,0 +1,53 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"cloud.google.com/go/cloudsqlconn"
+	"github.com/jackc/pgx/v5"
+)
+
+// newCloudSQLDialer はCloud SQL Goコネクターのダイヤラーを作成します
+// 認証情報はApplication Default Credentialsを使用する
+func newCloudSQLDialer(ctx context.Context, config CloudSQLConfig) (*cloudsqlconn.Dialer, error) {
+	var opts []cloudsqlconn.Option
+	if config.IAMAuth {
+		// ログイン用のトークンはコネクターが証明書と一緒に更新する
+		opts = append(opts, cloudsqlconn.WithIAMAuthN())
+	}
+	if config.PrivateIP {
+		opts = append(opts, cloudsqlconn.WithDefaultDialOptions(cloudsqlconn.WithPrivateIP()))
+	}
+	dialer, err := cloudsqlconn.NewDialer(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Cloud SQL dialer: %w", err)
+	}
+	return dialer, nil
+}
+
+// pgxConfig はepに接続するpgxの設定を作成します
+// パスワードは含めず、接続ごとにPasswordProviderから設定する
+func pgxConfig(config CloudSQLConfig, ep endpoint, dialer *cloudsqlconn.Dialer) (*pgx.ConnConfig, error) {
+	if dialer == nil {
+		return pgx.ParseConfig(fmt.Sprintf("host=%s port=%d user=%s dbname=%s sslmode=%s",
+			dsnValue(ep.address), ep.port, dsnValue(config.User), dsnValue(config.DBName), dsnValue(config.SSLMode)))
+	}
+
+	// 通信はコネクターがTLSで暗号化する
+	connConfig, err := pgx.ParseConfig(fmt.Sprintf("user=%s dbname=%s sslmode=disable", dsnValue(config.User), dsnValue(config.DBName)))
+	if err != nil {
+		return nil, err
+	}
+	connConfig.DialFunc = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.Dial(ctx, ep.address)
+	}
+	return connConfig, nil
+}
+
+// dsnValue はDSNの値を引用符で囲みます（空の値や空白を含む値に対応する）
+func dsnValue(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
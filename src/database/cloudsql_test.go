@@ -0,0 +1,143 @@
+package database
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cloud.google.com/go/cloudsqlconn"
+)
+
+func TestCloudSQLConfigFromEnv(t *testing.T) {
+	t.Setenv("DB_CONNECTOR", "CloudSQL")
+	t.Setenv("DB_INSTANCE_CONNECTION_NAME", "project:region:primary")
+	t.Setenv("DB_PRIVATE_IP", "true")
+	t.Setenv("DB_IAM_AUTH", "true")
+	t.Setenv("DB_USER", "app@project.iam")
+	t.Setenv("DB_REPLICA_HOSTS", "project:region:replica-a, project:region:replica-b")
+
+	config := CloudSQLConfigFromEnv()
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if config.Connector != ConnectorCloudSQL || !config.PrivateIP || !config.IAMAuth {
+		t.Fatalf("config = %+v", config)
+	}
+	// IAMデータベース認証ではパスワードを使用しない
+	if p := config.passwordProvider(); p != nil {
+		t.Fatalf("password provider = %v, want nil", p)
+	}
+
+	eps, err := config.endpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []endpoint{
+		{node: NodePrimary, address: "project:region:primary"},
+		{node: "replica-0", address: "project:region:replica-a"},
+		{node: "replica-1", address: "project:region:replica-b"},
+	}
+	if len(eps) != len(want) {
+		t.Fatalf("endpoints = %v", eps)
+	}
+	for i := range want {
+		if eps[i] != want[i] {
+			t.Fatalf("endpoints[%d] = %v, want %v", i, eps[i], want[i])
+		}
+	}
+
+	connConfig, err := pgxConfig(config, eps[0], &cloudsqlconn.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connConfig.DialFunc == nil || connConfig.TLSConfig != nil || connConfig.Password != "" {
+		t.Fatal("connector config must dial through the connector without TLS or password")
+	}
+}
+
+func TestCloudSQLConfigDSN(t *testing.T) {
+	t.Setenv("DB_HOST", "localhost")
+	t.Setenv("DB_PASSWORD", "secret")
+	t.Setenv("DB_SSLMODE", "disable")
+	t.Setenv("DB_REPLICA_HOSTS", "replica:6432")
+
+	config := CloudSQLConfigFromEnv()
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := config.passwordProvider().Password(context.Background()); p != "secret" {
+		t.Fatalf("password = %q", p)
+	}
+	eps, err := config.endpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eps[1] != (endpoint{node: "replica-0", address: "replica", port: 6432}) {
+		t.Fatalf("replica endpoint = %v", eps[1])
+	}
+
+	// パスワードはDSNに含めない
+	connConfig, err := pgxConfig(config, eps[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connConfig.Host != "localhost" || connConfig.Port != 5432 || connConfig.Password != "" {
+		t.Fatalf("conn config = %s:%d (password %q)", connConfig.Host, connConfig.Port, connConfig.Password)
+	}
+}
+
+func TestCloudSQLConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config CloudSQLConfig
+	}{
+		{"unknown connector", CloudSQLConfig{Connector: "proxy"}},
+		{"missing instance", CloudSQLConfig{Connector: ConnectorCloudSQL}},
+		{"iam without connector", CloudSQLConfig{Connector: ConnectorDSN, IAMAuth: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate(); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestFilePassword(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(path, []byte("first\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// ファイルの設定はPasswordより優先する
+	provider := CloudSQLConfig{Password: "ignored", PasswordFile: path}.passwordProvider()
+	ctx := context.Background()
+	if p, err := provider.Password(ctx); err != nil || p != "first" {
+		t.Fatalf("password = %q, err = %v", p, err)
+	}
+
+	// 呼び出すたびに読み込むため、ローテーションに追従する
+	if err := os.WriteFile(path, []byte("second\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := provider.Password(ctx); err != nil || p != "second" {
+		t.Fatalf("password = %q, err = %v", p, err)
+	}
+
+	if _, err := FilePassword(filepath.Join(t.TempDir(), "missing")).Password(ctx); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}
+
+func TestPgxConfigQuotesValues(t *testing.T) {
+	config := CloudSQLConfig{User: "o'neil", DBName: "", SSLMode: "disable"}
+	connConfig, err := pgxConfig(config, endpoint{node: NodePrimary, address: "db", port: 5432}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connConfig.User != "o'neil" || connConfig.Database != "" || connConfig.Host != "db" {
+		t.Fatalf("user = %q, database = %q, host = %q", connConfig.User, connConfig.Database, connConfig.Host)
+	}
+}
@@ -0,0 +1,69 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"otel-test/o11y/o11ytest"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+func TestConnect(t *testing.T) {
+	h := o11ytest.New(t)
+	ctx := context.Background()
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+	// 接続できるまで再試行する
+	attempts := 0
+	db, err := connect(ctx, time.Minute, newRetryRecorder(), func() (*gorm.DB, error) {
+		attempts++
+		if attempts == 1 {
+			return nil, refused
+		}
+		return &gorm.DB{}, nil
+	})
+	if err != nil || db == nil || attempts != 2 {
+		t.Fatalf("db = %v, err = %v, attempts = %d", db, err, attempts)
+	}
+	h.Span("DB.Connect").HasAttr("db.connect.attempts", 2).HasEvent("retry").NoError()
+	h.Logs().Containing("database is not reachable").Len(1)
+
+	// 一時的でないエラー（認証エラーなど）はすぐに返す
+	h.Reset()
+	authErr := &pgconn.PgError{Code: "28P01"}
+	attempts = 0
+	_, err = connect(ctx, time.Minute, newRetryRecorder(), func() (*gorm.DB, error) {
+		attempts++
+		return nil, authErr
+	})
+	if !errors.Is(err, authErr) || attempts != 1 {
+		t.Fatalf("err = %v, attempts = %d", err, attempts)
+	}
+	h.Span("DB.Connect").HasError()
+
+	// 次の再試行がtimeoutを超える場合は諦める
+	attempts = 0
+	_, err = connect(ctx, 100*time.Millisecond, newRetryRecorder(), func() (*gorm.DB, error) {
+		attempts++
+		return nil, refused
+	})
+	if !errors.Is(err, syscall.ECONNREFUSED) || attempts != 1 {
+		t.Fatalf("err = %v, attempts = %d", err, attempts)
+	}
+
+	// ctxが終了した場合は中断する
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = connect(canceled, time.Minute, newRetryRecorder(), func() (*gorm.DB, error) {
+		return nil, refused
+	})
+	if !errors.Is(err, ErrUnavailable) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+// Package databasetest はテスト用のSQLiteデータベースを提供します
+package databasetest
+
+import (
+	"path/filepath"
+	"testing"
+
+	"otel-test/database"
+
+	"github.com/glebarez/sqlite"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/plugin/opentelemetry/tracing"
+)
+
+// New はテストごとに一時ディレクトリにSQLiteデータベースを作成し、modelsをマイグレーションします
+// 本番と同じくOpenTelemetryトレーシングプラグインを設定するため、
+// o11ytest.Newの後に呼び出すとSQLのスパンも記録される
+func New(t testing.TB, models ...interface{}) *database.DB {
+	t.Helper()
+	return NewWithReplicas(t, 0, models...)
+}
+
+// NewWithReplicas はNewに加えて、n個のレプリカ用のSQLiteデータベースを作成します
+// レプリカはプライマリと別のファイルのため、書き込みは反映されない（テストでは直接書き込む）
+func NewWithReplicas(t testing.TB, n int, models ...interface{}) *database.DB {
+	t.Helper()
+
+	primary := open(t, database.NodePrimary, models)
+	replicas := make([]*gorm.DB, n)
+	for i := range replicas {
+		replicas[i] = open(t, database.ReplicaNode(i), models)
+	}
+
+	wrapped := database.New(primary, replicas...)
+	t.Cleanup(func() {
+		_ = wrapped.Close()
+	})
+	return wrapped
+}
+
+func open(t testing.TB, node string, models []interface{}) *gorm.DB {
+	t.Helper()
+
+	dsn := filepath.Join(t.TempDir(), node+".db") + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		Logger: database.NewLogger(logger.Warn, database.DefaultSlowThreshold, true),
+	})
+	if err != nil {
+		t.Fatalf("open sqlite: %v", err)
+	}
+
+	if len(models) > 0 {
+		if err := db.AutoMigrate(models...); err != nil {
+			t.Fatalf("migrate: %v", err)
+		}
+	}
+
+	// マイグレーションのSQLはスパンに含めない
+	if err := db.Use(database.NewResiliencePlugin(database.DefaultQueryTimeout)); err != nil {
+		t.Fatalf("setup resilience plugin: %v", err)
+	}
+	if err := db.Use(database.NewTenantPlugin()); err != nil {
+		t.Fatalf("setup tenant plugin: %v", err)
+	}
+	if err := db.Use(tracing.NewPlugin(
+		tracing.WithoutMetrics(),
+		tracing.WithAttributes(
+			attribute.String("db.system", "sqlite"),
+			attribute.String("db.node", node),
+		),
+	)); err != nil {
+		t.Fatalf("setup tracing plugin: %v", err)
+	}
+	return db
+}
@@ -2,101 +2,402 @@ package database
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"cloud.google.com/go/cloudsqlconn"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
 	"go.opentelemetry.io/otel/attribute"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
-	"gorm.io/gorm/logger"
 	"gorm.io/plugin/opentelemetry/tracing"
 )
 
 type DB struct {
 	*gorm.DB
+	config CloudSQLConfig
+	// replicas は読み込み専用のレプリカ（設定されている場合のみ）
+	replicas *replicaSet
+	// afterCommit はトランザクションのコミット後に実行する関数（トランザクション内の場合のみ）
+	afterCommit *[]func()
+	retries     *retryRecorder
+	// dialer はCloud SQL Goコネクター（ConnectorCloudSQLの場合のみ）
+	dialer io.Closer
 }
 
+// 接続方法（CloudSQLConfig.Connector）
+const (
+	// ConnectorDSN はHost・Portに直接接続する（ローカルのPostgresなど）
+	ConnectorDSN = "dsn"
+	// ConnectorCloudSQL はCloud SQL Goコネクターでインスタンス接続名に接続する
+	ConnectorCloudSQL = "cloudsql"
+)
+
 // CloudSQL接続設定
 type CloudSQLConfig struct {
-	Host     string
-	Port     int
+	// Connector は接続方法（dsn, cloudsql）
+	Connector string
+	Host      string
+	Port      int
+	// InstanceConnectionName はcloudsqlの接続先（project:region:instance）
+	InstanceConnectionName string
+	// PrivateIP はcloudsqlでプライベートIPに接続する
+	PrivateIP bool
+	// IAMAuth はcloudsqlでIAMデータベース認証を使用する（トークンはコネクターが更新する）
+	// Userはサービスアカウントのメールアドレスから.gserviceaccount.comを除いたもの
+	IAMAuth  bool
 	User     string
-	Password string
-	DBName   string
-	SSLMode  string
+	Password string `secret:"true"`
+	// PasswordFile はパスワードを読み込むファイル（設定されている場合はPasswordより優先する）
+	PasswordFile string
+	DBName       string
+	SSLMode      string
+	// ReplicaHosts はリードレプリカの接続先。認証情報とデータベース名はプライマリと同じ
+	// dsnは host または host:port、cloudsqlはインスタンス接続名
+	ReplicaHosts []string
+	// ReplicaCheckInterval はレプリカのヘルスチェックの間隔
+	ReplicaCheckInterval time.Duration
+	// ConnectTimeout は起動時にプライマリに接続できるまで再試行する時間
+	ConnectTimeout time.Duration
+	// QueryTimeout はコンテキストに期限がないクエリのタイムアウト（0の場合は打ち切らない）
+	QueryTimeout time.Duration
+	// LogLevel はSQLのログレベル（silent, error, warn, info）
+	LogLevel string
+	// SlowThreshold は遅いSQLとしてログとスパンのイベントに記録する実行時間（0の場合は記録しない）
+	SlowThreshold time.Duration
+	// LogParams はSQLのパラメーターをログとスパンに含める（個人情報を含むため本番では無効にする）
+	LogParams bool
 }
 
-func NewCloudSQLDB() (*DB, error) {
-	// CloudSQL設定
+// CloudSQLConfigFromEnv は環境変数から接続設定を読み込みます
+func CloudSQLConfigFromEnv() CloudSQLConfig {
 	config := CloudSQLConfig{
-		Host:     os.Getenv("DB_HOST"),
-		Port:     5432,
-		User:     os.Getenv("DB_USER"),
-		Password: os.Getenv("DB_PASSWORD"),
-		DBName:   os.Getenv("DB_NAME"),
-		SSLMode:  "require",
-	}
-	// CloudSQL接続文字列を構築
-	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
-		config.Host, config.Port, config.User, config.Password, config.DBName, config.SSLMode)
-
-	// GORM設定
-	gormConfig := &gorm.Config{
-		Logger: logger.New(
-			log.New(os.Stdout, "\r\n", log.LstdFlags), // io writer
-			logger.Config{
-				SlowThreshold:             time.Second,   // Slow SQL threshold
-				LogLevel:                  logger.Silent, // Log level
-				IgnoreRecordNotFoundError: true,          // Ignore ErrRecordNotFound error for logger
-				Colorful:                  false,         // Disable color
-			},
-		),
+		Connector:              strings.ToLower(strings.TrimSpace(os.Getenv("DB_CONNECTOR"))),
+		Host:                   os.Getenv("DB_HOST"),
+		Port:                   5432,
+		InstanceConnectionName: os.Getenv("DB_INSTANCE_CONNECTION_NAME"),
+		User:                   os.Getenv("DB_USER"),
+		Password:               os.Getenv("DB_PASSWORD"),
+		PasswordFile:           os.Getenv("DB_PASSWORD_FILE"),
+		DBName:                 os.Getenv("DB_NAME"),
+		SSLMode:                "require",
+		ReplicaCheckInterval:   defaultReplicaCheckInterval,
+		ConnectTimeout:         defaultConnectTimeout,
+		QueryTimeout:           DefaultQueryTimeout,
+		LogLevel:               os.Getenv("DB_LOG_LEVEL"),
+		SlowThreshold:          DefaultSlowThreshold,
+	}
+	if config.Connector == "" {
+		config.Connector = ConnectorDSN
+	}
+	if port, err := strconv.Atoi(os.Getenv("DB_PORT")); err == nil && port > 0 {
+		config.Port = port
+	}
+	if mode := os.Getenv("DB_SSLMODE"); mode != "" {
+		config.SSLMode = mode
+	}
+	config.PrivateIP, _ = strconv.ParseBool(os.Getenv("DB_PRIVATE_IP"))
+	config.IAMAuth, _ = strconv.ParseBool(os.Getenv("DB_IAM_AUTH"))
+	config.LogParams, _ = strconv.ParseBool(os.Getenv("DB_LOG_PARAMS"))
+	if config.LogLevel == "" {
+		config.LogLevel = "warn"
+	}
+	for _, host := range strings.Split(os.Getenv("DB_REPLICA_HOSTS"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			config.ReplicaHosts = append(config.ReplicaHosts, host)
+		}
+	}
+	if d, err := time.ParseDuration(os.Getenv("DB_REPLICA_CHECK_INTERVAL")); err == nil && d > 0 {
+		config.ReplicaCheckInterval = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("DB_CONNECT_TIMEOUT")); err == nil && d >= 0 {
+		config.ConnectTimeout = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("DB_QUERY_TIMEOUT")); err == nil && d >= 0 {
+		config.QueryTimeout = d
 	}
+	if d, err := time.ParseDuration(os.Getenv("DB_SLOW_QUERY_THRESHOLD")); err == nil && d >= 0 {
+		config.SlowThreshold = d
+	}
+	return config
+}
 
-	// データベース接続
-	db, err := gorm.Open(postgres.Open(dsn), gormConfig)
+// validate は接続方法と設定の組み合わせを検証します
+func (c CloudSQLConfig) validate() error {
+	if _, err := ParseLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	switch c.Connector {
+	case ConnectorDSN:
+		if c.IAMAuth {
+			return fmt.Errorf("IAM authentication requires the %q connector", ConnectorCloudSQL)
+		}
+	case ConnectorCloudSQL:
+		if c.InstanceConnectionName == "" {
+			return errors.New("instance connection name is required for the cloudsql connector")
+		}
+	default:
+		return fmt.Errorf("unknown connector %q", c.Connector)
+	}
+	return nil
+}
+
+// passwordProvider は設定のパスワードを返します
+// IAMAuthの場合はパスワードを使用しないためnil
+func (c CloudSQLConfig) passwordProvider() PasswordProvider {
+	switch {
+	case c.IAMAuth:
+		return nil
+	case c.PasswordFile != "":
+		return FilePassword(c.PasswordFile)
+	default:
+		return StaticPassword(c.Password)
+	}
+}
+
+// endpoint は接続するノード
+type endpoint struct {
+	node string
+	// address はdsnではホスト、cloudsqlではインスタンス接続名
+	address string
+	port    int
+}
+
+// endpoints はプライマリとレプリカの接続先を返します
+func (c CloudSQLConfig) endpoints() ([]endpoint, error) {
+	if c.Connector == ConnectorCloudSQL {
+		eps := []endpoint{{node: NodePrimary, address: c.InstanceConnectionName}}
+		for i, name := range c.ReplicaHosts {
+			eps = append(eps, endpoint{node: ReplicaNode(i), address: name})
+		}
+		return eps, nil
+	}
+
+	eps := []endpoint{{node: NodePrimary, address: c.Host, port: c.Port}}
+	for i, hostport := range c.ReplicaHosts {
+		ep := endpoint{node: ReplicaNode(i), address: hostport, port: c.Port}
+		if h, p, err := net.SplitHostPort(hostport); err == nil {
+			ep.address = h
+			if ep.port, err = strconv.Atoi(p); err != nil {
+				return nil, fmt.Errorf("invalid replica address %q: %w", hostport, err)
+			}
+		}
+		eps = append(eps, ep)
+	}
+	return eps, nil
+}
+
+// NewCloudSQLDB は環境変数の設定でCloudSQLに接続します
+func NewCloudSQLDB(ctx context.Context) (*DB, error) {
+	return OpenCloudSQL(ctx, CloudSQLConfigFromEnv(), nil)
+}
+
+// OpenCloudSQL はconfigでCloudSQLに接続します
+// passwordsがnilの場合は設定のPasswordFile、Passwordの順に使用する（IAMAuthの場合はパスワードを使用しない）
+// プライマリに接続できない場合はConnectTimeoutまで再試行し、ctxが終了した場合は中断する
+func OpenCloudSQL(ctx context.Context, config CloudSQLConfig, passwords PasswordProvider) (*DB, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if passwords == nil {
+		passwords = config.passwordProvider()
+	}
+	eps, err := config.endpoints()
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to CloudSQL: %w", err)
+		return nil, err
 	}
 
-	// OpenTelemetryトレーシングプラグインを追加
-	if err := db.Use(tracing.NewPlugin(
-		tracing.WithDBSystem(config.DBName),
-		tracing.WithAttributes(
-			attribute.String("db.system", "postgresql"),
-			attribute.String("db.name", config.DBName),
-			attribute.String("server.address", config.Host),
-			attribute.Int("server.port", config.Port),
-		),
-	)); err != nil {
-		return nil, fmt.Errorf("failed to setup tracing plugin: %w", err)
+	var dialer *cloudsqlconn.Dialer
+	if config.Connector == ConnectorCloudSQL {
+		if dialer, err = newCloudSQLDialer(ctx, config); err != nil {
+			return nil, err
+		}
+	}
+	fail := func(err error, opened ...*gorm.DB) (*DB, error) {
+		for _, db := range opened {
+			if sqlDB, err := db.DB(); err == nil {
+				sqlDB.Close()
+			}
+		}
+		if dialer != nil {
+			dialer.Close()
+		}
+		return nil, err
 	}
 
-	// コネクションプール設定
-	sqlDB, err := db.DB()
+	retries := newRetryRecorder()
+	db, err := connect(ctx, config.ConnectTimeout, retries, func() (*gorm.DB, error) {
+		return openCloudSQL(config, eps[0], passwords, dialer)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get sql.DB: %w", err)
+		return fail(err)
+	}
+
+	// レプリカは起動時に接続できなくてもよい（ヘルスチェックで異常として扱い、プライマリから読む）
+	opened := []*gorm.DB{db}
+	for _, ep := range eps[1:] {
+		replica, err := openCloudSQL(config, ep, passwords, dialer)
+		if err != nil {
+			return fail(err, opened...)
+		}
+		opened = append(opened, replica)
 	}
 
+	wrapped := &DB{DB: db, config: config, replicas: newReplicaSet(opened[1:]), retries: retries}
+	if dialer != nil {
+		wrapped.dialer = dialer
+	}
+	wrapped.CheckReplicas(ctx)
+	return wrapped, nil
+}
+
+// openCloudSQL はepに接続します
+// スパンにはノード（primary, replica-0など）をdb.nodeとして記録する
+func openCloudSQL(config CloudSQLConfig, ep endpoint, passwords PasswordProvider, dialer *cloudsqlconn.Dialer) (*gorm.DB, error) {
+	connConfig, err := pgxConfig(config, ep, dialer)
+	if err != nil {
+		return nil, err
+	}
+	// パスワードは接続ごとに取得する
+	sqlDB := stdlib.OpenDB(*connConfig, stdlib.OptionBeforeConnect(func(ctx context.Context, c *pgx.ConnConfig) error {
+		if passwords == nil {
+			return nil
+		}
+		password, err := passwords.Password(ctx)
+		if err != nil {
+			return err
+		}
+		c.Password = password
+		return nil
+	}))
+
+	// GORM設定（ログレベルはvalidateで検証済み）
+	logLevel, _ := ParseLogLevel(config.LogLevel)
+	gormConfig := &gorm.Config{
+		Logger: NewLogger(logLevel, config.SlowThreshold, config.LogParams),
+		// レプリカは接続できなくても起動する
+		DisableAutomaticPing: ep.node != NodePrimary,
+	}
+
+	// データベース接続
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), gormConfig)
+	if err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("failed to connect to CloudSQL (%s): %w", ep.node, err)
+	}
+
+	if err := usePlugins(db, config, ep); err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+
+	// コネクションプール設定
 	sqlDB.SetMaxIdleConns(10)
 	sqlDB.SetMaxOpenConns(100)
 	sqlDB.SetConnMaxLifetime(time.Hour)
 
-	return &DB{DB: db}, nil
+	return db, nil
+}
+
+// usePlugins はレジリエンス・テナント・トレーシングのプラグインを登録します
+func usePlugins(db *gorm.DB, config CloudSQLConfig, ep endpoint) error {
+	if err := db.Use(NewResiliencePlugin(config.QueryTimeout)); err != nil {
+		return fmt.Errorf("failed to setup resilience plugin: %w", err)
+	}
+	if err := db.Use(NewTenantPlugin()); err != nil {
+		return fmt.Errorf("failed to setup tenant plugin: %w", err)
+	}
+
+	// OpenTelemetryトレーシングプラグインを追加
+	attrs := []attribute.KeyValue{
+		attribute.String("db.system", "postgresql"),
+		attribute.String("db.name", config.DBName),
+		attribute.String("db.node", ep.node),
+		attribute.String("server.address", ep.address),
+	}
+	if ep.port > 0 {
+		attrs = append(attrs, attribute.Int("server.port", ep.port))
+	}
+	opts := []tracing.Option{
+		tracing.WithDBSystem(config.DBName),
+		tracing.WithAttributes(attrs...),
+	}
+	if !config.LogParams {
+		opts = append(opts, tracing.WithoutQueryVariables())
+	}
+	if err := db.Use(tracing.NewPlugin(opts...)); err != nil {
+		return fmt.Errorf("failed to setup tracing plugin: %w", err)
+	}
+	return nil
+}
+
+// New は既存の*gorm.DBからDBを作成します
+// テストなどCloudSQL以外の接続で使用する。replicasはReaderで読み込みに使用する
+// クエリのタイムアウトと再実行は、dbにNewResiliencePluginを設定した場合に有効になる
+// テナントでの分離は、dbとreplicasにNewTenantPluginを設定した場合に有効になる
+func New(db *gorm.DB, replicas ...*gorm.DB) *DB {
+	return &DB{DB: db, replicas: newReplicaSet(replicas), retries: newRetryRecorder()}
 }
 
 // WithContext はコンテキストを設定してトレース情報を伝播します
+// ctxにWithinTxで開始したdbのトランザクションがある場合は、そのトランザクションを使用する
 func (db *DB) WithContext(ctx context.Context) *gorm.DB {
+	if st := db.txFromContext(ctx); st != nil {
+		return st.tx.DB.WithContext(ctx)
+	}
 	return db.DB.WithContext(ctx)
 }
 
-// Close はデータベース接続を閉じます
+// Close はデータベース接続（レプリカとCloud SQL Goコネクターを含む）を閉じます
 func (db *DB) Close() error {
+	conns := []*gorm.DB{db.DB}
+	if db.replicas != nil {
+		for _, r := range db.replicas.replicas {
+			conns = append(conns, r.db)
+		}
+	}
+	var errs []error
+	for _, conn := range conns {
+		sqlDB, err := conn.DB()
+		if err == nil {
+			err = sqlDB.Close()
+		}
+		errs = append(errs, err)
+	}
+	if db.dialer != nil {
+		errs = append(errs, db.dialer.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Config は接続設定を返します
+func (db *DB) Config() CloudSQLConfig {
+	return db.config
+}
+
+// Stats はコネクションプールの統計情報を返します
+func (db *DB) Stats() (sql.DBStats, error) {
 	sqlDB, err := db.DB.DB()
 	if err != nil {
-		return err
+		return sql.DBStats{}, err
+	}
+	return sqlDB.Stats(), nil
+}
+
+// AfterCommit はトランザクションのコミット後にfnを実行します
+// ロールバックした場合は実行せず、トランザクション外の場合はすぐに実行する
+func (db *DB) AfterCommit(fn func()) {
+	if db.afterCommit == nil {
+		fn()
+		return
 	}
-	return sqlDB.Close()
+	*db.afterCommit = append(*db.afterCommit, fn)
 }
@@ -0,0 +1,139 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrDuplicateKey は一意制約に違反した
+	ErrDuplicateKey = errors.New("duplicate key")
+	// ErrVersionConflict は楽観的排他制御で、更新対象のバージョンが期待した値と異なる
+	ErrVersionConflict = errors.New("version conflict")
+	// ErrUnavailable は一時的なエラー（接続エラーなど）が再試行しても解消しなかった
+	ErrUnavailable = errors.New("database unavailable")
+)
+
+// 一時的なエラーの理由（メトリクス・スパンのdb.retry.reason）
+const (
+	reasonSerialization      = "serialization_failure"
+	reasonDeadlock           = "deadlock"
+	reasonTooManyConnections = "too_many_connections"
+	// reasonConnect はデータベースに接続できなかった（SQLは送信していない）
+	reasonConnect = "connect"
+	// reasonConnection は接続が切れた（SQLを実行したかわからない）
+	reasonConnection = "connection"
+)
+
+// TranslateError はドライバーのエラーのうち、一意制約違反をErrDuplicateKeyでラップします
+// それ以外のエラーはそのまま返す
+func TranslateError(err error) error {
+	if err == nil || errors.Is(err, ErrDuplicateKey) {
+		return err
+	}
+	if IsUniqueViolation(err) {
+		return fmt.Errorf("%w: %w", ErrDuplicateKey, err)
+	}
+	return err
+}
+
+// IsUniqueViolation はerrが一意制約違反かを返します
+// Postgres・MySQL・SQLiteのドライバーのエラーを判定する
+func IsUniqueViolation(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return true
+	}
+
+	// Postgres（pgx, lib/pq）: SQLSTATE 23505 unique_violation
+	var pg interface{ SQLState() string }
+	if errors.As(err, &pg) && pg.SQLState() == "23505" {
+		return true
+	}
+
+	// SQLite（modernc.org/sqlite）: SQLITE_CONSTRAINT_UNIQUE(2067), SQLITE_CONSTRAINT_PRIMARYKEY(1555)
+	var sqlite interface{ Code() int }
+	if errors.As(err, &sqlite) && (sqlite.Code() == 2067 || sqlite.Code() == 1555) {
+		return true
+	}
+
+	// MySQLのドライバーはコードをメソッドで公開していないためメッセージで判定する
+	//   MySQL: Error 1062 (23000): Duplicate entry
+	//   SQLite（mattn/go-sqlite3など）: UNIQUE constraint failed
+	msg := err.Error()
+	return strings.Contains(msg, "Error 1062") ||
+		strings.Contains(msg, "UNIQUE constraint failed")
+}
+
+// IsTransient はerrが時間をおいて再試行すれば成功しうる一時的なエラーかを返します
+// シリアライズ失敗・デッドロックに加えて、接続エラーと接続数の超過を含む
+func IsTransient(err error) bool {
+	return transientReason(err) != ""
+}
+
+// transientReason は一時的なエラーの理由を返します。一時的なエラーでない場合は空文字列
+func transientReason(err error) string {
+	// タイムアウトとキャンセルは呼び出し元の判断のため再試行しない
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return ""
+	}
+
+	// Postgres: SQLSTATE
+	var pg interface{ SQLState() string }
+	if errors.As(err, &pg) {
+		switch code := pg.SQLState(); {
+		case code == "40001":
+			return reasonSerialization
+		case code == "40P01":
+			return reasonDeadlock
+		case code == "53300": // too_many_connections
+			return reasonTooManyConnections
+		case code == "57P03" || code == "08001" || code == "08004": // cannot_connect_now, 接続の確立に失敗・拒否
+			return reasonConnect
+		case strings.HasPrefix(code, "08") || code == "57P01" || code == "57P02": // connection_exception, admin_shutdown, crash_shutdown
+			return reasonConnection
+		}
+	}
+
+	// database/sqlはErrBadConnを送信前に検知した場合にだけ返す
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, syscall.ECONNREFUSED) {
+		return reasonConnect
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return reasonConnect
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF) || opErr != nil {
+		return reasonConnection
+	}
+
+	// MySQLのドライバーとラップされて型が失われたエラーはメッセージで判定する
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "Error 1213"):
+		return reasonDeadlock
+	case strings.Contains(msg, "Error 1040") || strings.Contains(msg, "too many clients") || strings.Contains(msg, "too many connections"):
+		return reasonTooManyConnections
+	case strings.Contains(msg, "connection refused"):
+		return reasonConnect
+	case strings.Contains(msg, "connection reset by peer") || strings.Contains(msg, "broken pipe"):
+		return reasonConnection
+	}
+	return ""
+}
+
+// safeToRetryWrite はreasonで失敗した書き込み（コミット）を再実行してよいかを返します
+// 接続が切れた場合は書き込みが反映されている可能性があるため再実行しない
+func safeToRetryWrite(reason string) bool {
+	return reason != "" && reason != reasonConnection
+}
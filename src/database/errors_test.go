@@ -0,0 +1,83 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestTranslateError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"postgres unique", &pgconn.PgError{Code: "23505"}, true},
+		{"postgres wrapped", fmt.Errorf("insert: %w", &pgconn.PgError{Code: "23505"}), true},
+		{"postgres not null", &pgconn.PgError{Code: "23502"}, false},
+		{"mysql", errors.New("Error 1062 (23000): Duplicate entry 'a@example.com' for key 'users.idx_users_email'"), true},
+		{"sqlite", errors.New("UNIQUE constraint failed: users.email"), true},
+		{"other", errors.New("connection refused"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := TranslateError(tt.err)
+			if got := errors.Is(err, ErrDuplicateKey); got != tt.want {
+				t.Fatalf("errors.Is(ErrDuplicateKey) = %v, want %v (err: %v)", got, tt.want, err)
+			}
+			// 元のエラーも辿れる
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("translated error does not wrap the original: %v", err)
+			}
+		})
+	}
+	if TranslateError(nil) != nil {
+		t.Fatal("TranslateError(nil) != nil")
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	tests := []struct {
+		name       string
+		err        error
+		reason     string
+		retryWrite bool
+	}{
+		{"serialization", &pgconn.PgError{Code: "40001"}, reasonSerialization, true},
+		{"deadlock", &pgconn.PgError{Code: "40P01"}, reasonDeadlock, true},
+		{"too many connections", &pgconn.PgError{Code: "53300"}, reasonTooManyConnections, true},
+		{"starting up", &pgconn.PgError{Code: "57P03"}, reasonConnect, true},
+		{"admin shutdown", &pgconn.PgError{Code: "57P01"}, reasonConnection, false},
+		{"dial", fmt.Errorf("failed to connect: %w", refused), reasonConnect, true},
+		{"bad conn", driver.ErrBadConn, reasonConnect, true},
+		{"reset", reset, reasonConnection, false},
+		{"unexpected eof", io.ErrUnexpectedEOF, reasonConnection, false},
+		{"mysql too many connections", errors.New("Error 1040: Too many connections"), reasonTooManyConnections, true},
+		{"unique", &pgconn.PgError{Code: "23505"}, "", false},
+		{"timeout", context.DeadlineExceeded, "", false},
+		{"not found", errors.New("record not found"), "", false},
+		{"nil", nil, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := transientReason(tt.err); got != tt.reason {
+				t.Fatalf("transientReason = %q, want %q", got, tt.reason)
+			}
+			if got := IsTransient(tt.err); got != (tt.reason != "") {
+				t.Fatalf("IsTransient = %v", got)
+			}
+			if got := safeToRetryWrite(tt.reason); got != tt.retryWrite {
+				t.Fatalf("safeToRetryWrite = %v, want %v", got, tt.retryWrite)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"otel-test/o11y"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// DefaultSlowThreshold は遅いSQLとして記録する実行時間
+const DefaultSlowThreshold = time.Second
+
+// slogLogger はGORMのログをslog（ロガー名database）に出力するlogger.Interfaceの実装
+type slogLogger struct {
+	level         logger.LogLevel
+	slowThreshold time.Duration
+	logParams     bool
+}
+
+// NewLogger はGORMのログをslogに出力するロガーを作成します
+//
+//   - levelがinfoの場合は全てのSQL、warn以上の場合はslowThreshold以上かかったSQL、error以上の場合は失敗したSQLを出力する
+//     （レコードが見つからないエラーは出力しない）
+//   - ログにはコンテキストのトレースを関連付け、遅いSQLは呼び出し元のスパンにdb.slow_queryイベントを追加する
+//   - logParamsがfalseの場合はSQLのパラメーターを出力しない（プレースホルダーのまま出力する）
+//
+// slowThresholdが0以下の場合は遅いSQLを記録しない
+func NewLogger(level logger.LogLevel, slowThreshold time.Duration, logParams bool) logger.Interface {
+	return &slogLogger{level: level, slowThreshold: slowThreshold, logParams: logParams}
+}
+
+// ParseLogLevel はGORMのログレベル（silent, error, warn, info）を解析します。空の場合はwarn
+func ParseLogLevel(s string) (logger.LogLevel, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "silent":
+		return logger.Silent, nil
+	case "error":
+		return logger.Error, nil
+	case "", "warn", "warning":
+		return logger.Warn, nil
+	case "info":
+		return logger.Info, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+func (l *slogLogger) LogMode(level logger.LogLevel) logger.Interface {
+	c := *l
+	c.level = level
+	return &c
+}
+
+func (l *slogLogger) Info(ctx context.Context, msg string, data ...interface{}) {
+	if l.level >= logger.Info {
+		o11y.Logger("database").InfoContext(ctx, fmt.Sprintf(msg, data...))
+	}
+}
+
+func (l *slogLogger) Warn(ctx context.Context, msg string, data ...interface{}) {
+	if l.level >= logger.Warn {
+		o11y.Logger("database").WarnContext(ctx, fmt.Sprintf(msg, data...))
+	}
+}
+
+func (l *slogLogger) Error(ctx context.Context, msg string, data ...interface{}) {
+	if l.level >= logger.Error {
+		o11y.Logger("database").ErrorContext(ctx, fmt.Sprintf(msg, data...))
+	}
+}
+
+// ParamsFilter はSQLに展開するパラメーターを返します（gorm.ParamsFilter）
+func (l *slogLogger) ParamsFilter(_ context.Context, sql string, params ...interface{}) (string, []interface{}) {
+	if l.logParams {
+		return sql, params
+	}
+	return sql, nil
+}
+
+// Trace はSQLの実行後に呼び出されます
+// GORMのトレーシングのスパンは終了しているため、ctxのスパンはリポジトリなど呼び出し元のスパン
+func (l *slogLogger) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
+	if l.level <= logger.Silent {
+		return
+	}
+	elapsed := time.Since(begin)
+	slow := l.slowThreshold > 0 && elapsed >= l.slowThreshold
+	// 一意制約違反はリクエストの競合（409）として扱うため、エラーではなく警告で出力する
+	duplicate := err != nil && IsUniqueViolation(err)
+	failed := err != nil && !errors.Is(err, gorm.ErrRecordNotFound) && !duplicate
+
+	var level slog.Level
+	var msg string
+	switch {
+	case failed && l.level >= logger.Error:
+		level, msg = slog.LevelError, "query failed"
+	case duplicate && l.level >= logger.Warn:
+		level, msg = slog.LevelWarn, "duplicate key"
+	case slow && l.level >= logger.Warn:
+		level, msg = slog.LevelWarn, "slow query"
+	case l.level >= logger.Info:
+		level, msg = slog.LevelInfo, "query"
+	default:
+		if !slow {
+			return
+		}
+	}
+
+	sql, rows := fc()
+	if slow {
+		trace.SpanFromContext(ctx).AddEvent("db.slow_query", trace.WithAttributes(
+			attribute.String("db.query.text", sql),
+			attribute.Int64("db.duration_ms", elapsed.Milliseconds()),
+			attribute.Int64("db.slow_query.threshold_ms", l.slowThreshold.Milliseconds()),
+		))
+	}
+	if msg == "" {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("db.query.text", sql),
+		slog.Duration("db.duration", elapsed),
+	}
+	if rows >= 0 {
+		attrs = append(attrs, slog.Int64("db.rows_affected", rows))
+	}
+	if failed || duplicate {
+		attrs = append(attrs, slog.Any("error", err))
+	}
+	o11y.Logger("database").LogAttrs(ctx, level, msg, attrs...)
+}
@@ -0,0 +1,91 @@
+package database_test
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"otel-test/database"
+	"otel-test/database/databasetest"
+	"otel-test/o11y/o11ytest"
+
+	"go.opentelemetry.io/otel"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestLogger(t *testing.T) {
+	h := o11ytest.New(t)
+	db := databasetest.New(t, &item{})
+	db.WithContext(context.Background()).Create(&item{Name: "secret"})
+	h.Reset()
+
+	ctx, span := otel.Tracer("test").Start(context.Background(), "lookup")
+	session := func(level logger.LogLevel, slow time.Duration, params bool) *gorm.DB {
+		return db.WithContext(ctx).Session(&gorm.Session{Logger: database.NewLogger(level, slow, params)})
+	}
+
+	// 遅いSQLはWarnで出力し、呼び出し元のスパンにイベントを追加する。パラメーターは出力しない
+	var it item
+	if err := session(logger.Warn, time.Nanosecond, false).Where("name = ?", "secret").First(&it).Error; err != nil {
+		t.Fatal(err)
+	}
+	// infoの場合は全てのSQLを出力する
+	session(logger.Info, 0, true).Where("name = ?", "secret").First(&it)
+	// レコードが見つからないエラーは出力せず、それ以外のエラーはErrorで出力する
+	session(logger.Warn, 0, false).Where("name = ?", "missing").First(&it)
+	session(logger.Warn, 0, false).Table("missing").Find(&[]item{})
+	// 一意制約違反はWarnで出力する
+	session(logger.Warn, 0, false).Create(&item{ID: it.ID, Name: "duplicate"})
+	// silentは何も出力しない
+	session(logger.Silent, time.Nanosecond, true).Where("name = ?", "secret").First(&it)
+	span.End()
+
+	slow := h.Logs().Containing("slow query").Len(1).Records()
+	if len(slow) == 1 {
+		sql := slow[0].Attrs["db.query.text"].String()
+		if strings.Contains(sql, "secret") || !strings.Contains(sql, "name = ?") {
+			t.Fatalf("slow query text = %q", sql)
+		}
+	}
+	h.Logs().Containing("slow query").InSpan(h.Span("lookup"))
+	h.Span("lookup").HasEvent("db.slow_query")
+
+	query := h.Logs().Containing("query").WithAttr("logger", "database").Records()
+	var infos []string
+	for _, r := range query {
+		if r.Message == "query" {
+			infos = append(infos, r.Attrs["db.query.text"].String())
+		}
+	}
+	if len(infos) != 1 || !strings.Contains(infos[0], "secret") {
+		t.Fatalf("info logs = %v", infos)
+	}
+
+	failed := h.Logs().Containing("query failed").Len(1).Records()
+	if len(failed) == 1 && !strings.Contains(failed[0].Attrs["db.query.text"].String(), "missing") {
+		t.Fatalf("failed query = %v", failed[0].Attrs)
+	}
+	duplicate := h.Logs().Containing("duplicate key").Len(1).Records()
+	if len(duplicate) == 1 && duplicate[0].Level != slog.LevelWarn {
+		t.Fatalf("duplicate key level = %v", duplicate[0].Level)
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for s, want := range map[string]logger.LogLevel{
+		"":       logger.Warn,
+		"silent": logger.Silent,
+		"Error":  logger.Error,
+		"info":   logger.Info,
+	} {
+		if got, err := database.ParseLogLevel(s); err != nil || got != want {
+			t.Errorf("ParseLogLevel(%q) = %v, %v", s, got, err)
+		}
+	}
+	if _, err := database.ParseLogLevel("debug"); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+}
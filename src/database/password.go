@@ -0,0 +1,40 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// PasswordProvider はデータベースのパスワードを返す
+// 新しい接続を作成するたびに呼び出すため、パスワードのローテーションに追従できる
+type PasswordProvider interface {
+	Password(ctx context.Context) (string, error)
+}
+
+// StaticPassword は固定のパスワード
+type StaticPassword string
+
+func (p StaticPassword) Password(context.Context) (string, error) {
+	return string(p), nil
+}
+
+// FilePassword はファイルの内容（末尾の改行を除く）をパスワードとして返す
+// Secret ManagerやKubernetesのSecretをマウントしたファイルを想定する
+type FilePassword string
+
+func (f FilePassword) Password(context.Context) (string, error) {
+	b, err := os.ReadFile(string(f))
+	if err != nil {
+		return "", fmt.Errorf("failed to read password file: %w", err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// PasswordFunc は関数をPasswordProviderとして使用する（Secret Managerのクライアントなど）
+type PasswordFunc func(ctx context.Context) (string, error)
+
+func (f PasswordFunc) Password(ctx context.Context) (string, error) {
+	return f(ctx)
+}
@@ -0,0 +1,149 @@
+package database
+
+import (
+	"context"
+	"log/slog"
+	"otel-test/o11y"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const (
+	// NodePrimary はプライマリのノード名（スパンのdb.node）
+	NodePrimary = "primary"
+	// replicaPingTimeout はレプリカのヘルスチェックのタイムアウト
+	replicaPingTimeout = 2 * time.Second
+	// defaultReplicaCheckInterval はレプリカのヘルスチェックの間隔
+	defaultReplicaCheckInterval = 10 * time.Second
+)
+
+// ReplicaNode はi番目（0始まり）のレプリカのノード名（スパンのdb.node）を返します
+func ReplicaNode(i int) string {
+	return "replica-" + strconv.Itoa(i)
+}
+
+// replica は読み込み専用のレプリカ
+type replica struct {
+	node    string
+	db      *gorm.DB
+	healthy atomic.Bool
+}
+
+// replicaSet はレプリカの一覧と、ラウンドロビンで次に使用する位置
+type replicaSet struct {
+	replicas []*replica
+	next     atomic.Uint64
+}
+
+func newReplicaSet(dbs []*gorm.DB) *replicaSet {
+	if len(dbs) == 0 {
+		return nil
+	}
+	set := &replicaSet{}
+	for i, db := range dbs {
+		r := &replica{node: ReplicaNode(i), db: db}
+		r.healthy.Store(true)
+		set.replicas = append(set.replicas, r)
+	}
+	return set
+}
+
+// pick は正常なレプリカをラウンドロビンで選びます。正常なレプリカがない場合はnil
+func (s *replicaSet) pick() *replica {
+	n := uint64(len(s.replicas))
+	start := s.next.Add(1) - 1
+	for i := range n {
+		if r := s.replicas[(start+i)%n]; r.healthy.Load() {
+			return r
+		}
+	}
+	return nil
+}
+
+// primaryKey はReaderでもプライマリから読み込むコンテキストのキー
+type primaryKey struct{}
+
+// WithPrimary はReaderでもプライマリから読み込むコンテキストを返します
+// レプリカへの反映は遅れるため、キャッシュに保存する値など、古い値を読むと長く残る読み込みに使う
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+// Reader は読み込みに使用する接続を返します
+// レプリカへの反映は遅れるため、書き込んだ直後の値を読む必要がある処理はWithContextかWithPrimaryを使う
+//
+//   - トランザクション内（dbまたはctx）の場合は、そのトランザクション（プライマリ）
+//   - WithPrimaryのコンテキストの場合はプライマリ
+//   - それ以外は正常なレプリカをラウンドロビンで選び、正常なレプリカがない場合はプライマリ
+func (db *DB) Reader(ctx context.Context) *gorm.DB {
+	if db.replicas == nil || db.afterCommit != nil || db.txFromContext(ctx) != nil {
+		return db.WithContext(ctx)
+	}
+	if primary, _ := ctx.Value(primaryKey{}).(bool); primary {
+		return db.WithContext(ctx)
+	}
+	r := db.replicas.pick()
+	if r == nil {
+		// 全てのレプリカが異常な場合はプライマリにフェイルオーバーする
+		trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("db.replica.failover", true))
+		return db.WithContext(ctx)
+	}
+	return r.db.WithContext(ctx)
+}
+
+// CheckReplicas は全てのレプリカにpingし、正常かどうかを更新します
+// 異常なレプリカはReaderで選ばず、次のチェックで応答すれば戻す
+func (db *DB) CheckReplicas(ctx context.Context) {
+	if db.replicas == nil {
+		return
+	}
+	for _, r := range db.replicas.replicas {
+		err := pingReplica(ctx, r.db)
+		healthy := err == nil
+		if r.healthy.Swap(healthy) == healthy {
+			continue
+		}
+		logger := o11y.Logger("database")
+		if healthy {
+			logger.InfoContext(ctx, "replica recovered", slog.String("db.node", r.node))
+		} else {
+			logger.WarnContext(ctx, "replica is unhealthy, routing reads elsewhere", slog.String("db.node", r.node), slog.Any("error", err))
+		}
+	}
+}
+
+func pingReplica(ctx context.Context, db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, replicaPingTimeout)
+	defer cancel()
+	return sqlDB.PingContext(ctx)
+}
+
+// MonitorReplicas はctxがキャンセルされるまで、一定間隔でレプリカのヘルスチェックを行います
+func (db *DB) MonitorReplicas(ctx context.Context) {
+	if db.replicas == nil {
+		return
+	}
+	interval := db.config.ReplicaCheckInterval
+	if interval <= 0 {
+		interval = defaultReplicaCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		db.CheckReplicas(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package database_test
+
+import (
+	"context"
+	"testing"
+
+	"otel-test/database"
+	"otel-test/database/databasetest"
+	"otel-test/o11y/o11ytest"
+
+	"go.opentelemetry.io/otel"
+)
+
+// readName はReaderで最初のitemの名前を読み込みます
+func readName(t *testing.T, db *database.DB, ctx context.Context) string {
+	t.Helper()
+	var it item
+	if err := db.Reader(ctx).First(&it).Error; err != nil {
+		t.Fatal(err)
+	}
+	return it.Name
+}
+
+func TestReader(t *testing.T) {
+	h := o11ytest.New(t)
+	db := databasetest.NewWithReplicas(t, 2, &item{})
+	ctx := context.Background()
+
+	// レプリカは別のデータベースのため、どのノードから読んだか名前で区別する
+	if err := db.WithContext(ctx).Create(&item{Name: database.NodePrimary}).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i := range 2 {
+		if err := db.Reader(ctx).Create(&item{Name: database.ReplicaNode(i)}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// ラウンドロビンでレプリカから読む
+	for _, want := range []string{"replica-0", "replica-1", "replica-0"} {
+		if got := readName(t, db, ctx); got != want {
+			t.Fatalf("read from %q, want %q", got, want)
+		}
+	}
+	spans := h.Spans().Named("select items").Each()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 select spans, got %d", len(spans))
+	}
+	spans[0].HasAttr("db.node", "replica-0")
+	spans[1].HasAttr("db.node", "replica-1")
+
+	// トランザクション内はプライマリから読む
+	err := db.WithinTx(ctx, func(ctx context.Context) error {
+		if got := readName(t, db, ctx); got != database.NodePrimary {
+			t.Fatalf("read from %q in transaction", got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReaderFailover(t *testing.T) {
+	h := o11ytest.New(t)
+	db := databasetest.NewWithReplicas(t, 2, &item{})
+	ctx := context.Background()
+
+	db.WithContext(ctx).Create(&item{Name: database.NodePrimary})
+	for i := range 2 {
+		db.Reader(ctx).Create(&item{Name: database.ReplicaNode(i)})
+	}
+
+	// 次に選ばれるreplica-0を停止する
+	closeReader := func() {
+		t.Helper()
+		sqlDB, err := db.Reader(ctx).DB()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sqlDB.Close()
+	}
+	closeReader()
+	db.CheckReplicas(ctx)
+	h.Logs().Containing("replica is unhealthy").WithAttr("db.node", "replica-0").Len(1)
+
+	// 異常なレプリカは選ばない
+	for range 3 {
+		if got := readName(t, db, ctx); got != "replica-1" {
+			t.Fatalf("read from %q, want replica-1", got)
+		}
+	}
+
+	// 全てのレプリカが異常な場合はプライマリから読む
+	closeReader()
+	db.CheckReplicas(ctx)
+
+	h.Reset()
+	ctx, span := otel.Tracer("test").Start(ctx, "read")
+	got := readName(t, db, ctx)
+	span.End()
+	if got != database.NodePrimary {
+		t.Fatalf("read from %q, want primary", got)
+	}
+	h.Span("read").HasAttr("db.replica.failover", true)
+	h.Span("select items").HasAttr("db.node", database.NodePrimary)
+}
+
+func TestReaderWithoutReplicas(t *testing.T) {
+	db := databasetest.New(t, &item{})
+	ctx := context.Background()
+
+	db.WithContext(ctx).Create(&item{Name: database.NodePrimary})
+	if got := readName(t, db, ctx); got != database.NodePrimary {
+		t.Fatalf("read from %q, want primary", got)
+	}
+}
@@ -0,0 +1,239 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"otel-test/o11y"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const (
+	// DefaultQueryTimeout はコンテキストに期限がないクエリのタイムアウト
+	DefaultQueryTimeout = 10 * time.Second
+	// maxQueryAttempts は一時的なエラーの場合にクエリを実行する最大回数
+	maxQueryAttempts = 3
+	// queryRetryDelay はクエリの再実行までの待機時間（試行ごとに倍にする）
+	queryRetryDelay = 50 * time.Millisecond
+	// defaultConnectTimeout は起動時にデータベースに接続できるまで待つ時間
+	defaultConnectTimeout = time.Minute
+	// connectRetryDelay, maxConnectRetryDelay は起動時の接続の再試行の間隔
+	connectRetryDelay    = 500 * time.Millisecond
+	maxConnectRetryDelay = 10 * time.Second
+)
+
+// 再試行した処理（メトリクスのdb.retry.scope）
+const (
+	scopeConnect     = "connect"
+	scopeQuery       = "query"
+	scopeTransaction = "transaction"
+)
+
+// retryRecorder は再試行をスパンのイベントとメトリクスに記録する
+type retryRecorder struct {
+	retries metric.Int64Counter
+}
+
+func newRetryRecorder() *retryRecorder {
+	retries, _ := otel.Meter("database").Int64Counter("db.client.retries",
+		metric.WithDescription("Number of database operations retried after a transient error"),
+		metric.WithUnit("{retry}"),
+	)
+	return &retryRecorder{retries: retries}
+}
+
+// record はattempt回目の試行がreasonで失敗し、再試行することを記録します
+// イベントはctxのスパン（クエリの場合はSQLのスパン）に追加する
+func (r *retryRecorder) record(ctx context.Context, scope, reason string, attempt int, err error) {
+	trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+		attribute.Int("db.retry.attempt", attempt),
+		attribute.String("db.retry.reason", reason),
+		attribute.String("error", err.Error()),
+	))
+	r.retries.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("db.retry.scope", scope),
+		attribute.String("db.retry.reason", reason),
+	))
+}
+
+// retryDelay はattempt回目（1から）の失敗後に待機する時間を返します
+// base * 2^(attempt-1) をmaxで打ち切る（maxが0の場合は打ち切らない）
+func retryDelay(base, max time.Duration, attempt int) time.Duration {
+	d := base << (attempt - 1)
+	if max > 0 && (d > max || d <= 0) {
+		return max
+	}
+	return d
+}
+
+// sleep はdの間、またはctxが終了するまで待機します
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// connect はopenが一時的なエラーで失敗した場合に、間隔を延ばしながらtimeoutまで再試行します
+// 認証エラーなど一時的でないエラーはすぐに返す
+func connect(ctx context.Context, timeout time.Duration, recorder *retryRecorder, open func() (*gorm.DB, error)) (*gorm.DB, error) {
+	ctx, span := otel.Tracer("database").Start(ctx, "DB.Connect")
+	defer span.End()
+
+	deadline := time.Now().Add(timeout)
+	for attempt := 1; ; attempt++ {
+		span.SetAttributes(attribute.Int("db.connect.attempts", attempt))
+		db, err := open()
+		if err == nil {
+			return db, nil
+		}
+
+		reason := transientReason(err)
+		delay := retryDelay(connectRetryDelay, maxConnectRetryDelay, attempt)
+		if reason == "" || time.Now().Add(delay).After(deadline) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "failed to connect to database")
+			return nil, err
+		}
+
+		recorder.record(ctx, scopeConnect, reason, attempt, err)
+		o11y.Logger("database").WarnContext(ctx, "database is not reachable, retrying",
+			slog.Int("db.connect.attempt", attempt),
+			slog.String("db.retry.reason", reason),
+			slog.Duration("retry.delay", delay),
+			slog.Any("error", err),
+		)
+		if err := sleep(ctx, delay); err != nil {
+			return nil, errors.Join(fmt.Errorf("failed to connect to database: %w", ErrUnavailable), err)
+		}
+	}
+}
+
+// resilience はクエリのデフォルトのタイムアウトと、一時的なエラーの再実行を設定するGORMのプラグイン
+type resilience struct {
+	queryTimeout time.Duration
+	recorder     *retryRecorder
+}
+
+// NewResiliencePlugin はクエリのタイムアウトと再実行を設定するGORMのプラグインを作成します
+//
+//   - コンテキストに期限がないクエリはqueryTimeoutで打ち切る（0以下の場合は打ち切らない）
+//   - トランザクション外の読み込みは、一時的なエラーの場合に最大3回まで実行する
+//   - 書き込み（GORMが暗黙に開始するトランザクションを含む）とトランザクション内のクエリは再実行しない
+//     WithinTxで実行した場合はトランザクション全体を再実行する
+//
+// トランザクション外で一時的なエラーが解消しなかった場合はErrUnavailableでラップする
+func NewResiliencePlugin(queryTimeout time.Duration) gorm.Plugin {
+	return &resilience{queryTimeout: queryTimeout, recorder: newRetryRecorder()}
+}
+
+func (p *resilience) Name() string {
+	return "resilience"
+}
+
+func (p *resilience) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	// タイムアウトはトレーシングのスパンを含めて全てのコールバックに適用する
+	errs := []error{
+		cb.Create().Before("*").Register("resilience:before_create", p.before),
+		cb.Create().After("*").Register("resilience:after_create", p.after),
+		cb.Query().Before("*").Register("resilience:before_query", p.before),
+		cb.Query().After("*").Register("resilience:after_query", p.after),
+		cb.Update().Before("*").Register("resilience:before_update", p.before),
+		cb.Update().After("*").Register("resilience:after_update", p.after),
+		cb.Delete().Before("*").Register("resilience:before_delete", p.before),
+		cb.Delete().After("*").Register("resilience:after_delete", p.after),
+		cb.Raw().Before("*").Register("resilience:before_raw", p.before),
+		cb.Raw().After("*").Register("resilience:after_raw", p.after),
+	}
+	if fn := cb.Create().Get("gorm:create"); fn != nil {
+		errs = append(errs, cb.Create().Replace("gorm:create", p.retry(fn, false)))
+	}
+	if fn := cb.Query().Get("gorm:query"); fn != nil {
+		errs = append(errs, cb.Query().Replace("gorm:query", p.retry(fn, true)))
+	}
+	if fn := cb.Update().Get("gorm:update"); fn != nil {
+		errs = append(errs, cb.Update().Replace("gorm:update", p.retry(fn, false)))
+	}
+	if fn := cb.Delete().Get("gorm:delete"); fn != nil {
+		errs = append(errs, cb.Delete().Replace("gorm:delete", p.retry(fn, false)))
+	}
+	if fn := cb.Raw().Get("gorm:raw"); fn != nil {
+		errs = append(errs, cb.Raw().Replace("gorm:raw", p.retry(fn, false)))
+	}
+	return errors.Join(errs...)
+}
+
+// timeoutContext はタイムアウトを設定したクエリのコンテキスト
+// 同じ*gorm.DBで続けてクエリを実行できるよう、afterで元のコンテキストに戻す
+type timeoutContext struct {
+	context.Context
+	parent context.Context
+	cancel context.CancelFunc
+}
+
+func (p *resilience) before(db *gorm.DB) {
+	ctx := db.Statement.Context
+	if p.queryTimeout <= 0 || ctx == nil {
+		return
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, p.queryTimeout)
+	db.Statement.Context = timeoutContext{Context: timeoutCtx, parent: ctx, cancel: cancel}
+}
+
+func (p *resilience) after(db *gorm.DB) {
+	if c, ok := db.Statement.Context.(timeoutContext); ok {
+		c.cancel()
+		db.Statement.Context = c.parent
+	}
+}
+
+// retry はfn（gorm:queryなど）を一時的なエラーの場合に再実行します（retryableがfalseの場合はラップだけする）
+func (p *resilience) retry(fn func(*gorm.DB), retryable bool) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		for attempt := 1; ; attempt++ {
+			fn(db)
+			reason := transientReason(db.Error)
+			if reason == "" || inExplicitTx(db) {
+				return
+			}
+			if !retryable || attempt == maxQueryAttempts {
+				db.Error = fmt.Errorf("%w: %w", ErrUnavailable, db.Error)
+				return
+			}
+
+			ctx := db.Statement.Context
+			p.recorder.record(ctx, scopeQuery, reason, attempt, db.Error)
+			if err := sleep(ctx, retryDelay(queryRetryDelay, 0, attempt)); err != nil {
+				db.Error = fmt.Errorf("%w: %w", ErrUnavailable, errors.Join(db.Error, err))
+				return
+			}
+			db.Error = nil
+		}
+	}
+}
+
+// inExplicitTx はdbがWithinTxやTransactionで開始したトランザクション内かを返します
+// GORMが書き込みのために暗黙に開始したトランザクションは含まない
+func inExplicitTx(db *gorm.DB) bool {
+	if _, ok := db.Statement.ConnPool.(gorm.TxCommitter); !ok {
+		return false
+	}
+	started, _ := db.InstanceGet("gorm:started_transaction")
+	return started != true
+}
@@ -0,0 +1,178 @@
+package database_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"otel-test/database"
+	"otel-test/database/databasetest"
+	"otel-test/o11y/o11ytest"
+
+	"github.com/glebarez/sqlite"
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/plugin/opentelemetry/tracing"
+)
+
+var (
+	errReset         = &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	errTooManyConns  = &pgconn.PgError{Code: "53300"}
+	retryScopeQuery  = attribute.String("db.retry.scope", "query")
+	retryReasonReset = attribute.String("db.retry.reason", "connection")
+)
+
+// flaky は登録したエラーを順に返して、SQLを実行する前に失敗させる
+type flaky struct {
+	errs  []error
+	calls int
+}
+
+func (f *flaky) wrap(fn func(*gorm.DB)) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		f.calls++
+		if len(f.errs) > 0 {
+			err := f.errs[0]
+			f.errs = f.errs[1:]
+			db.AddError(err)
+			return
+		}
+		fn(db)
+	}
+}
+
+// newFlakyDB はgorm:createとgorm:queryがfのエラーで失敗するSQLiteのデータベースを作成します
+func newFlakyDB(t *testing.T, f *flaky) *database.DB {
+	t.Helper()
+	gdb, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.AutoMigrate(&item{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// プラグインはこの時点のコールバックを再実行するため、先に差し替える
+	cb := gdb.Callback()
+	cb.Create().Replace("gorm:create", f.wrap(cb.Create().Get("gorm:create")))
+	cb.Query().Replace("gorm:query", f.wrap(cb.Query().Get("gorm:query")))
+	if err := gdb.Use(database.NewResiliencePlugin(database.DefaultQueryTimeout)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gdb.Use(tracing.NewPlugin(tracing.WithoutMetrics())); err != nil {
+		t.Fatal(err)
+	}
+
+	db := database.New(gdb)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestQueryRetry(t *testing.T) {
+	h := o11ytest.New(t)
+	f := &flaky{}
+	db := newFlakyDB(t, f)
+	ctx := context.Background()
+
+	// 読み込みは一時的なエラーの場合に再実行する
+	db.WithContext(ctx).Create(&item{Name: "a"})
+	f.errs, f.calls = []error{errReset, errTooManyConns}, 0
+	var items []item
+	if err := db.WithContext(ctx).Find(&items).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || f.calls != 3 {
+		t.Fatalf("items = %v, calls = %d", items, f.calls)
+	}
+	h.Span("select items").HasEvent("retry").NoError()
+	h.Metric("db.client.retries").WithAttrs(retryScopeQuery, retryReasonReset).HasValue(1)
+
+	// 最大3回まで実行し、失敗した場合はErrUnavailableでラップする
+	f.errs, f.calls = []error{errReset, errReset, errReset}, 0
+	err := db.WithContext(ctx).Find(&items).Error
+	if !errors.Is(err, database.ErrUnavailable) || !errors.Is(err, syscall.ECONNRESET) || f.calls != 3 {
+		t.Fatalf("err = %v, calls = %d", err, f.calls)
+	}
+
+	// 書き込みは反映されたかわからないため再実行しない（WithinTxで再実行する）
+	f.errs, f.calls = []error{errTooManyConns}, 0
+	err = db.WithContext(ctx).Create(&item{Name: "b"}).Error
+	if !errors.Is(err, database.ErrUnavailable) || f.calls != 1 {
+		t.Fatalf("err = %v, calls = %d", err, f.calls)
+	}
+	if got := names(t, db); len(got) != 1 {
+		t.Fatalf("names = %v", got)
+	}
+}
+
+func TestWithinTxRetryTransient(t *testing.T) {
+	h := o11ytest.New(t)
+	f := &flaky{}
+	db := newFlakyDB(t, f)
+
+	// トランザクション内のクエリは再実行せず、トランザクション全体を再実行する
+	f.errs = []error{errReset}
+	attempts := 0
+	err := db.WithinTx(context.Background(), func(ctx context.Context) error {
+		attempts++
+		var items []item
+		if err := db.WithContext(ctx).Find(&items).Error; err != nil {
+			return err
+		}
+		return db.WithContext(ctx).Create(&item{Name: "a"}).Error
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("err = %v, attempts = %d", err, attempts)
+	}
+	h.Span("DB.WithinTx").HasAttr("db.transaction.attempts", 2).HasEvent("retry")
+	h.Metric("db.client.retries").
+		WithAttrs(attribute.String("db.retry.scope", "transaction"), retryReasonReset).
+		HasValue(1)
+	if got := names(t, db); len(got) != 1 {
+		t.Fatalf("names = %v", got)
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	db := databasetest.New(t, &item{})
+
+	var deadline time.Time
+	var hasDeadline bool
+	db.Callback().Query().Before("gorm:query").Register("test:deadline", func(db *gorm.DB) {
+		deadline, hasDeadline = db.Statement.Context.Deadline()
+	})
+
+	// コンテキストに期限がない場合はデフォルトのタイムアウトを設定する
+	start := time.Now()
+	tx := db.WithContext(context.Background()).Model(&item{})
+	var items []item
+	if err := tx.Find(&items).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !hasDeadline || deadline.Before(start.Add(database.DefaultQueryTimeout)) {
+		t.Fatalf("deadline = %v (set = %v)", deadline, hasDeadline)
+	}
+	// クエリの後は元のコンテキストに戻す
+	if _, ok := tx.Statement.Context.Deadline(); ok || tx.Statement.Context.Err() != nil {
+		t.Fatal("statement context is not restored")
+	}
+
+	// 呼び出し元の期限を優先する
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	want, _ := ctx.Deadline()
+	if err := db.WithContext(ctx).Find(&items).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !deadline.Equal(want) {
+		t.Fatalf("deadline = %v, want %v", deadline, want)
+	}
+}
@@ -0,0 +1,100 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"otel-test/tenant"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// TenantField はテナントで分離するモデルのフィールド名（カラムはtenant_id）
+const TenantField = "TenantID"
+
+// tenantScope はTenantIDフィールドを持つモデルをコンテキストのテナントで分離するGORMのプラグイン
+type tenantScope struct{}
+
+// NewTenantPlugin はTenantIDフィールドを持つモデルをテナントで分離するGORMのプラグインを作成します
+//
+//   - 読み込み・更新・削除にtenant_idの条件を追加する
+//   - 作成時はTenantIDにコンテキストのテナントを設定する（指定した値は使わない）
+//   - コンテキストにテナントがない場合はtenant.ErrMissingで失敗する
+//     tenant.WithAllTenantsのコンテキストでは条件を追加しない（作成はできない）
+//
+// Raw・Execで実行したSQLには適用しない
+func NewTenantPlugin() gorm.Plugin {
+	return tenantScope{}
+}
+
+func (tenantScope) Name() string {
+	return "tenant"
+}
+
+func (p tenantScope) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	return errors.Join(
+		cb.Create().Before("gorm:create").Register("tenant:create", p.assign),
+		cb.Query().Before("gorm:query").Register("tenant:query", p.scope),
+		cb.Update().Before("gorm:update").Register("tenant:update", p.scope),
+		cb.Delete().Before("gorm:delete").Register("tenant:delete", p.scope),
+	)
+}
+
+// field はモデルのTenantIDフィールドを返します。ない場合はnil
+func (tenantScope) field(db *gorm.DB) *schema.Field {
+	if db.Error != nil || db.Statement.Schema == nil {
+		return nil
+	}
+	return db.Statement.Schema.LookUpField(TenantField)
+}
+
+// scope はtenant_idの条件を追加します
+func (p tenantScope) scope(db *gorm.DB) {
+	field := p.field(db)
+	if field == nil {
+		return
+	}
+	ctx := db.Statement.Context
+	id, ok := tenant.FromContext(ctx)
+	if !ok {
+		if !tenant.AllTenants(ctx) {
+			_ = db.AddError(fmt.Errorf("%s: %w", db.Statement.Schema.Table, tenant.ErrMissing))
+		}
+		return
+	}
+	db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: id},
+	}})
+}
+
+// assign は作成する値のTenantIDにコンテキストのテナントを設定します
+func (p tenantScope) assign(db *gorm.DB) {
+	field := p.field(db)
+	if field == nil {
+		return
+	}
+	ctx := db.Statement.Context
+	id, ok := tenant.FromContext(ctx)
+	if !ok {
+		_ = db.AddError(fmt.Errorf("%s: %w", db.Statement.Schema.Table, tenant.ErrMissing))
+		return
+	}
+
+	rv := db.Statement.ReflectValue
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if err := field.Set(ctx, reflect.Indirect(rv.Index(i)), id); err != nil {
+				_ = db.AddError(err)
+				return
+			}
+		}
+	case reflect.Struct:
+		if err := field.Set(ctx, rv, id); err != nil {
+			_ = db.AddError(err)
+		}
+	}
+}
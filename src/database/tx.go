@@ -0,0 +1,142 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const (
+	// maxTxAttempts は一時的なエラーの場合にトランザクションを実行する最大回数
+	maxTxAttempts = 3
+	// txRetryDelay は再実行までの待機時間（試行ごとに倍にする）
+	txRetryDelay = 10 * time.Millisecond
+)
+
+// txKey はコンテキストに設定するトランザクションのキー
+type txKey struct{}
+
+// txState はWithinTxで開始したトランザクション
+type txState struct {
+	root *DB // トランザクションを開始したDB
+	tx   *DB
+}
+
+// txFromContext はctxに設定されたdbのトランザクションを返します
+func (db *DB) txFromContext(ctx context.Context) *txState {
+	st, ok := ctx.Value(txKey{}).(*txState)
+	if !ok || st.root != db {
+		return nil
+	}
+	return st
+}
+
+// InTx はctxにWithinTxで開始したトランザクションがあるかを返します
+func InTx(ctx context.Context) bool {
+	_, ok := ctx.Value(txKey{}).(*txState)
+	return ok
+}
+
+// OnCommit はctxのトランザクションのコミット後にfnを実行します
+// ロールバックした場合は実行せず、トランザクション外の場合はすぐに実行する
+func OnCommit(ctx context.Context, fn func()) {
+	st, ok := ctx.Value(txKey{}).(*txState)
+	if !ok {
+		fn()
+		return
+	}
+	st.tx.AfterCommit(fn)
+}
+
+// WithinTx はfnをトランザクション内で実行します
+// fnに渡すコンテキストにトランザクションを設定し、そのコンテキストを使うリポジトリ（WithContext）は同じトランザクションで実行される
+//
+//   - ctxに既にトランザクションがある場合はセーブポイントで入れ子にし、fnがエラーを返すとセーブポイントまでロールバックする
+//   - 最も外側のトランザクションは一時的なエラー（シリアライズ失敗・デッドロック・接続エラー・接続数の超過）の場合に
+//     最大3回まで再実行するため、fnは再実行できるようにする。再実行しても失敗した場合はErrUnavailableでラップする
+//   - コミット中に接続が切れた場合はコミットされたかわからないため再実行しない
+//   - AfterCommitとOnCommitの関数は最も外側のコミット後に実行し、ロールバックした入れ子の分は実行しない
+func (db *DB) WithinTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	ctx, span := otel.Tracer("database").Start(ctx, "DB.WithinTx")
+	defer span.End()
+
+	if parent := db.txFromContext(ctx); parent != nil {
+		span.SetAttributes(attribute.Bool("db.transaction.nested", true))
+		hooks, _, err := db.runTx(ctx, span, parent.tx, fn)
+		if err == nil {
+			*parent.tx.afterCommit = append(*parent.tx.afterCommit, hooks...)
+		}
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		span.SetAttributes(attribute.Int("db.transaction.attempts", attempt))
+		hooks, committing, err := db.runTx(ctx, span, db, fn)
+		if err == nil {
+			for _, hook := range hooks {
+				hook()
+			}
+			return nil
+		}
+
+		reason := transientReason(err)
+		if reason == "" || (committing && !safeToRetryWrite(reason)) {
+			return err
+		}
+		if attempt == maxTxAttempts {
+			return fmt.Errorf("%w: %w", ErrUnavailable, err)
+		}
+
+		db.retries.record(ctx, scopeTransaction, reason, attempt, err)
+		if sleepErr := sleep(ctx, retryDelay(txRetryDelay, 0, attempt)); sleepErr != nil {
+			return errors.Join(err, sleepErr)
+		}
+	}
+}
+
+// runTx はconnでトランザクション（connがトランザクションの場合はセーブポイント）を開始してfnを実行します
+// コミットした場合は、コミット後に実行する関数を返す。committingはfnが成功した後のコミットで失敗したか
+func (db *DB) runTx(ctx context.Context, span trace.Span, conn *DB, fn func(ctx context.Context) error) (hooks []func(), committing bool, err error) {
+	begin, commit, rollback := "begin", "commit", "rollback"
+	if conn.afterCommit != nil {
+		begin, commit, rollback = "savepoint", "release_savepoint", "rollback_to_savepoint"
+	}
+
+	var fnErr error
+	span.AddEvent(begin)
+	defer func() {
+		if r := recover(); r != nil {
+			span.AddEvent(rollback, trace.WithAttributes(attribute.Bool("panic", true)))
+			span.SetStatus(codes.Error, fmt.Sprint(r))
+			panic(r)
+		}
+		switch {
+		case err == nil:
+			span.AddEvent(commit)
+		case fnErr == nil:
+			// fnは成功したがコミットに失敗した
+			span.RecordError(err)
+			span.AddEvent(rollback)
+		default:
+			span.AddEvent(rollback)
+		}
+	}()
+
+	hooks = []func(){}
+	err = conn.DB.WithContext(ctx).Transaction(func(gtx *gorm.DB) error {
+		tx := &DB{DB: gtx, config: db.config, afterCommit: &hooks, retries: db.retries}
+		fnErr = fn(context.WithValue(ctx, txKey{}, &txState{root: db, tx: tx}))
+		return fnErr
+	})
+	if err != nil {
+		return nil, fnErr == nil, err
+	}
+	return hooks, false, nil
+}
@@ -0,0 +1,159 @@
+package database_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"otel-test/database"
+	"otel-test/database/databasetest"
+	"otel-test/o11y/o11ytest"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type item struct {
+	ID   uint
+	Name string
+}
+
+func names(t *testing.T, db *database.DB) []string {
+	t.Helper()
+	var got []string
+	if err := db.WithContext(context.Background()).Model(&item{}).Order("id").Pluck("name", &got).Error; err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestWithinTx(t *testing.T) {
+	h := o11ytest.New(t)
+	db := databasetest.New(t, &item{})
+	ctx := context.Background()
+	errFailed := errors.New("failed")
+
+	var committed []string
+	err := db.WithinTx(ctx, func(ctx context.Context) error {
+		if database.InTx(context.Background()) || !database.InTx(ctx) {
+			t.Fatal("InTx does not follow the context")
+		}
+		// コンテキストのトランザクションで実行される
+		if err := db.WithContext(ctx).Create(&item{Name: "outer"}).Error; err != nil {
+			return err
+		}
+		database.OnCommit(ctx, func() { committed = append(committed, "outer") })
+
+		// 入れ子のエラーはセーブポイントまでロールバックする
+		err := db.WithinTx(ctx, func(ctx context.Context) error {
+			db.WithContext(ctx).Create(&item{Name: "rolled back"})
+			database.OnCommit(ctx, func() { committed = append(committed, "rolled back") })
+			return errFailed
+		})
+		if !errors.Is(err, errFailed) {
+			t.Fatalf("nested error = %v", err)
+		}
+		if err := db.WithinTx(ctx, func(ctx context.Context) error {
+			database.OnCommit(ctx, func() { committed = append(committed, "nested") })
+			return db.WithContext(ctx).Create(&item{Name: "nested"}).Error
+		}); err != nil {
+			return err
+		}
+
+		if len(committed) != 0 {
+			t.Fatalf("hooks ran before commit: %v", committed)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := names(t, db); len(got) != 2 || got[0] != "outer" || got[1] != "nested" {
+		t.Fatalf("names = %v", got)
+	}
+	if len(committed) != 2 || committed[0] != "outer" || committed[1] != "nested" {
+		t.Fatalf("committed hooks = %v", committed)
+	}
+
+	spans := h.Spans().Named("DB.WithinTx").Each()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 transaction spans, got %d", len(spans))
+	}
+	// 終了した順（入れ子、入れ子、外側）
+	spans[2].IsRoot().HasEvent("begin").HasEvent("commit").HasAttr("db.transaction.attempts", 1)
+	spans[0].ChildOf(spans[2]).HasAttr("db.transaction.nested", true).HasEvent("savepoint").HasEvent("rollback_to_savepoint")
+	spans[1].HasEvent("release_savepoint")
+}
+
+func TestWithinTxRollback(t *testing.T) {
+	h := o11ytest.New(t)
+	db := databasetest.New(t, &item{})
+	errFailed := errors.New("failed")
+
+	ran := false
+	err := db.WithinTx(context.Background(), func(ctx context.Context) error {
+		db.WithContext(ctx).Create(&item{Name: "rolled back"})
+		database.OnCommit(ctx, func() { ran = true })
+		return errFailed
+	})
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("err = %v", err)
+	}
+	if got := names(t, db); len(got) != 0 || ran {
+		t.Fatalf("names = %v, hook ran = %v", got, ran)
+	}
+	h.Span("DB.WithinTx").HasEvent("rollback").NoEvent("commit").NoEvent("retry")
+}
+
+func TestWithinTxRetry(t *testing.T) {
+	h := o11ytest.New(t)
+	db := databasetest.New(t, &item{})
+	serialization := &pgconn.PgError{Code: "40001"}
+
+	// シリアライズ失敗は再実行する
+	attempts := 0
+	err := db.WithinTx(context.Background(), func(ctx context.Context) error {
+		attempts++
+		if err := db.WithContext(ctx).Create(&item{Name: "item"}).Error; err != nil {
+			return err
+		}
+		if attempts == 1 {
+			return serialization
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("err = %v, attempts = %d", err, attempts)
+	}
+	if got := names(t, db); len(got) != 1 {
+		t.Fatalf("names = %v", got)
+	}
+	h.Span("DB.WithinTx").HasAttr("db.transaction.attempts", 2).HasEvent("retry")
+
+	// 再実行は最大3回まで
+	attempts = 0
+	err = db.WithinTx(context.Background(), func(ctx context.Context) error {
+		attempts++
+		return serialization
+	})
+	if !errors.Is(err, serialization) || attempts != 3 {
+		t.Fatalf("err = %v, attempts = %d", err, attempts)
+	}
+
+	// 入れ子のトランザクションは再実行しない（最も外側で再実行する）
+	attempts = 0
+	inner := 0
+	err = db.WithinTx(context.Background(), func(ctx context.Context) error {
+		attempts++
+		return db.WithinTx(ctx, func(ctx context.Context) error {
+			inner++
+			if attempts == 1 {
+				return serialization
+			}
+			return nil
+		})
+	})
+	if err != nil || attempts != 2 || inner != 2 {
+		t.Fatalf("err = %v, attempts = %d, inner = %d", err, attempts, inner)
+	}
+}
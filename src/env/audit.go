@@ -0,0 +1,23 @@
+package env
+
+import "os"
+
+// AuditConfig は監査ログに記録する変更したユーザーの取得の設定
+type AuditConfig struct {
+	// IAPAudience はIAPのJWTの検証に使うaud（空の場合は検証しない）
+	IAPAudience string
+	// TrustedProxies はユーザーのヘッダーを信頼する接続元（CIDRまたはIPアドレス）
+	TrustedProxies []string
+}
+
+// 環境変数から監査ログの設定を取得する
+// どちらも設定しない場合、リクエストの変更はanonymousとして記録する
+//
+//	AUDIT_IAP_AUDIENCE     : X-Goog-IAP-JWT-Assertionのaud (default: なし)
+//	AUDIT_TRUSTED_PROXIES  : X-Goog-Authenticated-User-EmailとX-Actorを信頼する接続元（カンマ区切り） (default: なし)
+func GetAuditConfigFromEnv() AuditConfig {
+	return AuditConfig{
+		IAPAudience:    os.Getenv("AUDIT_IAP_AUDIENCE"),
+		TrustedProxies: getList("AUDIT_TRUSTED_PROXIES"),
+	}
+}
@@ -0,0 +1,44 @@
+package env
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// キャッシュのバックエンド名
+const (
+	CacheMemory = "memory"
+	CacheNone   = "none"
+)
+
+// CacheConfig はユーザー検索のキャッシュの設定
+type CacheConfig struct {
+	// Backend はキャッシュの保存先（memory, none）
+	Backend string
+	// Size はmemoryで保持する最大件数
+	Size int
+	// TTL は値を保存する期間
+	TTL time.Duration
+	// NegativeTTL は存在しないことを保存する期間
+	NegativeTTL time.Duration
+}
+
+// 環境変数からキャッシュの設定を取得する
+//
+//	CACHE_BACKEND       : memory または none (default: memory)
+//	CACHE_SIZE          : memoryの最大件数 (default: 10000)
+//	CACHE_TTL           : 値を保存する期間 (default: 5m)
+//	CACHE_NEGATIVE_TTL  : 存在しないことを保存する期間 (default: 30s, 0sで無効)
+func GetCacheConfigFromEnv() CacheConfig {
+	cfg := CacheConfig{
+		Backend:     strings.ToLower(strings.TrimSpace(os.Getenv("CACHE_BACKEND"))),
+		Size:        getInt("CACHE_SIZE", 10000),
+		TTL:         getDuration("CACHE_TTL", 5*time.Minute),
+		NegativeTTL: getDuration("CACHE_NEGATIVE_TTL", 30*time.Second),
+	}
+	if cfg.Backend == "" {
+		cfg.Backend = CacheMemory
+	}
+	return cfg
+}
@@ -0,0 +1,29 @@
+package env
+
+import "os"
+
+// CompressionConfig はHTTPのレスポンスの圧縮の設定
+type CompressionConfig struct {
+	// Encodings はレスポンスの圧縮方式（優先する順。空の場合は圧縮しない）
+	Encodings []string
+	// MinSize はこれより小さいレスポンスを圧縮しない（バイト）
+	MinSize int
+}
+
+// 環境変数からレスポンスの圧縮の設定を取得する
+//
+//	COMPRESSION_ENCODINGS : 圧縮方式（カンマ区切り、優先する順） (default: zstd,br,gzip, offで無効)
+//	COMPRESSION_MIN_SIZE  : 圧縮するレスポンスの最小サイズ（バイト） (default: 1024)
+func GetCompressionConfigFromEnv() CompressionConfig {
+	cfg := CompressionConfig{
+		Encodings: getList("COMPRESSION_ENCODINGS"),
+		MinSize:   getInt("COMPRESSION_MIN_SIZE", 1024),
+	}
+	switch {
+	case os.Getenv("COMPRESSION_ENCODINGS") == "":
+		cfg.Encodings = []string{"zstd", "br", "gzip"}
+	case len(cfg.Encodings) == 1 && cfg.Encodings[0] == "off":
+		cfg.Encodings = nil
+	}
+	return cfg
+}
@@ -23,3 +23,76 @@ func GetModeFromEnv() Mode {
 		return Default
 	}
 }
+
+// 環境変数から管理用サーバーのアドレスを取得する
+// 未設定の場合は管理用サーバーを起動しない
+func GetAdminAddrFromEnv() string {
+	return os.Getenv("ADMIN_ADDR")
+}
+
+// 環境変数からgRPCサーバーのアドレスを取得する
+// 未設定の場合は:50051
+func GetGRPCAddrFromEnv() string {
+	if addr := os.Getenv("GRPC_ADDR"); addr != "" {
+		return addr
+	}
+	return ":50051"
+}
+
+// LogConfig はログの設定
+type LogConfig struct {
+	// Level は全体のログレベル (debug, info, warn, error)
+	Level string
+	// Overrides はロガー名ごとのログレベル
+	Overrides map[string]string
+}
+
+// 環境変数からログ設定を取得する
+//
+//	LOG_LEVEL           : 全体のログレベル (default: info)
+//	LOG_LEVEL_OVERRIDES : ロガー名ごとのログレベル。ロガー名は大文字・小文字を区別する (例: database=debug,jobs=warn)
+func GetLogConfigFromEnv() LogConfig {
+	cfg := LogConfig{
+		Level:     os.Getenv("LOG_LEVEL"),
+		Overrides: map[string]string{},
+	}
+	if cfg.Level == "" {
+		cfg.Level = "info"
+	}
+	for _, pair := range getCaseSensitiveList("LOG_LEVEL_OVERRIDES") {
+		name, level, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		cfg.Overrides[strings.TrimSpace(name)] = strings.TrimSpace(level)
+	}
+	return cfg
+}
+
+// 環境変数からGoogle CloudのプロジェクトIDを取得する
+// Cloud Loggingのtraceフィールド（projects/<id>/traces/<trace-id>）に使用する
+func GetGCPProjectFromEnv() string {
+	if project := os.Getenv("GOOGLE_CLOUD_PROJECT"); project != "" {
+		return project
+	}
+	return os.Getenv("GCP_PROJECT")
+}
+
+// RedactConfig は個人情報のマスキング設定
+type RedactConfig struct {
+	// Rules は属性キーのパターンとアクションの組 (例: user.email=hash,user.name=mask,*.password=drop)
+	Rules string
+	// HashSalt はhashアクションのHMACの鍵（hashアクションを使用する場合は必須）
+	HashSalt string `secret:"true"`
+}
+
+// 環境変数からマスキング設定を取得する
+//
+//	REDACT_RULES     : マスキングルール (未設定の場合はマスキングしない)
+//	REDACT_HASH_SALT : hashアクションのHMACの鍵 (hashアクションを使用する場合は必須)
+func GetRedactConfigFromEnv() RedactConfig {
+	return RedactConfig{
+		Rules:    os.Getenv("REDACT_RULES"),
+		HashSalt: os.Getenv("REDACT_HASH_SALT"),
+	}
+}
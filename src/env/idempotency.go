@@ -0,0 +1,37 @@
+package env
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// IdempotencyConfig はIdempotency-Keyの処理の設定
+type IdempotencyConfig struct {
+	// TTL はキーとレスポンスを保存する期間
+	TTL time.Duration
+	// LockTimeout は処理中のキーのロック期間
+	LockTimeout time.Duration
+	// PurgeSchedule は期限切れのキーを削除するスケジュール（空の場合は実行しない）
+	PurgeSchedule string
+}
+
+// 環境変数からIdempotency-Keyの処理の設定を取得する
+//
+//	IDEMPOTENCY_TTL             : キーとレスポンスを保存する期間 (default: 24h)
+//	IDEMPOTENCY_LOCK_TIMEOUT    : 処理中のキーのロック期間 (default: 1m)
+//	IDEMPOTENCY_PURGE_SCHEDULE  : 期限切れのキーを削除するスケジュール (default: @hourly, offで無効)
+func GetIdempotencyConfigFromEnv() IdempotencyConfig {
+	cfg := IdempotencyConfig{
+		TTL:           getDuration("IDEMPOTENCY_TTL", 24*time.Hour),
+		LockTimeout:   getDuration("IDEMPOTENCY_LOCK_TIMEOUT", time.Minute),
+		PurgeSchedule: strings.TrimSpace(os.Getenv("IDEMPOTENCY_PURGE_SCHEDULE")),
+	}
+	switch cfg.PurgeSchedule {
+	case "":
+		cfg.PurgeSchedule = "@hourly"
+	case "off":
+		cfg.PurgeSchedule = ""
+	}
+	return cfg
+}
@@ -0,0 +1,57 @@
+package env
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// JobsConfig はバックグラウンドジョブの設定
+type JobsConfig struct {
+	// Concurrency は同時に実行するジョブの最大数
+	Concurrency int
+	// PollInterval はキューを確認する間隔
+	PollInterval time.Duration
+	// Lease は実行中のジョブのロック期間
+	Lease time.Duration
+	// MaxAttempts はジョブごとの最大試行回数
+	MaxAttempts int
+	// BackoffBase は1回目の失敗後の再試行間隔（以降は2倍ずつ増える）
+	BackoffBase time.Duration
+	// BackoffMax は再試行間隔の上限
+	BackoffMax time.Duration
+	// PurgeSchedule は論理削除済みユーザーを物理削除するスケジュール（空の場合は実行しない）
+	PurgeSchedule string
+	// PurgeRetention は論理削除済みユーザーを保持する期間
+	PurgeRetention time.Duration
+}
+
+// 環境変数からバックグラウンドジョブの設定を取得する
+//
+//	JOBS_CONCURRENCY      : 同時実行数 (default: 4)
+//	JOBS_POLL_INTERVAL    : キューを確認する間隔 (default: 1s)
+//	JOBS_LEASE            : 実行中のジョブのロック期間 (default: 5m)
+//	JOBS_MAX_ATTEMPTS     : 最大試行回数 (default: 5)
+//	JOBS_BACKOFF_BASE     : 最初の再試行間隔 (default: 10s)
+//	JOBS_BACKOFF_MAX      : 再試行間隔の上限 (default: 1h)
+//	JOBS_PURGE_SCHEDULE   : 削除済みユーザーの物理削除のスケジュール (default: @daily, offで無効)
+//	JOBS_PURGE_RETENTION  : 削除済みユーザーの保持期間 (default: 720h)
+func GetJobsConfigFromEnv() JobsConfig {
+	cfg := JobsConfig{
+		Concurrency:    getInt("JOBS_CONCURRENCY", 4),
+		PollInterval:   getDuration("JOBS_POLL_INTERVAL", time.Second),
+		Lease:          getDuration("JOBS_LEASE", 5*time.Minute),
+		MaxAttempts:    getInt("JOBS_MAX_ATTEMPTS", 5),
+		BackoffBase:    getDuration("JOBS_BACKOFF_BASE", 10*time.Second),
+		BackoffMax:     getDuration("JOBS_BACKOFF_MAX", time.Hour),
+		PurgeSchedule:  strings.TrimSpace(os.Getenv("JOBS_PURGE_SCHEDULE")),
+		PurgeRetention: getDuration("JOBS_PURGE_RETENTION", 30*24*time.Hour),
+	}
+	switch cfg.PurgeSchedule {
+	case "":
+		cfg.PurgeSchedule = "@daily"
+	case "off":
+		cfg.PurgeSchedule = ""
+	}
+	return cfg
+}
@@ -0,0 +1,70 @@
+package env
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// Sink名
+const (
+	SinkBus     = "bus"
+	SinkWebhook = "webhook"
+	SinkFile    = "file"
+)
+
+// OutboxConfig はアウトボックスのリレーの設定
+type OutboxConfig struct {
+	// Sinks はイベントの送信先（bus, webhook, file）
+	Sinks []string
+	// WebhookURL はwebhookの送信先URL（パスやクエリに認証情報を含むことがあるため伏せ字にする）
+	WebhookURL string `secret:"true"`
+	// File はfileの出力先パス（NDJSON）
+	File string
+	// Interval はアウトボックスを確認する間隔
+	Interval time.Duration
+	// BatchSize は1回の確認で送信するイベントの最大数
+	BatchSize int
+	// MaxAttempts はイベントごとの最大試行回数
+	MaxAttempts int
+	// Lease は送信中のイベントをロックする時間
+	Lease time.Duration
+}
+
+// 環境変数からアウトボックスの設定を取得する
+//
+//	OUTBOX_SINKS         : カンマ区切りの送信先 (default: bus)
+//	OUTBOX_WEBHOOK_URL   : webhookの送信先URL
+//	OUTBOX_FILE          : fileの出力先パス (default: events.ndjson)
+//	OUTBOX_INTERVAL      : アウトボックスを確認する間隔 (default: 1s)
+//	OUTBOX_BATCH_SIZE    : 1回に送信する最大数 (default: 100)
+//	OUTBOX_MAX_ATTEMPTS  : 最大試行回数 (default: 10)
+//	OUTBOX_LEASE         : 送信中のイベントをロックする時間 (default: 1m)
+func GetOutboxConfigFromEnv() OutboxConfig {
+	cfg := OutboxConfig{
+		Sinks:       getList("OUTBOX_SINKS"),
+		WebhookURL:  os.Getenv("OUTBOX_WEBHOOK_URL"),
+		File:        os.Getenv("OUTBOX_FILE"),
+		Interval:    getDuration("OUTBOX_INTERVAL", time.Second),
+		BatchSize:   getInt("OUTBOX_BATCH_SIZE", 100),
+		MaxAttempts: getInt("OUTBOX_MAX_ATTEMPTS", 10),
+		Lease:       getDuration("OUTBOX_LEASE", time.Minute),
+	}
+	if len(cfg.Sinks) == 0 {
+		cfg.Sinks = []string{SinkBus}
+	}
+	if cfg.File == "" {
+		cfg.File = "events.ndjson"
+	}
+	return cfg
+}
+
+// getInt は環境変数を正の整数として取得する
+// 未設定または不正な値の場合はデフォルト値を返す
+func getInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || v <= 0 {
+		return def
+	}
+	return v
+}
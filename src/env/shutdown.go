@@ -0,0 +1,116 @@
+package env
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// シャットダウンフェーズ名
+const (
+	PhaseReadiness  = "readiness"
+	PhasePreStop    = "prestop"
+	PhaseHTTP       = "http"
+	PhaseGRPC       = "grpc"
+	PhaseInFlight   = "inflight"
+	PhaseJobs       = "jobs"
+	PhaseBackground = "background"
+	PhaseTelemetry  = "telemetry"
+	PhaseDatabase   = "database"
+	PhaseAdmin      = "admin"
+)
+
+// DefaultShutdownOrder はデフォルトのシャットダウン順序
+// テレメトリは最後にフラッシュし、その後DBを閉じる
+// 管理用サーバーはシャットダウン中も調査できるよう最後に停止する
+var DefaultShutdownOrder = []string{
+	PhaseReadiness,
+	PhasePreStop,
+	PhaseHTTP,
+	PhaseGRPC,
+	PhaseInFlight,
+	PhaseJobs,
+	PhaseBackground,
+	PhaseTelemetry,
+	PhaseDatabase,
+	PhaseAdmin,
+}
+
+// ShutdownConfig はGraceful Shutdownの設定
+type ShutdownConfig struct {
+	// PreStopDelay はNot Readyにしてから新規受付を止めるまでの待機時間
+	PreStopDelay time.Duration
+	// Timeout はシャットダウン全体のタイムアウト
+	Timeout time.Duration
+	// Order はフェーズの実行順序（含まれないフェーズは実行しない）
+	Order []string
+	// PhaseTimeouts はフェーズごとのタイムアウト
+	PhaseTimeouts map[string]time.Duration
+}
+
+// PhaseTimeout はフェーズのタイムアウトを返す（未設定の場合は0）
+func (c ShutdownConfig) PhaseTimeout(phase string) time.Duration {
+	return c.PhaseTimeouts[phase]
+}
+
+// 環境変数からシャットダウン設定を取得する
+//
+//	SHUTDOWN_PRE_STOP_DELAY   : pre-stop待機時間 (default: 0s)
+//	SHUTDOWN_TIMEOUT          : 全体のタイムアウト (default: 30s)
+//	SHUTDOWN_ORDER            : カンマ区切りのフェーズ順序
+//	SHUTDOWN_<PHASE>_TIMEOUT  : フェーズごとのタイムアウト
+func GetShutdownConfigFromEnv() ShutdownConfig {
+	cfg := ShutdownConfig{
+		PreStopDelay: getDuration("SHUTDOWN_PRE_STOP_DELAY", 0),
+		Timeout:      getDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		Order:        DefaultShutdownOrder,
+		PhaseTimeouts: map[string]time.Duration{
+			PhaseHTTP:       getDuration("SHUTDOWN_HTTP_TIMEOUT", 10*time.Second),
+			PhaseGRPC:       getDuration("SHUTDOWN_GRPC_TIMEOUT", 10*time.Second),
+			PhaseInFlight:   getDuration("SHUTDOWN_INFLIGHT_TIMEOUT", 10*time.Second),
+			PhaseJobs:       getDuration("SHUTDOWN_JOBS_TIMEOUT", 10*time.Second),
+			PhaseBackground: getDuration("SHUTDOWN_BACKGROUND_TIMEOUT", 10*time.Second),
+			PhaseTelemetry:  getDuration("SHUTDOWN_TELEMETRY_TIMEOUT", 5*time.Second),
+			PhaseDatabase:   getDuration("SHUTDOWN_DATABASE_TIMEOUT", 5*time.Second),
+			PhaseAdmin:      getDuration("SHUTDOWN_ADMIN_TIMEOUT", 5*time.Second),
+		},
+	}
+	if order := getList("SHUTDOWN_ORDER"); len(order) > 0 {
+		cfg.Order = order
+	}
+	return cfg
+}
+
+// getDuration は環境変数をtime.Durationとして取得する
+// 未設定または不正な値の場合はデフォルト値を返す
+func getDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return def
+	}
+	return d
+}
+
+// getList はカンマ区切りの環境変数を小文字のスライスとして取得する
+func getList(key string) []string {
+	list := getCaseSensitiveList(key)
+	for i, v := range list {
+		list[i] = strings.ToLower(v)
+	}
+	return list
+}
+
+// getCaseSensitiveList はカンマ区切りの環境変数を大文字・小文字を変えずにスライスとして取得する
+func getCaseSensitiveList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,51 @@
+package env
+
+import (
+	"os"
+	"strings"
+)
+
+// TenantConfig はリクエストのテナントを決める設定
+type TenantConfig struct {
+	// Header はテナントIDを指定するヘッダー（空の場合は使用しない）
+	Header string
+	// Domain はサブドメインをテナントIDとして扱うドメイン（空の場合は使用しない）
+	Domain string
+	// Claim はBearerトークンのテナントIDのクレーム（空の場合は使用しない）
+	Claim string
+	// Default はテナントを指定しないリクエストのテナント（空の場合は400）
+	Default string
+	// Allowed は受け付けるテナントID（空の場合は形式が正しければ受け付ける）
+	Allowed []string
+}
+
+// 環境変数からテナントの設定を取得する
+// ヘッダーとトークンのクレームは検証せずに信用するため、前段（IAPやAPI Gatewayなど）で
+// 検証・上書きする構成でだけ有効にする。デフォルトでは全てのリクエストがTENANT_DEFAULTのテナントになる
+//
+//	TENANT_HEADER   : テナントIDのヘッダー (default: なし)
+//	TENANT_DOMAIN   : acme.example.comのacmeをテナントIDにする場合のexample.com (default: なし)
+//	TENANT_CLAIM    : Bearerトークン（JWT）のテナントIDのクレーム (default: なし)
+//	TENANT_DEFAULT  : テナントを指定しないリクエストのテナント (default: default, offで指定を必須にする)
+//	TENANT_ALLOWED  : 受け付けるテナントID（カンマ区切り）。指定した場合はメトリクスにもtenant.idを付与する (default: なし)
+func GetTenantConfigFromEnv() TenantConfig {
+	return TenantConfig{
+		Header:  getOptional("TENANT_HEADER", ""),
+		Domain:  strings.ToLower(strings.TrimSpace(os.Getenv("TENANT_DOMAIN"))),
+		Claim:   getOptional("TENANT_CLAIM", ""),
+		Default: getOptional("TENANT_DEFAULT", "default"),
+		Allowed: getList("TENANT_ALLOWED"),
+	}
+}
+
+// getOptional は環境変数の値を返します。未設定の場合はdef、offの場合は空
+func getOptional(key, def string) string {
+	switch v := strings.TrimSpace(os.Getenv(key)); v {
+	case "":
+		return def
+	case "off":
+		return ""
+	default:
+		return v
+	}
+}
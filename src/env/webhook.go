@@ -0,0 +1,38 @@
+package env
+
+import "time"
+
+// WebhookConfig はwebhookの配信設定
+type WebhookConfig struct {
+	// MaxAttempts は配信ごとの最大試行回数
+	MaxAttempts int
+	// BackoffBase は1回目の失敗後の再送間隔（以降は2倍ずつ増える）
+	BackoffBase time.Duration
+	// BackoffMax は再送間隔の上限
+	BackoffMax time.Duration
+	// Timeout は1回の送信のタイムアウト
+	Timeout time.Duration
+	// Interval は配信待ちを確認する間隔
+	Interval time.Duration
+	// Lease は送信中の配信をロックする時間
+	Lease time.Duration
+}
+
+// 環境変数からwebhookの設定を取得する
+//
+//	WEBHOOK_MAX_ATTEMPTS  : 最大試行回数 (default: 8)
+//	WEBHOOK_BACKOFF_BASE  : 最初の再送間隔 (default: 10s)
+//	WEBHOOK_BACKOFF_MAX   : 再送間隔の上限 (default: 1h)
+//	WEBHOOK_TIMEOUT       : 送信のタイムアウト (default: 10s)
+//	WEBHOOK_INTERVAL      : 配信待ちを確認する間隔 (default: 1s)
+//	WEBHOOK_LEASE         : 送信中の配信をロックする時間 (default: 5m)
+func GetWebhookConfigFromEnv() WebhookConfig {
+	return WebhookConfig{
+		MaxAttempts: getInt("WEBHOOK_MAX_ATTEMPTS", 8),
+		BackoffBase: getDuration("WEBHOOK_BACKOFF_BASE", 10*time.Second),
+		BackoffMax:  getDuration("WEBHOOK_BACKOFF_MAX", time.Hour),
+		Timeout:     getDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+		Interval:    getDuration("WEBHOOK_INTERVAL", time.Second),
+		Lease:       getDuration("WEBHOOK_LEASE", 5*time.Minute),
+	}
+}
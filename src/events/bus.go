@@ -0,0 +1,49 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Handler はイベントを処理する関数
+type Handler func(ctx context.Context, ev Event) error
+
+// Bus はプロセス内でイベントを配信するSink
+type Bus struct {
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+}
+
+// NewBus は新しいBusを作成します
+func NewBus() *Bus {
+	return &Bus{handlers: map[string][]Handler{}}
+}
+
+// Subscribe はイベントの種類に対してハンドラーを登録します
+// eventTypeが"*"の場合はすべてのイベントを受け取る
+func (b *Bus) Subscribe(eventType string, h Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[eventType] = append(b.handlers[eventType], h)
+}
+
+func (b *Bus) Name() string {
+	return "bus"
+}
+
+// Publish は登録されたハンドラーを順番に呼び出します
+// 各ハンドラーのエラーはまとめて返す
+func (b *Bus) Publish(ctx context.Context, ev Event) error {
+	b.mu.RLock()
+	handlers := append(append([]Handler(nil), b.handlers[ev.Type]...), b.handlers["*"]...)
+	b.mu.RUnlock()
+
+	var errs []error
+	for _, h := range handlers {
+		if err := h(ctx, ev); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
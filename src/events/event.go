@@ -0,0 +1,106 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"otel-test/tenant"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// イベントの種類
+const (
+	UserCreated = "user.created"
+	UserUpdated = "user.updated"
+	UserDeleted = "user.deleted"
+)
+
+// Event はドメインイベント
+type Event struct {
+	ID          uint64 `json:"id"`
+	Type        string `json:"type"`
+	AggregateID uint   `json:"aggregate_id"`
+	// TenantID はイベントを発生させたテナント（webhookはこのテナントの購読にだけ配信する）
+	TenantID   string          `json:"tenant_id,omitempty"`
+	Payload    json.RawMessage `json:"payload"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	// TraceContext はイベントを発生させたリクエストのトレースコンテキスト（traceparent等）
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+}
+
+// New はctxのテナントとトレースコンテキストを付与したイベントを作成します
+func New(ctx context.Context, eventType string, aggregateID uint, payload any) (Event, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Event{}, err
+	}
+	tenantID, _ := tenant.FromContext(ctx)
+	return Event{
+		Type:         eventType,
+		AggregateID:  aggregateID,
+		TenantID:     tenantID,
+		Payload:      data,
+		OccurredAt:   time.Now().UTC(),
+		TraceContext: injectTraceContext(ctx),
+	}, nil
+}
+
+// Sink はイベントの送信先
+type Sink interface {
+	Name() string
+	Publish(ctx context.Context, ev Event) error
+}
+
+// SpanContext はイベントを発生させたリクエストのスパンコンテキストを返します
+func (ev Event) SpanContext() trace.SpanContext {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(ev.TraceContext))
+	return trace.SpanContextFromContext(ctx)
+}
+
+// Link はイベントを発生させたリクエストのスパンへのリンクを返します
+func (ev Event) Link() trace.Link {
+	return trace.Link{
+		SpanContext: ev.SpanContext(),
+		Attributes:  []attribute.KeyValue{attribute.String("messaging.message.id", ev.idString())},
+	}
+}
+
+// Attributes はスパンに付与するメッセージングの属性を返します
+func (ev Event) Attributes() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("messaging.system", "outbox"),
+		attribute.String("messaging.destination.name", ev.Type),
+		attribute.String("messaging.message.id", ev.idString()),
+		attribute.Int("event.aggregate_id", int(ev.AggregateID)),
+	}
+}
+
+// StartConsumerSpan はイベントを処理するスパンを開始します
+// スパンはイベントを発生させたリクエストのスパンにリンクされる
+func StartConsumerSpan(ctx context.Context, ev Event, name string) (context.Context, trace.Span) {
+	return otel.Tracer("events").Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithLinks(ev.Link()),
+		trace.WithAttributes(ev.Attributes()...),
+		trace.WithAttributes(attribute.String("messaging.operation.type", "process")),
+	)
+}
+
+func (ev Event) idString() string {
+	return strconv.FormatUint(ev.ID, 10)
+}
+
+// injectTraceContext はctxのトレースコンテキストをmapに書き出します
+func injectTraceContext(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
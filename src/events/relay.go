@@ -0,0 +1,174 @@
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"otel-test/o11y"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Store は未送信のイベントを保持するアウトボックス
+type Store interface {
+	// Claim は未送信かつ試行回数がmaxAttempts未満のイベントを古い順に最大limit件取得し、leaseの間ownerがロックする
+	// 他のリレーがロックしているイベントは取得しない。ロックの期限が切れたイベント（停止したリレーのイベント）は再取得する
+	Claim(ctx context.Context, owner string, now time.Time, limit, maxAttempts int, lease time.Duration) ([]Event, error)
+	// MarkPublished は送信済みにしてロックを解除する
+	MarkPublished(ctx context.Context, id uint64) error
+	// MarkFailed は試行回数を増やしてロックを解除する
+	MarkFailed(ctx context.Context, id uint64, cause error) error
+}
+
+// RelayConfig はRelayの設定
+type RelayConfig struct {
+	// Interval はアウトボックスを確認する間隔
+	Interval time.Duration
+	// BatchSize は1回の確認で送信するイベントの最大数
+	BatchSize int
+	// MaxAttempts はイベントごとの最大試行回数（超えたイベントは送信しない）
+	MaxAttempts int
+	// Lease は取得したイベントをロックする時間（1バッチの送信にかかる時間より長くする）
+	Lease time.Duration
+}
+
+// Relay はアウトボックスのイベントをSinkに送信するワーカー
+// 複数のインスタンスで実行しても、ロックしたイベントだけを送信するため同じイベントを同時に送信しない
+// 一部のSinkだけ成功した場合やロックの期限が切れた場合は再送するため、配信はat-least-onceになる
+type Relay struct {
+	store     Store
+	sinks     []Sink
+	config    RelayConfig
+	owner     string
+	tracer    trace.Tracer
+	published metric.Int64Counter
+}
+
+// NewRelay は新しいRelayを作成します
+func NewRelay(store Store, config RelayConfig, sinks ...Sink) *Relay {
+	if config.Interval <= 0 {
+		config.Interval = time.Second
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 100
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 10
+	}
+	if config.Lease <= 0 {
+		config.Lease = time.Minute
+	}
+	published, _ := otel.Meter("events").Int64Counter("outbox.events.published",
+		metric.WithDescription("Number of outbox events published to sinks"),
+		metric.WithUnit("{event}"),
+	)
+	return &Relay{
+		store:     store,
+		sinks:     sinks,
+		config:    config,
+		owner:     relayID(),
+		tracer:    otel.Tracer("events"),
+		published: published,
+	}
+}
+
+// Run はctxが終了するまで一定間隔でイベントを送信します
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.Flush(ctx); err != nil && ctx.Err() == nil {
+			o11y.Logger("outbox").ErrorContext(ctx, "failed to relay outbox events", slog.Any("error", err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Flush は未送信のイベントを1バッチ分送信し、送信できた件数を返します
+func (r *Relay) Flush(ctx context.Context) (int, error) {
+	pending, err := r.store.Claim(ctx, r.owner, time.Now().UTC(), r.config.BatchSize, r.config.MaxAttempts, r.config.Lease)
+	if err != nil {
+		return 0, fmt.Errorf("failed to claim pending events: %w", err)
+	}
+
+	var published int
+	for _, ev := range pending {
+		if ctx.Err() != nil {
+			return published, ctx.Err()
+		}
+		if r.publish(ctx, ev) {
+			published++
+		}
+	}
+	return published, nil
+}
+
+// publish はイベントをすべてのSinkに送信し、結果をアウトボックスに記録します
+func (r *Relay) publish(ctx context.Context, ev Event) bool {
+	// リレーのスパンは独立したトレースとし、元のリクエストへはリンクで関連付ける
+	ctx, span := r.tracer.Start(ctx, "outbox publish "+ev.Type,
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithLinks(ev.Link()),
+		trace.WithAttributes(ev.Attributes()...),
+		trace.WithAttributes(attribute.String("messaging.operation.type", "publish")),
+	)
+	defer span.End()
+
+	var errs []error
+	for _, sink := range r.sinks {
+		if err := sink.Publish(ctx, ev); err != nil {
+			span.AddEvent("sink failed", trace.WithAttributes(
+				attribute.String("sink", sink.Name()),
+				attribute.String("error", err.Error()),
+			))
+			errs = append(errs, fmt.Errorf("%s: %w", sink.Name(), err))
+		}
+	}
+
+	result := "success"
+	if err := errors.Join(errs...); err != nil {
+		result = "failure"
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to publish event")
+		if err := r.store.MarkFailed(ctx, ev.ID, err); err != nil {
+			span.RecordError(err)
+		}
+		o11y.Logger("outbox").WarnContext(ctx, "failed to publish event",
+			slog.Uint64("event.id", ev.ID),
+			slog.String("event.type", ev.Type),
+			slog.Any("error", err),
+		)
+	} else if err := r.store.MarkPublished(ctx, ev.ID); err != nil {
+		result = "failure"
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to mark event as published")
+	}
+
+	r.published.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("event.type", ev.Type),
+		attribute.String("result", result),
+	))
+	return result == "success"
+}
+
+// relayID はリレーを識別する文字列を返します
+func relayID() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
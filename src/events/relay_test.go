@@ -0,0 +1,126 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"otel-test/o11y/o11ytest"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// memoryStore はテスト用のインメモリのアウトボックス
+type memoryStore struct {
+	events    []Event
+	published map[uint64]bool
+	attempts  map[uint64]int
+	locked    map[uint64]time.Time
+}
+
+func newMemoryStore(events ...Event) *memoryStore {
+	return &memoryStore{events: events, published: map[uint64]bool{}, attempts: map[uint64]int{}, locked: map[uint64]time.Time{}}
+}
+
+func (s *memoryStore) Claim(_ context.Context, _ string, now time.Time, limit, maxAttempts int, lease time.Duration) ([]Event, error) {
+	var claimed []Event
+	for _, ev := range s.events {
+		if !s.published[ev.ID] && s.attempts[ev.ID] < maxAttempts && !s.locked[ev.ID].After(now) && len(claimed) < limit {
+			s.locked[ev.ID] = now.Add(lease)
+			claimed = append(claimed, ev)
+		}
+	}
+	return claimed, nil
+}
+
+func (s *memoryStore) MarkPublished(_ context.Context, id uint64) error {
+	s.published[id] = true
+	s.attempts[id]++
+	delete(s.locked, id)
+	return nil
+}
+
+func (s *memoryStore) MarkFailed(_ context.Context, id uint64, _ error) error {
+	s.attempts[id]++
+	delete(s.locked, id)
+	return nil
+}
+
+func TestRelayLinksToOriginatingSpan(t *testing.T) {
+	h := o11ytest.New(t)
+
+	// リクエスト中にイベントを作成する
+	ctx, origin := otel.Tracer("test").Start(context.Background(), "POST /users")
+	ev, err := New(ctx, UserCreated, 1, map[string]string{"name": "Taro"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin.End()
+	ev.ID = 1
+
+	bus := NewBus()
+	var received []Event
+	bus.Subscribe(UserCreated, func(ctx context.Context, ev Event) error {
+		_, span := StartConsumerSpan(ctx, ev, "handle "+ev.Type)
+		defer span.End()
+		received = append(received, ev)
+		return nil
+	})
+
+	store := newMemoryStore(ev)
+	n, err := NewRelay(store, RelayConfig{}, bus).Flush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || len(received) != 1 || !store.published[1] {
+		t.Fatalf("published = %d, received = %d, store = %v", n, len(received), store.published)
+	}
+
+	h.Span("outbox publish user.created").
+		IsRoot().
+		HasKind(trace.SpanKindProducer).
+		HasAttr("messaging.destination.name", UserCreated).
+		HasLinkTo(origin.SpanContext())
+	h.Span("handle user.created").
+		HasKind(trace.SpanKindConsumer).
+		ChildOf(h.Span("outbox publish user.created")).
+		HasLinkTo(origin.SpanContext())
+	h.Metric("outbox.events.published").
+		WithAttrs(attribute.String("event.type", UserCreated), attribute.String("result", "success")).
+		HasValue(1)
+}
+
+func TestRelayRetriesFailedEvents(t *testing.T) {
+	h := o11ytest.New(t)
+
+	fail := true
+	bus := NewBus()
+	bus.Subscribe("*", func(context.Context, Event) error {
+		if fail {
+			return errors.New("boom")
+		}
+		return nil
+	})
+
+	store := newMemoryStore(Event{ID: 1, Type: UserDeleted})
+	relay := NewRelay(store, RelayConfig{MaxAttempts: 3}, bus)
+
+	if n, _ := relay.Flush(context.Background()); n != 0 {
+		t.Fatalf("published = %d, want 0", n)
+	}
+	if store.attempts[1] != 1 || store.published[1] {
+		t.Fatalf("attempts = %d, published = %v", store.attempts[1], store.published[1])
+	}
+	h.Span("outbox publish user.deleted").HasError().HasEvent("sink failed")
+
+	fail = false
+	if n, _ := relay.Flush(context.Background()); n != 1 {
+		t.Fatalf("published = %d, want 1", n)
+	}
+	if !store.published[1] {
+		t.Fatal("event was not published after retry")
+	}
+}
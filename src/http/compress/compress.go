@@ -0,0 +1,135 @@
+// Package compress はHTTPのリクエストボディの展開と、Accept-Encodingに応じたレスポンスの圧縮を提供します
+package compress
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// 対応する圧縮方式（Content-Encoding）
+const (
+	Gzip   = "gzip"
+	Brotli = "br"
+	Zstd   = "zstd"
+)
+
+// DefaultEncodings はレスポンスの圧縮方式のデフォルト（優先する順）
+var DefaultEncodings = []string{Zstd, Brotli, Gzip}
+
+// errUnsupported は対応していないContent-Encoding
+var errUnsupported = errors.New("unsupported content encoding")
+
+// supported は対応している圧縮方式かを返します
+func supported(encoding string) bool {
+	switch encoding {
+	case Gzip, Brotli, Zstd:
+		return true
+	}
+	return false
+}
+
+// encoder はレスポンスを圧縮するWriter
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// newEncoder はwに圧縮して書き込むencoderを作成します
+// 動的なレスポンスのため、圧縮率より速度を優先したレベルを使う
+func newEncoder(encoding string, w io.Writer) encoder {
+	switch encoding {
+	case Brotli:
+		return brotli.NewWriterLevel(w, 4)
+	case Zstd:
+		zw, _ := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		return zw
+	default:
+		gw, _ := gzip.NewWriterLevel(w, gzip.DefaultCompression)
+		return gw
+	}
+}
+
+// newDecoder はContent-Encodingがencodingのrを展開するReaderを作成します
+func newDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Brotli:
+		return io.NopCloser(brotli.NewReader(r)), nil
+	case Zstd:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnsupported, encoding)
+	}
+}
+
+// negotiate はAccept-Encodingから使用する圧縮方式を返します。圧縮しない場合は空
+// qが最も大きい方式を選び、同じ場合はencodingsの順を優先する
+func negotiate(accept string, encodings []string) string {
+	if accept == "" {
+		return ""
+	}
+	weights := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(param, "=")
+			if !ok || !strings.EqualFold(strings.TrimSpace(k), "q") {
+				continue
+			}
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				q = f
+			}
+		}
+		weights[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range encodings {
+		q, ok := weights[encoding]
+		if !ok {
+			q, ok = weights["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressible は圧縮の効果があるContent-Typeかを返します
+// 画像やアーカイブなど圧縮済みの形式は圧縮しない
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/x-ndjson", "application/xml", "application/javascript":
+		return true
+	}
+	return false
+}
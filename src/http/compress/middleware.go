@@ -0,0 +1,397 @@
+package compress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"otel-test/http/response"
+	"strings"
+
+	"github.com/felixge/httpsnoop"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 圧縮した向き（http.compression.direction）
+const (
+	directionRequest  = "request"
+	directionResponse = "response"
+)
+
+// Config は圧縮の設定
+type Config struct {
+	// Encodings はレスポンスの圧縮方式（優先する順）。空の場合はレスポンスを圧縮しない
+	Encodings []string
+	// MinSize はこれより小さいレスポンスを圧縮しない（バイト）
+	// 途中でFlushしたストリーミングのレスポンスは大きさに関係なく圧縮する
+	MinSize int
+	// MaxRequestSize は展開後のリクエストボディの上限 (default: 32MiB)
+	MaxRequestSize int64
+}
+
+// Middleware はリクエストボディの展開とレスポンスの圧縮を行うミドルウェアを作成する
+type Middleware struct {
+	cfg   Config
+	ratio metric.Float64Histogram
+}
+
+// New は新しいMiddlewareを作成します
+func New(cfg Config) (*Middleware, error) {
+	for _, encoding := range cfg.Encodings {
+		if !supported(encoding) {
+			return nil, fmt.Errorf("%w: %s", errUnsupported, encoding)
+		}
+	}
+	if cfg.MaxRequestSize <= 0 {
+		cfg.MaxRequestSize = 32 << 20
+	}
+	ratio, _ := otel.Meter("compress").Float64Histogram("http.compression.ratio",
+		metric.WithDescription("Ratio of the uncompressed body size to the compressed body size"),
+		metric.WithUnit("1"),
+		metric.WithExplicitBucketBoundaries(1, 1.5, 2, 3, 4, 6, 8, 12, 16, 32),
+	)
+	return &Middleware{cfg: cfg, ratio: ratio}, nil
+}
+
+// Handle は圧縮を処理するミドルウェア
+//
+//   - Content-Encodingがgzip/br/zstdのリクエストボディを展開してハンドラーに渡す。対応していない場合は415
+//   - Accept-Encodingで受け付ける方式のうち、qが最も大きい方式でレスポンスを圧縮する
+//   - MinSize未満のレスポンス、画像など圧縮の効果がないContent-Type、ボディのないレスポンスは圧縮しない
+//
+// 同じ強いETagを異なる表現で使わないよう、圧縮したレスポンスのETagには方式のサフィックスを付ける（ETag）
+// If-Match/If-None-Matchを判定する側ではTrimETagでサフィックスを取り除く
+func (m *Middleware) Handle(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if encoding := requestEncoding(r); encoding != "" {
+			decoded, finish, err := m.decodeRequest(w, r, encoding)
+			if err != nil {
+				trace.SpanFromContext(r.Context()).RecordError(err)
+				if errors.Is(err, errUnsupported) {
+					w.Header().Set("Accept-Encoding", strings.Join([]string{Gzip, Brotli, Zstd}, ", "))
+					response.Problem(w, http.StatusUnsupportedMediaType, err.Error(), nil)
+					return
+				}
+				response.Problem(w, http.StatusBadRequest, "invalid compressed request body", nil)
+				return
+			}
+			defer finish()
+			r = decoded
+		}
+
+		if len(m.cfg.Encodings) == 0 {
+			next(w, r)
+			return
+		}
+		cw := &responseWriter{
+			ResponseWriter: w,
+			cfg:            &m.cfg,
+			encoding:       negotiate(r.Header.Get("Accept-Encoding"), m.cfg.Encodings),
+			ifNoneMatch:    r.Header.Get("If-None-Match"),
+		}
+		next(cw.wrap(), r)
+		cw.close()
+		if cw.enc != nil {
+			m.record(r.Context(), directionResponse, cw.encoding, cw.written, cw.wire.n)
+		}
+	}
+}
+
+// requestEncoding はリクエストボディのContent-Encodingを返します。圧縮していない場合は空
+func requestEncoding(r *http.Request) string {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if encoding == "identity" {
+		return ""
+	}
+	return encoding
+}
+
+// decodeRequest はボディを展開するリクエストと、ハンドラーの終了後に呼ぶ関数を返します
+// アクセスログなど外側のミドルウェアが元のリクエストを参照できるよう、rは変更しない
+func (m *Middleware) decodeRequest(w http.ResponseWriter, r *http.Request, encoding string) (*http.Request, func(), error) {
+	wire := &countingReader{r: r.Body}
+	dec, err := newDecoder(encoding, wire)
+	if err != nil {
+		return nil, nil, err
+	}
+	decoded := &countingReader{r: dec}
+	closer := &closeOnce{c: dec}
+	finish := func() {
+		_ = closer.Close()
+		m.record(r.Context(), directionRequest, encoding, decoded.n, wire.n)
+	}
+
+	r = r.Clone(r.Context())
+	r.Body = http.MaxBytesReader(w, struct {
+		io.Reader
+		io.Closer
+	}{decoded, closer}, m.cfg.MaxRequestSize)
+	r.ContentLength = -1
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	return r, finish, nil
+}
+
+// record は圧縮率をメトリクスとスパンに記録します
+func (m *Middleware) record(ctx context.Context, direction, encoding string, uncompressed, compressed int64) {
+	if uncompressed == 0 || compressed == 0 {
+		return
+	}
+	ratio := float64(uncompressed) / float64(compressed)
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("http."+direction+".content_encoding", encoding),
+		attribute.Int64("http."+direction+".body.size", compressed),
+		attribute.Int64("http."+direction+".body.uncompressed_size", uncompressed),
+	)
+	m.ratio.Record(ctx, ratio, metric.WithAttributes(
+		attribute.String("http.compression.direction", direction),
+		attribute.String("http.compression.encoding", encoding),
+	))
+}
+
+// closeOnce は2回目以降のCloseを無視するCloser
+type closeOnce struct {
+	c      io.Closer
+	closed bool
+}
+
+func (c *closeOnce) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.c.Close()
+}
+
+// countingReader は読み込んだバイト数を数えるReader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingWriter は書き込んだバイト数を数えるWriter
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writerFunc は関数をio.Writerとして扱う
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// responseWriter はレスポンスを圧縮するhttp.ResponseWriter
+// 圧縮するかを決めるため、MinSizeに達するかFlushするまでステータスコードとボディを保留する
+type responseWriter struct {
+	http.ResponseWriter
+	cfg         *Config
+	encoding    string // Accept-Encodingで決めた方式（空の場合は圧縮しない）
+	ifNoneMatch string // 304のETagを決めるためのリクエストのIf-None-Match
+
+	status  int
+	buf     []byte
+	started bool
+	enc     encoder
+	wire    countingWriter // 送信した（圧縮後の）バイト数
+	written int64          // ハンドラーが書き込んだ（圧縮前の）バイト数
+	err     error
+}
+
+// wrap はFlusherなどのインターフェースを保ったまま圧縮するResponseWriterを返します
+func (w *responseWriter) wrap() http.ResponseWriter {
+	return httpsnoop.Wrap(w.ResponseWriter, httpsnoop.Hooks{
+		WriteHeader: func(httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+			return w.writeHeader
+		},
+		Write: func(httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+			return w.write
+		},
+		ReadFrom: func(httpsnoop.ReadFromFunc) httpsnoop.ReadFromFunc {
+			return func(src io.Reader) (int64, error) {
+				return io.Copy(writerFunc(w.write), src)
+			}
+		},
+		Flush: func(next httpsnoop.FlushFunc) httpsnoop.FlushFunc {
+			return func() {
+				w.flush()
+				next()
+			}
+		},
+	})
+}
+
+func (w *responseWriter) writeHeader(code int) {
+	if w.started {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	// 1xxは最終的なレスポンスではないため保留しない
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.status != 0 {
+		return
+	}
+	w.status = code
+	if !bodyAllowed(code) {
+		w.start(false)
+	}
+}
+
+func (w *responseWriter) write(b []byte) (int, error) {
+	if !w.started {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		w.buf = append(w.buf, b...)
+		if len(w.buf) >= w.cfg.MinSize {
+			w.start(false)
+		}
+		return len(b), w.err
+	}
+	if w.enc != nil {
+		w.written += int64(len(b))
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseWriter) flush() {
+	if !w.started {
+		w.start(true)
+	}
+	if w.enc != nil {
+		if err := w.enc.Flush(); err != nil && w.err == nil {
+			w.err = err
+		}
+	}
+}
+
+// close は保留しているレスポンスを送信し、圧縮を終了します
+func (w *responseWriter) close() {
+	if !w.started && (w.status != 0 || len(w.buf) > 0) {
+		w.start(false)
+	}
+	if w.enc != nil {
+		_ = w.enc.Close()
+	}
+}
+
+// start は圧縮するかを決め、保留していたステータスコードとボディを送信します
+func (w *responseWriter) start(streaming bool) {
+	w.started = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	h := w.Header()
+	if bodyAllowed(w.status) {
+		addVary(h, "Accept-Encoding")
+	}
+	if w.shouldCompress(streaming) {
+		// 圧縮後のボディからContent-Typeを判定されないよう、先に設定する
+		if h.Get("Content-Type") == "" {
+			h.Set("Content-Type", http.DetectContentType(w.buf))
+		}
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", w.encoding)
+		if etag := h.Get("ETag"); etag != "" {
+			h.Set("ETag", ETag(etag, w.encoding))
+		}
+		w.wire.w = w.ResponseWriter
+		w.enc = newEncoder(w.encoding, &w.wire)
+	} else if w.status == http.StatusNotModified && w.encoding != "" {
+		// 304は保存済みの（圧縮した）レスポンスのETagを返す
+		if etag := ETag(h.Get("ETag"), w.encoding); etag != "" && hasETag(w.ifNoneMatch, etag) {
+			h.Set("ETag", etag)
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buf := w.buf
+	w.buf = nil
+	if len(buf) > 0 {
+		if _, err := w.write(buf); err != nil {
+			w.err = err
+		}
+	}
+}
+
+func (w *responseWriter) shouldCompress(streaming bool) bool {
+	h := w.Header()
+	if w.encoding == "" || !bodyAllowed(w.status) || h.Get("Content-Encoding") != "" {
+		return false
+	}
+	if !streaming && len(w.buf) < w.cfg.MinSize {
+		return false
+	}
+	contentType := h.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(w.buf)
+	}
+	return compressible(contentType)
+}
+
+// bodyAllowed はステータスコードのレスポンスがボディを持てるかを返します
+func bodyAllowed(code int) bool {
+	return code >= 200 && code != http.StatusNoContent && code != http.StatusNotModified
+}
+
+// addVary はVaryヘッダーにvalueがなければ追加します
+// 保存済みのレスポンスを返すIdempotency-Keyの処理などで重複しないようにする
+func addVary(h http.Header, value string) {
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), value) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", value)
+}
+
+// ETag はetagに圧縮方式のサフィックスを付けたエンティティタグを返します（"3" → "3-gzip"）
+// 同じ強いエンティティタグを異なる表現で使わないため（RFC 9110 8.8.1）。弱いエンティティタグは変更しない
+func ETag(etag, encoding string) string {
+	if len(etag) < 2 || !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return etag[:len(etag)-1] + "-" + encoding + `"`
+}
+
+// TrimETag はETagで付けた圧縮方式のサフィックスを取り除きます
+// If-Match/If-None-Matchのエンティティタグを元の表現のETagと比較するために使う
+func TrimETag(tag string) string {
+	for _, encoding := range []string{Gzip, Brotli, Zstd} {
+		if trimmed, ok := strings.CutSuffix(tag, "-"+encoding+`"`); ok {
+			return trimmed + `"`
+		}
+	}
+	return tag
+}
+
+// hasETag はIf-None-Matchにetagが含まれるかを返します
+func hasETag(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
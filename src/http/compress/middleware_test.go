@@ -0,0 +1,347 @@
+package compress_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"otel-test/http/compress"
+	"otel-test/o11y/o11ytest"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// largeJSON はMinSizeより大きい圧縮しやすいJSON
+var largeJSON = `{"users":[` + strings.Repeat(`{"name":"Taro","email":"taro@example.com"},`, 100) + `{}]}`
+
+func newTestMiddleware(t *testing.T, cfg compress.Config) (*o11ytest.Harness, *compress.Middleware) {
+	t.Helper()
+	h := o11ytest.New(t)
+	if cfg.Encodings == nil {
+		cfg.Encodings = compress.DefaultEncodings
+	}
+	m, err := compress.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, m
+}
+
+// serve はスパンを開始したリクエストをhandlerで処理します
+func serve(handler http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	ctx, span := otel.Tracer("test").Start(req.Context(), "request")
+	defer span.End()
+	rec := httptest.NewRecorder()
+	handler(rec, req.WithContext(ctx))
+	return rec
+}
+
+func writeHandler(contentType, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", "1")
+		io.WriteString(w, body)
+	}
+}
+
+func encode(t *testing.T, encoding string, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case compress.Gzip:
+		w = gzip.NewWriter(&buf)
+	case compress.Brotli:
+		w = brotli.NewWriter(&buf)
+	case compress.Zstd:
+		w, _ = zstd.NewWriter(&buf)
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decode(t *testing.T, encoding string, data []byte) string {
+	t.Helper()
+	var r io.Reader
+	switch encoding {
+	case "":
+		return string(data)
+	case compress.Gzip:
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gr
+	case compress.Brotli:
+		r = brotli.NewReader(bytes.NewReader(data))
+	case compress.Zstd:
+		zr, err := zstd.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestHandleNegotiatesEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", compress.Gzip},
+		{"gzip, deflate, br", compress.Brotli},
+		{"gzip, br, zstd", compress.Zstd},
+		{"br;q=0.5, gzip", compress.Gzip},
+		{"*", compress.Zstd},
+		{"zstd;q=0, *", compress.Brotli},
+		{"identity", ""},
+		{"deflate", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			_, m := newTestMiddleware(t, compress.Config{MinSize: 1024})
+			req := httptest.NewRequest(http.MethodGet, "/users", nil)
+			req.Header.Set("Accept-Encoding", tt.accept)
+			rec := serve(m.Handle(writeHandler("application/json", largeJSON)), req)
+
+			if got := rec.Header().Get("Content-Encoding"); got != tt.want {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.want)
+			}
+			if got := decode(t, tt.want, rec.Body.Bytes()); got != largeJSON {
+				t.Fatalf("body = %q", got)
+			}
+			if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Fatalf("Vary = %q", got)
+			}
+			if tt.want != "" && (rec.Header().Get("Content-Length") != "" || rec.Body.Len() >= len(largeJSON)) {
+				t.Fatalf("Content-Length = %q, size = %d", rec.Header().Get("Content-Length"), rec.Body.Len())
+			}
+		})
+	}
+}
+
+func TestHandleRecordsResponseRatio(t *testing.T) {
+	h, m := newTestMiddleware(t, compress.Config{MinSize: 1024})
+	req := httptest.NewRequest(http.MethodGet, "/users", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := serve(m.Handle(writeHandler("application/json", largeJSON)), req)
+
+	h.Span("request").
+		HasAttr("http.response.content_encoding", "gzip").
+		HasAttr("http.response.body.size", rec.Body.Len()).
+		HasAttr("http.response.body.uncompressed_size", len(largeJSON))
+	ratio := h.Metric("http.compression.ratio").
+		WithAttrs(attribute.String("http.compression.direction", "response"), attribute.String("http.compression.encoding", "gzip")).
+		HasCount(1)
+	if want := float64(len(largeJSON)) / float64(rec.Body.Len()); ratio.Value() != want {
+		t.Fatalf("ratio = %v, want %v", ratio.Value(), want)
+	}
+}
+
+func TestHandleSkipsResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"smaller than MinSize", writeHandler("application/json", `{"id":1}`)},
+		{"incompressible content type", writeHandler("image/png", largeJSON)},
+		{"already encoded", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			io.WriteString(w, largeJSON)
+		}},
+		{"no content", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, m := newTestMiddleware(t, compress.Config{MinSize: 1024})
+			req := httptest.NewRequest(http.MethodGet, "/users", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			want := httptest.NewRecorder()
+			tt.handler(want, req)
+
+			rec := serve(m.Handle(tt.handler), req)
+			if rec.Code != want.Code || rec.Body.String() != want.Body.String() {
+				t.Fatalf("got %d %q, want %d %q", rec.Code, rec.Body.String(), want.Code, want.Body.String())
+			}
+			if got, want := rec.Header().Get("Content-Encoding"), want.Header().Get("Content-Encoding"); got != want {
+				t.Fatalf("Content-Encoding = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestHandleSuffixesETag(t *testing.T) {
+	_, m := newTestMiddleware(t, compress.Config{MinSize: 1024})
+	handler := func(etag string) http.HandlerFunc {
+		return m.Handle(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", etag)
+			if r.Header.Get("If-None-Match") != "" {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, largeJSON)
+		})
+	}
+
+	tests := []struct {
+		name        string
+		etag        string
+		accept      string
+		ifNoneMatch string
+		want        string
+	}{
+		{"gzip", `"3"`, "gzip", "", `"3-gzip"`},
+		{"zstd", `"3"`, "zstd", "", `"3-zstd"`},
+		{"identity", `"3"`, "", "", `"3"`},
+		{"weak", `W/"3"`, "gzip", "", `W/"3"`},
+		// 304は保存済みのレスポンスと同じETagを返す
+		{"not modified compressed", `"3"`, "br", `"3-br"`, `"3-br"`},
+		{"not modified identity", `"3"`, "br", `"3"`, `"3"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+			req.Header.Set("Accept-Encoding", tt.accept)
+			if tt.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			rec := serve(handler(tt.etag), req)
+			if got := rec.Header().Get("ETag"); got != tt.want {
+				t.Fatalf("ETag = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrimETag(t *testing.T) {
+	tests := map[string]string{
+		`"3-gzip"`:   `"3"`,
+		`"3-br"`:     `"3"`,
+		`W/"3-zstd"`: `W/"3"`,
+		`"3"`:        `"3"`,
+		`"3-gzip`:    `"3-gzip`,
+	}
+	for tag, want := range tests {
+		if got := compress.TrimETag(tag); got != want {
+			t.Errorf("TrimETag(%s) = %s, want %s", tag, got, want)
+		}
+	}
+}
+
+func TestHandleCompressesFlushedResponse(t *testing.T) {
+	_, m := newTestMiddleware(t, compress.Config{MinSize: 1024})
+	handler := m.Handle(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		io.WriteString(w, "{\"id\":1}\n")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "{\"id\":2}\n")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/users:export", nil)
+	req.Header.Set("Accept-Encoding", "br")
+	rec := serve(handler, req)
+
+	if !rec.Flushed || rec.Header().Get("Content-Encoding") != compress.Brotli {
+		t.Fatalf("flushed = %v, Content-Encoding = %q", rec.Flushed, rec.Header().Get("Content-Encoding"))
+	}
+	if got := decode(t, compress.Brotli, rec.Body.Bytes()); got != "{\"id\":1}\n{\"id\":2}\n" {
+		t.Fatalf("body = %q", got)
+	}
+}
+
+func TestHandleDecodesRequest(t *testing.T) {
+	for _, encoding := range compress.DefaultEncodings {
+		t.Run(encoding, func(t *testing.T) {
+			h, m := newTestMiddleware(t, compress.Config{})
+			var got string
+			handler := m.Handle(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Content-Encoding") != "" || r.ContentLength != -1 {
+					t.Errorf("Content-Encoding = %q, ContentLength = %d", r.Header.Get("Content-Encoding"), r.ContentLength)
+				}
+				body, _ := io.ReadAll(r.Body)
+				got = string(body)
+			})
+			body := encode(t, encoding, largeJSON)
+			req := httptest.NewRequest(http.MethodPost, "/users", bytes.NewReader(body))
+			req.Header.Set("Content-Encoding", encoding)
+			serve(handler, req)
+
+			if got != largeJSON {
+				t.Fatalf("body = %q", got)
+			}
+			h.Span("request").
+				HasAttr("http.request.content_encoding", encoding).
+				HasAttr("http.request.body.size", len(body)).
+				HasAttr("http.request.body.uncompressed_size", len(largeJSON))
+			h.Metric("http.compression.ratio").
+				WithAttrs(attribute.String("http.compression.direction", "request"), attribute.String("http.compression.encoding", encoding)).
+				HasCount(1)
+		})
+	}
+}
+
+func TestHandleRejectsRequest(t *testing.T) {
+	_, m := newTestMiddleware(t, compress.Config{MaxRequestSize: 100})
+	var readErr error
+	handler := m.Handle(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = io.ReadAll(r.Body)
+	})
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		want     int
+	}{
+		{"unsupported encoding", "deflate", []byte("x"), http.StatusUnsupportedMediaType},
+		{"multiple encodings", "gzip, br", encode(t, compress.Gzip, "{}"), http.StatusUnsupportedMediaType},
+		{"broken gzip", compress.Gzip, []byte("not gzip"), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/users", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Encoding", tt.encoding)
+			rec := serve(handler, req)
+			if rec.Code != tt.want || rec.Header().Get("Content-Type") != "application/problem+json" {
+				t.Fatalf("status = %d, Content-Type = %q, want %d", rec.Code, rec.Header().Get("Content-Type"), tt.want)
+			}
+		})
+	}
+
+	// 展開後のサイズで上限を判定する
+	req := httptest.NewRequest(http.MethodPost, "/users", bytes.NewReader(encode(t, compress.Zstd, largeJSON)))
+	req.Header.Set("Content-Encoding", compress.Zstd)
+	serve(handler, req)
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(readErr, &maxBytesErr) {
+		t.Fatalf("err = %v, want %T", readErr, maxBytesErr)
+	}
+}
+
+func TestNewRejectsUnknownEncoding(t *testing.T) {
+	if _, err := compress.New(compress.Config{Encodings: []string{"deflate"}}); err == nil {
+		t.Fatal("expected error")
+	}
+}
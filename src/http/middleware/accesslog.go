@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"otel-test/o11y"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+)
+
+// AccessLog はリクエストごとにCloud LoggingのhttpRequest形式でアクセスログを出力するミドルウェア
+func AccessLog(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		metrics := httpsnoop.CaptureMetrics(next, w, r)
+
+		level := slog.LevelInfo
+		switch {
+		case metrics.Code >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case metrics.Code >= http.StatusBadRequest:
+			level = slog.LevelWarn
+		}
+
+		remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			remoteIP = r.RemoteAddr
+		}
+
+		o11y.Logger("access").LogAttrs(r.Context(), level, "request completed", o11y.HTTPRequestAttr(o11y.HTTPRequest{
+			RequestMethod: r.Method,
+			RequestURL:    r.URL.String(),
+			RequestSize:   r.ContentLength,
+			Status:        metrics.Code,
+			ResponseSize:  metrics.Written,
+			UserAgent:     r.UserAgent(),
+			RemoteIP:      remoteIP,
+			Referer:       r.Referer(),
+			Latency:       time.Since(start),
+			Protocol:      r.Proto,
+		}))
+	}
+}
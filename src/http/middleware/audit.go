@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"net/http"
+	"otel-test/audit"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// AuditMetadata は変更したユーザーとリクエストIDをコンテキストに設定するミドルウェア
+// 監査ログに記録し、リクエストIDはレスポンスのX-Request-Idで返す
+func AuditMetadata(resolver *audit.Resolver) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			md := resolver.Metadata(r.Context(), r.RemoteAddr, r.Header.Get)
+			w.Header().Set(audit.HeaderRequestID, md.RequestID)
+			trace.SpanFromContext(r.Context()).SetAttributes(
+				attribute.String("enduser.id", md.Actor),
+				attribute.String("request.id", md.RequestID),
+			)
+			next(w, r.WithContext(audit.WithMetadata(r.Context(), md)))
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package middleware
+
+import (
+	"net/http"
+	"otel-test/shutdown"
+)
+
+// TrackInFlight は実行中のリクエストをtrackerで数えるミドルウェア
+// Graceful Shutdown時に実行中のリクエストの完了を待つために使用する
+func TrackInFlight(tracker *shutdown.Tracker) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			done := tracker.Add()
+			defer done()
+			next(w, r)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"otel-test/http/response"
+	"otel-test/o11y"
+	"otel-test/tenant"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type tenantErrorKey struct{}
+
+// ResolveTenant はリクエストのテナントをコンテキストに設定するミドルウェア
+// 以降のスパン・ログ（アクセスログを含む）にtenant.idを付与する
+// メトリクスにはテナントの種類が限られている場合（tenant.Resolver.Bounded）だけ付与する
+// テナントを決められない場合もリクエストは拒否せず、RequireTenantを設定したルートだけが400を返す
+func ResolveTenant(resolver *tenant.Resolver) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			id, err := resolver.Resolve(r.Host, r.Header.Get)
+			if err != nil {
+				next(w, r.WithContext(context.WithValue(ctx, tenantErrorKey{}, err)))
+				return
+			}
+
+			// リクエストのスパンとHTTPのメトリクスはテナントを決める前に開始しているため、ここで設定する
+			attr := attribute.String(tenant.AttributeKey, id)
+			trace.SpanFromContext(ctx).SetAttributes(attr)
+			ctx = tenant.WithID(ctx, id)
+			if resolver.Bounded() {
+				if labeler, ok := otelhttp.LabelerFromContext(ctx); ok {
+					labeler.Add(attr)
+				}
+				ctx = tenant.WithMetricAttribute(ctx)
+			}
+			next(w, r.WithContext(ctx))
+		}
+	}
+}
+
+// RequireTenant はテナントが決まらないリクエストを400で拒否するミドルウェア
+// ResolveTenantの後に設定する
+func RequireTenant(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := tenant.FromContext(r.Context()); ok {
+			next(w, r)
+			return
+		}
+		err, _ := r.Context().Value(tenantErrorKey{}).(error)
+		if err == nil {
+			err = tenant.ErrMissing
+		}
+		trace.SpanFromContext(r.Context()).RecordError(err)
+		o11y.Logger("tenant").WarnContext(r.Context(), "rejected request without a valid tenant", "error", err)
+		response.Problem(w, http.StatusBadRequest, err.Error(), nil)
+	}
+}
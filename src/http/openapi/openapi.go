@@ -0,0 +1,170 @@
+// Package openapi はAPIのOpenAPI 3.1ドキュメントと、それに基づくリクエスト・レスポンスの検証を提供します
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+//go:embed openapi.json
+var specJSON []byte
+
+// Document はOpenAPIドキュメントのうち検証に必要な部分
+type Document struct {
+	raw        []byte
+	Paths      map[string]*PathItem `json:"paths"`
+	Components struct {
+		Schemas   map[string]*Schema   `json:"schemas"`
+		Responses map[string]*Response `json:"responses"`
+	} `json:"components"`
+}
+
+// PathItem はパスごとの操作
+type PathItem struct {
+	Parameters []*Parameter `json:"parameters"`
+	Get        *Operation   `json:"get"`
+	Put        *Operation   `json:"put"`
+	Post       *Operation   `json:"post"`
+	Patch      *Operation   `json:"patch"`
+	Delete     *Operation   `json:"delete"`
+}
+
+// Operation はメソッドごとの操作
+type Operation struct {
+	OperationID string               `json:"operationId"`
+	Parameters  []*Parameter         `json:"parameters"`
+	RequestBody *RequestBody         `json:"requestBody"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+// Parameter はpath/query/headerのパラメーター
+type Parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+// RequestBody はリクエストボディ
+type RequestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+// Response はステータスコードごとのレスポンス
+type Response struct {
+	Ref         string                `json:"$ref"`
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content"`
+}
+
+// MediaType はContent-Typeごとのスキーマ
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Load は埋め込まれたOpenAPIドキュメントを読み込みます
+func Load() (*Document, error) {
+	return Parse(specJSON)
+}
+
+// MustLoad はLoadに失敗した場合にpanicします
+func MustLoad() *Document {
+	doc, err := Load()
+	if err != nil {
+		panic(err)
+	}
+	return doc
+}
+
+// Parse はOpenAPIドキュメントを解析し、$refを解決します
+func Parse(data []byte) (*Document, error) {
+	doc := &Document{raw: data}
+	if err := json.Unmarshal(data, doc); err != nil {
+		return nil, fmt.Errorf("failed to parse OpenAPI document: %w", err)
+	}
+
+	// レスポンスの$refを解決
+	for path, item := range doc.Paths {
+		for _, op := range item.operations() {
+			for status, res := range op.Responses {
+				if res.Ref == "" {
+					continue
+				}
+				resolved, ok := doc.Components.Responses[strings.TrimPrefix(res.Ref, "#/components/responses/")]
+				if !ok {
+					return nil, fmt.Errorf("%s: unresolved response %s", path, res.Ref)
+				}
+				op.Responses[status] = resolved
+			}
+		}
+	}
+	return doc, nil
+}
+
+// ServeHTTP はOpenAPIドキュメントを返す
+func (d *Document) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(d.raw); err != nil {
+		log.Println(err)
+	}
+}
+
+// Operation はルートとメソッドに対応する操作を返します
+func (d *Document) Operation(route, method string) (*PathItem, *Operation) {
+	item, ok := d.Paths[route]
+	if !ok {
+		return nil, nil
+	}
+	return item, item.operation(method)
+}
+
+func (p *PathItem) operation(method string) *Operation {
+	switch method {
+	case http.MethodGet:
+		return p.Get
+	case http.MethodPut:
+		return p.Put
+	case http.MethodPost:
+		return p.Post
+	case http.MethodPatch:
+		return p.Patch
+	case http.MethodDelete:
+		return p.Delete
+	default:
+		return nil
+	}
+}
+
+func (p *PathItem) operations() []*Operation {
+	var ops []*Operation
+	for _, op := range []*Operation{p.Get, p.Put, p.Post, p.Patch, p.Delete} {
+		if op != nil {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// parameters はパス共通のパラメーターと操作のパラメーターを合わせて返す
+// 同じ名前と場所の場合は操作のパラメーターを優先する
+func (p *PathItem) parameters(op *Operation) []*Parameter {
+	params := append([]*Parameter(nil), op.Parameters...)
+	for _, common := range p.Parameters {
+		overridden := false
+		for _, param := range op.Parameters {
+			if param.Name == common.Name && param.In == common.In {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			params = append(params, common)
+		}
+	}
+	return params
+}
@@ -0,0 +1,237 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/mail"
+	"net/url"
+	"otel-test/http/response"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Schema はJSON Schema (2020-12) のうち、このAPIで使用するキーワード
+type Schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 schemaType         `json:"type"`
+	Format               string             `json:"format"`
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *bool              `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+	Enum                 []interface{}      `json:"enum"`
+	Pattern              string             `json:"pattern"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+}
+
+// schemaType は "string" と ["string", "null"] の両方の形式を受け付ける
+type schemaType []string
+
+func (t *schemaType) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = schemaType{single}
+		return nil
+	}
+	var multi []string
+	if err := json.Unmarshal(data, &multi); err != nil {
+		return err
+	}
+	*t = multi
+	return nil
+}
+
+func (t schemaType) has(name string) bool {
+	for _, v := range t {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve は$refを解決したスキーマを返す
+func (d *Document) resolve(s *Schema) *Schema {
+	for s != nil && s.Ref != "" {
+		s = d.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	return s
+}
+
+// validate は値をスキーマで検証し、不正なフィールドをerrsに追加する
+// 値はjson.DecoderのUseNumberで解析したもの
+func (d *Document) validate(s *Schema, v interface{}, field string, errs *[]response.FieldError) {
+	s = d.resolve(s)
+	if s == nil {
+		return
+	}
+	add := func(format string, args ...interface{}) {
+		*errs = append(*errs, response.FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if v == nil {
+		if len(s.Type) > 0 && !s.Type.has("null") {
+			add("must not be null")
+		}
+		return
+	}
+
+	if len(s.Enum) > 0 && !inEnum(s.Enum, v) {
+		add("must be one of %s", formatEnum(s.Enum))
+		return
+	}
+
+	switch value := v.(type) {
+	case string:
+		if len(s.Type) > 0 && !s.Type.has("string") {
+			add("must be %s", strings.Join(s.Type, " or "))
+			return
+		}
+		length := utf8.RuneCountInString(value)
+		if s.MinLength != nil && length < *s.MinLength {
+			add("must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			add("must be at most %d characters", *s.MaxLength)
+		}
+		if s.Pattern != "" {
+			if re, err := regexp.Compile(s.Pattern); err == nil && !re.MatchString(value) {
+				add("must match pattern %s", s.Pattern)
+			}
+		}
+		if msg := checkFormat(s.Format, value); msg != "" {
+			add("%s", msg)
+		}
+	case json.Number:
+		f, err := value.Float64()
+		if err != nil {
+			add("must be a number")
+			return
+		}
+		isInteger := f == math.Trunc(f) && !strings.ContainsAny(value.String(), ".eE")
+		switch {
+		case s.Type.has("integer") && !isInteger && !s.Type.has("number"):
+			add("must be an integer")
+			return
+		case len(s.Type) > 0 && !s.Type.has("integer") && !s.Type.has("number"):
+			add("must be %s", strings.Join(s.Type, " or "))
+			return
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			add("must be >= %v", *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			add("must be <= %v", *s.Maximum)
+		}
+	case bool:
+		if len(s.Type) > 0 && !s.Type.has("boolean") {
+			add("must be %s", strings.Join(s.Type, " or "))
+		}
+	case []interface{}:
+		if len(s.Type) > 0 && !s.Type.has("array") {
+			add("must be %s", strings.Join(s.Type, " or "))
+			return
+		}
+		if s.MinItems != nil && len(value) < *s.MinItems {
+			add("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(value) > *s.MaxItems {
+			add("must have at most %d items", *s.MaxItems)
+		}
+		for i, item := range value {
+			d.validate(s.Items, item, fmt.Sprintf("%s[%d]", field, i), errs)
+		}
+	case map[string]interface{}:
+		if len(s.Type) > 0 && !s.Type.has("object") {
+			add("must be %s", strings.Join(s.Type, " or "))
+			return
+		}
+		for _, name := range s.Required {
+			if _, ok := value[name]; !ok {
+				*errs = append(*errs, response.FieldError{Field: field + "." + name, Message: "is required"})
+			}
+		}
+		for _, name := range sortedKeys(value) {
+			prop, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					*errs = append(*errs, response.FieldError{Field: field + "." + name, Message: "is not allowed"})
+				}
+				continue
+			}
+			d.validate(prop, value[name], field+"."+name, errs)
+		}
+	}
+}
+
+// checkFormat はformatを検証し、不正な場合はメッセージを返す
+func checkFormat(format, v string) string {
+	switch format {
+	case "email":
+		addr, err := mail.ParseAddress(v)
+		if err != nil || addr.Address != v {
+			return "must be a valid email address"
+		}
+	case "date-time":
+		if _, err := time.Parse(time.RFC3339, v); err != nil {
+			return "must be an RFC 3339 date-time"
+		}
+	case "uri":
+		if u, err := url.Parse(v); err != nil || u.Scheme == "" || u.Host == "" {
+			return "must be an absolute URI"
+		}
+	}
+	return ""
+}
+
+// coerce はpath/queryの文字列をスキーマの型に変換する
+func coerce(s *Schema, raw string) (interface{}, error) {
+	switch {
+	case s == nil:
+		return raw, nil
+	case s.Type.has("integer"):
+		if _, err := strconv.ParseInt(raw, 10, 64); err != nil {
+			return nil, fmt.Errorf("must be an integer")
+		}
+		return json.Number(raw), nil
+	case s.Type.has("number"):
+		if _, err := strconv.ParseFloat(raw, 64); err != nil {
+			return nil, fmt.Errorf("must be a number")
+		}
+		return json.Number(raw), nil
+	case s.Type.has("boolean"):
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("must be a boolean")
+		}
+		return b, nil
+	default:
+		return raw, nil
+	}
+}
+
+func inEnum(enum []interface{}, v interface{}) bool {
+	for _, e := range enum {
+		if fmt.Sprint(e) == fmt.Sprint(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatEnum(enum []interface{}) string {
+	values := make([]string, len(enum))
+	for i, e := range enum {
+		values[i] = fmt.Sprint(e)
+	}
+	return "[" + strings.Join(values, ", ") + "]"
+}
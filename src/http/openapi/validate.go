@@ -0,0 +1,214 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"otel-test/http/response"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxBodySize は検証のために読み込むリクエストボディの上限
+const maxBodySize = 1 << 20
+
+// Middleware はルートに対応する操作のパラメーターとリクエストボディを検証するミドルウェア
+// パラメーターやJSONの形式が不正な場合は400、ボディがスキーマに一致しない場合は422を返す
+// ドキュメントにないメソッドはそのままハンドラーに渡す
+func (d *Document) Middleware(route string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			item, op := d.Operation(route, r.Method)
+			if op == nil {
+				next(w, r)
+				return
+			}
+
+			if errs := d.validateParameters(item, op, r); len(errs) > 0 {
+				recordValidationFailure(r, errs)
+				response.Problem(w, http.StatusBadRequest, "invalid parameters", errs)
+				return
+			}
+
+			if op.RequestBody != nil {
+				body, status, errs := d.validateBody(op.RequestBody, r)
+				if len(errs) > 0 {
+					recordValidationFailure(r, errs)
+					detail := "invalid request body"
+					if status == http.StatusUnprocessableEntity {
+						detail = "request body does not match schema"
+					}
+					response.Problem(w, status, detail, errs)
+					return
+				}
+				// ハンドラーで再度読めるようにする
+				if body != nil {
+					r.Body = io.NopCloser(bytes.NewReader(body))
+				}
+			}
+
+			next(w, r)
+		}
+	}
+}
+
+func (d *Document) validateParameters(item *PathItem, op *Operation, r *http.Request) []response.FieldError {
+	var errs []response.FieldError
+	query := r.URL.Query()
+	for _, p := range item.parameters(op) {
+		var (
+			raw     string
+			present bool
+		)
+		switch p.In {
+		case "path":
+			raw = r.PathValue(p.Name)
+			present = raw != ""
+		case "query":
+			raw = query.Get(p.Name)
+			present = query.Has(p.Name)
+		case "header":
+			raw = r.Header.Get(p.Name)
+			present = raw != ""
+		default:
+			continue
+		}
+
+		field := p.In + "." + p.Name
+		if !present {
+			if p.Required {
+				errs = append(errs, response.FieldError{Field: field, Message: "is required"})
+			}
+			continue
+		}
+
+		schema := d.resolve(p.Schema)
+		v, err := coerce(schema, raw)
+		if err != nil {
+			errs = append(errs, response.FieldError{Field: field, Message: err.Error()})
+			continue
+		}
+		d.validate(schema, v, field, &errs)
+	}
+	return errs
+}
+
+// validateBody はリクエストボディを読み込んで検証し、読み込んだボディを返す
+// application/jsonのスキーマがない場合（CSVなど）は、ハンドラーがストリームとして読めるよう読み込まずにnilを返す
+func (d *Document) validateBody(rb *RequestBody, r *http.Request) ([]byte, int, []response.FieldError) {
+	media, ok := rb.Content["application/json"]
+	if !ok || media.Schema == nil {
+		return nil, 0, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, []response.FieldError{{Field: "body", Message: "failed to read"}}
+	}
+	if len(body) > maxBodySize {
+		return nil, http.StatusRequestEntityTooLarge, []response.FieldError{{Field: "body", Message: fmt.Sprintf("must be at most %d bytes", maxBodySize)}}
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		if rb.Required {
+			return nil, http.StatusBadRequest, []response.FieldError{{Field: "body", Message: "is required"}}
+		}
+		return body, 0, nil
+	}
+
+	v, err := decodeJSON(body)
+	if err != nil {
+		return nil, http.StatusBadRequest, []response.FieldError{{Field: "body", Message: "must be valid JSON"}}
+	}
+
+	var errs []response.FieldError
+	d.validate(media.Schema, v, "body", &errs)
+	return body, http.StatusUnprocessableEntity, errs
+}
+
+// recordValidationFailure は検証エラーをスパンに記録する（値は個人情報を含みうるため記録しない）
+func recordValidationFailure(r *http.Request, errs []response.FieldError) {
+	fields := make([]string, len(errs))
+	for i, e := range errs {
+		fields[i] = e.Field
+	}
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttributes(
+		attribute.Bool("validation.failed", true),
+		attribute.Int("validation.error_count", len(errs)),
+	)
+	span.AddEvent("validation.failed", trace.WithAttributes(attribute.StringSlice("validation.fields", fields)))
+}
+
+// ValidateResponse はレスポンスがドキュメントに一致するかを検証します（テスト用）
+// application/jsonのスキーマがある場合はボディを検証する
+func (d *Document) ValidateResponse(route, method string, status int, contentType string, body []byte) error {
+	_, op := d.Operation(route, method)
+	if op == nil {
+		return fmt.Errorf("%s %s is not documented", method, route)
+	}
+	res, ok := op.Responses[strconv.Itoa(status)]
+	if !ok {
+		res, ok = op.Responses["default"]
+	}
+	if !ok {
+		return fmt.Errorf("%s %s: status %d is not documented", method, route, status)
+	}
+	if len(res.Content) == 0 {
+		return nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	media, ok := res.Content[mediaType]
+	if !ok {
+		return fmt.Errorf("%s %s %d: content type %q is not documented", method, route, status, contentType)
+	}
+	// application/x-ndjsonなどはJSONとして検証しない
+	if media.Schema == nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+		return nil
+	}
+
+	v, err := decodeJSON(body)
+	if err != nil {
+		return fmt.Errorf("%s %s %d: invalid JSON: %w", method, route, status, err)
+	}
+	var errs []response.FieldError
+	d.validate(media.Schema, v, "body", &errs)
+	if len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for i, e := range errs {
+			msgs[i] = e.Field + " " + e.Message
+		}
+		return fmt.Errorf("%s %s %d: response does not match schema: %s", method, route, status, strings.Join(msgs, ", "))
+	}
+	return nil
+}
+
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+	return v, nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
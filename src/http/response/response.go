@@ -11,16 +11,32 @@ type errorResponse struct {
 	Message string `json:"message"`
 }
 
+// ContentTypeJSON はJSONのレスポンスのContent-Type
+const ContentTypeJSON = "application/json; charset=utf-8"
+
+// Success HTTPコード:200 でJSONを出力する（responseがnilの場合は何もしない）
 func Success(writer http.ResponseWriter, response interface{}) {
 	if response == nil {
 		return
 	}
+	JSON(writer, http.StatusOK, response)
+}
+
+// JSON 任意のHTTPコードでJSONを出力する（responseがnilの場合はボディなし）
+// ヘッダーはWriteHeaderの前に設定する必要があるため、ステータスコードもこの関数で書き込む
+func JSON(writer http.ResponseWriter, code int, response interface{}) {
+	if response == nil {
+		writer.WriteHeader(code)
+		return
+	}
 	data, err := json.Marshal(response)
 	if err != nil {
 		log.Println(err)
 		InternalServerError(writer, "marshal error")
 		return
 	}
+	writer.Header().Set("Content-Type", ContentTypeJSON)
+	writer.WriteHeader(code)
 	if _, err := writer.Write(data); err != nil {
 		log.Println(err)
 	}
@@ -31,12 +47,18 @@ func InternalServerError(writer http.ResponseWriter, message string) {
 	httpError(writer, http.StatusInternalServerError, message)
 }
 
+// Error 任意のHTTPコードのエラーを処理する
+func Error(writer http.ResponseWriter, code int, message string) {
+	httpError(writer, code, message)
+}
+
 // httpError エラー用のレスポンス出力を行う
 func httpError(writer http.ResponseWriter, code int, message string) {
 	data, _ := json.Marshal(errorResponse{
 		Code:    code,
 		Message: message,
 	})
+	writer.Header().Set("Content-Type", ContentTypeJSON)
 	writer.WriteHeader(code)
 	if data != nil {
 		if _, err := writer.Write(data); err != nil {
@@ -45,3 +67,40 @@ func httpError(writer http.ResponseWriter, code int, message string) {
 		}
 	}
 }
+
+// FieldError は不正なフィールドとその理由
+type FieldError struct {
+	// Field は不正な箇所 (例: body.email, query.limit, path.id)
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// problem はRFC 9457 Problem Details形式のエラーレスポンス
+type problem struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// Problem はapplication/problem+json形式のエラーレスポンスを出力する
+func Problem(writer http.ResponseWriter, code int, detail string, errors []FieldError) {
+	data, err := json.Marshal(problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(code),
+		Status: code,
+		Detail: detail,
+		Errors: errors,
+	})
+	if err != nil {
+		log.Println(err)
+		InternalServerError(writer, "marshal error")
+		return
+	}
+	writer.Header().Set("Content-Type", "application/problem+json")
+	writer.WriteHeader(code)
+	if _, err := writer.Write(data); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,57 @@
+// Package idempotency はIdempotency-Keyヘッダーによるリクエストの重複実行の防止を提供します
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// HeaderKey はクライアントがリクエストごとに生成するキーのヘッダー
+const HeaderKey = "Idempotency-Key"
+
+// HeaderReplayed は保存済みのレスポンスを返したことを示すヘッダー
+const HeaderReplayed = "Idempotent-Replayed"
+
+// maxKeyLength はキーの最大長
+const maxKeyLength = 255
+
+// ErrLockLost はロックの期限が切れ、同じキーのリクエストに処理を引き継がれた
+var ErrLockLost = errors.New("idempotency lock lost")
+
+// Record は保存されたキーとレスポンス
+type Record struct {
+	// Scope はキーの有効範囲（テナントとメソッドとルート。例: acme:POST /users）
+	Scope string
+	Key   string
+	// Fingerprint はリクエストのハッシュ。同じキーで異なるリクエストを送った場合の検出に使う
+	Fingerprint string
+	// Token は処理中のロックの所有者を表す値
+	Token string
+	// Completed はレスポンスを保存済みか（falseの場合は処理中）
+	Completed  bool
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// LockedUntil は処理中のロックの期限。期限が切れると同じキーのリクエストが処理を引き継ぐ
+	LockedUntil time.Time
+	// ExpiresAt はキーの有効期限。期限が切れたキーは再利用できる
+	ExpiresAt time.Time
+}
+
+// Store はキーとレスポンスの保存先
+type Store interface {
+	// Lock はrecを処理中として登録し、nilを返します
+	// 有効なレコードが既にある場合は登録せずにそのレコードを返す
+	// 有効期限が切れたレコードと、ロックの期限が切れた処理中のレコードは置き換える
+	Lock(ctx context.Context, rec Record, now time.Time) (*Record, error)
+	// Complete は処理中のレコードにレスポンスを保存します
+	// ロックを失っている場合はErrLockLostを返す
+	Complete(ctx context.Context, rec Record) error
+	// Release は処理中のレコードを削除し、同じキーで再実行できるようにします
+	// ロックを失っている場合はErrLockLostを返す
+	Release(ctx context.Context, rec Record) error
+	// PurgeExpired はbefore以前に有効期限が切れたレコードを削除し、削除した件数を返します
+	PurgeExpired(ctx context.Context, before time.Time) (int64, error)
+}
@@ -0,0 +1,25 @@
+package idempotency
+
+import (
+	"context"
+	"log/slog"
+	"otel-test/jobs"
+	"otel-test/o11y"
+	"time"
+)
+
+// JobPurgeExpired は有効期限が切れたキーを削除するジョブの種類
+const JobPurgeExpired = "idempotency.purge_expired"
+
+// PurgeExpiredJob は有効期限が切れたキーを削除するジョブのハンドラーを返します
+// 期限切れのキーは再利用時に置き換えるため、削除しなくても動作は変わらない
+func PurgeExpiredJob(store Store) jobs.Handler {
+	return func(ctx context.Context, _ jobs.Job) error {
+		n, err := store.PurgeExpired(ctx, time.Now())
+		if err != nil {
+			return err
+		}
+		o11y.Logger("jobs").InfoContext(ctx, "purged expired idempotency keys", slog.Int64("count", n))
+		return nil
+	}
+}
@@ -0,0 +1,252 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"otel-test/http/response"
+	"otel-test/o11y"
+	"otel-test/tenant"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxBodySize はフィンガープリントのために読み込むリクエストボディの上限
+const maxBodySize = 1 << 20
+
+// 処理結果（idempotency.outcome）
+const (
+	outcomeStored     = "stored"      // 実行してレスポンスを保存した
+	outcomeReleased   = "released"    // 5xxのため保存せず、再実行できるようにした
+	outcomeReplayed   = "replayed"    // 保存済みのレスポンスを返した
+	outcomeInProgress = "in_progress" // 同じキーのリクエストを処理中
+	outcomeMismatch   = "mismatch"    // 同じキーで異なるリクエストが送られた
+)
+
+// Config はIdempotency-Keyの処理の設定
+type Config struct {
+	// TTL はキーとレスポンスを保存する期間 (default: 24h)
+	TTL time.Duration
+	// LockTimeout は処理中のロックの期間 (default: 1m)
+	// ハンドラーがこれより長くかかると、同じキーのリクエストが処理を引き継ぐ
+	LockTimeout time.Duration
+}
+
+// Middleware はIdempotency-Keyを処理するミドルウェアを作成する
+type Middleware struct {
+	store    Store
+	cfg      Config
+	now      func() time.Time
+	requests metric.Int64Counter
+}
+
+// New は新しいMiddlewareを作成します
+func New(store Store, cfg Config) *Middleware {
+	if cfg.TTL <= 0 {
+		cfg.TTL = 24 * time.Hour
+	}
+	if cfg.LockTimeout <= 0 {
+		cfg.LockTimeout = time.Minute
+	}
+	requests, _ := otel.Meter("idempotency").Int64Counter("idempotency.requests",
+		metric.WithDescription("Number of requests with an Idempotency-Key by outcome"),
+		metric.WithUnit("{request}"),
+	)
+	return &Middleware{store: store, cfg: cfg, now: time.Now, requests: requests}
+}
+
+// Route はrouteのPOSTリクエストでIdempotency-Keyを処理するミドルウェアを返します
+//
+//   - 初回はハンドラーを実行し、5xx以外のレスポンスを保存する
+//   - 同じキーの再送には保存済みのレスポンスを返す（Idempotent-Replayed: true）
+//   - 同じキーで異なるリクエストを送った場合は422、処理中の場合は409を返す
+//
+// ヘッダーがないリクエストとPOST以外のメソッドはそのままハンドラーに渡す
+func (m *Middleware) Route(route string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(HeaderKey)
+			if r.Method != http.MethodPost || key == "" {
+				next(w, r)
+				return
+			}
+			ctx := r.Context()
+			span := trace.SpanFromContext(ctx)
+			span.SetAttributes(attribute.String("idempotency.key", key))
+
+			if len(key) > maxKeyLength {
+				response.Problem(w, http.StatusBadRequest, "invalid parameters", []response.FieldError{
+					{Field: "header." + HeaderKey, Message: fmt.Sprintf("must be at most %d characters", maxKeyLength)},
+				})
+				return
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+			if err != nil {
+				span.RecordError(err)
+				response.Problem(w, http.StatusBadRequest, "invalid request body", nil)
+				return
+			}
+			// ハンドラーで再度読めるようにする
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			now := m.now()
+			rec := Record{
+				Scope:       scope(r, route),
+				Key:         key,
+				Fingerprint: fingerprint(r, body),
+				Token:       newToken(),
+				LockedUntil: now.Add(m.cfg.LockTimeout),
+				ExpiresAt:   now.Add(m.cfg.TTL),
+			}
+			existing, err := m.store.Lock(ctx, rec, now)
+			if err != nil {
+				span.RecordError(err)
+				response.InternalServerError(w, "Failed to process idempotency key")
+				return
+			}
+
+			if existing != nil {
+				switch {
+				case existing.Fingerprint != rec.Fingerprint:
+					m.record(ctx, route, outcomeMismatch)
+					response.Problem(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used with a different request", nil)
+				case !existing.Completed:
+					m.record(ctx, route, outcomeInProgress)
+					w.Header().Set("Retry-After", "1")
+					response.Problem(w, http.StatusConflict, "a request with the same Idempotency-Key is in progress", nil)
+				default:
+					m.record(ctx, route, outcomeReplayed)
+					replay(w, existing)
+				}
+				return
+			}
+
+			m.serve(w, r, next, rec, route)
+		}
+	}
+}
+
+// serve はハンドラーを実行し、レスポンスを保存します
+// 5xxやpanicの場合は保存せずにロックを解放し、同じキーで再実行できるようにする
+func (m *Middleware) serve(w http.ResponseWriter, r *http.Request, next http.HandlerFunc, rec Record, route string) {
+	// クライアントが切断しても保存する
+	ctx := context.WithoutCancel(r.Context())
+
+	var buf bytes.Buffer
+	status := 0
+	capture := func() {
+		if status == 0 {
+			status = http.StatusOK
+			rec.Header = w.Header().Clone()
+		}
+	}
+	ww := httpsnoop.Wrap(w, httpsnoop.Hooks{
+		WriteHeader: func(next httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+			return func(code int) {
+				if status == 0 {
+					status = code
+					rec.Header = w.Header().Clone()
+				}
+				next(code)
+			}
+		},
+		Write: func(next httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+			return func(b []byte) (int, error) {
+				capture()
+				buf.Write(b)
+				return next(b)
+			}
+		},
+	})
+
+	completed := false
+	defer func() {
+		if completed {
+			return
+		}
+		// panicした場合もロックを解放する
+		if err := m.store.Release(ctx, rec); err != nil {
+			m.logError(ctx, "failed to release idempotency key", err)
+		}
+		m.record(ctx, route, outcomeReleased)
+	}()
+
+	next(ww, r)
+	capture()
+
+	if status >= http.StatusInternalServerError {
+		return
+	}
+	completed = true
+	rec.Completed = true
+	rec.StatusCode = status
+	rec.Body = buf.Bytes()
+	if err := m.store.Complete(ctx, rec); err != nil {
+		m.logError(ctx, "failed to store idempotent response", err)
+	}
+	m.record(ctx, route, outcomeStored)
+}
+
+func (m *Middleware) record(ctx context.Context, route, outcome string) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("idempotency.outcome", outcome))
+	m.requests.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("http.route", route),
+		attribute.String("idempotency.outcome", outcome),
+	))
+}
+
+func (m *Middleware) logError(ctx context.Context, msg string, err error) {
+	level := slog.LevelError
+	if errors.Is(err, ErrLockLost) {
+		level = slog.LevelWarn
+	}
+	o11y.Logger("idempotency").Log(ctx, level, msg, slog.Any("error", err))
+}
+
+// replay は保存済みのレスポンスを書き込みます
+func replay(w http.ResponseWriter, rec *Record) {
+	for k, v := range rec.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Set(HeaderReplayed, "true")
+	w.WriteHeader(rec.StatusCode)
+	_, _ = w.Write(rec.Body)
+}
+
+// scope はキーの有効範囲を返します
+// テナントが決まっている場合は、別のテナントのレスポンスを返さないようテナントごとに分ける
+func scope(r *http.Request, route string) string {
+	s := r.Method + " " + route
+	if id, ok := tenant.FromContext(r.Context()); ok {
+		s = id + ":" + s
+	}
+	return s
+}
+
+// fingerprint はメソッド、パス、クエリとボディのハッシュを返します
+func fingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s?%s\n", r.Method, r.URL.Path, r.URL.RawQuery)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// newToken はロックの所有者を表すランダムな値を返します
+func newToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,242 @@
+package idempotency_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"otel-test/database/databasetest"
+	"otel-test/idempotency"
+	"otel-test/o11y/o11ytest"
+	"otel-test/server/entity"
+	"otel-test/server/repository"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func newTestMiddleware(t *testing.T, cfg idempotency.Config) (*o11ytest.Harness, *repository.IdempotencyRepository, *idempotency.Middleware) {
+	t.Helper()
+	h := o11ytest.New(t)
+	store := repository.NewIdempotencyRepository(databasetest.New(t, &entity.IdempotencyKey{}))
+	return h, store, idempotency.New(store, cfg)
+}
+
+// post はIdempotency-Keyを付けてhandlerにPOSTリクエストを送信します
+func post(handler http.HandlerFunc, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(idempotency.HeaderKey, key)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+// createHandler は呼び出された回数を連番のIDとして201を返すハンドラー
+func createHandler(calls *atomic.Int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", fmt.Sprintf("/users/%d", n))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"id":%d}`, n)
+	}
+}
+
+func TestMiddlewareReplaysStoredResponse(t *testing.T) {
+	h, _, m := newTestMiddleware(t, idempotency.Config{})
+	var calls atomic.Int32
+	handler := m.Route("/users")(createHandler(&calls))
+
+	first := post(handler, "key-1", `{"name":"Taro"}`)
+	second := post(handler, "key-1", `{"name":"Taro"}`)
+
+	if calls.Load() != 1 {
+		t.Fatalf("calls = %d, want 1", calls.Load())
+	}
+	if second.Code != http.StatusCreated || second.Body.String() != `{"id":1}` {
+		t.Fatalf("replayed %d %q, want %d %q", second.Code, second.Body.String(), first.Code, first.Body.String())
+	}
+	if got := second.Header().Get("Location"); got != "/users/1" {
+		t.Fatalf("Location = %q, want /users/1", got)
+	}
+	if first.Header().Get(idempotency.HeaderReplayed) != "" || second.Header().Get(idempotency.HeaderReplayed) != "true" {
+		t.Fatalf("Idempotent-Replayed = %q, %q", first.Header().Get(idempotency.HeaderReplayed), second.Header().Get(idempotency.HeaderReplayed))
+	}
+
+	// 別のキーは別のリクエストとして実行する
+	if rec := post(handler, "key-2", `{"name":"Taro"}`); rec.Body.String() != `{"id":2}` {
+		t.Fatalf("body = %q, want %q", rec.Body.String(), `{"id":2}`)
+	}
+
+	route := attribute.String("http.route", "/users")
+	h.Metric("idempotency.requests").WithAttrs(route, attribute.String("idempotency.outcome", "stored")).HasValue(2)
+	h.Metric("idempotency.requests").WithAttrs(route, attribute.String("idempotency.outcome", "replayed")).HasValue(1)
+}
+
+func TestMiddlewareRejectsDifferentRequest(t *testing.T) {
+	h, _, m := newTestMiddleware(t, idempotency.Config{})
+	var calls atomic.Int32
+	handler := m.Route("/users")(createHandler(&calls))
+
+	post(handler, "key-1", `{"name":"Taro"}`)
+	rec := post(handler, "key-1", `{"name":"Jiro"}`)
+
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusUnprocessableEntity)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("calls = %d, want 1", calls.Load())
+	}
+	h.Metric("idempotency.requests").WithAttrs(attribute.String("idempotency.outcome", "mismatch")).HasValue(1)
+}
+
+func TestMiddlewareRejectsConcurrentDuplicate(t *testing.T) {
+	h, _, m := newTestMiddleware(t, idempotency.Config{})
+	var calls atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := m.Route("/users")(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		createHandler(&calls)(w, r)
+	})
+
+	var wg sync.WaitGroup
+	var first *httptest.ResponseRecorder
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		first = post(handler, "key-1", `{"name":"Taro"}`)
+	}()
+	<-started
+
+	// 1つ目のリクエストの処理中は409を返す
+	rec := post(handler, "key-1", `{"name":"Taro"}`)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatal("Retry-After is not set")
+	}
+
+	close(release)
+	wg.Wait()
+	if first.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", first.Code, http.StatusCreated)
+	}
+	// 完了後は保存したレスポンスを返す
+	if rec := post(handler, "key-1", `{"name":"Taro"}`); rec.Code != http.StatusCreated || rec.Header().Get(idempotency.HeaderReplayed) != "true" {
+		t.Fatalf("status = %d, replayed = %q", rec.Code, rec.Header().Get(idempotency.HeaderReplayed))
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("calls = %d, want 1", calls.Load())
+	}
+	h.Metric("idempotency.requests").WithAttrs(attribute.String("idempotency.outcome", "in_progress")).HasValue(1)
+}
+
+func TestMiddlewareReleasesOnServerError(t *testing.T) {
+	h, _, m := newTestMiddleware(t, idempotency.Config{})
+	var calls atomic.Int32
+	handler := m.Route("/users")(func(w http.ResponseWriter, r *http.Request) {
+		switch calls.Add(1) {
+		case 1:
+			http.Error(w, "boom", http.StatusInternalServerError)
+		case 2:
+			panic("boom")
+		default:
+			w.WriteHeader(http.StatusCreated)
+		}
+	})
+
+	if rec := post(handler, "key-1", `{}`); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("handler did not panic")
+			}
+		}()
+		post(handler, "key-1", `{}`)
+	}()
+	// 5xxとpanicのレスポンスは保存しないため、同じキーで再実行できる
+	if rec := post(handler, "key-1", `{}`); rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusCreated)
+	}
+	if calls.Load() != 3 {
+		t.Fatalf("calls = %d, want 3", calls.Load())
+	}
+	h.Metric("idempotency.requests").WithAttrs(attribute.String("idempotency.outcome", "released")).HasValue(2)
+}
+
+func TestMiddlewareTakesOverExpiredLock(t *testing.T) {
+	h, _, m := newTestMiddleware(t, idempotency.Config{LockTimeout: 10 * time.Millisecond})
+	var calls atomic.Int32
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	handler := m.Route("/users")(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		if calls.Add(1) == 1 {
+			<-release
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		post(handler, "key-1", `{}`)
+	}()
+	<-started
+	time.Sleep(20 * time.Millisecond)
+
+	// ロックの期限が切れたため処理を引き継ぐ
+	if rec := post(handler, "key-1", `{}`); rec.Code != http.StatusCreated || rec.Header().Get(idempotency.HeaderReplayed) != "" {
+		t.Fatalf("status = %d, replayed = %q", rec.Code, rec.Header().Get(idempotency.HeaderReplayed))
+	}
+	close(release)
+	<-done
+
+	if calls.Load() != 2 {
+		t.Fatalf("calls = %d, want 2", calls.Load())
+	}
+	// 引き継がれた1つ目のリクエストはレスポンスを保存しない
+	h.Logs().Containing("failed to store idempotent response").Len(1)
+}
+
+func TestMiddlewareWithoutKey(t *testing.T) {
+	h, _, m := newTestMiddleware(t, idempotency.Config{})
+	var calls atomic.Int32
+	handler := m.Route("/users")(createHandler(&calls))
+
+	post(handler, "", `{}`)
+	post(handler, "", `{}`)
+	if calls.Load() != 2 {
+		t.Fatalf("calls = %d, want 2", calls.Load())
+	}
+	h.Spans().Len(0)
+}
+
+func TestPurgeExpired(t *testing.T) {
+	_, store, _ := newTestMiddleware(t, idempotency.Config{})
+	ctx := context.Background()
+	now := time.Now()
+
+	for i, expires := range []time.Time{now.Add(-time.Hour), now.Add(time.Hour)} {
+		rec := idempotency.Record{Scope: "POST /users", Key: fmt.Sprint(i), LockedUntil: now, ExpiresAt: expires}
+		if existing, err := store.Lock(ctx, rec, now.Add(-2*time.Hour)); err != nil || existing != nil {
+			t.Fatalf("lock: %v, %v", existing, err)
+		}
+	}
+	n, err := store.PurgeExpired(ctx, now)
+	if err != nil || n != 1 {
+		t.Fatalf("purged %d, %v; want 1", n, err)
+	}
+}
@@ -0,0 +1,134 @@
+// Package jobs はデータベースをキューとするバックグラウンドジョブを提供します
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrLeaseLost はロックの期限が切れ、ジョブが別のワーカーに再取得された
+var ErrLeaseLost = errors.New("job lease lost")
+
+// Job はキューに登録されたジョブ
+type Job struct {
+	ID      uint64
+	Type    string
+	Payload json.RawMessage
+	// RunAt は実行予定時刻
+	RunAt time.Time
+	// Attempt は今回の試行回数（1から）
+	Attempt     int
+	MaxAttempts int
+	// UniqueKey が同じジョブは一度しか登録されない（空の場合は制限なし）
+	UniqueKey string
+	// TraceContext はジョブを登録したスパンのトレースコンテキスト（traceparent等）
+	TraceContext map[string]string
+	// LockedBy は実行中のジョブを取得したワーカーの識別子
+	LockedBy string
+}
+
+// Decode はペイロードをvにデコードします
+// デコードできない場合は再試行しても成功しないためPermanentエラーを返す
+func (j Job) Decode(v any) error {
+	if err := json.Unmarshal(j.Payload, v); err != nil {
+		return Permanent(err)
+	}
+	return nil
+}
+
+// SpanContext はジョブを登録したスパンのスパンコンテキストを返します
+func (j Job) SpanContext() trace.SpanContext {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(j.TraceContext))
+	return trace.SpanContextFromContext(ctx)
+}
+
+// Attributes はスパンに付与するジョブの属性を返します
+func (j Job) Attributes() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("messaging.system", "jobs"),
+		attribute.String("messaging.destination.name", j.Type),
+		attribute.String("messaging.message.id", strconv.FormatUint(j.ID, 10)),
+		attribute.Int("job.attempt", j.Attempt),
+	}
+}
+
+// Handler はジョブを実行する関数
+// エラーを返すとバックオフ後に再試行する（Permanentエラーの場合は再試行しない）
+type Handler func(ctx context.Context, job Job) error
+
+// Store はジョブを永続化するキュー
+type Store interface {
+	// Enqueue はジョブを追加する
+	// UniqueKeyが登録済みの場合は追加せずcreated=falseを返す
+	Enqueue(ctx context.Context, job Job) (id uint64, created bool, err error)
+	// Claim は実行予定時刻を過ぎたジョブを最大limit件取得し、leaseの間ownerがロックする
+	// ロックの期限が切れた実行中のジョブ（停止したワーカーのジョブ）も再取得する
+	Claim(ctx context.Context, owner string, now time.Time, limit int, lease time.Duration) ([]Job, error)
+	// Complete はジョブを完了にする
+	Complete(ctx context.Context, job Job) error
+	// Retry はジョブをrunAtに再実行する
+	Retry(ctx context.Context, job Job, runAt time.Time, cause error) error
+	// Fail はジョブをデッドレターにする
+	Fail(ctx context.Context, job Job, cause error) error
+}
+
+// Option はジョブ登録時のオプション
+type Option func(*Job)
+
+// WithRunAt は実行予定時刻を指定します
+func WithRunAt(t time.Time) Option {
+	return func(j *Job) { j.RunAt = t }
+}
+
+// WithDelay は実行を遅らせます
+func WithDelay(d time.Duration) Option {
+	return func(j *Job) { j.RunAt = j.RunAt.Add(d) }
+}
+
+// WithMaxAttempts は最大試行回数を指定します
+func WithMaxAttempts(n int) Option {
+	return func(j *Job) { j.MaxAttempts = n }
+}
+
+// WithUniqueKey は重複登録を防ぐキーを指定します
+func WithUniqueKey(key string) Option {
+	return func(j *Job) { j.UniqueKey = key }
+}
+
+// permanentError は再試行しないエラー
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent はerrを再試行しないエラーとしてラップします
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent はerrが再試行しないエラーかを返します
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// injectTraceContext はctxのトレースコンテキストをmapに書き出します
+func injectTraceContext(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
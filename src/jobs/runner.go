@@ -0,0 +1,426 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"otel-test/o11y"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 実行の結果（メトリクスとスパンの属性）
+const (
+	resultSuccess = "success"
+	resultRetry   = "retry"
+	resultDead    = "dead"
+)
+
+// Config はRunnerの設定
+type Config struct {
+	// Concurrency は同時に実行するジョブの最大数
+	Concurrency int
+	// PollInterval はキューを確認する間隔
+	PollInterval time.Duration
+	// Lease は取得したジョブのロック期間（超えると別のワーカーが再取得する）
+	Lease time.Duration
+	// MaxAttempts はジョブごとの最大試行回数のデフォルト値
+	MaxAttempts int
+	// RetryDelay はattempt回目の失敗後に再試行するまでの時間
+	RetryDelay func(attempt int) time.Duration
+}
+
+// schedule は定期実行するジョブ
+type schedule struct {
+	name     string
+	schedule Schedule
+	jobType  string
+	payload  json.RawMessage
+}
+
+// Runner はキューのジョブをワーカープールで実行する
+// 配信はat-least-onceのため、ハンドラーは冪等に実装する
+type Runner struct {
+	store     Store
+	config    Config
+	tracer    trace.Tracer
+	worker    string
+	now       func() time.Time
+	mu        sync.RWMutex
+	handlers  map[string]Handler
+	schedules []schedule
+
+	executions metric.Int64Counter
+	duration   metric.Float64Histogram
+	wait       metric.Float64Histogram
+
+	busy       atomic.Int64
+	wake       chan struct{}
+	stop       chan struct{}
+	stopOnce   sync.Once
+	started    atomic.Bool
+	done       chan struct{}
+	jobCtx     context.Context
+	cancelJobs context.CancelFunc
+}
+
+// NewRunner は新しいRunnerを作成します
+func NewRunner(store Store, config Config) *Runner {
+	if config.Concurrency <= 0 {
+		config.Concurrency = 4
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = time.Second
+	}
+	if config.Lease <= 0 {
+		config.Lease = 5 * time.Minute
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 5
+	}
+	if config.RetryDelay == nil {
+		config.RetryDelay = defaultRetryDelay
+	}
+
+	meter := otel.Meter("jobs")
+	executions, _ := meter.Int64Counter("jobs.executions",
+		metric.WithDescription("Number of job executions"),
+		metric.WithUnit("{execution}"),
+	)
+	duration, _ := meter.Float64Histogram("jobs.execution.duration",
+		metric.WithDescription("Duration of job executions"),
+		metric.WithUnit("s"),
+	)
+	wait, _ := meter.Float64Histogram("jobs.queue.wait",
+		metric.WithDescription("Time from the scheduled run time until a job starts"),
+		metric.WithUnit("s"),
+	)
+
+	jobCtx, cancelJobs := context.WithCancel(context.Background())
+	return &Runner{
+		store:      store,
+		config:     config,
+		tracer:     otel.Tracer("jobs"),
+		worker:     workerID(),
+		now:        time.Now,
+		handlers:   make(map[string]Handler),
+		executions: executions,
+		duration:   duration,
+		wait:       wait,
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		jobCtx:     jobCtx,
+		cancelJobs: cancelJobs,
+	}
+}
+
+// Register はジョブの種類にハンドラーを登録します
+func (r *Runner) Register(jobType string, h Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[jobType] = h
+}
+
+// Schedule はspecのスケジュールでジョブを定期的に登録します（Startの前に呼び出す）
+// 登録は実行予定時刻ごとに一意のため、複数のインスタンスで実行しても重複しない
+func (r *Runner) Schedule(name, spec, jobType string, payload any) error {
+	s, err := ParseSchedule(spec)
+	if err != nil {
+		return fmt.Errorf("invalid schedule for %s: %w", name, err)
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schedules = append(r.schedules, schedule{name: name, schedule: s, jobType: jobType, payload: data})
+	return nil
+}
+
+// Enqueue はジョブをキューに登録します
+// 実行時のスパンは登録したスパン（ctxのリクエスト）にリンクされる
+func (r *Runner) Enqueue(ctx context.Context, jobType string, payload any, opts ...Option) (uint64, error) {
+	ctx, span := r.tracer.Start(ctx, "jobs enqueue "+jobType,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "jobs"),
+			attribute.String("messaging.destination.name", jobType),
+			attribute.String("messaging.operation.type", "send"),
+		),
+	)
+	defer span.End()
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		span.RecordError(err)
+		return 0, err
+	}
+	job := Job{
+		Type:        jobType,
+		Payload:     data,
+		RunAt:       r.now().UTC(),
+		MaxAttempts: r.config.MaxAttempts,
+	}
+	for _, opt := range opts {
+		opt(&job)
+	}
+	job.TraceContext = injectTraceContext(ctx)
+
+	id, created, err := r.store.Enqueue(ctx, job)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to enqueue job")
+		return 0, fmt.Errorf("failed to enqueue job: %w", err)
+	}
+	span.SetAttributes(
+		attribute.String("messaging.message.id", fmt.Sprint(id)),
+		attribute.Bool("job.duplicate", !created),
+	)
+
+	// 同じプロセスのワーカーにすぐ確認させる
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return id, nil
+}
+
+// Start はShutdownが呼ばれるまでジョブを取得して実行します
+func (r *Runner) Start(ctx context.Context) error {
+	r.started.Store(true)
+	defer close(r.done)
+
+	queue := make(chan Job)
+	var wg sync.WaitGroup
+	for range r.config.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				r.execute(job)
+				r.busy.Add(-1)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.runScheduler(ctx)
+	}()
+
+	ticker := time.NewTicker(r.config.PollInterval)
+	defer ticker.Stop()
+	for {
+		r.poll(ctx, queue)
+		select {
+		case <-r.stop:
+			close(queue)
+			wg.Wait()
+			return nil
+		case <-ticker.C:
+		case <-r.wake:
+		}
+	}
+}
+
+// Shutdown は新しいジョブの取得を止め、実行中のジョブの完了を待ちます
+// ctxが終了した場合は実行中のジョブをキャンセルする（ロックの期限後に再実行される）
+func (r *Runner) Shutdown(ctx context.Context) error {
+	r.stopOnce.Do(func() { close(r.stop) })
+	if !r.started.Load() {
+		return nil
+	}
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		r.cancelJobs()
+		return ctx.Err()
+	}
+}
+
+// poll は空いているワーカーの数だけジョブを取得してキューに送ります
+func (r *Runner) poll(ctx context.Context, queue chan<- Job) {
+	free := r.config.Concurrency - int(r.busy.Load())
+	if free <= 0 {
+		return
+	}
+	owner := r.worker + "/" + randomHex(4)
+	claimed, err := r.store.Claim(ctx, owner, r.now().UTC(), free, r.config.Lease)
+	if err != nil {
+		o11y.Logger("jobs").ErrorContext(ctx, "failed to claim jobs", slog.Any("error", err))
+		return
+	}
+	for _, job := range claimed {
+		r.busy.Add(1)
+		queue <- job
+	}
+}
+
+// execute はジョブを実行し、結果をキューに記録します
+func (r *Runner) execute(job Job) {
+	// ジョブのスパンは独立したトレースとし、登録したリクエストへはリンクで関連付ける
+	opts := []trace.SpanStartOption{
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(job.Attributes()...),
+		trace.WithAttributes(attribute.String("messaging.operation.type", "process")),
+	}
+	if sc := job.SpanContext(); sc.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: sc}))
+	}
+	ctx, span := r.tracer.Start(r.jobCtx, "jobs run "+job.Type, opts...)
+	defer span.End()
+
+	start := r.now()
+	r.wait.Record(ctx, start.Sub(job.RunAt).Seconds(), metric.WithAttributes(attribute.String("job.type", job.Type)))
+
+	err := r.call(ctx, job)
+
+	// キャンセルされた場合も結果は記録する
+	storeCtx := context.WithoutCancel(ctx)
+	result := resultSuccess
+	var storeErr error
+	switch {
+	case err == nil:
+		storeErr = r.store.Complete(storeCtx, job)
+	case IsPermanent(err) || job.Attempt >= job.MaxAttempts:
+		result = resultDead
+		storeErr = r.store.Fail(storeCtx, job, err)
+		o11y.Logger("jobs").ErrorContext(ctx, "job moved to dead letter",
+			slog.Uint64("job.id", job.ID),
+			slog.String("job.type", job.Type),
+			slog.Int("job.attempt", job.Attempt),
+			slog.Any("error", err),
+		)
+	default:
+		result = resultRetry
+		delay := r.config.RetryDelay(job.Attempt)
+		storeErr = r.store.Retry(storeCtx, job, r.now().UTC().Add(delay), err)
+		o11y.Logger("jobs").WarnContext(ctx, "job failed, will retry",
+			slog.Uint64("job.id", job.ID),
+			slog.String("job.type", job.Type),
+			slog.Int("job.attempt", job.Attempt),
+			slog.Duration("retry.delay", delay),
+			slog.Any("error", err),
+		)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "job failed")
+	}
+	if storeErr != nil {
+		span.RecordError(storeErr)
+		o11y.Logger("jobs").ErrorContext(ctx, "failed to record job result",
+			slog.Uint64("job.id", job.ID),
+			slog.String("job.type", job.Type),
+			slog.Any("error", storeErr),
+		)
+	}
+
+	span.SetAttributes(attribute.String("job.result", result))
+	attrs := metric.WithAttributes(attribute.String("job.type", job.Type), attribute.String("job.result", result))
+	r.executions.Add(ctx, 1, attrs)
+	r.duration.Record(ctx, r.now().Sub(start).Seconds(), attrs)
+}
+
+// call はハンドラーを呼び出します（panicはエラーとして扱う）
+func (r *Runner) call(ctx context.Context, job Job) (err error) {
+	r.mu.RLock()
+	h, ok := r.handlers[job.Type]
+	r.mu.RUnlock()
+	if !ok {
+		return Permanent(fmt.Errorf("no handler registered for job type %q", job.Type))
+	}
+	if job.Attempt > job.MaxAttempts {
+		// ロックの期限切れで再取得が繰り返されたジョブ
+		return Permanent(fmt.Errorf("exceeded max attempts (%d)", job.MaxAttempts))
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("job panicked: %v", p)
+		}
+	}()
+	return h(ctx, job)
+}
+
+// runScheduler はスケジュールの時刻になったジョブを登録します
+func (r *Runner) runScheduler(ctx context.Context) {
+	r.mu.RLock()
+	schedules := append([]schedule(nil), r.schedules...)
+	r.mu.RUnlock()
+	if len(schedules) == 0 {
+		return
+	}
+
+	next := make([]time.Time, len(schedules))
+	for i, s := range schedules {
+		next[i] = s.schedule.Next(r.now())
+	}
+	for {
+		earliest := next[0]
+		for _, t := range next[1:] {
+			if t.Before(earliest) {
+				earliest = t
+			}
+		}
+		timer := time.NewTimer(earliest.Sub(r.now()))
+		select {
+		case <-r.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		now := r.now()
+		for i, s := range schedules {
+			if next[i].After(now) {
+				continue
+			}
+			key := fmt.Sprintf("schedule:%s:%d", s.name, next[i].Unix())
+			_, err := r.Enqueue(ctx, s.jobType, s.payload, WithRunAt(next[i].UTC()), WithUniqueKey(key))
+			if err != nil {
+				o11y.Logger("jobs").ErrorContext(ctx, "failed to enqueue scheduled job",
+					slog.String("schedule", s.name),
+					slog.Any("error", err),
+				)
+			}
+			next[i] = s.schedule.Next(now)
+		}
+	}
+}
+
+// defaultRetryDelay は10秒から2倍ずつ増え、1時間で打ち切る
+func defaultRetryDelay(attempt int) time.Duration {
+	d := 10 * time.Second
+	for i := 1; i < attempt && d < time.Hour; i++ {
+		d *= 2
+	}
+	return min(d, time.Hour)
+}
+
+// workerID はワーカーを識別する文字列を返します
+func workerID() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), randomHex(4))
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,340 @@
+package jobs_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"otel-test/database"
+	"otel-test/database/databasetest"
+	"otel-test/jobs"
+	"otel-test/o11y/o11ytest"
+	"otel-test/server/entity"
+	"otel-test/server/repository"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// noDelay はすぐに再試行する
+func noDelay(int) time.Duration { return 0 }
+
+func newTestRunner(t *testing.T, config jobs.Config) (*o11ytest.Harness, *database.DB, *jobs.Runner) {
+	t.Helper()
+	h := o11ytest.New(t)
+	db := databasetest.New(t, &entity.Job{})
+	if config.PollInterval == 0 {
+		config.PollInterval = 10 * time.Millisecond
+	}
+	return h, db, jobs.NewRunner(repository.NewJobRepository(db), config)
+}
+
+// start はRunnerを起動し、停止する関数を返します
+// 停止後は実行中のジョブのスパンとメトリクスがすべて記録されている
+func start(t *testing.T, r *jobs.Runner) (stop func()) {
+	t.Helper()
+	errCh := make(chan error, 1)
+	go func() { errCh <- r.Start(context.Background()) }()
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := r.Shutdown(ctx); err != nil {
+				t.Errorf("shutdown: %v", err)
+			}
+			if err := <-errCh; err != nil {
+				t.Errorf("start: %v", err)
+			}
+		})
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+// waitFor はcondが満たされるまで待ちます
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRunnerLinksToEnqueuingSpan(t *testing.T) {
+	h, _, r := newTestRunner(t, jobs.Config{})
+
+	var got atomic.Value
+	r.Register("test.echo", func(ctx context.Context, job jobs.Job) error {
+		var payload map[string]string
+		if err := job.Decode(&payload); err != nil {
+			return err
+		}
+		got.Store(payload["message"])
+		return nil
+	})
+	stop := start(t, r)
+
+	ctx, span := otel.Tracer("test").Start(context.Background(), "POST /users")
+	if _, err := r.Enqueue(ctx, "test.echo", map[string]string{"message": "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	span.End()
+
+	waitFor(t, func() bool { return got.Load() != nil })
+	stop()
+
+	if got.Load() != "hello" {
+		t.Fatalf("payload = %v, want hello", got.Load())
+	}
+	enqueue := h.Span("jobs enqueue test.echo").
+		HasKind(trace.SpanKindProducer).
+		ChildOf(h.Span("POST /users"))
+	h.Span("jobs run test.echo").
+		IsRoot().
+		HasKind(trace.SpanKindConsumer).
+		HasLinkTo(enqueue.Stub().SpanContext).
+		HasAttr("job.attempt", 1).
+		HasAttr("job.result", "success").
+		NoError()
+	h.Metric("jobs.executions").
+		WithAttrs(attribute.String("job.type", "test.echo"), attribute.String("job.result", "success")).
+		HasValue(1)
+	h.Metric("jobs.execution.duration").HasCount(1).HasUnit("s")
+}
+
+func TestRunnerRetriesThenDeadLetter(t *testing.T) {
+	h, db, r := newTestRunner(t, jobs.Config{MaxAttempts: 3, RetryDelay: noDelay})
+
+	var calls atomic.Int32
+	r.Register("test.fail", func(ctx context.Context, job jobs.Job) error {
+		calls.Add(1)
+		return errors.New("boom")
+	})
+	stop := start(t, r)
+
+	if _, err := r.Enqueue(context.Background(), "test.fail", nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return calls.Load() == 3 })
+	stop()
+
+	var job entity.Job
+	if err := db.First(&job).Error; err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != entity.JobDead || job.Attempts != 3 || job.LastError != "boom" {
+		t.Fatalf("unexpected job: %+v", job)
+	}
+
+	runs := h.Spans().Named("jobs run test.fail").Len(3).Each()
+	runs[0].HasAttr("job.result", "retry").HasAttr("job.attempt", 1).HasError()
+	runs[1].HasAttr("job.result", "retry").HasAttr("job.attempt", 2).HasError()
+	runs[2].HasAttr("job.result", "dead").HasAttr("job.attempt", 3).HasError()
+	h.Metric("jobs.executions").
+		WithAttrs(attribute.String("job.type", "test.fail"), attribute.String("job.result", "retry")).
+		HasValue(2)
+	h.Logs().Containing("dead letter").Len(1)
+}
+
+func TestRunnerPermanentErrorIsNotRetried(t *testing.T) {
+	_, db, r := newTestRunner(t, jobs.Config{MaxAttempts: 5, RetryDelay: noDelay})
+
+	var calls atomic.Int32
+	r.Register("test.invalid", func(ctx context.Context, job jobs.Job) error {
+		calls.Add(1)
+		var payload struct{ ID int }
+		return job.Decode(&payload)
+	})
+	stop := start(t, r)
+
+	if _, err := r.Enqueue(context.Background(), "test.invalid", "not an object"); err != nil {
+		t.Fatal(err)
+	}
+	// 登録されていない種類のジョブも再試行しない
+	if _, err := r.Enqueue(context.Background(), "test.unknown", nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		var n int64
+		db.Model(&entity.Job{}).Where("status = ?", entity.JobDead).Count(&n)
+		return n == 2
+	})
+	stop()
+
+	if calls.Load() != 1 {
+		t.Fatalf("calls = %d, want 1", calls.Load())
+	}
+}
+
+func TestRunnerConcurrency(t *testing.T) {
+	_, _, r := newTestRunner(t, jobs.Config{Concurrency: 2})
+
+	var running, peak, done atomic.Int32
+	r.Register("test.slow", func(ctx context.Context, job jobs.Job) error {
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		running.Add(-1)
+		done.Add(1)
+		return nil
+	})
+	stop := start(t, r)
+
+	for range 6 {
+		if _, err := r.Enqueue(context.Background(), "test.slow", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool { return done.Load() == 6 })
+	stop()
+
+	if peak.Load() != 2 {
+		t.Fatalf("peak concurrency = %d, want 2", peak.Load())
+	}
+}
+
+func TestRunnerShutdownWaitsForRunningJobs(t *testing.T) {
+	_, db, r := newTestRunner(t, jobs.Config{})
+
+	started := make(chan struct{})
+	r.Register("test.wait", func(ctx context.Context, job jobs.Job) error {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	})
+	stop := start(t, r)
+
+	if _, err := r.Enqueue(context.Background(), "test.wait", nil); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	stop()
+
+	var job entity.Job
+	if err := db.First(&job).Error; err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != entity.JobSucceeded {
+		t.Fatalf("status = %q, want %q", job.Status, entity.JobSucceeded)
+	}
+}
+
+func TestRunnerShutdownTimeoutCancelsJobs(t *testing.T) {
+	_, db, r := newTestRunner(t, jobs.Config{RetryDelay: noDelay})
+
+	started := make(chan struct{})
+	r.Register("test.block", func(ctx context.Context, job jobs.Job) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	errCh := make(chan error, 1)
+	go func() { errCh <- r.Start(context.Background()) }()
+
+	if _, err := r.Enqueue(context.Background(), "test.block", nil); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := r.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("shutdown error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	// キャンセルされたジョブは再実行のためキューに戻る
+	var job entity.Job
+	if err := db.First(&job).Error; err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != entity.JobQueued || job.LockedBy != "" {
+		t.Fatalf("unexpected job: %+v", job)
+	}
+}
+
+func TestRunnerReclaimsExpiredLease(t *testing.T) {
+	_, db, r := newTestRunner(t, jobs.Config{})
+
+	var attempt atomic.Int32
+	r.Register("test.reclaim", func(ctx context.Context, job jobs.Job) error {
+		attempt.Store(int32(job.Attempt))
+		return nil
+	})
+
+	store := repository.NewJobRepository(db)
+	if _, err := r.Enqueue(context.Background(), "test.reclaim", nil); err != nil {
+		t.Fatal(err)
+	}
+	// 停止したワーカーがジョブを取得したままロックの期限が切れた状態
+	claimed, err := store.Claim(context.Background(), "crashed", time.Now(), 1, time.Millisecond)
+	if err != nil || len(claimed) != 1 {
+		t.Fatalf("claimed = %v, err = %v", claimed, err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	stop := start(t, r)
+	waitFor(t, func() bool { return attempt.Load() != 0 })
+	stop()
+
+	if attempt.Load() != 2 {
+		t.Fatalf("attempt = %d, want 2", attempt.Load())
+	}
+	// 期限が切れたワーカーは結果を記録できない
+	if err := store.Complete(context.Background(), claimed[0]); !errors.Is(err, jobs.ErrLeaseLost) {
+		t.Fatalf("complete error = %v, want %v", err, jobs.ErrLeaseLost)
+	}
+}
+
+func TestRunnerScheduleRunsOncePerTick(t *testing.T) {
+	store := repository.NewJobRepository(databasetest.New(t, &entity.Job{}))
+
+	var mu sync.Mutex
+	seen := map[string]int{}
+	handler := func(ctx context.Context, job jobs.Job) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[job.UniqueKey]++
+		return nil
+	}
+
+	// 同じスケジュールを持つ2つのインスタンス
+	for range 2 {
+		r := jobs.NewRunner(store, jobs.Config{PollInterval: 10 * time.Millisecond})
+		r.Register("test.tick", handler)
+		if err := r.Schedule("tick", "@every 50ms", "test.tick", nil); err != nil {
+			t.Fatal(err)
+		}
+		start(t, r)
+	}
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(seen) >= 3
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	for key, n := range seen {
+		if n != 1 {
+			t.Errorf("%s ran %d times, want 1", key, n)
+		}
+	}
+}
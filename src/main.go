@@ -2,19 +2,27 @@ package main
 
 import (
 	"context"
-	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
+	"otel-test/audit"
+	"otel-test/cache"
 	"otel-test/database"
 	"otel-test/env"
+	"otel-test/events"
+	"otel-test/http/compress"
+	"otel-test/idempotency"
+	"otel-test/jobs"
 	"otel-test/o11y"
 	"otel-test/server"
 	"otel-test/server/entity"
 	"otel-test/server/repository"
 	"otel-test/server/service"
+	"otel-test/shutdown"
+	"otel-test/tenant"
+	"otel-test/webhook"
 	"syscall"
-	"time"
 )
 
 func main() {
@@ -29,51 +37,252 @@ func main() {
 		os.Exit(1)
 	}
 
+	// シグナルによるログレベルの変更 (SIGUSR1/SIGUSR2)
+	o11y.WatchLogLevelSignals(ctx)
+
 	// データベース接続
-	db, err := database.NewCloudSQLDB()
+	db, err := database.NewCloudSQLDB(ctx)
 	if err != nil {
 		slog.ErrorContext(ctx, "failed to connect to database", slog.Any("error", err))
 		os.Exit(1)
 	}
-	defer db.Close()
 
 	// マイグレーション
-	if err := db.AutoMigrate(&entity.User{}); err != nil {
+	if err := db.AutoMigrate(
+		&entity.User{},
+		&entity.OutboxEvent{},
+		&entity.WebhookSubscription{},
+		&entity.WebhookDelivery{},
+		&entity.WebhookAttempt{},
+		&entity.Job{},
+		&entity.IdempotencyKey{},
+		&entity.AuditLog{},
+		&entity.Hoge{},
+	); err != nil {
 		slog.ErrorContext(ctx, "failed to migrate database", slog.Any("error", err))
 		os.Exit(1)
 	}
+	// メールアドレスの一意制約をテナントごと・論理削除していないユーザーに変更したため、以前のインデックスを削除する
+	for _, index := range []string{"idx_users_email", "idx_users_tenant_email"} {
+		if !db.Migrator().HasIndex(&entity.User{}, index) {
+			continue
+		}
+		if err := db.Migrator().DropIndex(&entity.User{}, index); err != nil {
+			slog.ErrorContext(ctx, "failed to migrate database", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}
 
 	// リポジトリとサービスの初期化
-	userRepo := repository.NewUserRepository(db)
-	userService := service.NewUserService(userRepo)
+	cacheConfig := env.GetCacheConfigFromEnv()
+	userRepo, err := newUserStore(db, cacheConfig)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to create user store", slog.Any("error", err))
+		os.Exit(1)
+	}
+	outboxRepo := repository.NewOutboxRepository(db)
+	userService := service.NewUserService(db, userRepo, outboxRepo, repository.NewAuditRepository(db))
+	webhookConfig := env.GetWebhookConfigFromEnv()
+	webhookService := service.NewWebhookService(repository.NewWebhookRepository(db), service.WebhookConfig{
+		MaxAttempts: webhookConfig.MaxAttempts,
+		Backoff:     webhook.Backoff{Base: webhookConfig.BackoffBase, Max: webhookConfig.BackoffMax},
+		Timeout:     webhookConfig.Timeout,
+		Interval:    webhookConfig.Interval,
+		Lease:       webhookConfig.Lease,
+	})
+
+	// バックグラウンドジョブ
+	jobsConfig := env.GetJobsConfigFromEnv()
+	jobRunner := jobs.NewRunner(repository.NewJobRepository(db), jobs.Config{
+		Concurrency:  jobsConfig.Concurrency,
+		PollInterval: jobsConfig.PollInterval,
+		Lease:        jobsConfig.Lease,
+		MaxAttempts:  jobsConfig.MaxAttempts,
+		RetryDelay:   webhook.Backoff{Base: jobsConfig.BackoffBase, Max: jobsConfig.BackoffMax}.Delay,
+	})
+	jobRunner.Register(service.JobPurgeDeletedUsers, userService.PurgeDeletedUsersJob(jobsConfig.PurgeRetention))
+	if jobsConfig.PurgeSchedule != "" {
+		if err := jobRunner.Schedule("purge-deleted-users", jobsConfig.PurgeSchedule, service.JobPurgeDeletedUsers, nil); err != nil {
+			slog.ErrorContext(ctx, "failed to schedule job", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}
+
+	// POSTの再送で同じ処理を繰り返さないようIdempotency-Keyとレスポンスを保存する
+	idempotencyConfig := env.GetIdempotencyConfigFromEnv()
+	idempotencyRepo := repository.NewIdempotencyRepository(db)
+	jobRunner.Register(idempotency.JobPurgeExpired, idempotency.PurgeExpiredJob(idempotencyRepo))
+	if idempotencyConfig.PurgeSchedule != "" {
+		if err := jobRunner.Schedule("purge-idempotency-keys", idempotencyConfig.PurgeSchedule, idempotency.JobPurgeExpired, nil); err != nil {
+			slog.ErrorContext(ctx, "failed to schedule job", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}
+
+	// Graceful Shutdown用の状態
+	readiness := shutdown.NewReadiness()
+	inFlight := shutdown.NewTracker()
+	background := shutdown.NewTracker()
+
+	// アウトボックスのイベントを送信するリレー
+	outboxConfig := env.GetOutboxConfigFromEnv()
+	bus := events.NewBus()
+	bus.Subscribe("*", logEvent)
+	bus.Subscribe("*", webhookService.Enqueue)
+	sinks, closeSinks, err := newEventSinks(outboxConfig, bus)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to create event sinks", slog.Any("error", err))
+		os.Exit(1)
+	}
+	relay := events.NewRelay(outboxRepo, events.RelayConfig{
+		Interval:    outboxConfig.Interval,
+		BatchSize:   outboxConfig.BatchSize,
+		MaxAttempts: outboxConfig.MaxAttempts,
+		Lease:       outboxConfig.Lease,
+	}, sinks...)
+	workerCtx, stopWorkers := context.WithCancel(ctx)
+	background.Go(func() { relay.Run(workerCtx) })
+	background.Go(func() { webhookService.Run(workerCtx) })
+	background.Go(func() { db.MonitorReplicas(workerCtx) })
 
 	// サーバー依存性の準備
+	tenantConfig := env.GetTenantConfigFromEnv()
+	compressionConfig := env.GetCompressionConfigFromEnv()
+	compression, err := compress.New(compress.Config{
+		Encodings: compressionConfig.Encodings,
+		MinSize:   compressionConfig.MinSize,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "invalid compression config", slog.Any("error", err))
+		os.Exit(1)
+	}
+	auditConfig := env.GetAuditConfigFromEnv()
+	trustedProxies, err := audit.ParseTrustedProxies(auditConfig.TrustedProxies)
+	if err != nil {
+		slog.ErrorContext(ctx, "invalid audit config", slog.Any("error", err))
+		os.Exit(1)
+	}
 	deps := &server.Dependencies{
-		UserService: userService,
+		UserService:    userService,
+		WebhookService: webhookService,
+		Readiness:      readiness,
+		InFlight:       inFlight,
+		Idempotency: idempotency.New(idempotencyRepo, idempotency.Config{
+			TTL:         idempotencyConfig.TTL,
+			LockTimeout: idempotencyConfig.LockTimeout,
+		}),
+		// 汎用のCRUDで公開するリソース
+		Resources: []server.ResourceRoutes{
+			server.NewResource("/hoges", service.NewHogeService(db)),
+		},
+		Tenants: tenant.NewResolver(tenant.Config{
+			Header:  tenantConfig.Header,
+			Domain:  tenantConfig.Domain,
+			Claim:   tenantConfig.Claim,
+			Default: tenantConfig.Default,
+			Allowed: tenantConfig.Allowed,
+		}),
+		Compression: compression,
+		Audit: audit.NewResolver(audit.Config{
+			IAPAudience:    auditConfig.IAPAudience,
+			TrustedProxies: trustedProxies,
+		}),
 	}
 
 	// サーバーの作成
 	httpServer := server.NewServer(mode, deps)
+	grpcServer := server.NewGRPCServer(env.GetGRPCAddrFromEnv(), mode, deps)
+	servers := []server.Server{httpServer, grpcServer, jobRunner}
+
+	shutdownConfig := env.GetShutdownConfigFromEnv()
+
+	// 管理用サーバーの作成（ADMIN_ADDRが設定されている場合のみ）
+	var adminServer server.Server
+	if addr := env.GetAdminAddrFromEnv(); addr != "" {
+		adminServer = server.NewAdminServer(addr, &server.AdminDependencies{
+			Routes: httpServer.Routes,
+			Config: map[string]any{
+				"mode":        mode,
+				"database":    db.Config(),
+				"shutdown":    shutdownConfig,
+				"log":         env.GetLogConfigFromEnv(),
+				"redact":      env.GetRedactConfigFromEnv(),
+				"outbox":      outboxConfig,
+				"webhook":     webhookConfig,
+				"jobs":        jobsConfig,
+				"cache":       cacheConfig,
+				"idempotency": idempotencyConfig,
+				"tenant":      tenantConfig,
+				"compression": compressionConfig,
+			},
+			DBStats: db.Stats,
+		})
+		servers = append(servers, adminServer)
+		slog.InfoContext(ctx, "admin server enabled", slog.String("addr", addr))
+	}
 
 	slog.InfoContext(ctx, "server starting...")
 
 	// サーバーの起動とGraceful Shutdown
-	if err := runWithGracefulShutdown(ctx, httpServer, otelShutdown); err != nil {
+	phases := map[string]func(context.Context) error{
+		// Not Ready（gRPCはNOT_SERVING）にしてロードバランサーから外す
+		env.PhaseReadiness: func(context.Context) error {
+			readiness.SetReady(false)
+			grpcServer.SetServing(false)
+			return nil
+		},
+		// ロードバランサーが変更を検知するまで待つ
+		env.PhasePreStop: func(ctx context.Context) error {
+			return shutdown.Sleep(ctx, shutdownConfig.PreStopDelay)
+		},
+		// 新規受付を停止
+		env.PhaseHTTP: httpServer.Shutdown,
+		env.PhaseGRPC: grpcServer.Shutdown,
+		// 実行中のリクエストの完了を待つ
+		env.PhaseInFlight: inFlight.Wait,
+		// 新しいジョブの取得を止め、実行中のジョブの完了を待つ
+		env.PhaseJobs: jobRunner.Shutdown,
+		// リレーとwebhookの配信を止めてバックグラウンド処理の完了を待つ
+		env.PhaseBackground: func(ctx context.Context) error {
+			stopWorkers()
+			if err := background.Wait(ctx); err != nil {
+				return err
+			}
+			return closeSinks()
+		},
+		// テレメトリのフラッシュ
+		env.PhaseTelemetry: otelShutdown,
+		// データベース接続のクローズ
+		env.PhaseDatabase: func(context.Context) error {
+			return db.Close()
+		},
+		// 管理用サーバーの停止
+		env.PhaseAdmin: func(ctx context.Context) error {
+			if adminServer == nil {
+				return nil
+			}
+			return adminServer.Shutdown(ctx)
+		},
+	}
+
+	if err := runWithGracefulShutdown(ctx, servers, shutdownConfig, phases); err != nil {
 		slog.ErrorContext(ctx, "server exited with error", slog.Any("error", err))
 		os.Exit(1)
 	}
 }
 
-func runWithGracefulShutdown(ctx context.Context, httpServer server.Server, otelShutdown func(context.Context) error) error {
+func runWithGracefulShutdown(ctx context.Context, servers []server.Server, config env.ShutdownConfig, phases map[string]func(context.Context) error) error {
 	// シグナルを受信するためのチャネル
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	// サーバーの起動
-	serverErrChan := make(chan error, 1)
-	go func() {
-		serverErrChan <- httpServer.Start(ctx)
-	}()
+	serverErrChan := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func() {
+			serverErrChan <- srv.Start(ctx)
+		}()
+	}
 
 	// シグナルまたはサーバーエラーを待機
 	select {
@@ -87,34 +296,91 @@ func runWithGracefulShutdown(ctx context.Context, httpServer server.Server, otel
 	}
 
 	// Graceful Shutdownの実行
-	return performGracefulShutdown(ctx, httpServer, otelShutdown)
+	return performGracefulShutdown(ctx, config, phases)
 }
 
-func performGracefulShutdown(ctx context.Context, httpServer server.Server, otelShutdown func(context.Context) error) error {
-	// シャットダウンのタイムアウト設定
-	shutdownCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
-
-	var shutdownErrors []error
+func performGracefulShutdown(ctx context.Context, config env.ShutdownConfig, phases map[string]func(context.Context) error) error {
+	// 設定された順序でフェーズを組み立てる
+	// テレメトリのフラッシュ以降のフェーズのスパンはエクスポートされないため、ログにのみ記録する
+	var ordered []shutdown.Phase
+	untraced := false
+	for _, name := range config.Order {
+		run, ok := phases[name]
+		if !ok {
+			slog.WarnContext(ctx, "unknown shutdown phase, skipping", slog.String("phase", name))
+			continue
+		}
+		untraced = untraced || name == env.PhaseTelemetry
+		ordered = append(ordered, shutdown.Phase{
+			Name:     name,
+			Timeout:  config.PhaseTimeout(name),
+			Run:      run,
+			Untraced: untraced,
+		})
+	}
 
-	// HTTPサーバーのシャットダウン
-	slog.InfoContext(shutdownCtx, "shutting down HTTP server...")
-	if err := httpServer.Shutdown(shutdownCtx); err != nil {
-		slog.ErrorContext(shutdownCtx, "HTTP server shutdown error", slog.Any("error", err))
-		shutdownErrors = append(shutdownErrors, err)
+	if err := shutdown.Run(ctx, config.Timeout, ordered); err != nil {
+		return err
 	}
 
-	// OpenTelemetryのシャットダウン
-	slog.InfoContext(shutdownCtx, "shutting down OpenTelemetry...")
-	if err := otelShutdown(shutdownCtx); err != nil {
-		slog.ErrorContext(shutdownCtx, "OpenTelemetry shutdown error", slog.Any("error", err))
-		shutdownErrors = append(shutdownErrors, err)
+	slog.InfoContext(ctx, "graceful shutdown completed")
+	return nil
+}
+
+// newUserStore は設定に応じてキャッシュでデコレートしたユーザーのストアを作成します
+func newUserStore(db *database.DB, cfg env.CacheConfig) (repository.UserStore, error) {
+	userRepo := repository.NewUserRepository(db)
+	var backend cache.Backend
+	switch cfg.Backend {
+	case env.CacheNone:
+		return userRepo, nil
+	case env.CacheMemory:
+		backend = cache.NewLRU("users", cfg.Size)
+	default:
+		return nil, fmt.Errorf("unknown cache backend: %s", cfg.Backend)
 	}
+	return repository.NewCachedUserRepository(userRepo, cache.New("users", backend, cache.Config{
+		TTL:         cfg.TTL,
+		NegativeTTL: cfg.NegativeTTL,
+	})), nil
+}
 
-	if len(shutdownErrors) > 0 {
-		return errors.Join(shutdownErrors...)
+// newEventSinks は設定からイベントの送信先を作成します
+func newEventSinks(cfg env.OutboxConfig, bus *events.Bus) ([]events.Sink, func() error, error) {
+	var sinks []events.Sink
+	closeSinks := func() error { return nil }
+	for _, name := range cfg.Sinks {
+		switch name {
+		case env.SinkBus:
+			sinks = append(sinks, bus)
+		case env.SinkWebhook:
+			if cfg.WebhookURL == "" {
+				return nil, nil, fmt.Errorf("OUTBOX_WEBHOOK_URL is required for the webhook sink")
+			}
+			sinks = append(sinks, events.NewWebhookSink(cfg.WebhookURL))
+		case env.SinkFile:
+			fileSink, err := events.NewFileSink(cfg.File)
+			if err != nil {
+				return nil, nil, err
+			}
+			sinks = append(sinks, fileSink)
+			closeSinks = fileSink.Close
+		default:
+			return nil, nil, fmt.Errorf("unknown event sink: %s", name)
+		}
 	}
+	return sinks, closeSinks, nil
+}
 
-	slog.InfoContext(shutdownCtx, "graceful shutdown completed")
+// logEvent はプロセス内のバスで受け取ったイベントをログに出力します
+// スパンはイベントを発生させたリクエストのスパンにリンクされる
+func logEvent(ctx context.Context, ev events.Event) error {
+	ctx, span := events.StartConsumerSpan(ctx, ev, "log "+ev.Type)
+	defer span.End()
+	o11y.Logger("events").InfoContext(ctx, "domain event",
+		slog.Uint64("event.id", ev.ID),
+		slog.String("event.type", ev.Type),
+		slog.Uint64("event.aggregate_id", uint64(ev.AggregateID)),
+	)
 	return nil
 }
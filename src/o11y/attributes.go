@@ -0,0 +1,249 @@
+package o11y
+
+import (
+	"context"
+	"log/slog"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+type attributesKey struct{}
+
+// contextAttributes はコンテキストに追加したテレメトリの属性
+type contextAttributes struct {
+	all    []attribute.KeyValue // スパンとログに付与する属性
+	metric []attribute.KeyValue // メトリクスにも付与する属性
+}
+
+// ContextWithAttributes はコンテキストにテレメトリの属性を追加します
+// 追加した属性は、そのコンテキストで開始したスパン、出力したログ、記録したメトリクスに付与される
+// （NewContextAttributesSpanProcessor, HandlerWithContextAttributes, MeterProviderWithContextAttributes）
+// 同じキーを追加した場合は後の値を使う
+func ContextWithAttributes(ctx context.Context, attrs ...attribute.KeyValue) context.Context {
+	prev := contextAttributesFrom(ctx)
+	return context.WithValue(ctx, attributesKey{}, contextAttributes{
+		all:    mergeAttributes(prev.all, attrs, nil),
+		metric: mergeAttributes(prev.metric, attrs, nil),
+	})
+}
+
+// ContextWithTraceAttributes はスパンとログにだけ付与する属性をコンテキストに追加します
+// リクエストで指定された値など、メトリクスの属性にすると種類が際限なく増える値に使う
+// 同じキーをContextWithAttributesで追加していた場合、メトリクスからは取り除く
+func ContextWithTraceAttributes(ctx context.Context, attrs ...attribute.KeyValue) context.Context {
+	prev := contextAttributesFrom(ctx)
+	return context.WithValue(ctx, attributesKey{}, contextAttributes{
+		all:    mergeAttributes(prev.all, attrs, nil),
+		metric: mergeAttributes(prev.metric, nil, attrs),
+	})
+}
+
+// AttributesFromContext はコンテキストに追加したスパンとログの属性を返します
+func AttributesFromContext(ctx context.Context) []attribute.KeyValue {
+	return contextAttributesFrom(ctx).all
+}
+
+func contextAttributesFrom(ctx context.Context) contextAttributes {
+	if ctx == nil {
+		return contextAttributes{}
+	}
+	attrs, _ := ctx.Value(attributesKey{}).(contextAttributes)
+	return attrs
+}
+
+// mergeAttributes はprevにattrsを追加し、removeと同じキーを取り除いた属性を返します
+func mergeAttributes(prev, attrs, remove []attribute.KeyValue) []attribute.KeyValue {
+	merged := make([]attribute.KeyValue, 0, len(prev)+len(attrs))
+	for _, a := range prev {
+		if !hasKey(remove, a.Key) {
+			merged = append(merged, a)
+		}
+	}
+	merged = append(merged, attrs...)
+	if len(merged) == 0 {
+		return nil
+	}
+	set := attribute.NewSet(merged...)
+	return set.ToSlice()
+}
+
+func hasKey(attrs []attribute.KeyValue, key attribute.Key) bool {
+	for _, a := range attrs {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// contextAttributesSpanProcessor は開始したスパンにコンテキストの属性を設定するSpanProcessor
+type contextAttributesSpanProcessor struct{}
+
+// NewContextAttributesSpanProcessor はスパンの開始時にコンテキストの属性を設定するSpanProcessorを作成します
+// GORMなどのライブラリが作成したスパンにも設定される
+func NewContextAttributesSpanProcessor() sdktrace.SpanProcessor {
+	return contextAttributesSpanProcessor{}
+}
+
+func (contextAttributesSpanProcessor) OnStart(ctx context.Context, s sdktrace.ReadWriteSpan) {
+	if attrs := AttributesFromContext(ctx); len(attrs) > 0 {
+		s.SetAttributes(attrs...)
+	}
+}
+
+func (contextAttributesSpanProcessor) OnEnd(sdktrace.ReadOnlySpan)      {}
+func (contextAttributesSpanProcessor) Shutdown(context.Context) error   { return nil }
+func (contextAttributesSpanProcessor) ForceFlush(context.Context) error { return nil }
+
+// contextAttributesHandler はコンテキストの属性をログに追加するslog.Handler
+type contextAttributesHandler struct {
+	slog.Handler
+}
+
+// HandlerWithContextAttributes はコンテキストの属性をログに追加するslog.Handlerを返します
+func HandlerWithContextAttributes(handler slog.Handler) slog.Handler {
+	return &contextAttributesHandler{Handler: handler}
+}
+
+func (h *contextAttributesHandler) Handle(ctx context.Context, record slog.Record) error {
+	for _, a := range AttributesFromContext(ctx) {
+		record.AddAttrs(slog.Any(string(a.Key), a.Value.AsInterface()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *contextAttributesHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextAttributesHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextAttributesHandler) WithGroup(name string) slog.Handler {
+	return &contextAttributesHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+// MeterProviderWithContextAttributes は同期的な計測器の記録時にコンテキストの属性を追加するMeterProviderを返します
+// ContextWithTraceAttributesで追加した属性は追加しない
+// 記録時に指定した属性と同じキーの場合は、記録時の値を使う
+// コンテキストのない非同期の計測器（Observable）には追加しない
+func MeterProviderWithContextAttributes(mp metric.MeterProvider) metric.MeterProvider {
+	return contextAttributesMeterProvider{MeterProvider: mp}
+}
+
+type contextAttributesMeterProvider struct {
+	metric.MeterProvider
+}
+
+func (p contextAttributesMeterProvider) Meter(name string, opts ...metric.MeterOption) metric.Meter {
+	return contextAttributesMeter{Meter: p.MeterProvider.Meter(name, opts...)}
+}
+
+type contextAttributesMeter struct {
+	metric.Meter
+}
+
+func (m contextAttributesMeter) Int64Counter(name string, opts ...metric.Int64CounterOption) (metric.Int64Counter, error) {
+	c, err := m.Meter.Int64Counter(name, opts...)
+	return int64Counter{c}, err
+}
+
+func (m contextAttributesMeter) Int64UpDownCounter(name string, opts ...metric.Int64UpDownCounterOption) (metric.Int64UpDownCounter, error) {
+	c, err := m.Meter.Int64UpDownCounter(name, opts...)
+	return int64UpDownCounter{c}, err
+}
+
+func (m contextAttributesMeter) Int64Histogram(name string, opts ...metric.Int64HistogramOption) (metric.Int64Histogram, error) {
+	h, err := m.Meter.Int64Histogram(name, opts...)
+	return int64Histogram{h}, err
+}
+
+func (m contextAttributesMeter) Int64Gauge(name string, opts ...metric.Int64GaugeOption) (metric.Int64Gauge, error) {
+	g, err := m.Meter.Int64Gauge(name, opts...)
+	return int64Gauge{g}, err
+}
+
+func (m contextAttributesMeter) Float64Counter(name string, opts ...metric.Float64CounterOption) (metric.Float64Counter, error) {
+	c, err := m.Meter.Float64Counter(name, opts...)
+	return float64Counter{c}, err
+}
+
+func (m contextAttributesMeter) Float64UpDownCounter(name string, opts ...metric.Float64UpDownCounterOption) (metric.Float64UpDownCounter, error) {
+	c, err := m.Meter.Float64UpDownCounter(name, opts...)
+	return float64UpDownCounter{c}, err
+}
+
+func (m contextAttributesMeter) Float64Histogram(name string, opts ...metric.Float64HistogramOption) (metric.Float64Histogram, error) {
+	h, err := m.Meter.Float64Histogram(name, opts...)
+	return float64Histogram{h}, err
+}
+
+func (m contextAttributesMeter) Float64Gauge(name string, opts ...metric.Float64GaugeOption) (metric.Float64Gauge, error) {
+	g, err := m.Meter.Float64Gauge(name, opts...)
+	return float64Gauge{g}, err
+}
+
+// addOptions はコンテキストの属性をoptsの前に追加します（同じキーはoptsの値を使う）
+func addOptions(ctx context.Context, opts []metric.AddOption) []metric.AddOption {
+	attrs := contextAttributesFrom(ctx).metric
+	if len(attrs) == 0 {
+		return opts
+	}
+	return append([]metric.AddOption{metric.WithAttributes(attrs...)}, opts...)
+}
+
+// recordOptions はコンテキストの属性をoptsの前に追加します（同じキーはoptsの値を使う）
+func recordOptions(ctx context.Context, opts []metric.RecordOption) []metric.RecordOption {
+	attrs := contextAttributesFrom(ctx).metric
+	if len(attrs) == 0 {
+		return opts
+	}
+	return append([]metric.RecordOption{metric.WithAttributes(attrs...)}, opts...)
+}
+
+type int64Counter struct{ metric.Int64Counter }
+
+func (c int64Counter) Add(ctx context.Context, v int64, opts ...metric.AddOption) {
+	c.Int64Counter.Add(ctx, v, addOptions(ctx, opts)...)
+}
+
+type int64UpDownCounter struct{ metric.Int64UpDownCounter }
+
+func (c int64UpDownCounter) Add(ctx context.Context, v int64, opts ...metric.AddOption) {
+	c.Int64UpDownCounter.Add(ctx, v, addOptions(ctx, opts)...)
+}
+
+type int64Histogram struct{ metric.Int64Histogram }
+
+func (h int64Histogram) Record(ctx context.Context, v int64, opts ...metric.RecordOption) {
+	h.Int64Histogram.Record(ctx, v, recordOptions(ctx, opts)...)
+}
+
+type int64Gauge struct{ metric.Int64Gauge }
+
+func (g int64Gauge) Record(ctx context.Context, v int64, opts ...metric.RecordOption) {
+	g.Int64Gauge.Record(ctx, v, recordOptions(ctx, opts)...)
+}
+
+type float64Counter struct{ metric.Float64Counter }
+
+func (c float64Counter) Add(ctx context.Context, v float64, opts ...metric.AddOption) {
+	c.Float64Counter.Add(ctx, v, addOptions(ctx, opts)...)
+}
+
+type float64UpDownCounter struct{ metric.Float64UpDownCounter }
+
+func (c float64UpDownCounter) Add(ctx context.Context, v float64, opts ...metric.AddOption) {
+	c.Float64UpDownCounter.Add(ctx, v, addOptions(ctx, opts)...)
+}
+
+type float64Histogram struct{ metric.Float64Histogram }
+
+func (h float64Histogram) Record(ctx context.Context, v float64, opts ...metric.RecordOption) {
+	h.Float64Histogram.Record(ctx, v, recordOptions(ctx, opts)...)
+}
+
+type float64Gauge struct{ metric.Float64Gauge }
+
+func (g float64Gauge) Record(ctx context.Context, v float64, opts ...metric.RecordOption) {
+	g.Float64Gauge.Record(ctx, v, recordOptions(ctx, opts)...)
+}
@@ -0,0 +1,134 @@
+package o11y
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Cloud Loggingの特殊フィールド
+// https://cloud.google.com/logging/docs/structured-logging#special-payload-fields
+const (
+	traceKey          = "logging.googleapis.com/trace"
+	spanIDKey         = "logging.googleapis.com/spanId"
+	traceSampledKey   = "logging.googleapis.com/trace_sampled"
+	sourceLocationKey = "logging.googleapis.com/sourceLocation"
+	labelsKey         = "logging.googleapis.com/labels"
+	operationKey      = "logging.googleapis.com/operation"
+	httpRequestKey    = "httpRequest"
+)
+
+// Cloud LoggingのLogSeverityに対応する追加のログレベル
+// https://cloud.google.com/logging/docs/reference/v2/rest/v2/LogEntry#LogSeverity
+const (
+	LevelNotice    = slog.Level(2)
+	LevelCritical  = slog.Level(12)
+	LevelAlert     = slog.Level(16)
+	LevelEmergency = slog.Level(20)
+)
+
+// severity はslog.LevelをCloud LoggingのLogSeverityに変換する
+// 間のレベルは直下のLogSeverityに丸める
+func severity(level slog.Level) string {
+	switch {
+	case level < slog.LevelInfo:
+		return "DEBUG"
+	case level < LevelNotice:
+		return "INFO"
+	case level < slog.LevelWarn:
+		return "NOTICE"
+	case level < slog.LevelError:
+		return "WARNING"
+	case level < LevelCritical:
+		return "ERROR"
+	case level < LevelAlert:
+		return "CRITICAL"
+	case level < LevelEmergency:
+		return "ALERT"
+	default:
+		return "EMERGENCY"
+	}
+}
+
+// HTTPRequest はCloud LoggingのHttpRequestに対応する
+// slog.Any(HTTPRequestKey, req) で出力するとリクエストログとして表示される
+// https://cloud.google.com/logging/docs/reference/v2/rest/v2/LogEntry#HttpRequest
+type HTTPRequest struct {
+	RequestMethod string
+	RequestURL    string
+	RequestSize   int64
+	Status        int
+	ResponseSize  int64
+	UserAgent     string
+	RemoteIP      string
+	ServerIP      string
+	Referer       string
+	Latency       time.Duration
+	Protocol      string
+}
+
+// LogValue implements slog.LogValuer.
+func (r HTTPRequest) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("requestMethod", r.RequestMethod),
+		slog.String("requestUrl", r.RequestURL),
+		slog.Int("status", r.Status),
+		slog.String("responseSize", strconv.FormatInt(r.ResponseSize, 10)),
+		slog.String("latency", fmt.Sprintf("%.9fs", r.Latency.Seconds())),
+	}
+	if r.RequestSize > 0 {
+		attrs = append(attrs, slog.String("requestSize", strconv.FormatInt(r.RequestSize, 10)))
+	}
+	optional := []struct{ key, value string }{
+		{"userAgent", r.UserAgent},
+		{"remoteIp", r.RemoteIP},
+		{"serverIp", r.ServerIP},
+		{"referer", r.Referer},
+		{"protocol", r.Protocol},
+	}
+	for _, o := range optional {
+		if o.value != "" {
+			attrs = append(attrs, slog.String(o.key, o.value))
+		}
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// HTTPRequestAttr はhttpRequestフィールドの属性を返します
+func HTTPRequestAttr(r HTTPRequest) slog.Attr {
+	return slog.Any(httpRequestKey, r)
+}
+
+// Labels はlabelsフィールドの属性を返します
+func Labels(labels map[string]string) slog.Attr {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]any, 0, len(labels))
+	for _, k := range keys {
+		attrs = append(attrs, slog.String(k, labels[k]))
+	}
+	return slog.Group(labelsKey, attrs...)
+}
+
+// Operation はoperationフィールドの属性を返します
+// 同じidのログはCloud Loggingで1つの操作としてまとめて表示される
+// https://cloud.google.com/logging/docs/reference/v2/rest/v2/LogEntry#LogEntryOperation
+func Operation(id, producer string, first, last bool) slog.Attr {
+	attrs := []any{
+		slog.String("id", id),
+		slog.String("producer", producer),
+	}
+	if first {
+		attrs = append(attrs, slog.Bool("first", true))
+	}
+	if last {
+		attrs = append(attrs, slog.Bool("last", true))
+	}
+	return slog.Group(operationKey, attrs...)
+}
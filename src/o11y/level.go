@@ -0,0 +1,199 @@
+package o11y
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"otel-test/env"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// LoggerKey はロガー名の属性キー（ロガー名ごとのログレベルに使用する）
+	LoggerKey = "logger"
+
+	// DebugLogHeader はリクエスト単位でデバッグログを有効にするヘッダー
+	DebugLogHeader = "X-Debug-Log"
+	// DebugLogBaggageKey はトレース単位でデバッグログを有効にするbaggageのキー
+	DebugLogBaggageKey = "log.debug"
+)
+
+var (
+	// logLevel は全体のログレベル
+	logLevel = new(slog.LevelVar)
+
+	// loggerLevels はロガー名ごとのログレベル
+	loggerLevelsMu sync.RWMutex
+	loggerLevels   = map[string]slog.Level{}
+)
+
+// configureLogLevel は設定からログレベルを初期化する
+func configureLogLevel(cfg env.LogConfig) error {
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(level)
+
+	for name, l := range cfg.Overrides {
+		level, err := ParseLevel(l)
+		if err != nil {
+			return fmt.Errorf("logger %s: %w", name, err)
+		}
+		SetLoggerLevel(name, level)
+	}
+	return nil
+}
+
+// ParseLevel はログレベルの文字列を解析する
+// debug/info/warn/errorのほか、数値も指定できる
+func ParseLevel(s string) (slog.Level, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.Atoi(s); err == nil {
+		return slog.Level(n), nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", s)
+	}
+	return level, nil
+}
+
+// LogLevel は全体のログレベルを返します
+func LogLevel() slog.Level {
+	return logLevel.Level()
+}
+
+// SetLogLevel は全体のログレベルを変更します
+func SetLogLevel(level slog.Level) {
+	logLevel.Set(level)
+}
+
+// SetLoggerLevel はロガー名ごとのログレベルを設定します
+func SetLoggerLevel(name string, level slog.Level) {
+	loggerLevelsMu.Lock()
+	defer loggerLevelsMu.Unlock()
+	loggerLevels[name] = level
+}
+
+// ClearLoggerLevel はロガー名ごとのログレベルを解除します
+func ClearLoggerLevel(name string) {
+	loggerLevelsMu.Lock()
+	defer loggerLevelsMu.Unlock()
+	delete(loggerLevels, name)
+}
+
+// LoggerLevels はロガー名ごとのログレベルの一覧を返します
+func LoggerLevels() map[string]slog.Level {
+	loggerLevelsMu.RLock()
+	defer loggerLevelsMu.RUnlock()
+	levels := make(map[string]slog.Level, len(loggerLevels))
+	for name, level := range loggerLevels {
+		levels[name] = level
+	}
+	return levels
+}
+
+// levelFor はロガー名に対するログレベルを返す
+func levelFor(name string) slog.Level {
+	if name != "" {
+		loggerLevelsMu.RLock()
+		level, ok := loggerLevels[name]
+		loggerLevelsMu.RUnlock()
+		if ok {
+			return level
+		}
+	}
+	return logLevel.Level()
+}
+
+// Logger は名前付きのロガーを返します
+// LOG_LEVEL_OVERRIDESや管理用エンドポイントで名前ごとにログレベルを変更できる
+func Logger(name string) *slog.Logger {
+	return slog.Default().With(slog.String(LoggerKey, name))
+}
+
+// minLevel はベースのハンドラーに設定するレベル（フィルタリングはlevelHandlerで行う）
+const minLevel = slog.Level(math.MinInt)
+
+// levelHandler はログレベルでフィルタリングするslog.Handler
+// ロガー名ごとのログレベルとトレース単位のデバッグログを考慮する
+type levelHandler struct {
+	slog.Handler
+	name string
+}
+
+func handlerWithLevel(handler slog.Handler) *levelHandler {
+	return &levelHandler{Handler: handler}
+}
+
+// Enabled overrides slog.Handler's Enabled method.
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if debugLogEnabled(ctx) {
+		return true
+	}
+	return level >= levelFor(h.name)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	name := h.name
+	for _, a := range attrs {
+		if a.Key == LoggerKey {
+			name = a.Value.String()
+		}
+	}
+	return &levelHandler{Handler: h.Handler.WithAttrs(attrs), name: name}
+}
+
+func (h *levelHandler) WithGroup(group string) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithGroup(group), name: h.name}
+}
+
+type debugLogKey struct{}
+
+// WithDebugLogging はコンテキストに対してデバッグログを有効にします
+func WithDebugLogging(ctx context.Context) context.Context {
+	return context.WithValue(ctx, debugLogKey{}, true)
+}
+
+// debugLogEnabled はコンテキストでデバッグログが有効かどうかを返す
+// baggageのlog.debugはクライアントが自由に設定できるため、DebugLogMiddlewareで確認した場合のみ有効にする
+func debugLogEnabled(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	enabled, _ := ctx.Value(debugLogKey{}).(bool)
+	return enabled
+}
+
+// DebugLogMiddleware はX-Debug-Logヘッダーが指定されたリクエストでデバッグログを有効にするミドルウェア
+// baggageのlog.debugが指定された場合は、baggageを伝播した後続のサービスも含めてトレース全体で有効になる
+// 誰でもログの量を増やせないよう、trustedがtrueを返すリクエスト（信頼するプロキシからなど）の指定だけを使用する
+func DebugLogMiddleware(trusted func(r *http.Request) bool) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			requested := isTrue(r.Header.Get(DebugLogHeader)) ||
+				isTrue(baggage.FromContext(ctx).Member(DebugLogBaggageKey).Value())
+			if requested && trusted(r) {
+				ctx = WithDebugLogging(ctx)
+				trace.SpanFromContext(ctx).SetAttributes(attribute.Bool(DebugLogBaggageKey, true))
+				r = r.WithContext(ctx)
+			}
+			next(w, r)
+		}
+	}
+}
+
+func isTrue(s string) bool {
+	b, err := strconv.ParseBool(s)
+	return err == nil && b
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package o11y
+
+import "context"
+
+// WatchLogLevelSignals はSIGUSR1/SIGUSR2がないプラットフォームでは何もしない
+func WatchLogLevelSignals(ctx context.Context) {}
@@ -0,0 +1,43 @@
+//go:build unix
+
+package o11y
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// levelStep はシグナル1回あたりのログレベルの変化量
+const levelStep = slog.LevelInfo - slog.LevelDebug
+
+// WatchLogLevelSignals はシグナルでログレベルを変更します
+// SIGUSR1で1段階詳細に（Info→Debug）、SIGUSR2で1段階簡潔に（Info→Warn）する
+func WatchLogLevelSignals(ctx context.Context) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		defer signal.Stop(sigChan)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-sigChan:
+				level := LogLevel()
+				switch sig {
+				case syscall.SIGUSR1:
+					level = max(level-levelStep, slog.LevelDebug)
+				case syscall.SIGUSR2:
+					level = min(level+levelStep, slog.LevelError)
+				}
+				SetLogLevel(level)
+				slog.WarnContext(ctx, "log level changed by signal",
+					slog.String("signal", sig.String()),
+					slog.String("level", level.String()))
+			}
+		}
+	}()
+}
@@ -0,0 +1,48 @@
+//go:build unix
+
+package o11y
+
+import (
+	"context"
+	"log/slog"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWatchLogLevelSignals(t *testing.T) {
+	resetLogLevels(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	WatchLogLevelSignals(ctx)
+
+	steps := []struct {
+		from slog.Level
+		sig  syscall.Signal
+		want slog.Level
+	}{
+		{slog.LevelInfo, syscall.SIGUSR1, slog.LevelDebug},
+		{slog.LevelWarn, syscall.SIGUSR2, slog.LevelError},
+		// Debugより詳細に、Errorより簡潔にはしない
+		{slog.LevelDebug + 1, syscall.SIGUSR1, slog.LevelDebug},
+		{slog.LevelError - 1, syscall.SIGUSR2, slog.LevelError},
+	}
+	for _, step := range steps {
+		SetLogLevel(step.from)
+		if err := syscall.Kill(syscall.Getpid(), step.sig); err != nil {
+			t.Fatal(err)
+		}
+		waitForLevel(t, step.want)
+	}
+}
+
+func waitForLevel(t *testing.T, want slog.Level) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for LogLevel() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("level = %v, want %v", LogLevel(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,156 @@
+package o11y
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"otel-test/env"
+
+	"go.opentelemetry.io/otel/baggage"
+)
+
+// resetLogLevels はテスト終了時にログレベルを元に戻します
+func resetLogLevels(t *testing.T) {
+	t.Helper()
+	level := LogLevel()
+	overrides := LoggerLevels()
+	t.Cleanup(func() {
+		SetLogLevel(level)
+		for name := range LoggerLevels() {
+			ClearLoggerLevel(name)
+		}
+		for name, level := range overrides {
+			SetLoggerLevel(name, level)
+		}
+	})
+}
+
+// newLevelLogger はlevelHandlerでフィルタリングしたログをbufに出力するロガーを返します
+func newLevelLogger(buf *bytes.Buffer) *slog.Logger {
+	return slog.New(handlerWithLevel(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: minLevel})))
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		in   string
+		want slog.Level
+	}{
+		{"debug", slog.LevelDebug},
+		{" WARN ", slog.LevelWarn},
+		{"info+2", slog.LevelInfo + 2},
+		{"-8", slog.Level(-8)},
+	}
+	for _, tt := range tests {
+		if got, err := ParseLevel(tt.in); err != nil || got != tt.want {
+			t.Errorf("ParseLevel(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("ParseLevel(verbose) expected error")
+	}
+}
+
+func TestLoggerLevelOverrides(t *testing.T) {
+	resetLogLevels(t)
+	err := configureLogLevel(env.LogConfig{
+		Level:     "warn",
+		Overrides: map[string]string{"database": "debug", "Jobs": "error"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	logger := newLevelLogger(&buf)
+	ctx := context.Background()
+	logger.With(LoggerKey, "database").DebugContext(ctx, "database debug")
+	logger.With(LoggerKey, "access").InfoContext(ctx, "access info")
+	logger.With(LoggerKey, "access").WarnContext(ctx, "access warn")
+	// ロガー名は大文字・小文字を区別する
+	logger.With(LoggerKey, "Jobs").WarnContext(ctx, "Jobs warn")
+	logger.With(LoggerKey, "jobs").WarnContext(ctx, "jobs warn")
+	// グループの中でもロガー名を引き継ぐ
+	logger.With(LoggerKey, "database").WithGroup("query").DebugContext(ctx, "database group debug")
+
+	got := buf.String()
+	for _, want := range []string{"database debug", "access warn", "jobs warn", "database group debug"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("log does not contain %q:\n%s", want, got)
+		}
+	}
+	for _, unwanted := range []string{"access info", "Jobs warn"} {
+		if strings.Contains(got, unwanted) {
+			t.Errorf("log contains %q:\n%s", unwanted, got)
+		}
+	}
+
+	// 解除すると全体のログレベルに戻る
+	ClearLoggerLevel("database")
+	buf.Reset()
+	logger.With(LoggerKey, "database").DebugContext(ctx, "database debug")
+	if buf.Len() != 0 {
+		t.Errorf("log after ClearLoggerLevel:\n%s", buf.String())
+	}
+	if _, ok := LoggerLevels()["database"]; ok {
+		t.Error("LoggerLevels contains cleared logger")
+	}
+
+	if err := configureLogLevel(env.LogConfig{Level: "info", Overrides: map[string]string{"database": "loud"}}); err == nil {
+		t.Error("configureLogLevel expected error for invalid override")
+	}
+}
+
+func TestDebugLogMiddleware(t *testing.T) {
+	resetLogLevels(t)
+	SetLogLevel(slog.LevelInfo)
+	member, _ := baggage.NewMember(DebugLogBaggageKey, "true")
+	bag, _ := baggage.New(member)
+
+	tests := []struct {
+		name    string
+		header  string
+		baggage bool
+		trusted bool
+		want    bool
+	}{
+		{"no request", "", false, true, false},
+		{"header", "true", false, true, true},
+		{"baggage", "", true, true, true},
+		{"invalid header", "yes", false, true, false},
+		// 信頼しない接続元からの指定は無視する
+		{"untrusted header", "true", false, false, false},
+		{"untrusted baggage", "", true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := newLevelLogger(&buf)
+			handler := DebugLogMiddleware(func(*http.Request) bool { return tt.trusted })(func(w http.ResponseWriter, r *http.Request) {
+				logger.DebugContext(r.Context(), "debug")
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/users", nil)
+			if tt.header != "" {
+				req.Header.Set(DebugLogHeader, tt.header)
+			}
+			if tt.baggage {
+				req = req.WithContext(baggage.ContextWithBaggage(req.Context(), bag))
+			}
+			handler(httptest.NewRecorder(), req)
+
+			if got := buf.Len() > 0; got != tt.want {
+				t.Fatalf("debug log written = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// ミドルウェアを通らないコンテキストではbaggageだけではデバッグログを有効にしない
+	if debugLogEnabled(baggage.ContextWithBaggage(context.Background(), bag)) {
+		t.Error("baggage enabled debug logging without DebugLogMiddleware")
+	}
+}
@@ -2,28 +2,55 @@ package o11y
 
 import (
 	"context"
+	"io"
 	"log/slog"
 	"os"
+	"otel-test/env"
+	"strconv"
 
 	"go.opentelemetry.io/otel/trace"
 )
 
-func setupLogging() {
-	jsonHandler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{ReplaceAttr: replacer})
+func setupLogging(cfg env.LogConfig, policy *RedactPolicy) error {
+	if err := configureLogLevel(cfg); err != nil {
+		return err
+	}
+
+	slog.SetDefault(slog.New(newGCPHandler(os.Stdout, env.GetGCPProjectFromEnv(), policy)))
+	return nil
+}
+
+// newGCPHandler はCloud Loggingの構造化ログ形式で出力するslog.Handlerを作成する
+// projectIDが空の場合、traceフィールドはプレフィックスなしのトレースIDになる
+// policyがnilの場合は属性をマスキングしない
+func newGCPHandler(w io.Writer, projectID string, policy *RedactPolicy) slog.Handler {
+	// レベルによるフィルタリングはlevelHandlerで行う
+	var handler slog.Handler = slog.NewJSONHandler(w, &slog.HandlerOptions{
+		AddSource:   true,
+		Level:       minLevel,
+		ReplaceAttr: replacer,
+	})
 
-	instrumentedHandler := handlerWithSpanContext(jsonHandler)
+	if policy != nil {
+		handler = handlerWithRedaction(handler, policy)
+	}
+	// テナントなどコンテキストの属性を追加する（マスキングの対象にする）
+	handler = HandlerWithContextAttributes(handler)
+
+	instrumentedHandler := handlerWithSpanContext(handler, projectID)
 
-	slog.SetDefault(slog.New(instrumentedHandler))
+	return handlerWithLevel(instrumentedHandler)
 }
 
-func handlerWithSpanContext(handler slog.Handler) *spanContextLogHandler {
-	return &spanContextLogHandler{Handler: handler}
+func handlerWithSpanContext(handler slog.Handler, projectID string) *spanContextLogHandler {
+	return &spanContextLogHandler{Handler: handler, projectID: projectID}
 }
 
 // spanContextLogHandler is a slog.Handler which adds attributes from the
 // span context.
 type spanContextLogHandler struct {
 	slog.Handler
+	projectID string
 }
 
 // Handle overrides slog.Handler's Handle method. This adds attributes from the
@@ -33,33 +60,62 @@ func (t *spanContextLogHandler) Handle(ctx context.Context, record slog.Record)
 	if s := trace.SpanContextFromContext(ctx); s.IsValid() {
 		// Add trace context attributes following Cloud Logging structured log format described
 		// in https://cloud.google.com/logging/docs/structured-logging#special-payload-fields
+		trace := s.TraceID().String()
+		if t.projectID != "" {
+			trace = "projects/" + t.projectID + "/traces/" + trace
+		}
 		record.AddAttrs(
-			slog.Any("logging.googleapis.com/trace", s.TraceID()),
+			slog.String(traceKey, trace),
 		)
 		record.AddAttrs(
-			slog.Any("logging.googleapis.com/spanId", s.SpanID()),
+			slog.Any(spanIDKey, s.SpanID()),
 		)
 		record.AddAttrs(
-			slog.Bool("logging.googleapis.com/trace_sampled", s.TraceFlags().IsSampled()),
+			slog.Bool(traceSampledKey, s.TraceFlags().IsSampled()),
 		)
 	}
 	return t.Handler.Handle(ctx, record)
 }
 
+func (t *spanContextLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return handlerWithSpanContext(t.Handler.WithAttrs(attrs), t.projectID)
+}
+
+func (t *spanContextLogHandler) WithGroup(name string) slog.Handler {
+	return handlerWithSpanContext(t.Handler.WithGroup(name), t.projectID)
+}
+
 func replacer(groups []string, a slog.Attr) slog.Attr {
+	// 組み込みのキーはトップレベルにのみ現れる
+	if len(groups) > 0 {
+		return a
+	}
+
 	// Rename attribute keys to match Cloud Logging structured log format
 	switch a.Key {
 	case slog.LevelKey:
 		a.Key = "severity"
 		// Map slog.Level string values to Cloud Logging LogSeverity
 		// https://cloud.google.com/logging/docs/reference/v2/rest/v2/LogEntry#LogSeverity
-		if level := a.Value.Any().(slog.Level); level == slog.LevelWarn {
-			a.Value = slog.StringValue("WARNING")
+		if level, ok := a.Value.Any().(slog.Level); ok {
+			a.Value = slog.StringValue(severity(level))
 		}
 	case slog.TimeKey:
 		a.Key = "timestamp"
 	case slog.MessageKey:
 		a.Key = "message"
+	case slog.SourceKey:
+		// https://cloud.google.com/logging/docs/reference/v2/rest/v2/LogEntry#LogEntrySourceLocation
+		source, ok := a.Value.Any().(*slog.Source)
+		if !ok || source == nil || source.File == "" {
+			// 呼び出し元が不明な場合は出力しない
+			return slog.Attr{}
+		}
+		a = slog.Group(sourceLocationKey,
+			slog.String("file", source.File),
+			slog.String("line", strconv.Itoa(source.Line)),
+			slog.String("function", source.Function),
+		)
 	}
 	return a
 }
@@ -0,0 +1,199 @@
+package o11y
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+var testTime = time.Date(2025, 1, 2, 3, 4, 5, 6000, time.UTC)
+
+func testSpanContext() context.Context {
+	traceID, _ := trace.TraceIDFromHex("0af7651916cd43dd8448eb211c80319c")
+	spanID, _ := trace.SpanIDFromHex("b7ad6b7169203331")
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	})
+	return trace.ContextWithSpanContext(context.Background(), sc)
+}
+
+type logEntry struct {
+	ctx     context.Context
+	level   slog.Level
+	message string
+	attrs   []slog.Attr
+	source  bool
+}
+
+func TestGCPHandlerGolden(t *testing.T) {
+	tests := []struct {
+		name      string
+		projectID string
+		entries   []logEntry
+	}{
+		{
+			name: "severity",
+			entries: []logEntry{
+				{level: slog.LevelDebug, message: "debug"},
+				{level: slog.LevelInfo, message: "info"},
+				{level: LevelNotice, message: "notice"},
+				{level: slog.LevelWarn, message: "warning"},
+				{level: slog.LevelError, message: "error"},
+				{level: LevelCritical, message: "critical"},
+				{level: LevelAlert, message: "alert"},
+				{level: LevelEmergency, message: "emergency"},
+				{level: slog.LevelInfo + 1, message: "between info and notice"},
+			},
+		},
+		{
+			name: "trace",
+			entries: []logEntry{
+				{ctx: testSpanContext(), level: slog.LevelInfo, message: "with span context"},
+			},
+		},
+		{
+			name:      "trace_project",
+			projectID: "my-project",
+			entries: []logEntry{
+				{ctx: testSpanContext(), level: slog.LevelInfo, message: "with span context"},
+			},
+		},
+		{
+			name: "source_location",
+			entries: []logEntry{
+				{level: slog.LevelInfo, message: "with source", source: true},
+			},
+		},
+		{
+			name: "http_request",
+			entries: []logEntry{
+				{level: slog.LevelInfo, message: "request completed", attrs: []slog.Attr{
+					HTTPRequestAttr(HTTPRequest{
+						RequestMethod: "POST",
+						RequestURL:    "/users?limit=10",
+						RequestSize:   42,
+						Status:        201,
+						ResponseSize:  128,
+						UserAgent:     "curl/8.0",
+						RemoteIP:      "192.0.2.1",
+						Latency:       1500 * time.Millisecond,
+						Protocol:      "HTTP/1.1",
+					}),
+				}},
+			},
+		},
+		{
+			name: "labels_operation",
+			entries: []logEntry{
+				{level: slog.LevelInfo, message: "operation started", attrs: []slog.Attr{
+					Labels(map[string]string{"service": "otel-test", "env": "test"}),
+					Operation("import-1", "otel-test/import", true, false),
+				}},
+				{level: slog.LevelInfo, message: "operation finished", attrs: []slog.Attr{
+					Operation("import-1", "otel-test/import", false, true),
+				}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			handler := newGCPHandler(&buf, tt.projectID, nil)
+			var lines []int
+
+			for _, e := range tt.entries {
+				ctx := e.ctx
+				if ctx == nil {
+					ctx = context.Background()
+				}
+				var pc uintptr
+				if e.source {
+					var pcs [1]uintptr
+					runtime.Callers(1, pcs[:])
+					pc = pcs[0]
+					frame, _ := runtime.CallersFrames(pcs[:]).Next()
+					lines = append(lines, frame.Line)
+				}
+				record := slog.NewRecord(testTime, e.level, e.message, pc)
+				record.AddAttrs(e.attrs...)
+				if err := handler.Handle(ctx, record); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// 行番号はテストの編集で変わるため、ゴールデンファイルとは別に確認する
+			for _, line := range lines {
+				if want := fmt.Sprintf(`"line":"%d"`, line); !strings.Contains(buf.String(), want) {
+					t.Errorf("output does not contain %s: %s", want, buf.String())
+				}
+			}
+			got := normalizeSource(t, buf.String())
+			golden := filepath.Join("testdata", tt.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("read golden file (run with -update to create): %v", err)
+			}
+			if got != string(want) {
+				t.Errorf("output mismatch for %s\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+// sourceLine はソースの行番号にマッチする
+var sourceLine = regexp.MustCompile(`"line":"\d+"`)
+
+// normalizeSource はソースファイルの絶対パスと行番号を環境に依存しない形にする
+func normalizeSource(t *testing.T, s string) string {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = strings.ReplaceAll(s, wd+string(filepath.Separator), "")
+	return sourceLine.ReplaceAllString(s, `"line":"0"`)
+}
+
+func TestSeverity(t *testing.T) {
+	tests := []struct {
+		level slog.Level
+		want  string
+	}{
+		{slog.LevelDebug - 4, "DEBUG"},
+		{slog.LevelDebug, "DEBUG"},
+		{slog.LevelInfo, "INFO"},
+		{LevelNotice, "NOTICE"},
+		{slog.LevelWarn, "WARNING"},
+		{slog.LevelError, "ERROR"},
+		{LevelCritical, "CRITICAL"},
+		{LevelAlert, "ALERT"},
+		{LevelEmergency, "EMERGENCY"},
+		{LevelEmergency + 10, "EMERGENCY"},
+	}
+	for _, tt := range tests {
+		if got := severity(tt.level); got != tt.want {
+			t.Errorf("severity(%v) = %s, want %s", tt.level, got, tt.want)
+		}
+	}
+}
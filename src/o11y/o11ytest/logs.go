@@ -0,0 +1,167 @@
+package o11ytest
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// LogRecord は記録されたログ
+type LogRecord struct {
+	Level   slog.Level
+	Message string
+	// Attrs はグループを"."で連結したキーの属性
+	Attrs       map[string]slog.Value
+	SpanContext trace.SpanContext
+}
+
+// LogRecorder はログをメモリに記録するslog.Handler
+type LogRecorder struct {
+	mu      *sync.Mutex
+	records *[]LogRecord
+	attrs   []slog.Attr
+	prefix  string
+}
+
+// NewLogRecorder は新しいLogRecorderを作成します
+func NewLogRecorder() *LogRecorder {
+	return &LogRecorder{mu: &sync.Mutex{}, records: &[]LogRecord{}}
+}
+
+// Enabled は全てのレベルを記録する
+func (r *LogRecorder) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (r *LogRecorder) Handle(ctx context.Context, record slog.Record) error {
+	attrs := map[string]slog.Value{}
+	for _, a := range r.attrs {
+		flatten(attrs, "", a)
+	}
+	record.Attrs(func(a slog.Attr) bool {
+		flatten(attrs, r.prefix, a)
+		return true
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*r.records = append(*r.records, LogRecord{
+		Level:       record.Level,
+		Message:     record.Message,
+		Attrs:       attrs,
+		SpanContext: trace.SpanContextFromContext(ctx),
+	})
+	return nil
+}
+
+func (r *LogRecorder) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *r
+	clone.attrs = append(append([]slog.Attr(nil), r.attrs...), prefixed(r.prefix, attrs)...)
+	return &clone
+}
+
+func (r *LogRecorder) WithGroup(name string) slog.Handler {
+	clone := *r
+	clone.prefix = r.prefix + name + "."
+	return &clone
+}
+
+// Records は記録されたログの一覧を返します
+func (r *LogRecorder) Records() []LogRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]LogRecord(nil), *r.records...)
+}
+
+// Reset は記録されたログを破棄します
+func (r *LogRecorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*r.records = nil
+}
+
+// prefixed はWithGroup後に追加された属性をグループでまとめる
+func prefixed(prefix string, attrs []slog.Attr) []slog.Attr {
+	if prefix == "" {
+		return attrs
+	}
+	list := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		a.Key = prefix + a.Key
+		list[i] = a
+	}
+	return list
+}
+
+func flatten(dst map[string]slog.Value, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		groupPrefix := prefix
+		if a.Key != "" {
+			groupPrefix = prefix + a.Key + "."
+		}
+		for _, ga := range v.Group() {
+			flatten(dst, groupPrefix, ga)
+		}
+		return
+	}
+	dst[prefix+a.Key] = v
+}
+
+// LogAssertions は記録されたログに対するアサーション
+type LogAssertions struct {
+	t       testing.TB
+	records []LogRecord
+}
+
+// Records はログの一覧を返します
+func (a *LogAssertions) Records() []LogRecord {
+	return a.records
+}
+
+// Containing はメッセージに文字列を含むログに絞り込みます
+func (a *LogAssertions) Containing(substr string) *LogAssertions {
+	var records []LogRecord
+	for _, r := range a.records {
+		if strings.Contains(r.Message, substr) {
+			records = append(records, r)
+		}
+	}
+	return &LogAssertions{t: a.t, records: records}
+}
+
+// WithAttr は属性の値が一致するログに絞り込みます
+func (a *LogAssertions) WithAttr(key string, want any) *LogAssertions {
+	var records []LogRecord
+	for _, r := range a.records {
+		if v, ok := r.Attrs[key]; ok && v.Equal(slog.AnyValue(want)) {
+			records = append(records, r)
+		}
+	}
+	return &LogAssertions{t: a.t, records: records}
+}
+
+// Len はログの数を確認します
+func (a *LogAssertions) Len(n int) *LogAssertions {
+	a.t.Helper()
+	if len(a.records) != n {
+		a.t.Errorf("expected %d log records, got %d", n, len(a.records))
+	}
+	return a
+}
+
+// InSpan は全てのログが指定したスパンのコンテキストで出力されたことを確認します
+func (a *LogAssertions) InSpan(span *SpanAssertion) *LogAssertions {
+	a.t.Helper()
+	sc := span.span.SpanContext
+	for _, r := range a.records {
+		if r.SpanContext.TraceID() != sc.TraceID() || r.SpanContext.SpanID() != sc.SpanID() {
+			a.t.Errorf("log %q: not emitted in span %q", r.Message, span.span.Name)
+		}
+	}
+	return a
+}
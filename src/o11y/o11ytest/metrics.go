@@ -0,0 +1,185 @@
+package o11ytest
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// MetricAssertions は収集したメトリクスに対するアサーション
+type MetricAssertions struct {
+	t       testing.TB
+	metrics []metricdata.Metrics
+}
+
+func collectMetrics(t testing.TB, reader *sdkmetric.ManualReader) *MetricAssertions {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatalf("collect metrics: %v", err)
+	}
+	var metrics []metricdata.Metrics
+	for _, sm := range rm.ScopeMetrics {
+		metrics = append(metrics, sm.Metrics...)
+	}
+	return &MetricAssertions{t: t, metrics: metrics}
+}
+
+// Names はメトリクス名の一覧を返します
+func (a *MetricAssertions) Names() []string {
+	names := make([]string, len(a.metrics))
+	for i, m := range a.metrics {
+		names[i] = m.Name
+	}
+	return names
+}
+
+// Has は指定した名前のメトリクスがあるかどうかを返します
+func (a *MetricAssertions) Has(name string) bool {
+	for _, m := range a.metrics {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Named は指定した名前のメトリクスのアサーションを返します
+func (a *MetricAssertions) Named(name string) *MetricAssertion {
+	a.t.Helper()
+	for _, m := range a.metrics {
+		if m.Name == name {
+			return &MetricAssertion{t: a.t, metric: m}
+		}
+	}
+	a.t.Fatalf("metric %q not found (metrics: %v)", name, a.Names())
+	return nil
+}
+
+// MetricAssertion は1つのメトリクスに対するアサーション
+// WithAttrsで絞り込んだデータポイントの合計値を比較する
+type MetricAssertion struct {
+	t      testing.TB
+	metric metricdata.Metrics
+	attrs  []attribute.KeyValue
+}
+
+// WithAttrs は指定した属性を全て含むデータポイントに絞り込みます
+func (a *MetricAssertion) WithAttrs(attrs ...attribute.KeyValue) *MetricAssertion {
+	return &MetricAssertion{t: a.t, metric: a.metric, attrs: append(append([]attribute.KeyValue(nil), a.attrs...), attrs...)}
+}
+
+func (a *MetricAssertion) matches(set attribute.Set) bool {
+	for _, kv := range a.attrs {
+		if v, ok := set.Value(kv.Key); !ok || v != kv.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// point はデータポイントを種類に関係なく扱うための値
+type point struct {
+	attrs attribute.Set
+	value float64 // Sum/Gaugeの値、Histogramの場合は合計
+	count uint64  // Histogramの件数、それ以外は1
+}
+
+func (a *MetricAssertion) points() []point {
+	var points []point
+	switch data := a.metric.Data.(type) {
+	case metricdata.Sum[int64]:
+		for _, dp := range data.DataPoints {
+			points = append(points, point{attrs: dp.Attributes, value: float64(dp.Value), count: 1})
+		}
+	case metricdata.Sum[float64]:
+		for _, dp := range data.DataPoints {
+			points = append(points, point{attrs: dp.Attributes, value: dp.Value, count: 1})
+		}
+	case metricdata.Gauge[int64]:
+		for _, dp := range data.DataPoints {
+			points = append(points, point{attrs: dp.Attributes, value: float64(dp.Value), count: 1})
+		}
+	case metricdata.Gauge[float64]:
+		for _, dp := range data.DataPoints {
+			points = append(points, point{attrs: dp.Attributes, value: dp.Value, count: 1})
+		}
+	case metricdata.Histogram[int64]:
+		for _, dp := range data.DataPoints {
+			points = append(points, point{attrs: dp.Attributes, value: float64(dp.Sum), count: dp.Count})
+		}
+	case metricdata.Histogram[float64]:
+		for _, dp := range data.DataPoints {
+			points = append(points, point{attrs: dp.Attributes, value: dp.Sum, count: dp.Count})
+		}
+	default:
+		a.t.Fatalf("metric %q: unsupported data type %T", a.metric.Name, a.metric.Data)
+	}
+
+	var matched []point
+	for _, p := range points {
+		if a.matches(p.attrs) {
+			matched = append(matched, p)
+		}
+	}
+	return matched
+}
+
+// Value は絞り込んだデータポイントの値の合計を返します（Histogramの場合はSumの合計）
+func (a *MetricAssertion) Value() float64 {
+	a.t.Helper()
+	var total float64
+	for _, p := range a.points() {
+		total += p.value
+	}
+	return total
+}
+
+// Count は絞り込んだデータポイントの件数の合計を返します（Histogramの場合は記録回数）
+func (a *MetricAssertion) Count() uint64 {
+	a.t.Helper()
+	var total uint64
+	for _, p := range a.points() {
+		total += p.count
+	}
+	return total
+}
+
+// HasValue は値の合計を確認します
+func (a *MetricAssertion) HasValue(want float64) *MetricAssertion {
+	a.t.Helper()
+	if got := a.Value(); got != want {
+		a.t.Errorf("metric %q%v: value %v, want %v", a.metric.Name, a.attrs, got, want)
+	}
+	return a
+}
+
+// HasCount は記録回数の合計を確認します
+func (a *MetricAssertion) HasCount(want uint64) *MetricAssertion {
+	a.t.Helper()
+	if got := a.Count(); got != want {
+		a.t.Errorf("metric %q%v: count %d, want %d", a.metric.Name, a.attrs, got, want)
+	}
+	return a
+}
+
+// HasPoints はデータポイントの数を確認します
+func (a *MetricAssertion) HasPoints(want int) *MetricAssertion {
+	a.t.Helper()
+	if got := len(a.points()); got != want {
+		a.t.Errorf("metric %q%v: %d data points, want %d", a.metric.Name, a.attrs, got, want)
+	}
+	return a
+}
+
+// HasUnit はメトリクスの単位を確認します
+func (a *MetricAssertion) HasUnit(want string) *MetricAssertion {
+	a.t.Helper()
+	if a.metric.Unit != want {
+		a.t.Errorf("metric %q: unit %q, want %q", a.metric.Name, a.metric.Unit, want)
+	}
+	return a
+}
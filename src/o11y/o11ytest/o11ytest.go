@@ -0,0 +1,115 @@
+// Package o11ytest はテスト用にインメモリのエクスポーターを組み込んだ
+// OpenTelemetryのプロバイダーとアサーションを提供します
+package o11ytest
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"otel-test/o11y"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// Harness はテストごとに作成するインメモリのテレメトリ環境
+type Harness struct {
+	t              testing.TB
+	spans          *tracetest.InMemoryExporter
+	reader         *sdkmetric.ManualReader
+	logs           *LogRecorder
+	TracerProvider *sdktrace.TracerProvider
+	MeterProvider  *sdkmetric.MeterProvider
+}
+
+// New は新しいプロバイダーを作成してグローバルに設定します
+// 本番と同じく、o11y.ContextWithAttributesの属性をスパン・ログ・メトリクスに追加する
+// テスト終了時に元のプロバイダーとロガーに戻す
+// グローバルな状態を変更するため、t.Parallelとは併用しないこと
+func New(t testing.TB) *Harness {
+	t.Helper()
+
+	spans := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(
+		// 終了したスパンをすぐに参照できるよう同期的にエクスポートする
+		sdktrace.WithSyncer(spans),
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithSpanProcessor(o11y.NewContextAttributesSpanProcessor()),
+	)
+
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	logs := NewLogRecorder()
+
+	prevTP := otel.GetTracerProvider()
+	prevMP := otel.GetMeterProvider()
+	prevPropagator := otel.GetTextMapPropagator()
+	prevLogger := slog.Default()
+
+	otel.SetTracerProvider(tp)
+	otel.SetMeterProvider(o11y.MeterProviderWithContextAttributes(mp))
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	slog.SetDefault(slog.New(o11y.HandlerWithContextAttributes(logs)))
+
+	t.Cleanup(func() {
+		ctx := context.Background()
+		_ = tp.Shutdown(ctx)
+		_ = mp.Shutdown(ctx)
+		otel.SetTracerProvider(prevTP)
+		otel.SetMeterProvider(prevMP)
+		otel.SetTextMapPropagator(prevPropagator)
+		slog.SetDefault(prevLogger)
+	})
+
+	return &Harness{
+		t:              t,
+		spans:          spans,
+		reader:         reader,
+		logs:           logs,
+		TracerProvider: tp,
+		MeterProvider:  mp,
+	}
+}
+
+// Reset は記録済みのスパンとログを破棄します
+func (h *Harness) Reset() {
+	h.spans.Reset()
+	h.logs.Reset()
+}
+
+// Spans は終了したスパンのアサーションを返します
+func (h *Harness) Spans() *SpanAssertions {
+	spans := h.spans.GetSpans()
+	return &SpanAssertions{t: h.t, spans: spans, all: spans}
+}
+
+// Span は指定した名前のスパンがちょうど1つであることを確認し、そのアサーションを返します
+func (h *Harness) Span(name string) *SpanAssertion {
+	h.t.Helper()
+	return h.Spans().Single(name)
+}
+
+// Metrics は現在のメトリクスを収集し、アサーションを返します
+func (h *Harness) Metrics() *MetricAssertions {
+	h.t.Helper()
+	return collectMetrics(h.t, h.reader)
+}
+
+// Metric は指定した名前のメトリクスのアサーションを返します
+func (h *Harness) Metric(name string) *MetricAssertion {
+	h.t.Helper()
+	return h.Metrics().Named(name)
+}
+
+// Logs は記録されたログのアサーションを返します
+func (h *Harness) Logs() *LogAssertions {
+	return &LogAssertions{t: h.t, records: h.logs.Records()}
+}
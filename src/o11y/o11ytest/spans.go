@@ -0,0 +1,341 @@
+package o11ytest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SpanAssertions は複数のスパンに対するアサーション
+type SpanAssertions struct {
+	t     testing.TB
+	spans tracetest.SpanStubs
+	// all は絞り込み前の全てのスパン（親子関係の参照に使用する）
+	all tracetest.SpanStubs
+}
+
+// Len はスパンの数を確認します
+func (a *SpanAssertions) Len(n int) *SpanAssertions {
+	a.t.Helper()
+	if len(a.spans) != n {
+		a.t.Errorf("expected %d spans, got %d: %v", n, len(a.spans), a.Names())
+	}
+	return a
+}
+
+// Names はスパン名の一覧を終了順に返します
+func (a *SpanAssertions) Names() []string {
+	names := make([]string, len(a.spans))
+	for i, s := range a.spans {
+		names[i] = s.Name
+	}
+	return names
+}
+
+// Named は指定した名前のスパンに絞り込みます
+func (a *SpanAssertions) Named(name string) *SpanAssertions {
+	var spans tracetest.SpanStubs
+	for _, s := range a.spans {
+		if s.Name == name {
+			spans = append(spans, s)
+		}
+	}
+	return &SpanAssertions{t: a.t, spans: spans, all: a.all}
+}
+
+// InTrace は指定したトレースのスパンに絞り込みます
+func (a *SpanAssertions) InTrace(traceID trace.TraceID) *SpanAssertions {
+	var spans tracetest.SpanStubs
+	for _, s := range a.spans {
+		if s.SpanContext.TraceID() == traceID {
+			spans = append(spans, s)
+		}
+	}
+	return &SpanAssertions{t: a.t, spans: spans, all: a.all}
+}
+
+// Single は指定した名前のスパンがちょうど1つであることを確認します
+func (a *SpanAssertions) Single(name string) *SpanAssertion {
+	a.t.Helper()
+	named := a.Named(name)
+	if len(named.spans) != 1 {
+		a.t.Fatalf("expected exactly one span named %q, got %d (spans: %v)", name, len(named.spans), a.Names())
+	}
+	return &SpanAssertion{t: a.t, span: named.spans[0], all: a.all}
+}
+
+// Each は各スパンのアサーションを返します
+func (a *SpanAssertions) Each() []*SpanAssertion {
+	list := make([]*SpanAssertion, len(a.spans))
+	for i, s := range a.spans {
+		list[i] = &SpanAssertion{t: a.t, span: s, all: a.all}
+	}
+	return list
+}
+
+// Tree はスパンの親子関係を確認するための期待値
+type Tree struct {
+	Name     string
+	Children []Tree
+}
+
+// T はTreeを作成するヘルパー
+func T(name string, children ...Tree) Tree {
+	return Tree{Name: name, Children: children}
+}
+
+// HasTree は指定した名前のルートスパンから始まるツリーの形が一致することを確認します
+// 子スパンは開始時刻の順に比較する
+// ignore に指定した名前のスパンは（子孫も含めて）比較から除外する
+func (a *SpanAssertions) HasTree(want Tree, ignore ...string) *SpanAssertions {
+	a.t.Helper()
+	root := a.Single(want.Name)
+	got := buildTree(root.span, a.all, ignore)
+	if diff := diffTree(want, got, want.Name); diff != "" {
+		a.t.Errorf("span tree mismatch:\n%s\nwant:\n%s\ngot:\n%s", diff, want, got)
+	}
+	return a
+}
+
+func buildTree(root tracetest.SpanStub, spans tracetest.SpanStubs, ignore []string) Tree {
+	tree := Tree{Name: root.Name}
+	var children tracetest.SpanStubs
+	for _, s := range spans {
+		if s.Parent.SpanID() == root.SpanContext.SpanID() && s.Parent.TraceID() == root.SpanContext.TraceID() {
+			children = append(children, s)
+		}
+	}
+	sort.SliceStable(children, func(i, j int) bool {
+		return children[i].StartTime.Before(children[j].StartTime)
+	})
+	for _, c := range children {
+		if contains(ignore, c.Name) {
+			continue
+		}
+		tree.Children = append(tree.Children, buildTree(c, spans, ignore))
+	}
+	return tree
+}
+
+func diffTree(want, got Tree, path string) string {
+	if want.Name != got.Name {
+		return fmt.Sprintf("%s: name %q != %q", path, got.Name, want.Name)
+	}
+	if len(want.Children) != len(got.Children) {
+		return fmt.Sprintf("%s: %d children %v, want %d %v", path, len(got.Children), childNames(got), len(want.Children), childNames(want))
+	}
+	for i := range want.Children {
+		if d := diffTree(want.Children[i], got.Children[i], path+" > "+want.Children[i].Name); d != "" {
+			return d
+		}
+	}
+	return ""
+}
+
+func childNames(t Tree) []string {
+	names := make([]string, len(t.Children))
+	for i, c := range t.Children {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// String はツリーをインデント付きで表示します
+func (t Tree) String() string {
+	var b strings.Builder
+	t.write(&b, 0)
+	return b.String()
+}
+
+func (t Tree) write(b *strings.Builder, depth int) {
+	b.WriteString(strings.Repeat("  ", depth))
+	b.WriteString(t.Name)
+	b.WriteString("\n")
+	for _, c := range t.Children {
+		c.write(b, depth+1)
+	}
+}
+
+// SpanAssertion は1つのスパンに対するアサーション
+type SpanAssertion struct {
+	t    testing.TB
+	span tracetest.SpanStub
+	all  tracetest.SpanStubs
+}
+
+// Stub はスパンのデータを返します
+func (a *SpanAssertion) Stub() tracetest.SpanStub {
+	return a.span
+}
+
+// HasAttr は属性の値を確認します
+// 値はattribute.Valueと同じ型（string, bool, int, int64, float64）で指定する
+func (a *SpanAssertion) HasAttr(key string, want any) *SpanAssertion {
+	a.t.Helper()
+	v, ok := findAttr(a.span.Attributes, key)
+	if !ok {
+		a.t.Errorf("span %q: attribute %q not found (attributes: %v)", a.span.Name, key, a.span.Attributes)
+		return a
+	}
+	if !valueEqual(v, want) {
+		a.t.Errorf("span %q: attribute %q = %v, want %v", a.span.Name, key, v.Emit(), want)
+	}
+	return a
+}
+
+// HasAttrKey は属性が存在することを確認します
+func (a *SpanAssertion) HasAttrKey(key string) *SpanAssertion {
+	a.t.Helper()
+	if _, ok := findAttr(a.span.Attributes, key); !ok {
+		a.t.Errorf("span %q: attribute %q not found", a.span.Name, key)
+	}
+	return a
+}
+
+// NoAttr は属性が存在しないことを確認します
+func (a *SpanAssertion) NoAttr(key string) *SpanAssertion {
+	a.t.Helper()
+	if v, ok := findAttr(a.span.Attributes, key); ok {
+		a.t.Errorf("span %q: unexpected attribute %q = %v", a.span.Name, key, v.Emit())
+	}
+	return a
+}
+
+// HasStatus はスパンのステータスを確認します
+func (a *SpanAssertion) HasStatus(code codes.Code) *SpanAssertion {
+	a.t.Helper()
+	if a.span.Status.Code != code {
+		a.t.Errorf("span %q: status %v, want %v", a.span.Name, a.span.Status.Code, code)
+	}
+	return a
+}
+
+// HasKind はスパンの種類を確認します
+func (a *SpanAssertion) HasKind(kind trace.SpanKind) *SpanAssertion {
+	a.t.Helper()
+	if a.span.SpanKind != kind {
+		a.t.Errorf("span %q: kind %v, want %v", a.span.Name, a.span.SpanKind, kind)
+	}
+	return a
+}
+
+// HasEvent は指定した名前のイベントがあることを確認します
+func (a *SpanAssertion) HasEvent(name string) *SpanAssertion {
+	a.t.Helper()
+	for _, e := range a.span.Events {
+		if e.Name == name {
+			return a
+		}
+	}
+	a.t.Errorf("span %q: event %q not found", a.span.Name, name)
+	return a
+}
+
+// NoEvent は指定した名前のイベントがないことを確認します
+func (a *SpanAssertion) NoEvent(name string) *SpanAssertion {
+	a.t.Helper()
+	for _, e := range a.span.Events {
+		if e.Name == name {
+			a.t.Errorf("span %q: unexpected event %q", a.span.Name, name)
+		}
+	}
+	return a
+}
+
+// HasError はエラーが記録されていることを確認します
+func (a *SpanAssertion) HasError() *SpanAssertion {
+	a.t.Helper()
+	return a.HasEvent("exception")
+}
+
+// NoError はエラーが記録されていないことを確認します
+func (a *SpanAssertion) NoError() *SpanAssertion {
+	a.t.Helper()
+	return a.NoEvent("exception")
+}
+
+// ChildOf は親スパンを確認します
+func (a *SpanAssertion) ChildOf(parent *SpanAssertion) *SpanAssertion {
+	a.t.Helper()
+	if a.span.Parent.SpanID() != parent.span.SpanContext.SpanID() {
+		a.t.Errorf("span %q: parent is not %q", a.span.Name, parent.span.Name)
+	}
+	return a
+}
+
+// IsRoot はローカルのルートスパンであること（親がないかリモートであること）を確認します
+func (a *SpanAssertion) IsRoot() *SpanAssertion {
+	a.t.Helper()
+	if a.span.Parent.IsValid() && !a.span.Parent.IsRemote() {
+		a.t.Errorf("span %q: expected root span, has parent %s", a.span.Name, a.span.Parent.SpanID())
+	}
+	return a
+}
+
+// HasLinkTo は指定したスパンへのリンクがあることを確認します
+func (a *SpanAssertion) HasLinkTo(sc trace.SpanContext) *SpanAssertion {
+	a.t.Helper()
+	for _, l := range a.span.Links {
+		if l.SpanContext.TraceID() == sc.TraceID() && l.SpanContext.SpanID() == sc.SpanID() {
+			return a
+		}
+	}
+	a.t.Errorf("span %q: link to %s/%s not found", a.span.Name, sc.TraceID(), sc.SpanID())
+	return a
+}
+
+// Parent は親スパンのアサーションを返します
+func (a *SpanAssertion) Parent() *SpanAssertion {
+	a.t.Helper()
+	for _, s := range a.all {
+		if s.SpanContext.SpanID() == a.span.Parent.SpanID() {
+			return &SpanAssertion{t: a.t, span: s, all: a.all}
+		}
+	}
+	a.t.Fatalf("span %q: parent span not found", a.span.Name)
+	return nil
+}
+
+func findAttr(attrs []attribute.KeyValue, key string) (attribute.Value, bool) {
+	for _, kv := range attrs {
+		if string(kv.Key) == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+// valueEqual はattribute.ValueとGoの値を比較する
+func valueEqual(v attribute.Value, want any) bool {
+	switch w := want.(type) {
+	case string:
+		return v.Type() == attribute.STRING && v.AsString() == w
+	case bool:
+		return v.Type() == attribute.BOOL && v.AsBool() == w
+	case int:
+		return v.Type() == attribute.INT64 && v.AsInt64() == int64(w)
+	case int64:
+		return v.Type() == attribute.INT64 && v.AsInt64() == w
+	case float64:
+		return v.Type() == attribute.FLOAT64 && v.AsFloat64() == w
+	case attribute.Value:
+		return v == w
+	default:
+		return v.Emit() == fmt.Sprint(w)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
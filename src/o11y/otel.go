@@ -11,7 +11,7 @@ import (
 	"go.opentelemetry.io/otel/sdk/trace"
 )
 
-func setupOpenTelemetry(ctx context.Context) (shutdown func(context.Context) error, err error) {
+func setupOpenTelemetry(ctx context.Context, policy *RedactPolicy) (shutdown func(context.Context) error, err error) {
 	var shutdownFuncs []func(context.Context) error
 
 	// shutdown combines shutdown functions from multiple OpenTelemetry
@@ -34,7 +34,18 @@ func setupOpenTelemetry(ctx context.Context) (shutdown func(context.Context) err
 		err = errors.Join(err, shutdown(ctx))
 		return
 	}
-	tp := trace.NewTracerProvider(trace.WithBatcher(texporter))
+	sampler := newSamplerFromEnv()
+	currentSampler.Store(&sampler)
+	var processor trace.SpanProcessor = trace.NewBatchSpanProcessor(texporter)
+	if policy != nil {
+		processor = NewRedactingSpanProcessor(policy, processor)
+	}
+	tp := trace.NewTracerProvider(
+		// テナントなどコンテキストの属性を全てのスパンに設定する
+		trace.WithSpanProcessor(NewContextAttributesSpanProcessor()),
+		trace.WithSpanProcessor(processor),
+		trace.WithSampler(sampler),
+	)
 	shutdownFuncs = append(shutdownFuncs, tp.Shutdown)
 	otel.SetTracerProvider(tp)
 
@@ -44,11 +55,13 @@ func setupOpenTelemetry(ctx context.Context) (shutdown func(context.Context) err
 		err = errors.Join(err, shutdown(ctx))
 		return
 	}
-	mp := metric.NewMeterProvider(
-		metric.WithReader(mreader),
-	)
+	mopts := []metric.Option{metric.WithReader(mreader)}
+	if policy != nil {
+		mopts = append(mopts, metric.WithView(policy.MetricView()))
+	}
+	mp := metric.NewMeterProvider(mopts...)
 	shutdownFuncs = append(shutdownFuncs, mp.Shutdown)
-	otel.SetMeterProvider(mp)
+	otel.SetMeterProvider(MeterProviderWithContextAttributes(mp))
 
 	return shutdown, nil
 }
@@ -0,0 +1,338 @@
+package o11y
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"otel-test/env"
+	"path"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// RedactAction は個人情報の属性に対する処理
+type RedactAction string
+
+const (
+	// RedactHash は値をソルトを鍵としたHMAC-SHA256に置き換える（同じ値同士の突合は可能）
+	// メールアドレスなどは値の種類が少なく辞書攻撃で元に戻せるため、ソルトは必須
+	RedactHash RedactAction = "hash"
+	// RedactMask は値の大部分を*に置き換える
+	RedactMask RedactAction = "mask"
+	// RedactDrop は属性自体を削除する
+	RedactDrop RedactAction = "drop"
+)
+
+// RedactRule は属性キーのパターンとアクションの組
+// Patternはpath.Matchの形式 (例: user.email, user.*, *.password)
+type RedactRule struct {
+	Pattern string
+	Action  RedactAction
+}
+
+// RedactPolicy はスパン・ログ・メトリクスに共通で適用するマスキングポリシー
+type RedactPolicy struct {
+	rules []RedactRule
+	key   []byte
+}
+
+// NewRedactPolicy は新しいRedactPolicyを作成します
+// hashアクションのルールがある場合はsaltが必要
+func NewRedactPolicy(salt string, rules ...RedactRule) (*RedactPolicy, error) {
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid redact pattern %q: %w", rule.Pattern, err)
+		}
+		switch rule.Action {
+		case RedactHash, RedactMask, RedactDrop:
+		default:
+			return nil, fmt.Errorf("invalid redact action %q for %s", rule.Action, rule.Pattern)
+		}
+		if rule.Action == RedactHash && salt == "" {
+			return nil, fmt.Errorf("REDACT_HASH_SALT is required for the hash action of %s", rule.Pattern)
+		}
+	}
+	return &RedactPolicy{rules: rules, key: []byte(salt)}, nil
+}
+
+// newRedactPolicyFromConfig は設定からポリシーを作成する（ルールがない場合はnil）
+func newRedactPolicyFromConfig(cfg env.RedactConfig) (*RedactPolicy, error) {
+	rules, err := ParseRedactRules(cfg.Rules)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	return NewRedactPolicy(cfg.HashSalt, rules...)
+}
+
+// ParseRedactRules は "key=action,key=action" 形式のルールを解析する
+func ParseRedactRules(s string) ([]RedactRule, error) {
+	var rules []RedactRule
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		pattern, action, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid redact rule %q", pair)
+		}
+		rules = append(rules, RedactRule{
+			Pattern: strings.TrimSpace(pattern),
+			Action:  RedactAction(strings.ToLower(strings.TrimSpace(action))),
+		})
+	}
+	return rules, nil
+}
+
+// actionFor はキーに一致する最初のルールのアクションを返す
+func (p *RedactPolicy) actionFor(key string) (RedactAction, bool) {
+	for _, rule := range p.rules {
+		if ok, _ := path.Match(rule.Pattern, key); ok {
+			return rule.Action, true
+		}
+	}
+	return "", false
+}
+
+// redactString はアクションに従って文字列を変換する
+func (p *RedactPolicy) redactString(action RedactAction, v string) string {
+	switch action {
+	case RedactHash:
+		mac := hmac.New(sha256.New, p.key)
+		mac.Write([]byte(v))
+		return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil)[:8])
+	case RedactMask:
+		return mask(v)
+	default:
+		return ""
+	}
+}
+
+// mask は先頭1文字を残して*に置き換える
+// メールアドレスの場合はドメインを残す
+func mask(v string) string {
+	local, domain, isEmail := strings.Cut(v, "@")
+	runes := []rune(local)
+	if len(runes) == 0 {
+		return v
+	}
+	masked := string(runes[0]) + strings.Repeat("*", len(runes)-1)
+	if isEmail {
+		return masked + "@" + domain
+	}
+	return masked
+}
+
+// RedactAttributes はOpenTelemetryの属性にポリシーを適用する
+func (p *RedactPolicy) RedactAttributes(attrs []attribute.KeyValue) []attribute.KeyValue {
+	var redacted []attribute.KeyValue
+	for i, kv := range attrs {
+		action, ok := p.actionFor(string(kv.Key))
+		if !ok {
+			if redacted != nil {
+				redacted = append(redacted, kv)
+			}
+			continue
+		}
+		if redacted == nil {
+			redacted = append(make([]attribute.KeyValue, 0, len(attrs)), attrs[:i]...)
+		}
+		if action == RedactDrop {
+			continue
+		}
+		redacted = append(redacted, attribute.String(string(kv.Key), p.redactString(action, kv.Value.Emit())))
+	}
+	if redacted == nil {
+		return attrs
+	}
+	return redacted
+}
+
+// MetricAttributeFilter はメトリクスから対象の属性を削除するフィルター
+// メトリクスではカーディナリティを増やさないよう、アクションに関係なく属性を削除する
+func (p *RedactPolicy) MetricAttributeFilter() attribute.Filter {
+	return func(kv attribute.KeyValue) bool {
+		_, ok := p.actionFor(string(kv.Key))
+		return !ok
+	}
+}
+
+// MetricView は全てのメトリクスに属性フィルターを適用するViewを返します
+func (p *RedactPolicy) MetricView() sdkmetric.View {
+	return sdkmetric.NewView(
+		sdkmetric.Instrument{Name: "*"},
+		sdkmetric.Stream{AttributeFilter: p.MetricAttributeFilter()},
+	)
+}
+
+// redactingSpanProcessor は終了したスパンの属性にポリシーを適用してから次のプロセッサーに渡す
+type redactingSpanProcessor struct {
+	sdktrace.SpanProcessor
+	policy *RedactPolicy
+}
+
+// NewRedactingSpanProcessor はスパンの属性とイベントの属性をマスキングするSpanProcessorを作成します
+func NewRedactingSpanProcessor(policy *RedactPolicy, next sdktrace.SpanProcessor) sdktrace.SpanProcessor {
+	return &redactingSpanProcessor{SpanProcessor: next, policy: policy}
+}
+
+func (p *redactingSpanProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	p.SpanProcessor.OnEnd(&redactedSpan{ReadOnlySpan: s, policy: p.policy})
+}
+
+// redactedSpan はマスキングした属性を返すReadOnlySpan
+type redactedSpan struct {
+	sdktrace.ReadOnlySpan
+	policy *RedactPolicy
+}
+
+func (s *redactedSpan) Attributes() []attribute.KeyValue {
+	return s.policy.RedactAttributes(s.ReadOnlySpan.Attributes())
+}
+
+// Events はイベントの属性に加えて、例外のメッセージに含まれる対象の属性値もマスキングします
+func (s *redactedSpan) Events() []sdktrace.Event {
+	events := s.ReadOnlySpan.Events()
+	replacer := s.replacer()
+	redacted := make([]sdktrace.Event, len(events))
+	for i, e := range events {
+		e.Attributes = s.policy.RedactAttributes(e.Attributes)
+		if replacer != nil && e.Name == "exception" {
+			e.Attributes = redactExceptionMessage(e.Attributes, replacer)
+		}
+		redacted[i] = e
+	}
+	return redacted
+}
+
+// Status はステータスの説明に含まれる対象の属性値をマスキングします
+func (s *redactedSpan) Status() sdktrace.Status {
+	status := s.ReadOnlySpan.Status()
+	if replacer := s.replacer(); replacer != nil {
+		status.Description = replacer.Replace(status.Description)
+	}
+	return status
+}
+
+// replacer はスパンとイベントの対象の属性値をマスキング後の値に置き換えるReplacerを返す（対象がない場合はnil）
+// エラーのメッセージにはキーがないため、同じスパンに記録された値と一致する部分を置き換える
+func (s *redactedSpan) replacer() *strings.Replacer {
+	var oldnew []string
+	add := func(attrs []attribute.KeyValue) {
+		for _, kv := range attrs {
+			action, ok := s.policy.actionFor(string(kv.Key))
+			if !ok || kv.Value.Type() != attribute.STRING || kv.Value.AsString() == "" {
+				continue
+			}
+			oldnew = append(oldnew, kv.Value.AsString(), s.policy.redactString(action, kv.Value.AsString()))
+		}
+	}
+	add(s.ReadOnlySpan.Attributes())
+	for _, e := range s.ReadOnlySpan.Events() {
+		add(e.Attributes)
+	}
+	if len(oldnew) == 0 {
+		return nil
+	}
+	return strings.NewReplacer(oldnew...)
+}
+
+// redactExceptionMessage は例外イベントのメッセージとスタックトレースを置き換える
+func redactExceptionMessage(attrs []attribute.KeyValue, replacer *strings.Replacer) []attribute.KeyValue {
+	redacted := make([]attribute.KeyValue, len(attrs))
+	for i, kv := range attrs {
+		if kv.Key == "exception.message" || kv.Key == "exception.stacktrace" {
+			kv = kv.Key.String(replacer.Replace(kv.Value.AsString()))
+		}
+		redacted[i] = kv
+	}
+	return redacted
+}
+
+func (s *redactedSpan) Links() []sdktrace.Link {
+	links := s.ReadOnlySpan.Links()
+	redacted := make([]sdktrace.Link, len(links))
+	for i, l := range links {
+		l.Attributes = s.policy.RedactAttributes(l.Attributes)
+		redacted[i] = l
+	}
+	return redacted
+}
+
+// redactHandler はログの属性にポリシーを適用するslog.Handler
+// グループ内の属性は "group.key" の形式でパターンと照合する
+type redactHandler struct {
+	slog.Handler
+	policy *RedactPolicy
+	prefix string
+}
+
+func handlerWithRedaction(handler slog.Handler, policy *RedactPolicy) *redactHandler {
+	return &redactHandler{Handler: handler, policy: policy}
+}
+
+// Handle overrides slog.Handler's Handle method.
+func (h *redactHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	record.Attrs(func(a slog.Attr) bool {
+		if a, ok := h.redactAttr(h.prefix, a); ok {
+			redacted.AddAttrs(a)
+		}
+		return true
+	})
+	return h.Handler.Handle(ctx, redacted)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, a := range attrs {
+		if a, ok := h.redactAttr(h.prefix, a); ok {
+			redacted = append(redacted, a)
+		}
+	}
+	return &redactHandler{Handler: h.Handler.WithAttrs(redacted), policy: h.policy, prefix: h.prefix}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{Handler: h.Handler.WithGroup(name), policy: h.policy, prefix: h.prefix + name + "."}
+}
+
+// redactAttr は属性にポリシーを適用する（削除する場合はfalseを返す）
+func (h *redactHandler) redactAttr(prefix string, a slog.Attr) (slog.Attr, bool) {
+	a.Value = a.Value.Resolve()
+	key := prefix + a.Key
+
+	if a.Value.Kind() == slog.KindGroup {
+		// キーが空のグループは親にインライン展開される
+		groupPrefix := prefix
+		if a.Key != "" {
+			groupPrefix = key + "."
+		}
+		var attrs []slog.Attr
+		for _, ga := range a.Value.Group() {
+			if ga, ok := h.redactAttr(groupPrefix, ga); ok {
+				attrs = append(attrs, ga)
+			}
+		}
+		a.Value = slog.GroupValue(attrs...)
+		return a, true
+	}
+
+	action, ok := h.policy.actionFor(key)
+	if !ok {
+		return a, true
+	}
+	if action == RedactDrop {
+		return slog.Attr{}, false
+	}
+	return slog.String(a.Key, h.policy.redactString(action, a.Value.String())), true
+}
@@ -0,0 +1,242 @@
+package o11y
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"otel-test/env"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func testRedactPolicy(t *testing.T) *RedactPolicy {
+	t.Helper()
+	rules, err := ParseRedactRules("user.email=hash, user.name=MASK, *.password=drop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := NewRedactPolicy("salt", rules...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+func TestNewRedactPolicyRejectsInvalidRule(t *testing.T) {
+	tests := []RedactRule{
+		{Pattern: "user.[", Action: RedactHash},
+		{Pattern: "user.email", Action: "encrypt"},
+	}
+	for _, rule := range tests {
+		if _, err := NewRedactPolicy("salt", rule); err == nil {
+			t.Errorf("NewRedactPolicy(%+v) expected error", rule)
+		}
+	}
+	// hashアクションはソルトが必要
+	if _, err := NewRedactPolicy("", RedactRule{Pattern: "user.email", Action: RedactHash}); err == nil {
+		t.Error("NewRedactPolicy expected error for hash action without salt")
+	}
+	if _, err := newRedactPolicyFromConfig(env.RedactConfig{Rules: "user.email=hash"}); err == nil {
+		t.Error("newRedactPolicyFromConfig expected error for hash action without salt")
+	}
+	if _, err := NewRedactPolicy("", RedactRule{Pattern: "user.name", Action: RedactMask}); err != nil {
+		t.Errorf("NewRedactPolicy without hash action: %v", err)
+	}
+	if _, err := ParseRedactRules("user.email"); err == nil {
+		t.Error("ParseRedactRules expected error for rule without action")
+	}
+}
+
+func TestRedactAttributes(t *testing.T) {
+	policy := testRedactPolicy(t)
+	attrs := []attribute.KeyValue{
+		attribute.Int("user.id", 1),
+		attribute.String("user.email", "taro@example.com"),
+		attribute.String("user.name", "Taro"),
+		attribute.String("auth.password", "secret"),
+		attribute.String("http.route", "/users"),
+	}
+	got := policy.RedactAttributes(attrs)
+
+	want := []attribute.KeyValue{
+		attribute.Int("user.id", 1),
+		attribute.String("user.email", policy.redactString(RedactHash, "taro@example.com")),
+		attribute.String("user.name", "T***"),
+		attribute.String("http.route", "/users"),
+	}
+	if len(got) != len(want) {
+		t.Fatalf("attrs = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("attrs[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+	if attrs[1].Value.AsString() != "taro@example.com" {
+		t.Error("RedactAttributes modified the original attributes")
+	}
+
+	// 対象がない場合は元のスライスをそのまま返す
+	plain := []attribute.KeyValue{attribute.Int("user.id", 1)}
+	if got := policy.RedactAttributes(plain); &got[0] != &plain[0] {
+		t.Error("RedactAttributes copied attributes without matching rules")
+	}
+}
+
+func TestRedactActions(t *testing.T) {
+	policy := testRedactPolicy(t)
+
+	hashed := policy.redactString(RedactHash, "taro@example.com")
+	mac := hmac.New(sha256.New, []byte("salt"))
+	mac.Write([]byte("taro@example.com"))
+	if want := "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil)[:8]); hashed != want {
+		t.Errorf("hash = %q, want %q", hashed, want)
+	}
+	if again := policy.redactString(RedactHash, "taro@example.com"); again != hashed {
+		t.Errorf("hash is not stable: %q != %q", again, hashed)
+	}
+	other, _ := NewRedactPolicy("other", RedactRule{Pattern: "user.email", Action: RedactHash})
+	if other.redactString(RedactHash, "taro@example.com") == hashed {
+		t.Error("hash does not depend on the salt")
+	}
+
+	masks := []struct {
+		in, want string
+	}{
+		{"taro@example.com", "t***@example.com"},
+		{"太郎", "太*"},
+		{"T", "T"},
+		{"", ""},
+		{"@example.com", "@example.com"},
+	}
+	for _, tt := range masks {
+		if got := policy.redactString(RedactMask, tt.in); got != tt.want {
+			t.Errorf("mask(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRedactHandler(t *testing.T) {
+	policy := testRedactPolicy(t)
+	var buf bytes.Buffer
+	logger := slog.New(handlerWithRedaction(slog.NewJSONHandler(&buf, nil), policy))
+
+	logger.With("user.name", "Taro").
+		WithGroup("user").
+		Info("created",
+			slog.String("email", "taro@example.com"),
+			slog.Group("auth", slog.String("password", "secret"), slog.String("method", "basic")),
+			slog.Group("", slog.String("name", "Hanako")),
+		)
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["user.name"] != "T***" {
+		t.Errorf("user.name = %v", got["user.name"])
+	}
+	user := got["user"].(map[string]any)
+	if user["email"] != policy.redactString(RedactHash, "taro@example.com") {
+		t.Errorf("user.email = %v", user["email"])
+	}
+	// キーが空のグループは親のグループとして照合する
+	if user["name"] != "H*****" {
+		t.Errorf("user.name in group = %v", user["name"])
+	}
+	auth := user["auth"].(map[string]any)
+	if _, ok := auth["password"]; ok || auth["method"] != "basic" {
+		t.Errorf("user.auth = %v", auth)
+	}
+	for _, s := range []string{"taro@example.com", "secret", "Hanako"} {
+		if strings.Contains(buf.String(), s) {
+			t.Errorf("log contains %q: %s", s, buf.String())
+		}
+	}
+}
+
+func TestRedactMetricView(t *testing.T) {
+	policy := testRedactPolicy(t)
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader), sdkmetric.WithView(policy.MetricView()))
+	counter, err := mp.Meter("test").Int64Counter("users.created")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, email := range []string{"taro@example.com", "hanako@example.com"} {
+		counter.Add(ctx, 1, metric.WithAttributes(attribute.String("user.email", email), attribute.String("tenant.id", "acme")))
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(ctx, &rm); err != nil {
+		t.Fatal(err)
+	}
+	points := rm.ScopeMetrics[0].Metrics[0].Data.(metricdata.Sum[int64]).DataPoints
+	// 属性を削除した結果、1つのデータポイントに集約される
+	if len(points) != 1 || points[0].Value != 2 {
+		t.Fatalf("points = %+v", points)
+	}
+	if _, ok := points[0].Attributes.Value("user.email"); ok {
+		t.Error("user.email was not removed from metrics")
+	}
+	if v, _ := points[0].Attributes.Value("tenant.id"); v.AsString() != "acme" {
+		t.Errorf("tenant.id = %v", v.AsString())
+	}
+}
+
+func TestRedactingSpanProcessor(t *testing.T) {
+	policy := testRedactPolicy(t)
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(NewRedactingSpanProcessor(policy, recorder)))
+
+	_, span := tp.Tracer("test").Start(context.Background(), "CreateUser")
+	span.SetAttributes(attribute.String("user.email", "taro@example.com"), attribute.String("auth.password", "secret"))
+	span.AddEvent("validated", trace.WithAttributes(attribute.String("user.name", "Taro")))
+	err := errors.New("user taro@example.com: already exists")
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	span.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("spans = %d", len(spans))
+	}
+	s := spans[0]
+	hashed := policy.redactString(RedactHash, "taro@example.com")
+	attrs := attribute.NewSet(s.Attributes()...)
+	if v, _ := attrs.Value("user.email"); v.AsString() != hashed {
+		t.Errorf("user.email = %q", v.AsString())
+	}
+	if _, ok := attrs.Value("auth.password"); ok {
+		t.Error("auth.password was not dropped")
+	}
+
+	events := s.Events()
+	validated, exception := attribute.NewSet(events[0].Attributes...), attribute.NewSet(events[1].Attributes...)
+	if v, _ := validated.Value("user.name"); v.AsString() != "T***" {
+		t.Errorf("event user.name = %q", v.AsString())
+	}
+	// 例外のメッセージとステータスの説明に含まれる値も置き換える
+	if v, _ := exception.Value("exception.message"); v.AsString() != "user "+hashed+": already exists" {
+		t.Errorf("exception.message = %q", v.AsString())
+	}
+	if got := s.Status().Description; got != "user "+hashed+": already exists" {
+		t.Errorf("status = %q", got)
+	}
+}
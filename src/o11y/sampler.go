@@ -0,0 +1,49 @@
+package o11y
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/sdk/trace"
+)
+
+// currentSampler は設定済みのサンプラー（デバッグ用に参照する）
+var currentSampler atomic.Pointer[trace.Sampler]
+
+// newSamplerFromEnv はOTEL_TRACES_SAMPLER/OTEL_TRACES_SAMPLER_ARGからサンプラーを作成する
+// https://opentelemetry.io/docs/languages/sdk-configuration/general/#otel_traces_sampler
+func newSamplerFromEnv() trace.Sampler {
+	ratio := 1.0
+	if arg := os.Getenv("OTEL_TRACES_SAMPLER_ARG"); arg != "" {
+		if r, err := strconv.ParseFloat(arg, 64); err == nil && r >= 0 && r <= 1 {
+			ratio = r
+		}
+	}
+
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("OTEL_TRACES_SAMPLER"))) {
+	case "always_on":
+		return trace.AlwaysSample()
+	case "always_off":
+		return trace.NeverSample()
+	case "traceidratio":
+		return trace.TraceIDRatioBased(ratio)
+	case "parentbased_always_off":
+		return trace.ParentBased(trace.NeverSample())
+	case "parentbased_traceidratio":
+		return trace.ParentBased(trace.TraceIDRatioBased(ratio))
+	default:
+		return trace.ParentBased(trace.AlwaysSample())
+	}
+}
+
+// SamplerDescription は現在のサンプラーの設定を返します
+// OpenTelemetryが無効な場合は"disabled"を返します
+func SamplerDescription() string {
+	s := currentSampler.Load()
+	if s == nil {
+		return "disabled"
+	}
+	return (*s).Description()
+}
@@ -6,10 +6,17 @@ import (
 )
 
 func SetupObservability(ctx context.Context, mode env.Mode) (func(context.Context) error, error) {
-	setupLogging()
+	// 個人情報のマスキング（スパン・ログ・メトリクス共通）
+	policy, err := newRedactPolicyFromConfig(env.GetRedactConfigFromEnv())
+	if err != nil {
+		return nil, err
+	}
+	if err := setupLogging(env.GetLogConfigFromEnv(), policy); err != nil {
+		return nil, err
+	}
 	switch mode {
 	case env.GCPOtel:
-		shutdown, err := setupOpenTelemetry(ctx)
+		shutdown, err := setupOpenTelemetry(ctx, policy)
 		if err != nil {
 			return nil, err
 		}
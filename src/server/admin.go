@@ -0,0 +1,276 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"otel-test/http/response"
+	"otel-test/o11y"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+)
+
+// redacted はシークレットを置き換える文字列
+const redacted = "[REDACTED]"
+
+// AdminServer はpprofや設定などのデバッグ情報を公開する管理用サーバー
+// 公開用のポートとは別のポートで起動する
+type AdminServer struct {
+	server    *http.Server
+	addr      string
+	deps      *AdminDependencies
+	startedAt time.Time
+}
+
+// AdminDependencies は管理用サーバーが参照する情報
+type AdminDependencies struct {
+	// Routes は公開サーバーに登録されたルートを返す
+	Routes func() []string
+	// Config はセクション名ごとの実効設定（`secret:"true"`のフィールドは伏せ字にする）
+	Config map[string]any
+	// DBStats はコネクションプールの統計情報を返す
+	DBStats func() (sql.DBStats, error)
+}
+
+// NewAdminServer は新しい管理用サーバーを作成します
+func NewAdminServer(addr string, deps *AdminDependencies) *AdminServer {
+	return &AdminServer{
+		addr:      addr,
+		deps:      deps,
+		startedAt: time.Now(),
+	}
+}
+
+func (s *AdminServer) Start(ctx context.Context) error {
+	s.server = &http.Server{
+		Addr:    s.addr,
+		Handler: s.Handler(),
+	}
+
+	if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Handler は管理用のエンドポイントを登録したハンドラーを返します
+func (s *AdminServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	// pprof
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	mux.HandleFunc("/debug/buildinfo", s.handleBuildInfo)
+	mux.HandleFunc("/debug/config", s.handleConfig)
+	mux.HandleFunc("/debug/routes", s.handleRoutes)
+	mux.HandleFunc("/debug/sampler", s.handleSampler)
+	mux.HandleFunc("/debug/db", s.handleDB)
+	mux.HandleFunc("/debug/loglevel", s.handleLogLevel)
+	return mux
+}
+
+func (s *AdminServer) Shutdown(ctx context.Context) error {
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Shutdown(ctx)
+}
+
+// handleBuildInfo はビルド情報とランタイム情報を返す
+func (s *AdminServer) handleBuildInfo(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	info := map[string]interface{}{
+		"go_version": runtime.Version(),
+		"goos":       runtime.GOOS,
+		"goarch":     runtime.GOARCH,
+		"num_cpu":    runtime.NumCPU(),
+		"gomaxprocs": runtime.GOMAXPROCS(0),
+		"goroutines": runtime.NumGoroutine(),
+		"started_at": s.startedAt,
+		"uptime":     time.Since(s.startedAt).String(),
+		"memory": map[string]uint64{
+			"heap_alloc":  mem.HeapAlloc,
+			"heap_inuse":  mem.HeapInuse,
+			"heap_sys":    mem.HeapSys,
+			"sys":         mem.Sys,
+			"num_gc":      uint64(mem.NumGC),
+			"total_alloc": mem.TotalAlloc,
+		},
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		settings := map[string]string{}
+		for _, setting := range bi.Settings {
+			settings[setting.Key] = setting.Value
+		}
+		info["path"] = bi.Path
+		info["main"] = bi.Main
+		info["settings"] = settings
+	}
+
+	response.Success(w, info)
+}
+
+// handleConfig はシークレットを伏せた実効設定を返す
+func (s *AdminServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	config := map[string]interface{}{}
+	for name, section := range s.deps.Config {
+		config[name] = redact(reflect.ValueOf(section))
+	}
+	response.Success(w, config)
+}
+
+// handleRoutes は公開サーバーのルート一覧を返す
+func (s *AdminServer) handleRoutes(w http.ResponseWriter, r *http.Request) {
+	var routes []string
+	if s.deps.Routes != nil {
+		routes = s.deps.Routes()
+	}
+	sort.Strings(routes)
+	response.Success(w, map[string]interface{}{"routes": routes})
+}
+
+// handleSampler は現在のサンプラー設定を返す
+func (s *AdminServer) handleSampler(w http.ResponseWriter, r *http.Request) {
+	response.Success(w, map[string]string{"sampler": o11y.SamplerDescription()})
+}
+
+// handleDB はコネクションプールの統計情報を返す
+func (s *AdminServer) handleDB(w http.ResponseWriter, r *http.Request) {
+	if s.deps.DBStats == nil {
+		http.Error(w, "Database not configured", http.StatusNotFound)
+		return
+	}
+	stats, err := s.deps.DBStats()
+	if err != nil {
+		response.InternalServerError(w, "Failed to get database stats")
+		return
+	}
+	response.Success(w, map[string]interface{}{
+		"max_open_connections": stats.MaxOpenConnections,
+		"open_connections":     stats.OpenConnections,
+		"in_use":               stats.InUse,
+		"idle":                 stats.Idle,
+		"wait_count":           stats.WaitCount,
+		"wait_duration":        stats.WaitDuration.String(),
+		"max_idle_closed":      stats.MaxIdleClosed,
+		"max_idle_time_closed": stats.MaxIdleTimeClosed,
+		"max_lifetime_closed":  stats.MaxLifetimeClosed,
+	})
+}
+
+// handleLogLevel はログレベルの取得・変更を行う
+//
+//	GET         : 現在のログレベルを返す
+//	PUT, POST   : {"level": "debug"} で全体、{"logger": "name", "level": "debug"} でロガーごとに変更する
+//	              ロガーを指定してlevelを空にするとロガーごとの設定を解除する
+func (s *AdminServer) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var req struct {
+			Logger string `json:"logger"`
+			Level  string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		if req.Logger != "" && req.Level == "" {
+			o11y.ClearLoggerLevel(req.Logger)
+			break
+		}
+
+		level, err := o11y.ParseLevel(req.Level)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Logger == "" {
+			o11y.SetLogLevel(level)
+		} else {
+			o11y.SetLoggerLevel(req.Logger, level)
+		}
+		slog.WarnContext(r.Context(), "log level changed by admin endpoint",
+			slog.String("logger", req.Logger),
+			slog.String("level", level.String()))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	overrides := map[string]string{}
+	for name, level := range o11y.LoggerLevels() {
+		overrides[name] = level.String()
+	}
+	response.Success(w, map[string]interface{}{
+		"level":     o11y.LogLevel().String(),
+		"overrides": overrides,
+	})
+}
+
+// redact は設定値をJSON出力用に変換し、`secret:"true"`タグのフィールドを伏せ字にする
+func redact(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	if d, ok := v.Interface().(time.Duration); ok {
+		return d.String()
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return redact(v.Elem())
+	case reflect.Struct:
+		fields := map[string]interface{}{}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if field.Tag.Get("secret") == "true" {
+				if !v.Field(i).IsZero() {
+					fields[field.Name] = redacted
+				} else {
+					fields[field.Name] = ""
+				}
+				continue
+			}
+			fields[field.Name] = redact(v.Field(i))
+		}
+		return fields
+	case reflect.Map:
+		m := map[string]interface{}{}
+		iter := v.MapRange()
+		for iter.Next() {
+			m[fmt.Sprint(iter.Key().Interface())] = redact(iter.Value())
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			list[i] = redact(v.Index(i))
+		}
+		return list
+	default:
+		return v.Interface()
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"otel-test/database"
+	"otel-test/env"
+)
+
+func TestRedact(t *testing.T) {
+	type credentials struct {
+		User     string
+		Password string `secret:"true"`
+		Token    string `secret:"true"`
+	}
+	type config struct {
+		Name     string
+		Timeout  time.Duration
+		Primary  credentials
+		Replicas []*credentials
+		Backends map[string]credentials
+		Optional *credentials
+		internal string
+	}
+	cfg := config{
+		Name:     "app",
+		Timeout:  5 * time.Second,
+		Primary:  credentials{User: "app", Password: "p@ss"},
+		Replicas: []*credentials{{User: "ro", Password: "ro-pass", Token: "tok"}},
+		Backends: map[string]credentials{"cache": {User: "redis", Token: "redis-token"}},
+		internal: "hidden",
+	}
+
+	got := redact(reflect.ValueOf(&cfg))
+	want := map[string]any{
+		"Name":    "app",
+		"Timeout": "5s",
+		// 空のシークレットは設定されていないことがわかるよう空文字列にする
+		"Primary":  map[string]any{"User": "app", "Password": redacted, "Token": ""},
+		"Replicas": []any{map[string]any{"User": "ro", "Password": redacted, "Token": redacted}},
+		"Backends": map[string]any{"cache": map[string]any{"User": "redis", "Password": "", "Token": redacted}},
+		"Optional": nil,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("redact = %#v\nwant %#v", got, want)
+	}
+}
+
+func TestAdminConfig(t *testing.T) {
+	srv := NewAdminServer("", &AdminDependencies{
+		Config: map[string]any{
+			"database": database.CloudSQLConfig{User: "app", Password: "db-password"},
+			"redact":   env.RedactConfig{Rules: "user.email=hash", HashSalt: "salt"},
+			"outbox":   env.OutboxConfig{Sinks: []string{env.SinkWebhook}, WebhookURL: "https://hooks.example.com/services/T000/B000/token"},
+			"shutdown": env.ShutdownConfig{Timeout: 30 * time.Second},
+		},
+	})
+	ts := httptest.NewServer(srv.Handler())
+	t.Cleanup(ts.Close)
+
+	res, err := http.Get(ts.URL + "/debug/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"db-password", `"salt"`, "hooks.example.com"} {
+		if strings.Contains(string(body), secret) {
+			t.Fatalf("response contains %s: %s", secret, body)
+		}
+	}
+	var config map[string]map[string]any
+	if err := json.Unmarshal(body, &config); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := config["database"]["Password"]; got != redacted {
+		t.Errorf("database.Password = %v", got)
+	}
+	if got := config["database"]["User"]; got != "app" {
+		t.Errorf("database.User = %v", got)
+	}
+	if got := config["redact"]["HashSalt"]; got != redacted {
+		t.Errorf("redact.HashSalt = %v", got)
+	}
+	if got := config["outbox"]["WebhookURL"]; got != redacted {
+		t.Errorf("outbox.WebhookURL = %v", got)
+	}
+	if got := config["outbox"]["Sinks"]; fmt.Sprint(got) != "[webhook]" {
+		t.Errorf("outbox.Sinks = %v", got)
+	}
+	if got := config["shutdown"]["Timeout"]; got != "30s" {
+		t.Errorf("shutdown.Timeout = %v", got)
+	}
+}
@@ -8,10 +8,10 @@ import (
 
 // あんま関係ない
 
-func callSingle(ctx context.Context) error {
+func callSingle(ctx context.Context, url string) error {
 	// otelhttp.Get makes an http GET request, just like net/http.Get.
 	// In addition, it records a span, records metrics, and propagates context.
-	res, err := otelhttp.Get(ctx, "http://localhost:8080/single")
+	res, err := otelhttp.Get(ctx, url)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,24 @@
+package entity
+
+import "time"
+
+// AuditResourceUser はユーザーの監査ログのResourceType
+const AuditResourceUser = "user"
+
+// AuditLog はリソースの変更履歴（監査ログ）
+// 追記のみで、更新・削除はしない
+// TenantIDは変更したリソースのテナント（database.NewTenantPluginが設定・絞り込みする）
+type AuditLog struct {
+	ID           uint64    `gorm:"primarykey"`
+	TenantID     string    `gorm:"size:63;not null;default:default;index"`
+	ResourceType string    `gorm:"size:64;not null;index:idx_audit_logs_resource,priority:1"`
+	ResourceID   uint      `gorm:"not null;index:idx_audit_logs_resource,priority:2"`
+	Action       string    `gorm:"size:16;not null"`
+	Actor        string    `gorm:"size:128;not null"`
+	RequestID    string    `gorm:"size:128;index"`
+	TraceID      string    `gorm:"size:32;index"`
+	Before       string    `gorm:"type:text"`          // JSON形式の変更前の値（作成時は空）
+	After        string    `gorm:"type:text"`          // JSON形式の変更後の値（削除時は空）
+	Changes      string    `gorm:"type:text;not null"` // JSON形式のフィールドごとの変更
+	CreatedAt    time.Time `gorm:"not null"`
+}
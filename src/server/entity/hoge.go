@@ -1,6 +1,8 @@
 package entity
 
+// Hoge は汎用のCRUDで公開するエンティティ（/hoges）
 type Hoge struct {
-	Piyo string
-	Huga int
+	Model
+	Piyo string `gorm:"size:255;not null" json:"piyo"`
+	Huga int    `gorm:"not null;default:0" json:"huga"`
 }
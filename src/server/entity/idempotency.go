@@ -0,0 +1,27 @@
+package entity
+
+import "time"
+
+// Idempotency-Keyの状態
+const (
+	IdempotencyProcessing = "processing"
+	IdempotencyCompleted  = "completed"
+)
+
+// IdempotencyKey はIdempotency-Keyと保存したレスポンス
+// 処理中のキーはLockedUntilまでロックし、ExpiresAtを過ぎたキーは再利用できる
+type IdempotencyKey struct {
+	ID          uint64 `gorm:"primarykey"`
+	Scope       string `gorm:"size:255;not null;uniqueIndex:idx_idempotency_keys_scope_key,priority:1"`
+	Key         string `gorm:"column:idempotency_key;size:255;not null;uniqueIndex:idx_idempotency_keys_scope_key,priority:2"`
+	Fingerprint string `gorm:"size:64;not null"`
+	Token       string `gorm:"size:64;not null"`
+	Status      string `gorm:"size:16;not null"`
+	StatusCode  int    `gorm:"not null;default:0"`
+	Header      string `gorm:"type:text"` // JSON形式のレスポンスヘッダー
+	Body        []byte
+	LockedUntil time.Time `gorm:"not null"`
+	ExpiresAt   time.Time `gorm:"not null;index"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
@@ -0,0 +1,31 @@
+package entity
+
+import "time"
+
+// ジョブの状態
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobDead      = "dead"
+)
+
+// Job はバックグラウンドジョブのキュー
+// ワーカーはLockedUntilまでジョブをロックし、期限が切れたジョブは再取得される
+type Job struct {
+	ID           uint64     `gorm:"primarykey" json:"id"`
+	Type         string     `gorm:"size:128;not null;index" json:"type"`
+	Payload      string     `gorm:"type:text;not null" json:"payload"`
+	Status       string     `gorm:"size:16;not null;index:idx_jobs_due,priority:1" json:"status"`
+	RunAt        time.Time  `gorm:"not null;index:idx_jobs_due,priority:2" json:"run_at"`
+	Attempts     int        `gorm:"not null;default:0" json:"attempts"`
+	MaxAttempts  int        `gorm:"not null" json:"max_attempts"`
+	UniqueKey    *string    `gorm:"size:255;uniqueIndex" json:"unique_key,omitempty"`
+	TraceContext string     `gorm:"type:text" json:"-"` // JSON形式のトレースコンテキスト
+	LockedBy     string     `gorm:"size:128" json:"-"`
+	LockedUntil  *time.Time `json:"-"`
+	LastError    string     `gorm:"type:text" json:"last_error,omitempty"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
@@ -0,0 +1,38 @@
+package entity
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Model は汎用のCRUD（repository.CRUDRepository, service.CRUDService, server.Resource）で扱うエンティティの共通フィールド
+// Versionは更新のたびに1増え、楽観的排他制御とETagに使用する
+type Model struct {
+	ID        uint           `gorm:"primarykey" json:"id"`
+	Version   uint           `gorm:"not null;default:1" json:"version"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// Modeler はModelを埋め込んだエンティティ
+type Modeler interface {
+	GetModel() *Model
+}
+
+// GetModel は共通フィールドを返します
+func (m *Model) GetModel() *Model {
+	return m
+}
+
+// ModelPtr は*TがModelerを実装する（TがModelを埋め込んでいる）ことを表す制約
+type ModelPtr[T any] interface {
+	*T
+	Modeler
+}
+
+// ModelOf はvの共通フィールドを返します
+func ModelOf[T any, PT ModelPtr[T]](v *T) *Model {
+	return PT(v).GetModel()
+}
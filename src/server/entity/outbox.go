@@ -0,0 +1,22 @@
+package entity
+
+import "time"
+
+// OutboxEvent はトランザクショナルアウトボックスに保存するドメインイベント
+// 変更と同じトランザクションで書き込み、リレーが非同期に送信する
+// TenantIDはイベントを発生させたテナント（database.NewTenantPluginが設定する）
+type OutboxEvent struct {
+	ID           uint64     `gorm:"primarykey"`
+	Type         string     `gorm:"size:64;not null;index"`
+	AggregateID  uint       `gorm:"not null;index"`
+	TenantID     string     `gorm:"size:63;not null;default:default;index"`
+	Payload      string     `gorm:"type:text;not null"`
+	TraceContext string     `gorm:"type:text"` // JSON形式のトレースコンテキスト
+	OccurredAt   time.Time  `gorm:"not null"`
+	PublishedAt  *time.Time `gorm:"index"`
+	Attempts     int        `gorm:"not null;default:0"`
+	LastError    string     `gorm:"type:text"`
+	// LockedBy とLockedUntil は送信中のリレーとロックの期限
+	LockedBy    string     `gorm:"size:128"`
+	LockedUntil *time.Time `gorm:"index"`
+}
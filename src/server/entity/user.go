@@ -6,10 +6,16 @@ import (
 	"gorm.io/gorm"
 )
 
+// User はユーザー
+// Versionは更新のたびに1増え、楽観的排他制御とETagに使用する
+// TenantIDはdatabase.NewTenantPluginがコンテキストのテナントで設定・絞り込みする
+// メールアドレスは論理削除していないユーザーの中でテナントごとに一意（削除したユーザーのメールアドレスは再び使える）
 type User struct {
 	ID        uint           `gorm:"primarykey" json:"id"`
+	TenantID  string         `gorm:"size:63;not null;default:default;uniqueIndex:idx_users_tenant_email_active,priority:1,where:deleted_at IS NULL" json:"-"`
 	Name      string         `gorm:"size:255;not null" json:"name"`
-	Email     string         `gorm:"size:255;uniqueIndex;not null" json:"email"`
+	Email     string         `gorm:"size:255;not null;uniqueIndex:idx_users_tenant_email_active,priority:2,where:deleted_at IS NULL" json:"email"`
+	Version   uint           `gorm:"not null;default:1" json:"version"`
 	CreatedAt time.Time      `json:"created_at"`
 	UpdatedAt time.Time      `json:"updated_at"`
 	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
@@ -0,0 +1,71 @@
+package entity
+
+import (
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 配信の状態
+const (
+	DeliveryPending    = "pending"
+	DeliveryDelivering = "delivering" // 送信中（LockedUntilまでロックする）
+	DeliverySucceeded  = "succeeded"
+	DeliveryDead       = "dead" // 最大試行回数を超えた（デッドレター）
+)
+
+// WebhookSubscription はwebhookの送信先とイベントのフィルター
+// TenantIDは登録したテナントで、同じテナントのイベントだけを配信する（database.NewTenantPluginが設定・絞り込みする）
+type WebhookSubscription struct {
+	ID         uint           `gorm:"primarykey" json:"id"`
+	TenantID   string         `gorm:"size:63;not null;default:default;index" json:"-"`
+	URL        string         `gorm:"size:2048;not null" json:"url"`
+	EventTypes string         `gorm:"size:1024;not null" json:"-"` // カンマ区切り（空の場合はすべて）
+	Secret     string         `gorm:"size:255;not null" json:"-"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+	DeletedAt  gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// Events はフィルターのイベントの種類を返します
+func (s *WebhookSubscription) Events() []string {
+	if s.EventTypes == "" {
+		return []string{}
+	}
+	return strings.Split(s.EventTypes, ",")
+}
+
+// WebhookDelivery はイベントごと・送信先ごとの配信
+// TenantIDは購読と同じテナント（database.NewTenantPluginが設定・絞り込みする）
+// 送信するインスタンスはLockedUntilまで配信をロックし、期限が切れた配信は再取得される
+type WebhookDelivery struct {
+	ID             uint       `gorm:"primarykey" json:"id"`
+	TenantID       string     `gorm:"size:63;not null;default:default;index" json:"-"`
+	SubscriptionID uint       `gorm:"not null;index" json:"subscription_id"`
+	EventID        uint64     `gorm:"not null" json:"event_id"`
+	EventType      string     `gorm:"size:64;not null" json:"event_type"`
+	Payload        string     `gorm:"type:text;not null" json:"-"`
+	TraceContext   string     `gorm:"type:text" json:"-"` // イベントを発生させたリクエストのトレースコンテキスト
+	Status         string     `gorm:"size:16;not null;index" json:"status"`
+	Attempts       int        `gorm:"not null;default:0" json:"attempts"`
+	NextAttemptAt  time.Time  `gorm:"not null;index" json:"next_attempt_at"`
+	LastStatusCode int        `json:"last_status_code,omitempty"`
+	LastError      string     `gorm:"type:text" json:"last_error,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+	LockedBy       string     `gorm:"size:128" json:"-"`
+	LockedUntil    *time.Time `json:"-"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// WebhookAttempt は配信の試行ごとの記録
+type WebhookAttempt struct {
+	ID         uint      `gorm:"primarykey" json:"id"`
+	DeliveryID uint      `gorm:"not null;index" json:"delivery_id"`
+	Attempt    int       `gorm:"not null" json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `gorm:"type:text" json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
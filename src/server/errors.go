@@ -0,0 +1,45 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"otel-test/server/service"
+
+	"google.golang.org/grpc/codes"
+)
+
+// errorMappings はドメインエラーとトランスポートごとのステータスコードの対応
+// HTTPとgRPCで同じ対応を使う
+var errorMappings = []struct {
+	err  error
+	http int
+	grpc codes.Code
+}{
+	{service.ErrNotFound, http.StatusNotFound, codes.NotFound},
+	{service.ErrAlreadyExists, http.StatusConflict, codes.AlreadyExists},
+	{service.ErrInvalidArgument, http.StatusBadRequest, codes.InvalidArgument},
+	{service.ErrPreconditionFailed, http.StatusPreconditionFailed, codes.Aborted},
+	{service.ErrUnavailable, http.StatusServiceUnavailable, codes.Unavailable},
+}
+
+// httpStatus はエラーに対応するHTTPステータスコードを返します
+// ドメインエラーでない場合は500
+func httpStatus(err error) int {
+	for _, m := range errorMappings {
+		if errors.Is(err, m.err) {
+			return m.http
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// grpcCode はエラーに対応するgRPCステータスコードを返します
+// ドメインエラーでない場合はInternal
+func grpcCode(err error) codes.Code {
+	for _, m := range errorMappings {
+		if errors.Is(err, m.err) {
+			return m.grpc
+		}
+	}
+	return codes.Internal
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"otel-test/http/compress"
+	"otel-test/server/entity"
+	"otel-test/server/service"
+	"strconv"
+	"strings"
+)
+
+// userETag はユーザーのETag（強いエンティティタグ）を返します
+// 値はバージョンで、更新のたびに変わる
+func userETag(user *entity.User) string {
+	return versionETag(user.Version)
+}
+
+// versionETag はバージョンのETag（強いエンティティタグ）を返します
+func versionETag(version uint) string {
+	return `"` + strconv.FormatUint(uint64(version), 10) + `"`
+}
+
+// splitETags はIf-Match/If-None-Matchのエンティティタグの一覧を分割します
+// 圧縮したレスポンスのETag（"3-gzip"）は、判定する側でcompress.TrimETagで元のETagに戻す
+func splitETags(header string) []string {
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// notModified はIf-None-Matchがetagに一致するかを弱い比較で判定します
+func notModified(header, etag string) bool {
+	for _, tag := range splitETags(header) {
+		if tag == "*" || strings.TrimPrefix(compress.TrimETag(tag), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatchVersion はIf-Matchから更新の前提となるバージョンを返します
+// 未指定または"*"の場合は0（バージョンを確認しない）
+// If-Matchは強い比較のため弱いエンティティタグは一致しない
+// 一致し得るタグがない場合はservice.ErrPreconditionFailed、異なるバージョンを複数指定した場合はservice.ErrInvalidArgumentを返す
+func ifMatchVersion(header string) (uint, error) {
+	tags := splitETags(header)
+	if len(tags) == 0 {
+		return 0, nil
+	}
+
+	var version uint
+	for _, tag := range tags {
+		if tag == "*" {
+			return 0, nil
+		}
+		unquoted, err := strconv.Unquote(compress.TrimETag(tag))
+		if err != nil || strings.HasPrefix(tag, "W/") {
+			continue
+		}
+		v, err := strconv.ParseUint(unquoted, 10, 32)
+		if err != nil || v == 0 {
+			continue
+		}
+		if version != 0 && uint(v) != version {
+			return 0, fmt.Errorf("If-Match with multiple entity tags is not supported: %w", service.ErrInvalidArgument)
+		}
+		version = uint(v)
+	}
+	if version == 0 {
+		return 0, fmt.Errorf("If-Match %s does not match: %w", header, service.ErrPreconditionFailed)
+	}
+	return version, nil
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"otel-test/audit"
+	"otel-test/env"
+	"otel-test/o11y"
+	userv1 "otel-test/proto/user/v1"
+	"otel-test/shutdown"
+	"otel-test/tenant"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCServer はgRPCサーバーの実装
+// UserServiceとヘルスチェック、リフレクションを公開する
+type GRPCServer struct {
+	server *grpc.Server
+	health *health.Server
+	addr   string
+}
+
+// NewGRPCServer は新しいgRPCサーバーを作成します
+// HTTPサーバーと同じ依存性を使用する
+func NewGRPCServer(addr string, mode env.Mode, deps *Dependencies) *GRPCServer {
+	tenants := deps.Tenants
+	if tenants == nil {
+		tenants = tenant.NewResolver(tenant.Config{Default: "default"})
+	}
+	auditResolver := deps.Audit
+	if auditResolver == nil {
+		auditResolver = audit.NewResolver(audit.Config{})
+	}
+	// アクセスログにもtenant.idを付与するため、最初にテナントを解決する
+	unary := []grpc.UnaryServerInterceptor{tenantUnaryInterceptor(tenants), accessLogUnaryInterceptor, auditMetadataUnaryInterceptor(auditResolver)}
+	if deps.InFlight != nil {
+		unary = append(unary, trackInFlightUnaryInterceptor(deps.InFlight))
+	}
+	opts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(unary...)}
+	if mode == env.GCPOtel {
+		opts = append(opts, grpc.StatsHandler(otelgrpc.NewServerHandler()))
+	}
+
+	s := &GRPCServer{
+		server: grpc.NewServer(opts...),
+		health: health.NewServer(),
+		addr:   addr,
+	}
+	userv1.RegisterUserServiceServer(s.server, newUserServiceServer(deps.UserService))
+	healthpb.RegisterHealthServer(s.server, s.health)
+	reflection.Register(s.server)
+
+	s.health.SetServingStatus(userv1.UserService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	return s
+}
+
+func (s *GRPCServer) Start(ctx context.Context) error {
+	lis, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	return s.server.Serve(lis)
+}
+
+// SetServing はヘルスチェックの状態を変更します
+// Graceful Shutdown時にNOT_SERVINGにしてロードバランサーから外す
+func (s *GRPCServer) SetServing(serving bool) {
+	if serving {
+		s.health.Resume()
+		return
+	}
+	s.health.Shutdown()
+}
+
+// Shutdown は実行中のRPCの完了を待ってからサーバーを停止します
+// ctxが終了した場合は実行中のRPCを強制的に終了する
+func (s *GRPCServer) Shutdown(ctx context.Context) error {
+	s.health.Shutdown()
+
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		s.server.Stop()
+		<-stopped
+		return ctx.Err()
+	}
+}
+
+// accessLogUnaryInterceptor はRPCごとにアクセスログを出力するインターセプター
+func accessLogUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	code := status.Code(err)
+
+	level := slog.LevelInfo
+	switch code {
+	case codes.OK:
+	case codes.Unknown, codes.DeadlineExceeded, codes.Unimplemented, codes.Internal, codes.Unavailable, codes.DataLoss:
+		level = slog.LevelError
+	default:
+		level = slog.LevelWarn
+	}
+
+	o11y.Logger("access").LogAttrs(ctx, level, "rpc completed",
+		slog.String("rpc.method", info.FullMethod),
+		slog.String("rpc.grpc.status_code", code.String()),
+		slog.Duration("latency", time.Since(start)),
+	)
+	return resp, err
+}
+
+// trackInFlightUnaryInterceptor は実行中のRPCをtrackerで数えるインターセプター
+func trackInFlightUnaryInterceptor(tracker *shutdown.Tracker) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		done := tracker.Add()
+		defer done()
+		return handler(ctx, req)
+	}
+}
+
+// auditMetadataUnaryInterceptor は変更したユーザーとリクエストIDをコンテキストに設定するインターセプター
+// HTTPと同じ名前のメタデータから取得し、リクエストIDはレスポンスヘッダーで返す
+func auditMetadataUnaryInterceptor(resolver *audit.Resolver) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		var remoteAddr string
+		if p, ok := peer.FromContext(ctx); ok {
+			remoteAddr = p.Addr.String()
+		}
+		meta := resolver.Metadata(ctx, remoteAddr, func(name string) string {
+			if v := md.Get(name); len(v) > 0 {
+				return v[0]
+			}
+			return ""
+		})
+		_ = grpc.SetHeader(ctx, metadata.Pairs(audit.HeaderRequestID, meta.RequestID))
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.String("enduser.id", meta.Actor),
+			attribute.String("request.id", meta.RequestID),
+		)
+		return handler(audit.WithMetadata(ctx, meta), req)
+	}
+}
+
+// tenantUnaryInterceptor はRPCのテナントをコンテキストに設定するインターセプター
+// HTTPと同じ名前のメタデータから取得し、:authorityをホストとして扱う
+// テナントで分離するUserServiceでは、テナントが決まらないRPCをInvalidArgumentで拒否する
+func tenantUnaryInterceptor(resolver *tenant.Resolver) grpc.UnaryServerInterceptor {
+	userService := "/" + userv1.UserService_ServiceDesc.ServiceName + "/"
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		get := func(name string) string {
+			if v := md.Get(name); len(v) > 0 {
+				return v[0]
+			}
+			return ""
+		}
+		id, err := resolver.Resolve(get(":authority"), get)
+		if err != nil {
+			if strings.HasPrefix(info.FullMethod, userService) {
+				trace.SpanFromContext(ctx).RecordError(err)
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			return handler(ctx, req)
+		}
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String(tenant.AttributeKey, id))
+		ctx = tenant.WithID(ctx, id)
+		if resolver.Bounded() {
+			ctx = tenant.WithMetricAttribute(ctx)
+		}
+		return handler(ctx, req)
+	}
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"otel-test/database/databasetest"
+	"otel-test/env"
+	"otel-test/o11y/o11ytest"
+	userv1 "otel-test/proto/user/v1"
+	"otel-test/server/entity"
+	"otel-test/server/repository"
+	"otel-test/server/service"
+	"otel-test/tenant"
+
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// newTestGRPCServer はインメモリのテレメトリとSQLiteを使ったテスト用gRPCサーバーを起動します
+func newTestGRPCServer(t *testing.T) (*o11ytest.Harness, *GRPCServer, *grpc.ClientConn) {
+	t.Helper()
+	h := o11ytest.New(t)
+	db := databasetest.New(t, &entity.User{}, &entity.OutboxEvent{}, &entity.AuditLog{})
+
+	srv := NewGRPCServer("", env.GCPOtel, &Dependencies{
+		UserService: service.NewUserService(db, repository.NewUserRepository(db), repository.NewOutboxRepository(db), repository.NewAuditRepository(db)),
+		Tenants:     tenant.NewResolver(tenant.Config{Header: "X-Tenant-ID", Default: "default"}),
+	})
+
+	lis := bufconn.Listen(1 << 20)
+	go srv.server.Serve(lis)
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return h, srv, conn
+}
+
+func TestGRPCUserLifecycle(t *testing.T) {
+	h, _, conn := newTestGRPCServer(t)
+	client := userv1.NewUserServiceClient(conn)
+	ctx := context.Background()
+
+	created, err := client.CreateUser(ctx, &userv1.CreateUserRequest{Name: "Taro", Email: "taro@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.GetId() == 0 || created.GetCreateTime() == nil {
+		t.Fatalf("unexpected user: %v", created)
+	}
+
+	h.Spans().HasTree(
+		o11ytest.T("user.v1.UserService/CreateUser",
+			o11ytest.T("UserService.CreateUser",
+				o11ytest.T("DB.WithinTx",
+					o11ytest.T("UserRepository.Create", o11ytest.T("insert users")),
+					o11ytest.T("AuditRepository.Add", o11ytest.T("insert audit_logs")),
+					o11ytest.T("OutboxRepository.Add", o11ytest.T("insert outbox_events")),
+				),
+			),
+		),
+	)
+	h.Span("user.v1.UserService/CreateUser").
+		HasKind(trace.SpanKindServer).
+		HasAttr("rpc.system", "grpc").
+		HasAttr("rpc.grpc.status_code", int64(codes.OK))
+
+	updated, err := client.UpdateUser(ctx, &userv1.UpdateUserRequest{Id: created.GetId(), Name: proto.String("Jiro")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.GetName() != "Jiro" || updated.GetEmail() != "taro@example.com" || updated.GetVersion() != created.GetVersion()+1 {
+		t.Fatalf("unexpected user: %v", updated)
+	}
+
+	got, err := client.GetUser(ctx, &userv1.GetUserRequest{Id: created.GetId()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.GetName() != "Jiro" {
+		t.Fatalf("unexpected user: %v", got)
+	}
+
+	list, err := client.ListUsers(ctx, &userv1.ListUsersRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.GetUsers()) != 1 {
+		t.Fatalf("len(users) = %d, want 1", len(list.GetUsers()))
+	}
+
+	if _, err := client.DeleteUser(ctx, &userv1.DeleteUserRequest{Id: created.GetId()}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Reset()
+	_, err = client.GetUser(ctx, &userv1.GetUserRequest{Id: created.GetId()})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("code = %v, want %v", status.Code(err), codes.NotFound)
+	}
+	h.Span("UserService.GetUserByID").HasAttr("user.not_found", true).NoError()
+	h.Span("user.v1.UserService/GetUser").HasAttr("rpc.grpc.status_code", int64(codes.NotFound))
+}
+
+func TestGRPCErrorMapping(t *testing.T) {
+	h, _, conn := newTestGRPCServer(t)
+	client := userv1.NewUserServiceClient(conn)
+	ctx := context.Background()
+
+	created, err := client.CreateUser(ctx, &userv1.CreateUserRequest{Name: "Taro", Email: "taro@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		call func() error
+		want codes.Code
+	}{
+		{"duplicate", func() error {
+			_, err := client.CreateUser(ctx, &userv1.CreateUserRequest{Name: "Taro", Email: "taro@example.com"})
+			return err
+		}, codes.AlreadyExists},
+		{"empty name", func() error {
+			_, err := client.CreateUser(ctx, &userv1.CreateUserRequest{Email: "jiro@example.com"})
+			return err
+		}, codes.InvalidArgument},
+		{"update missing", func() error {
+			_, err := client.UpdateUser(ctx, &userv1.UpdateUserRequest{Id: 42, Name: proto.String("Jiro")})
+			return err
+		}, codes.NotFound},
+		{"update stale version", func() error {
+			_, err := client.UpdateUser(ctx, &userv1.UpdateUserRequest{Id: created.GetId(), Version: created.GetVersion() + 1, Name: proto.String("Jiro")})
+			return err
+		}, codes.Aborted},
+		{"delete stale version", func() error {
+			_, err := client.DeleteUser(ctx, &userv1.DeleteUserRequest{Id: created.GetId(), Version: created.GetVersion() + 1})
+			return err
+		}, codes.Aborted},
+		{"delete missing", func() error {
+			_, err := client.DeleteUser(ctx, &userv1.DeleteUserRequest{Id: 42})
+			return err
+		}, codes.NotFound},
+		{"invalid limit", func() error {
+			_, err := client.ListUsers(ctx, &userv1.ListUsersRequest{Limit: 101})
+			return err
+		}, codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := status.Code(tt.call()); got != tt.want {
+				t.Fatalf("code = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// HTTPと同じ対応でクライアントエラーはサーバースパンをエラーにしない
+	for _, s := range h.Spans().Named("user.v1.UserService/CreateUser").Each() {
+		s.HasStatus(otelcodes.Unset)
+	}
+	h.Logs().Containing("rpc completed").WithAttr("rpc.grpc.status_code", "AlreadyExists").Len(1)
+	h.Spans().Named("UserService.CreateUser").Len(3)
+}
+
+func TestGRPCTenantIsolation(t *testing.T) {
+	h, _, conn := newTestGRPCServer(t)
+	client := userv1.NewUserServiceClient(conn)
+	acme := metadata.AppendToOutgoingContext(context.Background(), "x-tenant-id", "acme")
+	globex := metadata.AppendToOutgoingContext(context.Background(), "x-tenant-id", "globex")
+
+	created, err := client.CreateUser(acme, &userv1.CreateUserRequest{Name: "Taro", Email: "taro@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Span("user.v1.UserService/CreateUser").HasAttr(tenant.AttributeKey, "acme")
+	h.Span("insert users").HasAttr(tenant.AttributeKey, "acme")
+	h.Logs().Containing("rpc completed").WithAttr(tenant.AttributeKey, "acme").Len(1)
+
+	if _, err := client.GetUser(globex, &userv1.GetUserRequest{Id: created.GetId()}); status.Code(err) != codes.NotFound {
+		t.Fatalf("code = %v, want %v", status.Code(err), codes.NotFound)
+	}
+	if _, err := client.DeleteUser(globex, &userv1.DeleteUserRequest{Id: created.GetId(), Version: created.GetVersion()}); status.Code(err) != codes.NotFound {
+		t.Fatalf("code = %v, want %v", status.Code(err), codes.NotFound)
+	}
+	if _, err := client.GetUser(acme, &userv1.GetUserRequest{Id: created.GetId()}); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := metadata.AppendToOutgoingContext(context.Background(), "x-tenant-id", "Not_A_Tenant")
+	if _, err := client.GetUser(invalid, &userv1.GetUserRequest{Id: created.GetId()}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("code = %v, want %v", status.Code(err), codes.InvalidArgument)
+	}
+	// テナントで分離しないサービスは拒否しない
+	health := healthpb.NewHealthClient(conn)
+	if _, err := health.Check(invalid, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGRPCHealth(t *testing.T) {
+	_, srv, conn := newTestGRPCServer(t)
+	client := healthpb.NewHealthClient(conn)
+	ctx := context.Background()
+
+	check := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		t.Helper()
+		res, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.GetStatus()
+	}
+
+	for _, service := range []string{"", userv1.UserService_ServiceDesc.ServiceName} {
+		if got := check(service); got != healthpb.HealthCheckResponse_SERVING {
+			t.Fatalf("status(%q) = %v, want SERVING", service, got)
+		}
+	}
+
+	srv.SetServing(false)
+	if got := check(""); got != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("status = %v, want NOT_SERVING", got)
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	userv1 "otel-test/proto/user/v1"
+	"otel-test/server/entity"
+	"otel-test/server/service"
+
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// userServiceServer はUserServiceのgRPC実装
+type userServiceServer struct {
+	userv1.UnimplementedUserServiceServer
+	userService *service.UserService
+}
+
+func newUserServiceServer(userService *service.UserService) *userServiceServer {
+	return &userServiceServer{userService: userService}
+}
+
+func (s *userServiceServer) CreateUser(ctx context.Context, req *userv1.CreateUserRequest) (*userv1.User, error) {
+	user, err := s.userService.CreateUser(ctx, req.GetName(), req.GetEmail())
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return toProtoUser(user), nil
+}
+
+func (s *userServiceServer) GetUser(ctx context.Context, req *userv1.GetUserRequest) (*userv1.User, error) {
+	user, err := s.userService.GetUserByID(ctx, uint(req.GetId()))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return toProtoUser(user), nil
+}
+
+func (s *userServiceServer) ListUsers(ctx context.Context, req *userv1.ListUsersRequest) (*userv1.ListUsersResponse, error) {
+	// HTTPの/usersと同じ範囲に制限する
+	limit := int(req.GetLimit())
+	if limit == 0 {
+		limit = 10
+	}
+	if limit < 1 || limit > 100 {
+		return nil, status.Error(codes.InvalidArgument, "limit must be between 1 and 100")
+	}
+	offset := int(req.GetOffset())
+	if offset < 0 {
+		return nil, status.Error(codes.InvalidArgument, "offset must not be negative")
+	}
+
+	users, err := s.userService.ListUsers(ctx, limit, offset)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	res := &userv1.ListUsersResponse{Users: make([]*userv1.User, 0, len(users))}
+	for i := range users {
+		res.Users = append(res.Users, toProtoUser(&users[i]))
+	}
+	return res, nil
+}
+
+func (s *userServiceServer) UpdateUser(ctx context.Context, req *userv1.UpdateUserRequest) (*userv1.User, error) {
+	user, err := s.userService.UpdateUser(ctx, uint(req.GetId()), uint(req.GetVersion()), req.Name, req.Email)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return toProtoUser(user), nil
+}
+
+func (s *userServiceServer) DeleteUser(ctx context.Context, req *userv1.DeleteUserRequest) (*emptypb.Empty, error) {
+	if err := s.userService.DeleteUser(ctx, uint(req.GetId()), uint(req.GetVersion())); err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// grpcError はサービス層のエラーをgRPCのステータスに変換します
+// 内部エラーの詳細はクライアントに返さずスパンに記録する
+func grpcError(ctx context.Context, err error) error {
+	code := grpcCode(err)
+	if code == codes.Internal {
+		trace.SpanFromContext(ctx).RecordError(err)
+		return status.Error(code, "internal error")
+	}
+	return status.Error(code, err.Error())
+}
+
+func toProtoUser(user *entity.User) *userv1.User {
+	return &userv1.User{
+		Id:         uint32(user.ID),
+		Name:       user.Name,
+		Email:      user.Email,
+		CreateTime: timestamppb.New(user.CreatedAt),
+		UpdateTime: timestamppb.New(user.UpdatedAt),
+		Version:    uint32(user.Version),
+	}
+}
@@ -3,31 +3,34 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math/rand"
 	"net/http"
 	"otel-test/http/response"
+	"otel-test/server/service"
+	"otel-test/tenant"
 	"strconv"
 
 	"go.opentelemetry.io/otel/attribute"
 )
 
-func handlerSingle() http.HandlerFunc {
+func handlerSingle(wk *work) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		sleepTime := randomSleep(r)
+		sleepTime := wk.randomSleep(r)
 		fmt.Fprintf(w, "work completed in %v\n", sleepTime)
 	}
 }
 
-func handlerMulti() http.HandlerFunc {
+func handlerMulti(wk *work) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		subRequests := 3 + rand.Intn(4)
 		// Write a structured log with the request context, which allows the log to
 		// be linked with the trace for this request.
 		slog.InfoContext(r.Context(), "handle /multi request", slog.Int("subRequests", subRequests))
 
-		err := computeSubrequests(r, subRequests)
+		err := wk.computeSubrequests(r, subRequests)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadGateway)
 			return
@@ -65,8 +68,8 @@ func (s *HTTPServer) handleHealth() http.HandlerFunc {
 func (s *HTTPServer) performHealthCheck(ctx context.Context) error {
 	// データベース接続チェック（UserServiceが利用可能な場合）
 	if s.userService != nil {
-		// 簡単なクエリでデータベース接続を確認
-		_, err := s.userService.ListUsers(ctx, 1, 0)
+		// 簡単なクエリでデータベース接続を確認（結果は返さないため、テナントに関係なく読み込む）
+		_, err := s.userService.ListUsers(tenant.WithAllTenants(ctx), 1, 0)
 		if err != nil {
 			return fmt.Errorf("database health check failed: %w", err)
 		}
@@ -123,8 +126,7 @@ func (s *HTTPServer) getUsersList(ctx context.Context, w http.ResponseWriter, r
 	// サービス層の呼び出し
 	users, err := s.userService.ListUsers(ctx, limit, offset)
 	if err != nil {
-		span.RecordError(err)
-		response.InternalServerError(w, "Failed to get users")
+		writeServiceError(w, span, err, "Failed to get users")
 		return
 	}
 
@@ -137,30 +139,26 @@ func (s *HTTPServer) getUsersList(ctx context.Context, w http.ResponseWriter, r
 	})
 }
 
+// createUserRequest はユーザー作成のリクエストボディ
+// 形式はOpenAPIドキュメントのCreateUserRequestで検証済み
+type createUserRequest struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
 // createUser は新しいユーザーを作成
 func (s *HTTPServer) createUser(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	ctx, span := s.tracer.Start(ctx, "create-user")
 	defer span.End()
 
 	// リクエストボディの解析
-	var req struct {
-		Name  string `json:"name"`
-		Email string `json:"email"`
-	}
-
+	var req createUserRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		span.RecordError(err)
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
-	// バリデーション
-	if req.Name == "" || req.Email == "" {
-		span.SetAttributes(attribute.Bool("validation.failed", true))
-		http.Error(w, "Name and email are required", http.StatusBadRequest)
-		return
-	}
-
 	span.SetAttributes(
 		attribute.String("user.name", req.Name),
 		attribute.String("user.email", req.Email),
@@ -169,18 +167,20 @@ func (s *HTTPServer) createUser(ctx context.Context, w http.ResponseWriter, r *h
 	// サービス層の呼び出し
 	user, err := s.userService.CreateUser(ctx, req.Name, req.Email)
 	if err != nil {
-		span.RecordError(err)
-		response.InternalServerError(w, "Failed to create user")
+		// 一意制約違反などのクライアントエラーもスパンに記録する
+		if httpStatus(err) < http.StatusInternalServerError {
+			span.RecordError(err)
+		}
+		writeServiceError(w, span, err, "Failed to create user")
 		return
 	}
 
 	span.SetAttributes(attribute.Int("user.created_id", int(user.ID)))
 
-	w.WriteHeader(http.StatusCreated)
-	response.Success(w, user)
+	response.JSON(w, http.StatusCreated, user)
 }
 
-// handleUserByID は特定ユーザーの取得エンドポイント
+// handleUserByID は特定ユーザーの取得/更新/削除エンドポイント
 func (s *HTTPServer) handleUserByID() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -188,6 +188,10 @@ func (s *HTTPServer) handleUserByID() http.HandlerFunc {
 		switch r.Method {
 		case http.MethodGet:
 			s.getUserByID(ctx, w, r)
+		case http.MethodPatch:
+			s.updateUser(ctx, w, r)
+		case http.MethodDelete:
+			s.deleteUser(ctx, w, r)
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
@@ -215,17 +219,98 @@ func (s *HTTPServer) getUserByID(ctx context.Context, w http.ResponseWriter, r *
 
 	// サービス層の呼び出し
 	user, err := s.userService.GetUserByID(ctx, uint(id))
+	if errors.Is(err, service.ErrNotFound) {
+		span.SetAttributes(attribute.Bool("user.not_found", true))
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeServiceError(w, span, err, "Failed to get user")
+		return
+	}
+
+	etag := userETag(user)
+	span.SetAttributes(attribute.Int("user.version", int(user.Version)))
+	w.Header().Set("ETag", etag)
+	if notModified(r.Header.Get("If-None-Match"), etag) {
+		span.SetAttributes(attribute.Bool("http.not_modified", true))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	response.Success(w, user)
+}
+
+// updateUserRequest はユーザー更新のリクエストボディ
+// 形式はOpenAPIドキュメントのUpdateUserRequestで検証済み
+type updateUserRequest struct {
+	Name  *string `json:"name"`
+	Email *string `json:"email"`
+}
+
+// updateUser はユーザーを更新
+// If-Matchを指定した場合は、ETagが一致するときだけ更新する
+func (s *HTTPServer) updateUser(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ctx, span := s.tracer.Start(ctx, "update-user")
+	defer span.End()
+
+	id := pathID(r, "id")
+	span.SetAttributes(attribute.Int("user.id", int(id)))
+
+	version, err := ifMatchVersion(r.Header.Get("If-Match"))
 	if err != nil {
+		writeServiceError(w, span, err, "Failed to update user")
+		return
+	}
+
+	var req updateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		span.RecordError(err)
-		response.InternalServerError(w, "Failed to get user")
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
-	if user == nil {
-		span.SetAttributes(attribute.Bool("user.not_found", true))
-		http.Error(w, "User not found", http.StatusNotFound)
+	user, err := s.userService.UpdateUser(ctx, id, version, req.Name, req.Email)
+	if err != nil {
+		writeServiceError(w, span, err, "Failed to update user")
 		return
 	}
 
+	span.SetAttributes(attribute.Int("user.version", int(user.Version)))
+	w.Header().Set("ETag", userETag(user))
 	response.Success(w, user)
 }
+
+// deleteUser はユーザーを削除
+// If-Matchを指定した場合は、ETagが一致するときだけ削除する
+func (s *HTTPServer) deleteUser(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ctx, span := s.tracer.Start(ctx, "delete-user")
+	defer span.End()
+
+	id := pathID(r, "id")
+	span.SetAttributes(attribute.Int("user.id", int(id)))
+
+	version, err := ifMatchVersion(r.Header.Get("If-Match"))
+	if err != nil {
+		writeServiceError(w, span, err, "Failed to delete user")
+		return
+	}
+
+	if err := s.userService.DeleteUser(ctx, id, version); err != nil {
+		writeServiceError(w, span, err, "Failed to delete user")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleReady はReadinessエンドポイント
+// Graceful Shutdownが始まると503を返し、ロードバランサーからの新規トラフィックを止める
+func (s *HTTPServer) handleReady() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.readiness != nil && !s.readiness.IsReady() {
+			http.Error(w, "Not ready", http.StatusServiceUnavailable)
+			return
+		}
+		response.Success(w, map[string]string{"status": "ready"})
+	}
+}
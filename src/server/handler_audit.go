@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"otel-test/http/response"
+	"otel-test/server/entity"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// auditExportPageSize はCSVのエクスポートで1回に読み込む監査ログの件数
+const auditExportPageSize = 500
+
+// auditLogResponse は監査ログのレスポンス
+type auditLogResponse struct {
+	ID        uint64          `json:"id"`
+	Action    string          `json:"action"`
+	Actor     string          `json:"actor"`
+	RequestID string          `json:"request_id,omitempty"`
+	TraceID   string          `json:"trace_id,omitempty"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+	Changes   json.RawMessage `json:"changes"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+func newAuditLogResponse(log *entity.AuditLog) auditLogResponse {
+	return auditLogResponse{
+		ID:        log.ID,
+		Action:    log.Action,
+		Actor:     log.Actor,
+		RequestID: log.RequestID,
+		TraceID:   log.TraceID,
+		Before:    rawJSON(log.Before),
+		After:     rawJSON(log.After),
+		Changes:   rawJSON(log.Changes),
+		CreatedAt: log.CreatedAt,
+	}
+}
+
+// rawJSON は保存されたJSONを返します。空の場合はnull
+func rawJSON(s string) json.RawMessage {
+	if s == "" {
+		return json.RawMessage("null")
+	}
+	return json.RawMessage(s)
+}
+
+// handleUserAudit はユーザーの監査ログの一覧/エクスポートエンドポイント
+// format=csvの場合はcursor以降の全ての監査ログをCSVで返す
+func (s *HTTPServer) handleUserAudit() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx, span := s.tracer.Start(r.Context(), "list-user-audit")
+		defer span.End()
+
+		id := pathID(r, "id")
+		// 形式はOpenAPIドキュメントで検証済み
+		query := r.URL.Query()
+		cursor, _ := strconv.ParseUint(query.Get("cursor"), 10, 64)
+		span.SetAttributes(
+			attribute.Int("user.id", int(id)),
+			attribute.String("audit.format", query.Get("format")),
+		)
+
+		if query.Get("format") == "csv" {
+			s.exportUserAudit(ctx, w, span, id, cursor)
+			return
+		}
+
+		limit := 50
+		if l, err := strconv.Atoi(query.Get("limit")); err == nil {
+			limit = l
+		}
+		// 次のページがあるかを判定するため1件多く読み込む
+		logs, err := s.userService.ListUserAudit(ctx, id, cursor, limit+1)
+		if err != nil {
+			writeServiceError(w, span, err, "Failed to list audit logs")
+			return
+		}
+
+		res := map[string]any{}
+		if len(logs) > limit {
+			logs = logs[:limit]
+			res["next_cursor"] = strconv.FormatUint(logs[len(logs)-1].ID, 10)
+		}
+		entries := make([]auditLogResponse, 0, len(logs))
+		for i := range logs {
+			entries = append(entries, newAuditLogResponse(&logs[i]))
+		}
+		res["entries"] = entries
+		response.Success(w, res)
+	}
+}
+
+// exportUserAudit はcursor以降の監査ログを全てCSVで書き込みます
+// ページごとに読み込んで書き込むため、件数が多くてもメモリに全て載せない
+func (s *HTTPServer) exportUserAudit(ctx context.Context, w http.ResponseWriter, span trace.Span, id uint, cursor uint64) {
+	logs, err := s.userService.ListUserAudit(ctx, id, cursor, auditExportPageSize)
+	if err != nil {
+		writeServiceError(w, span, err, "Failed to export audit logs")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%d-audit.csv"`, id))
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"id", "created_at", "action", "actor", "request_id", "trace_id", "changes"})
+
+	count := 0
+	for len(logs) > 0 {
+		for _, log := range logs {
+			_ = cw.Write([]string{
+				strconv.FormatUint(log.ID, 10),
+				log.CreatedAt.UTC().Format(time.RFC3339Nano),
+				log.Action,
+				log.Actor,
+				log.RequestID,
+				log.TraceID,
+				log.Changes,
+			})
+		}
+		count += len(logs)
+		if len(logs) < auditExportPageSize {
+			break
+		}
+		// ヘッダーは送信済みのため、途中のエラーはスパンに記録して打ち切る
+		logs, err = s.userService.ListUserAudit(ctx, id, logs[len(logs)-1].ID, auditExportPageSize)
+		if err != nil {
+			span.RecordError(err)
+			break
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		span.RecordError(err)
+	}
+	span.SetAttributes(attribute.Int("result.count", count))
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"mime"
+	"net/http"
+	"otel-test/http/response"
+	"otel-test/server/entity"
+	"otel-test/server/service"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// maxImportSize は一括登録のリクエストボディの上限
+	maxImportSize = 64 << 20
+	// maxImportLineSize はNDJSONの1行の上限
+	maxImportLineSize = 64 << 10
+)
+
+// 一括登録/取得の形式
+const (
+	contentTypeCSV    = "text/csv"
+	contentTypeNDJSON = "application/x-ndjson"
+)
+
+// handleUsersImport はCSVまたはNDJSONのユーザーを一括登録するエンドポイント
+// dry_run=trueの場合は検証のみを行う。行ごとの失敗は結果で報告する
+func (s *HTTPServer) handleUsersImport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx, span := s.tracer.Start(r.Context(), "import-users")
+		defer span.End()
+
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		span.SetAttributes(attribute.String("import.format", mediaType))
+
+		body := http.MaxBytesReader(w, r.Body, maxImportSize)
+		var rows iter.Seq2[service.ImportRow, error]
+		switch mediaType {
+		case contentTypeCSV:
+			var err error
+			if rows, err = csvImportRows(body); err != nil {
+				span.RecordError(err)
+				response.Problem(w, http.StatusBadRequest, err.Error(), nil)
+				return
+			}
+		case contentTypeNDJSON:
+			rows = ndjsonImportRows(body)
+		default:
+			response.Problem(w, http.StatusUnsupportedMediaType, fmt.Sprintf("Content-Type must be %s or %s", contentTypeCSV, contentTypeNDJSON), nil)
+			return
+		}
+
+		// 形式はOpenAPIドキュメントで検証済み
+		dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+		result, err := s.userService.ImportUsers(ctx, rows, service.ImportOptions{DryRun: dryRun})
+		if err != nil {
+			writeServiceError(w, span, err, "Failed to import users")
+			return
+		}
+		response.Success(w, result)
+	}
+}
+
+// csvImportRows はヘッダー行にname, emailの列があるCSVを読み込みます
+// 他の列は無視するため、一括取得したCSVをそのまま登録できる
+func csvImportRows(r io.Reader) (iter.Seq2[service.ImportRow, error], error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("CSV header is required")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV header: %w", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		if i == 0 {
+			// Excelで保存したCSVの先頭のBOM
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	nameCol, hasName := columns["name"]
+	emailCol, hasEmail := columns["email"]
+	if !hasName || !hasEmail {
+		return nil, errors.New("CSV header must contain name and email columns")
+	}
+
+	return func(yield func(service.ImportRow, error) bool) {
+		for {
+			record, err := cr.Read()
+			if err == io.EOF {
+				return
+			}
+			// 形式が不正な行は失敗として報告し、次の行から読み込みを続ける
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				if !yield(service.ImportRow{Line: parseErr.StartLine, Err: err}, nil) {
+					return
+				}
+				continue
+			}
+			if err != nil {
+				yield(service.ImportRow{}, err)
+				return
+			}
+
+			line, _ := cr.FieldPos(0)
+			row := service.ImportRow{Line: line}
+			if nameCol >= len(record) || emailCol >= len(record) {
+				row.Err = fmt.Errorf("has %d columns, want at least %d", len(record), max(nameCol, emailCol)+1)
+			} else {
+				row.Name = strings.TrimSpace(record[nameCol])
+				row.Email = record[emailCol]
+			}
+			if !yield(row, nil) {
+				return
+			}
+		}
+	}, nil
+}
+
+// ndjsonImportRows は1行に1つのJSONオブジェクト（name, email）を読み込みます
+// 空行は無視する
+func ndjsonImportRows(r io.Reader) iter.Seq2[service.ImportRow, error] {
+	return func(yield func(service.ImportRow, error) bool) {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 4096), maxImportLineSize)
+		line := 0
+		for scanner.Scan() {
+			line++
+			data := scanner.Bytes()
+			if len(bytes.TrimSpace(data)) == 0 {
+				continue
+			}
+			row := service.ImportRow{Line: line}
+			var v struct {
+				Name  string `json:"name"`
+				Email string `json:"email"`
+			}
+			if err := json.Unmarshal(data, &v); err != nil {
+				row.Err = errors.New("must be a valid JSON object")
+			} else {
+				row.Name = strings.TrimSpace(v.Name)
+				row.Email = v.Email
+			}
+			if !yield(row, nil) {
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			if errors.Is(err, bufio.ErrTooLong) {
+				err = fmt.Errorf("line %d: exceeds %d bytes", line+1, maxImportLineSize)
+			}
+			yield(service.ImportRow{}, err)
+		}
+	}
+}
+
+// handleUsersExport は全てのユーザーをNDJSONまたはCSVで返すエンドポイント
+// ページごとに読み込んで書き込むため、件数が多くてもメモリに全て載せない
+func (s *HTTPServer) handleUsersExport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx, span := s.tracer.Start(r.Context(), "export-users")
+		defer span.End()
+
+		// 形式はOpenAPIドキュメントで検証済み
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "ndjson"
+		}
+		span.SetAttributes(attribute.String("export.format", format))
+
+		var (
+			write func(*entity.User) error
+			flush func() error
+		)
+		switch format {
+		case "csv":
+			cw := csv.NewWriter(w)
+			w.Header().Set("Content-Type", contentTypeCSV+"; charset=utf-8")
+			_ = cw.Write([]string{"id", "name", "email", "version", "created_at", "updated_at"})
+			write = func(u *entity.User) error {
+				return cw.Write([]string{
+					strconv.FormatUint(uint64(u.ID), 10),
+					u.Name,
+					u.Email,
+					strconv.FormatUint(uint64(u.Version), 10),
+					u.CreatedAt.UTC().Format(time.RFC3339Nano),
+					u.UpdatedAt.UTC().Format(time.RFC3339Nano),
+				})
+			}
+			flush = func() error {
+				cw.Flush()
+				return cw.Error()
+			}
+		default:
+			bw := bufio.NewWriter(w)
+			enc := json.NewEncoder(bw)
+			w.Header().Set("Content-Type", contentTypeNDJSON)
+			write = func(u *entity.User) error { return enc.Encode(u) }
+			flush = bw.Flush
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s"`, format))
+
+		count := 0
+		for user, err := range s.userService.ExportUsers(ctx) {
+			// ヘッダーは送信済みのため、途中のエラーはスパンに記録して打ち切る
+			if err == nil {
+				err = write(user)
+			}
+			if err != nil {
+				span.RecordError(err)
+				break
+			}
+			count++
+		}
+		if err := flush(); err != nil {
+			span.RecordError(err)
+		}
+		span.SetAttributes(attribute.Int("result.count", count))
+	}
+}
@@ -0,0 +1,1028 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+
+	"otel-test/audit"
+	"otel-test/database/databasetest"
+	"otel-test/env"
+	"otel-test/http/compress"
+	"otel-test/http/openapi"
+	"otel-test/http/response"
+	"otel-test/idempotency"
+	"otel-test/o11y/o11ytest"
+	"otel-test/server/entity"
+	"otel-test/server/repository"
+	"otel-test/server/service"
+	"otel-test/tenant"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newTestServer はインメモリのテレメトリとSQLiteを使ったテスト用サーバーを起動します
+func newTestServer(t *testing.T) (*o11ytest.Harness, *httptest.Server) {
+	t.Helper()
+	h, ts, _ := newTestServerWithWebhooks(t, service.WebhookConfig{})
+	return h, ts
+}
+
+// newTestServerWithWebhooks はwebhookの設定を指定してnewTestServerと同様にサーバーを作成し、配信に使用するサービスを返します
+func newTestServerWithWebhooks(t *testing.T, webhookConfig service.WebhookConfig) (*o11ytest.Harness, *httptest.Server, *service.WebhookService) {
+	t.Helper()
+	h := o11ytest.New(t)
+	db := databasetest.New(t,
+		&entity.User{},
+		&entity.OutboxEvent{},
+		&entity.WebhookSubscription{},
+		&entity.WebhookDelivery{},
+		&entity.WebhookAttempt{},
+		&entity.IdempotencyKey{},
+		&entity.AuditLog{},
+		&entity.Hoge{},
+	)
+
+	userService := service.NewUserService(db, repository.NewUserRepository(db), repository.NewOutboxRepository(db), repository.NewAuditRepository(db))
+	webhookService := service.NewWebhookService(repository.NewWebhookRepository(db), webhookConfig)
+	compression, err := compress.New(compress.Config{Encodings: compress.DefaultEncodings, MinSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// /multiのサブリクエスト先を決めるため、先にテストサーバーを作成する
+	var handler http.Handler
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+
+	srv := NewServer(env.GCPOtel, &Dependencies{
+		UserService:    userService,
+		WebhookService: webhookService,
+		Idempotency:    idempotency.New(repository.NewIdempotencyRepository(db), idempotency.Config{}),
+		SingleURL:      ts.URL + "/single",
+		Resources: []ResourceRoutes{
+			NewResource("/hoges", service.NewHogeService(db)),
+		},
+		Tenants:     tenant.NewResolver(tenant.Config{Header: "X-Tenant-ID", Default: "default", Allowed: []string{"acme", "globex"}}),
+		Compression: compression,
+		// テストのクライアントを前段のプロキシとして扱い、X-Actorを信頼する
+		Audit: audit.NewResolver(audit.Config{TrustedProxies: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}),
+	})
+	handler = srv.Handler()
+	return h, ts, webhookService
+}
+
+// spec はレスポンスの検証に使用するOpenAPIドキュメント
+var spec = openapi.MustLoad()
+
+// doJSON はリクエストを送信し、レスポンスがOpenAPIドキュメントのrouteの定義に一致することを確認します
+func doJSON(t *testing.T, method, route, url string, body any) *http.Response {
+	t.Helper()
+	return doJSONWithHeader(t, method, route, url, nil, body)
+}
+
+// doJSONWithHeader はリクエストヘッダーを指定してdoJSONと同様にリクエストを送信します
+func doJSONWithHeader(t *testing.T, method, route, url string, header http.Header, body any) *http.Response {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return doRequest(t, method, route, url, header, &buf)
+}
+
+// doRequest はリクエストを送信し、レスポンスがOpenAPIドキュメントに一致するかを検証します
+func doRequest(t *testing.T, method, route, url string, header http.Header, body io.Reader) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := spec.ValidateResponse(route, method, res.StatusCode, res.Header.Get("Content-Type"), data); err != nil {
+		t.Errorf("contract violation: %v", err)
+	}
+	res.Body = io.NopCloser(bytes.NewReader(data))
+	return res
+}
+
+func decode(t *testing.T, res *http.Response, v any) {
+	t.Helper()
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleUsersCreate(t *testing.T) {
+	h, ts := newTestServer(t)
+
+	res := doJSON(t, http.MethodPost, "/users", ts.URL+"/users", map[string]string{"name": "Taro", "email": "taro@example.com"})
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+	var user entity.User
+	decode(t, res, &user)
+	if user.ID == 0 || user.Email != "taro@example.com" {
+		t.Fatalf("unexpected user: %+v", user)
+	}
+
+	// 重複は事前に確認せず、一意制約で検出する
+	h.Spans().Len(10).HasTree(
+		o11ytest.T("/users",
+			o11ytest.T("create-user",
+				o11ytest.T("UserService.CreateUser",
+					o11ytest.T("DB.WithinTx",
+						o11ytest.T("UserRepository.Create",
+							o11ytest.T("insert users"),
+						),
+						o11ytest.T("AuditRepository.Add",
+							o11ytest.T("insert audit_logs"),
+						),
+						o11ytest.T("OutboxRepository.Add",
+							o11ytest.T("insert outbox_events"),
+						),
+					),
+				),
+			),
+		),
+	)
+
+	h.Span("/users").
+		IsRoot().
+		HasKind(trace.SpanKindServer).
+		HasAttr("http.route", "/users").
+		HasAttr("http.request.method", "POST").
+		HasAttr("http.response.status_code", http.StatusCreated)
+	h.Span("create-user").
+		HasAttr("user.name", "Taro").
+		HasAttr("user.email", "taro@example.com").
+		HasAttr("user.created_id", int(user.ID)).
+		NoError()
+	h.Span("UserService.CreateUser").
+		HasAttr("user.created_id", int(user.ID)).
+		NoAttr("user.already_exists")
+	h.Span("UserRepository.Create").
+		HasAttr("operation", "create_user").
+		HasAttr("user.id", int(user.ID)).
+		NoError()
+
+	h.Metric("http.server.request.duration").
+		WithAttrs(attribute.String("http.route", "/users"), attribute.Int("http.response.status_code", http.StatusCreated)).
+		HasCount(1)
+
+	h.Logs().Containing("request completed").Len(1).InSpan(h.Span("/users"))
+}
+
+func TestHandleUsersCreateValidation(t *testing.T) {
+	h, ts := newTestServer(t)
+
+	res := doJSON(t, http.MethodPost, "/users", ts.URL+"/users", map[string]string{"name": "", "nickname": "taro"})
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusUnprocessableEntity)
+	}
+	var problem struct {
+		Status int                   `json:"status"`
+		Errors []response.FieldError `json:"errors"`
+	}
+	decode(t, res, &problem)
+	want := []response.FieldError{
+		{Field: "body.email", Message: "is required"},
+		{Field: "body.name", Message: "must be at least 1 characters"},
+		{Field: "body.nickname", Message: "is not allowed"},
+	}
+	if !reflect.DeepEqual(problem.Errors, want) {
+		t.Fatalf("errors = %+v, want %+v", problem.Errors, want)
+	}
+
+	// ハンドラーに到達する前に検証で拒否される
+	h.Spans().Len(1)
+	h.Span("/users").
+		HasAttr("validation.failed", true).
+		HasAttr("validation.error_count", 3).
+		HasEvent("validation.failed")
+}
+
+func TestHandleUsersCreateInvalidJSON(t *testing.T) {
+	h, ts := newTestServer(t)
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/users", strings.NewReader("{"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "application/problem+json" {
+		t.Fatalf("content type = %q, want application/problem+json", ct)
+	}
+	h.Spans().Len(1)
+}
+
+func TestHandleUsersListInvalidQuery(t *testing.T) {
+	h, ts := newTestServer(t)
+
+	res := doJSON(t, http.MethodGet, "/users", ts.URL+"/users?limit=1000&offset=-1", nil)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+	var problem struct {
+		Errors []response.FieldError `json:"errors"`
+	}
+	decode(t, res, &problem)
+	if len(problem.Errors) != 2 {
+		t.Fatalf("errors = %+v, want limit and offset", problem.Errors)
+	}
+	h.Span("/users").HasAttr("validation.error_count", 2)
+}
+
+func TestHandleUsersCreateDuplicate(t *testing.T) {
+	h, ts := newTestServer(t)
+
+	body := map[string]string{"name": "Taro", "email": "taro@example.com"}
+	if res := doJSON(t, http.MethodPost, "/users", ts.URL+"/users", body); res.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+	h.Reset()
+
+	res := doJSON(t, http.MethodPost, "/users", ts.URL+"/users", body)
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusConflict)
+	}
+	// エラーのメッセージにメールアドレスを含めない（レスポンスやスパンの例外に残るため）
+	var problem map[string]any
+	decode(t, res, &problem)
+	if message := problem["message"]; message != "user email: already exists" {
+		t.Errorf("message = %v", message)
+	}
+
+	h.Spans().HasTree(
+		o11ytest.T("/users",
+			o11ytest.T("create-user",
+				o11ytest.T("UserService.CreateUser",
+					o11ytest.T("DB.WithinTx",
+						o11ytest.T("UserRepository.Create", o11ytest.T("insert users")),
+					),
+				),
+			),
+		),
+	)
+	h.Span("UserService.CreateUser").HasAttr("user.already_exists", true)
+	// 一意制約違反はリポジトリでエラーとして記録される
+	h.Span("UserRepository.Create").HasError()
+	h.Span("create-user").HasError()
+	h.Span("DB.WithinTx").HasEvent("rollback").NoEvent("commit")
+}
+
+func TestHandleUsersRecreateAfterDelete(t *testing.T) {
+	_, ts := newTestServer(t)
+	body := map[string]string{"name": "Taro", "email": "taro@example.com"}
+
+	res := doJSON(t, http.MethodPost, "/users", ts.URL+"/users", body)
+	var user entity.User
+	decode(t, res, &user)
+	url := fmt.Sprintf("%s/users/%d", ts.URL, user.ID)
+	if res := doJSONWithHeader(t, http.MethodDelete, "/users/{id}", url, http.Header{"If-Match": {`"1"`}}, nil); res.StatusCode != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusNoContent)
+	}
+
+	// 削除したユーザーのメールアドレスで再び登録できる
+	res = doJSON(t, http.MethodPost, "/users", ts.URL+"/users", body)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+	res = doJSON(t, http.MethodPost, "/users", ts.URL+"/users", body)
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusConflict)
+	}
+}
+
+func TestHandleUsersCreateConcurrentDuplicate(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	// 同じメールアドレスで同時に作成すると、一方だけが成功する
+	for i := range 5 {
+		email := fmt.Sprintf("race%d@example.com", i)
+		start := make(chan struct{})
+		statuses := make(chan int, 2)
+		for range 2 {
+			go func() {
+				<-start
+				body := strings.NewReader(fmt.Sprintf(`{"name": "Taro", "email": %q}`, email))
+				res, err := http.Post(ts.URL+"/users", "application/json", body)
+				if err != nil {
+					statuses <- 0
+					return
+				}
+				res.Body.Close()
+				statuses <- res.StatusCode
+			}()
+		}
+		close(start)
+
+		got := map[int]int{}
+		for range 2 {
+			got[<-statuses]++
+		}
+		if got[http.StatusCreated] != 1 || got[http.StatusConflict] != 1 {
+			t.Fatalf("%s: statuses = %v, want one 201 and one 409", email, got)
+		}
+	}
+}
+
+func TestHandleUsersCreateNormalizesEmail(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	res := doJSON(t, http.MethodPost, "/users", ts.URL+"/users", map[string]string{"name": "Taro", "email": "Taro@Bücher.Example"})
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+	var user entity.User
+	decode(t, res, &user)
+	if user.Email != "taro@xn--bcher-kva.example" {
+		t.Fatalf("email = %q, want %q", user.Email, "taro@xn--bcher-kva.example")
+	}
+
+	// 正規化後に同じになるメールアドレスは重複として扱う
+	res = doJSON(t, http.MethodPost, "/users", ts.URL+"/users", map[string]string{"name": "Taro", "email": "taro@xn--bcher-kva.example"})
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusConflict)
+	}
+}
+
+func TestHandleUsersCreateIdempotencyKey(t *testing.T) {
+	h, ts := newTestServer(t)
+
+	header := http.Header{idempotency.HeaderKey: {"create-taro"}}
+	body := map[string]string{"name": "Taro", "email": "taro@example.com"}
+	var users [2]entity.User
+	for i := range users {
+		res := doJSONWithHeader(t, http.MethodPost, "/users", ts.URL+"/users", header, body)
+		if res.StatusCode != http.StatusCreated {
+			t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusCreated)
+		}
+		if replayed := res.Header.Get(idempotency.HeaderReplayed) == "true"; replayed != (i == 1) {
+			t.Fatalf("request %d: replayed = %v", i, replayed)
+		}
+		decode(t, res, &users[i])
+	}
+	if users[0] != users[1] {
+		t.Fatalf("replayed %+v, want %+v", users[1], users[0])
+	}
+	// 再送ではユーザーを作成しない
+	h.Spans().Named("UserService.CreateUser").Len(1)
+	h.Spans().Named("/users").Each()[1].HasAttr("idempotency.outcome", "replayed")
+
+	body["name"] = "Jiro"
+	res := doJSONWithHeader(t, http.MethodPost, "/users", ts.URL+"/users", header, body)
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusUnprocessableEntity)
+	}
+
+	// 検証に失敗したリクエストはキーを消費しない
+	header = http.Header{idempotency.HeaderKey: {"create-saburo"}}
+	res = doJSONWithHeader(t, http.MethodPost, "/users", ts.URL+"/users", header, map[string]string{"name": "Saburo"})
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusUnprocessableEntity)
+	}
+	res = doJSONWithHeader(t, http.MethodPost, "/users", ts.URL+"/users", header, map[string]string{"name": "Saburo", "email": "saburo@example.com"})
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+}
+
+func TestHandleUsersList(t *testing.T) {
+	h, ts := newTestServer(t)
+
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		doJSON(t, http.MethodPost, "/users", ts.URL+"/users", map[string]string{"name": "user", "email": email})
+	}
+	h.Reset()
+
+	res := doJSON(t, http.MethodGet, "/users", ts.URL+"/users?limit=2&offset=1", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	var body struct {
+		Users []entity.User `json:"users"`
+		Count int           `json:"count"`
+	}
+	decode(t, res, &body)
+	if body.Count != 2 || body.Users[0].Email != "b@example.com" {
+		t.Fatalf("unexpected body: %+v", body)
+	}
+
+	h.Spans().Len(5).HasTree(
+		o11ytest.T("/users",
+			o11ytest.T("get-users-list",
+				o11ytest.T("UserService.ListUsers",
+					o11ytest.T("UserRepository.List", o11ytest.T("select users")),
+				),
+			),
+		),
+	)
+	h.Span("get-users-list").
+		HasAttr("query.limit", 2).
+		HasAttr("query.offset", 1).
+		HasAttr("result.count", 2)
+	h.Span("UserRepository.List").HasAttr("result.count", 2)
+}
+
+func TestHandleUsersMethodNotAllowed(t *testing.T) {
+	h, ts := newTestServer(t)
+
+	// ドキュメントにないメソッドのため、契約の検証はしない
+	req, err := http.NewRequest(http.MethodDelete, ts.URL+"/users", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusMethodNotAllowed)
+	}
+	h.Spans().Len(1)
+	h.Span("/users").HasAttr("http.response.status_code", http.StatusMethodNotAllowed)
+}
+
+func TestHandleUserByID(t *testing.T) {
+	h, ts := newTestServer(t)
+
+	res := doJSON(t, http.MethodPost, "/users", ts.URL+"/users", map[string]string{"name": "Taro", "email": "taro@example.com"})
+	var created entity.User
+	decode(t, res, &created)
+	h.Reset()
+
+	res = doJSON(t, http.MethodGet, "/users/{id}", fmt.Sprintf("%s/users/%d", ts.URL, created.ID), nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	var user entity.User
+	decode(t, res, &user)
+	if user.ID != created.ID {
+		t.Fatalf("id = %d, want %d", user.ID, created.ID)
+	}
+
+	h.Spans().Len(5).HasTree(
+		o11ytest.T("/users/{id}",
+			o11ytest.T("get-user-by-id",
+				o11ytest.T("UserService.GetUserByID",
+					o11ytest.T("UserRepository.GetByID", o11ytest.T("select users")),
+				),
+			),
+		),
+	)
+	h.Span("/users/{id}").HasAttr("http.route", "/users/{id}")
+	h.Span("get-user-by-id").HasAttr("user.id", int(created.ID)).NoAttr("user.not_found")
+	h.Span("UserRepository.GetByID").HasAttr("user.email", "taro@example.com")
+}
+
+func TestHandleUserByIDNotFound(t *testing.T) {
+	h, ts := newTestServer(t)
+
+	res := doJSON(t, http.MethodGet, "/users/{id}", ts.URL+"/users/42", nil)
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+
+	h.Span("get-user-by-id").HasAttr("user.not_found", true)
+	h.Span("UserService.GetUserByID").HasAttr("user.not_found", true).NoError()
+	h.Span("UserRepository.GetByID").HasError()
+}
+
+func TestHandleUserByIDInvalid(t *testing.T) {
+	h, ts := newTestServer(t)
+
+	res := doJSON(t, http.MethodGet, "/users/{id}", ts.URL+"/users/abc", nil)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+
+	h.Spans().Len(1)
+	h.Span("/users/{id}").HasAttr("validation.failed", true)
+}
+
+func TestHandleUserByIDETag(t *testing.T) {
+	h, ts := newTestServer(t)
+
+	res := doJSON(t, http.MethodPost, "/users", ts.URL+"/users", map[string]string{"name": "Taro", "email": "taro@example.com"})
+	var created entity.User
+	decode(t, res, &created)
+	url := fmt.Sprintf("%s/users/%d", ts.URL, created.ID)
+
+	res = doJSON(t, http.MethodGet, "/users/{id}", url, nil)
+	etag := res.Header.Get("ETag")
+	if etag != `"1"` {
+		t.Fatalf("ETag = %q, want %q", etag, `"1"`)
+	}
+
+	h.Reset()
+	for _, inm := range []string{etag, "W/" + etag, `"0", ` + etag, "*"} {
+		res = doJSONWithHeader(t, http.MethodGet, "/users/{id}", url, http.Header{"If-None-Match": {inm}}, nil)
+		if res.StatusCode != http.StatusNotModified {
+			t.Fatalf("If-None-Match %s: status = %d, want %d", inm, res.StatusCode, http.StatusNotModified)
+		}
+		if res.Header.Get("ETag") != etag {
+			t.Fatalf("ETag = %q, want %q", res.Header.Get("ETag"), etag)
+		}
+	}
+	h.Spans().Named("get-user-by-id").Len(4).Each()[0].
+		HasAttr("user.version", 1).
+		HasAttr("http.not_modified", true)
+
+	res = doJSONWithHeader(t, http.MethodGet, "/users/{id}", url, http.Header{"If-None-Match": {`"2"`}}, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	// 圧縮したレスポンスのETagも同じバージョンとして扱う
+	res = doJSONWithHeader(t, http.MethodGet, "/users/{id}", url, http.Header{"If-None-Match": {`"1-br"`}}, nil)
+	if res.StatusCode != http.StatusNotModified {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusNotModified)
+	}
+	res = doJSONWithHeader(t, http.MethodPatch, "/users/{id}", url, http.Header{"If-Match": {`"1-gzip"`}}, map[string]string{"name": "Jiro"})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+}
+
+func TestHandleUserUpdateIfMatch(t *testing.T) {
+	h, ts := newTestServer(t)
+
+	res := doJSON(t, http.MethodPost, "/users", ts.URL+"/users", map[string]string{"name": "Taro", "email": "taro@example.com"})
+	var created entity.User
+	decode(t, res, &created)
+	url := fmt.Sprintf("%s/users/%d", ts.URL, created.ID)
+
+	h.Reset()
+	res = doJSONWithHeader(t, http.MethodPatch, "/users/{id}", url, http.Header{"If-Match": {`"1"`}}, map[string]string{"name": "Jiro"})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	var updated entity.User
+	decode(t, res, &updated)
+	if updated.Name != "Jiro" || updated.Email != "taro@example.com" || updated.Version != 2 {
+		t.Fatalf("unexpected user: %+v", updated)
+	}
+	if got := res.Header.Get("ETag"); got != `"2"` {
+		t.Fatalf("ETag = %q, want %q", got, `"2"`)
+	}
+	h.Spans().HasTree(
+		o11ytest.T("/users/{id}",
+			o11ytest.T("update-user",
+				o11ytest.T("UserService.UpdateUser",
+					o11ytest.T("DB.WithinTx",
+						o11ytest.T("UserRepository.GetByID", o11ytest.T("select users")),
+						o11ytest.T("UserRepository.Update", o11ytest.T("update users")),
+						o11ytest.T("AuditRepository.Add", o11ytest.T("insert audit_logs")),
+						o11ytest.T("OutboxRepository.Add", o11ytest.T("insert outbox_events")),
+					),
+				),
+			),
+		),
+	)
+	h.Span("UserService.UpdateUser").
+		HasAttr("user.version.expected", 1).
+		HasAttr("user.version", 2)
+
+	// 古いETagでの更新・削除は失敗し、変更されない
+	h.Reset()
+	res = doJSONWithHeader(t, http.MethodPatch, "/users/{id}", url, http.Header{"If-Match": {`"1"`}}, map[string]string{"name": "Saburo"})
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusPreconditionFailed)
+	}
+	h.Span("UserService.UpdateUser").HasAttr("user.version_mismatch", true).HasAttr("user.version", 2).NoError()
+	h.Spans().Named("UserRepository.Update").Len(0)
+
+	res = doJSONWithHeader(t, http.MethodDelete, "/users/{id}", url, http.Header{"If-Match": {`"1"`}}, nil)
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusPreconditionFailed)
+	}
+	// 弱いETagは強い比較で一致しない
+	res = doJSONWithHeader(t, http.MethodDelete, "/users/{id}", url, http.Header{"If-Match": {`W/"2"`}}, nil)
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusPreconditionFailed)
+	}
+
+	res = doJSON(t, http.MethodGet, "/users/{id}", url, nil)
+	var got entity.User
+	decode(t, res, &got)
+	if got.Name != "Jiro" {
+		t.Fatalf("name = %q, want Jiro", got.Name)
+	}
+
+	res = doJSONWithHeader(t, http.MethodDelete, "/users/{id}", url, http.Header{"If-Match": {`"2"`}}, nil)
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusNoContent)
+	}
+	res = doJSON(t, http.MethodGet, "/users/{id}", url, nil)
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestHandleUserUpdateWithoutIfMatch(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	res := doJSON(t, http.MethodPost, "/users", ts.URL+"/users", map[string]string{"name": "Taro", "email": "taro@example.com"})
+	var created entity.User
+	decode(t, res, &created)
+	url := fmt.Sprintf("%s/users/%d", ts.URL, created.ID)
+
+	// If-Matchを省略した場合はバージョンを確認しない
+	for i, name := range []string{"Jiro", "Saburo"} {
+		res = doJSON(t, http.MethodPatch, "/users/{id}", url, map[string]string{"name": name})
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusOK)
+		}
+		var user entity.User
+		decode(t, res, &user)
+		if user.Name != name || user.Version != uint(i+2) {
+			t.Fatalf("unexpected user: %+v", user)
+		}
+	}
+
+	res = doJSON(t, http.MethodPatch, "/users/{id}", url, map[string]string{"nickname": "Jiro"})
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusUnprocessableEntity)
+	}
+	res = doJSON(t, http.MethodPatch, "/users/{id}", ts.URL+"/users/42", map[string]string{"name": "Jiro"})
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestHandleUserAudit(t *testing.T) {
+	h, ts := newTestServer(t)
+	header := http.Header{"X-Actor": {"admin@example.com"}, "X-Request-Id": {"req-1"}}
+
+	res := doJSONWithHeader(t, http.MethodPost, "/users", ts.URL+"/users", header, map[string]string{"name": "Taro", "email": "taro@example.com"})
+	if got := res.Header.Get("X-Request-Id"); got != "req-1" {
+		t.Fatalf("X-Request-Id = %q, want req-1", got)
+	}
+	var created entity.User
+	decode(t, res, &created)
+	url := fmt.Sprintf("%s/users/%d", ts.URL, created.ID)
+	doJSON(t, http.MethodPatch, "/users/{id}", url, map[string]string{"name": "Jiro"})
+	if res := doJSON(t, http.MethodDelete, "/users/{id}", url, nil); res.StatusCode != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusNoContent)
+	}
+	traceID := h.Span("create-user").Stub().SpanContext.TraceID().String()
+	h.Span("/users").HasAttr("enduser.id", "admin@example.com").HasAttr("request.id", "req-1")
+
+	type entry struct {
+		Action    string                    `json:"action"`
+		Actor     string                    `json:"actor"`
+		RequestID string                    `json:"request_id"`
+		TraceID   string                    `json:"trace_id"`
+		Before    *entity.User              `json:"before"`
+		After     *entity.User              `json:"after"`
+		Changes   map[string]map[string]any `json:"changes"`
+	}
+	var page struct {
+		Entries    []entry `json:"entries"`
+		NextCursor string  `json:"next_cursor"`
+	}
+
+	// 削除済みのユーザーの監査ログも取得できる
+	res = doJSON(t, http.MethodGet, "/users/{id}/audit", url+"/audit?limit=2", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	decode(t, res, &page)
+	if len(page.Entries) != 2 || page.NextCursor == "" {
+		t.Fatalf("unexpected page: %+v", page)
+	}
+	if e := page.Entries[0]; e.Action != "create" || e.Actor != "admin@example.com" || e.RequestID != "req-1" || e.TraceID != traceID || e.Before != nil || e.After.Name != "Taro" {
+		t.Fatalf("unexpected create entry: %+v", e)
+	}
+	if e := page.Entries[1]; e.Action != "update" || e.Actor != "anonymous" || e.RequestID == "" || !reflect.DeepEqual(e.Changes["name"], map[string]any{"from": "Taro", "to": "Jiro"}) {
+		t.Fatalf("unexpected update entry: %+v", e)
+	}
+	if _, ok := page.Entries[1].Changes["version"]; !ok {
+		t.Fatalf("version is not recorded: %+v", page.Entries[1].Changes)
+	}
+
+	res = doJSON(t, http.MethodGet, "/users/{id}/audit", url+"/audit?limit=2&cursor="+page.NextCursor, nil)
+	page.Entries, page.NextCursor = nil, ""
+	decode(t, res, &page)
+	if len(page.Entries) != 1 || page.NextCursor != "" || page.Entries[0].Action != "delete" || page.Entries[0].After != nil {
+		t.Fatalf("unexpected page: %+v", page)
+	}
+
+	res = doJSON(t, http.MethodGet, "/users/{id}/audit", url+"/audit?format=csv", nil)
+	if got := res.Header.Get("Content-Type"); got != "text/csv; charset=utf-8" {
+		t.Fatalf("Content-Type = %q", got)
+	}
+	body, _ := io.ReadAll(res.Body)
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "id,created_at,action,actor") || !strings.Contains(lines[1], ",create,admin@example.com,req-1,") {
+		t.Fatalf("unexpected csv:\n%s", body)
+	}
+
+	res = doJSON(t, http.MethodGet, "/users/{id}/audit", url+"/audit?format=xml", nil)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestHandleUsersImportExport(t *testing.T) {
+	h, ts := newTestServer(t)
+	csvHeader := http.Header{"Content-Type": {"text/csv"}}
+	importCSV := "name,email\nTaro,taro@example.com\n,noname@example.com\nJiro,TARO@example.com\n"
+
+	// dry_runでは登録しない
+	res := doRequest(t, http.MethodPost, "/users:import", ts.URL+"/users:import?dry_run=true", csvHeader, strings.NewReader(importCSV))
+	var result service.ImportResult
+	decode(t, res, &result)
+	if res.StatusCode != http.StatusOK || !result.DryRun || result.Imported != 1 || result.Failed != 2 {
+		t.Fatalf("status = %d, result = %+v", res.StatusCode, result)
+	}
+	if result.Errors[0].Line != 3 || result.Errors[0].Field != "name" || result.Errors[1].Line != 4 {
+		t.Fatalf("errors = %+v", result.Errors)
+	}
+
+	res = doRequest(t, http.MethodPost, "/users:import", ts.URL+"/users:import", csvHeader, strings.NewReader(importCSV))
+	result = service.ImportResult{}
+	decode(t, res, &result)
+	if result.DryRun || result.Imported != 1 {
+		t.Fatalf("result = %+v", result)
+	}
+
+	h.Reset()
+	ndjson := `{"name": "Saburo", "email": "saburo@example.com"}` + "\n\n" + `{"name": "Taro", "email": "taro@example.com"}` + "\nnot json\n"
+	res = doRequest(t, http.MethodPost, "/users:import", ts.URL+"/users:import", http.Header{"Content-Type": {"application/x-ndjson"}}, strings.NewReader(ndjson))
+	result = service.ImportResult{}
+	decode(t, res, &result)
+	want := []service.ImportError{{Line: 3, Field: "email", Message: "already exists"}, {Line: 4, Message: "must be a valid JSON object"}}
+	if result.Total != 3 || result.Imported != 1 || !reflect.DeepEqual(result.Errors, want) {
+		t.Fatalf("result = %+v", result)
+	}
+	h.Span("UserService.ImportUsers").HasEvent("import.batch")
+
+	res = doRequest(t, http.MethodPost, "/users:import", ts.URL+"/users:import", csvHeader, strings.NewReader("id,name\n1,Taro\n"))
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+	res = doRequest(t, http.MethodPost, "/users:import", ts.URL+"/users:import", http.Header{"Content-Type": {"application/json"}}, strings.NewReader(`[]`))
+	if res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusUnsupportedMediaType)
+	}
+
+	// NDJSONは1行に1つのユーザーを返す
+	res = doRequest(t, http.MethodGet, "/users:export", ts.URL+"/users:export", nil, nil)
+	if got := res.Header.Get("Content-Type"); got != "application/x-ndjson" {
+		t.Fatalf("Content-Type = %q", got)
+	}
+	var emails []string
+	for dec := json.NewDecoder(res.Body); dec.More(); {
+		var user entity.User
+		if err := dec.Decode(&user); err != nil {
+			t.Fatal(err)
+		}
+		emails = append(emails, user.Email)
+	}
+	if !reflect.DeepEqual(emails, []string{"taro@example.com", "saburo@example.com"}) {
+		t.Fatalf("emails = %v", emails)
+	}
+
+	// 一括取得したCSVはそのまま登録できる（全て登録済みのため失敗する）
+	res = doRequest(t, http.MethodGet, "/users:export", ts.URL+"/users:export?format=csv", nil, nil)
+	exported, _ := io.ReadAll(res.Body)
+	if !strings.HasPrefix(string(exported), "id,name,email,version,created_at,updated_at\n1,Taro,taro@example.com,1,") {
+		t.Fatalf("unexpected csv:\n%s", exported)
+	}
+	res = doRequest(t, http.MethodPost, "/users:import", ts.URL+"/users:import", csvHeader, bytes.NewReader(exported))
+	result = service.ImportResult{}
+	decode(t, res, &result)
+	if result.Total != 2 || result.Failed != 2 || result.Errors[0].Message != "already exists" {
+		t.Fatalf("result = %+v", result)
+	}
+}
+
+func TestHandleUsersTenantIsolation(t *testing.T) {
+	h, ts := newTestServer(t)
+	acme := http.Header{"X-Tenant-Id": {"acme"}}
+	globex := http.Header{"X-Tenant-Id": {"globex"}}
+
+	res := doJSONWithHeader(t, http.MethodPost, "/users", ts.URL+"/users", acme, map[string]string{"name": "Taro", "email": "taro@example.com"})
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+	var created entity.User
+	decode(t, res, &created)
+	// メールアドレスはテナントごとに一意
+	res = doJSONWithHeader(t, http.MethodPost, "/users", ts.URL+"/users", globex, map[string]string{"name": "Taro", "email": "taro@example.com"})
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+	h.Reset()
+
+	// 別のテナントのユーザーは存在しないものとして扱う
+	res = doJSONWithHeader(t, http.MethodGet, "/users/{id}", fmt.Sprintf("%s/users/%d", ts.URL, created.ID), globex, nil)
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+	res = doJSONWithHeader(t, http.MethodDelete, "/users/{id}", fmt.Sprintf("%s/users/%d", ts.URL, created.ID), http.Header{"X-Tenant-Id": {"globex"}, "If-Match": {`"1"`}}, nil)
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+	res = doJSONWithHeader(t, http.MethodGet, "/users", ts.URL+"/users", globex, nil)
+	var body struct {
+		Users []entity.User `json:"users"`
+	}
+	decode(t, res, &body)
+	if len(body.Users) != 1 || body.Users[0].ID == created.ID {
+		t.Fatalf("unexpected users: %+v", body.Users)
+	}
+
+	// テナントはリクエストのスパン・DBのスパン・アクセスログ・HTTPのメトリクスに付与する
+	for _, span := range h.Spans().Named("/users/{id}").Each() {
+		span.HasAttr(tenant.AttributeKey, "globex")
+	}
+	for _, span := range h.Spans().Named("select users").Each() {
+		span.HasAttr(tenant.AttributeKey, "globex")
+	}
+	h.Logs().Containing("request completed").WithAttr(tenant.AttributeKey, "globex").Len(3)
+	h.Metric("http.server.request.duration").
+		WithAttrs(attribute.String("http.route", "/users/{id}"), attribute.String(tenant.AttributeKey, "globex")).
+		HasCount(2)
+
+	res = doJSONWithHeader(t, http.MethodGet, "/users/{id}", fmt.Sprintf("%s/users/%d", ts.URL, created.ID), acme, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+}
+
+func TestHandleUsersInvalidTenant(t *testing.T) {
+	h, ts := newTestServer(t)
+
+	// 受け付けるテナント以外は形式が正しくても400
+	res := doJSONWithHeader(t, http.MethodGet, "/users", ts.URL+"/users", http.Header{"X-Tenant-Id": {"initech"}}, nil)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+	h.Metric("http.server.request.duration").WithAttrs(attribute.String(tenant.AttributeKey, "initech")).HasPoints(0)
+	h.Reset()
+
+	res = doJSONWithHeader(t, http.MethodGet, "/users", ts.URL+"/users", http.Header{"X-Tenant-Id": {"Not_A_Tenant"}}, nil)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+	h.Span("/users").HasError().NoAttr(tenant.AttributeKey)
+	h.Spans().Named("get-users-list").Len(0)
+
+	// テナントで分離しないルートは拒否しない
+	res = doJSONWithHeader(t, http.MethodGet, "/health", ts.URL+"/health", http.Header{"X-Tenant-Id": {"Not_A_Tenant"}}, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+}
+
+func TestHandleUsersCompression(t *testing.T) {
+	h, ts := newTestServer(t)
+
+	// 圧縮したリクエストボディは展開してハンドラーに渡す
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gw).Encode(map[string]string{"name": "Taro", "email": "taro@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	res := doRequest(t, http.MethodPost, "/users", ts.URL+"/users", http.Header{"Content-Encoding": {"gzip"}}, &buf)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+	h.Span("/users").HasAttr("http.request.content_encoding", "gzip")
+
+	res = doRequest(t, http.MethodPost, "/users", ts.URL+"/users", http.Header{"Content-Encoding": {"deflate"}}, strings.NewReader("{}"))
+	if res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusUnsupportedMediaType)
+	}
+
+	for i := range 20 {
+		doJSON(t, http.MethodPost, "/users", ts.URL+"/users", map[string]string{"name": "Taro", "email": fmt.Sprintf("taro%d@example.com", i)})
+	}
+	h.Reset()
+
+	// Accept-Encodingを指定するとhttp.Clientは展開しないため、レスポンスをそのまま受け取る
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/users", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip;q=0.5, br")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Content-Encoding") != "br" || res.Header.Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("Content-Encoding = %q, Vary = %q", res.Header.Get("Content-Encoding"), res.Header.Get("Vary"))
+	}
+	data, err := io.ReadAll(brotli.NewReader(res.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := spec.ValidateResponse("/users", http.MethodGet, res.StatusCode, res.Header.Get("Content-Type"), data); err != nil {
+		t.Fatalf("contract violation: %v", err)
+	}
+
+	h.Span("/users").
+		HasAttr("http.response.content_encoding", "br").
+		HasAttr("http.response.body.uncompressed_size", len(data))
+	h.Metric("http.compression.ratio").
+		WithAttrs(attribute.String("http.compression.direction", "response"), attribute.String("http.compression.encoding", "br")).
+		HasCount(1)
+}
+
+func TestHandleHealth(t *testing.T) {
+	h, ts := newTestServer(t)
+
+	res := doJSON(t, http.MethodGet, "/health", ts.URL+"/health", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	var body map[string]string
+	decode(t, res, &body)
+	if body["status"] != "healthy" {
+		t.Fatalf("unexpected body: %v", body)
+	}
+
+	h.Spans().Len(5).HasTree(
+		o11ytest.T("/health",
+			o11ytest.T("health-check",
+				o11ytest.T("UserService.ListUsers",
+					o11ytest.T("UserRepository.List", o11ytest.T("select users")),
+				),
+			),
+		),
+	)
+	h.Span("health-check").
+		HasAttr("endpoint", "health").
+		HasAttr("health.check.success", true)
+}
+
+func TestHandleMulti(t *testing.T) {
+	h, ts := newTestServer(t)
+
+	res := doJSON(t, http.MethodGet, "/multi", ts.URL+"/multi", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	multi := h.Span("/multi").IsRoot().HasKind(trace.SpanKindServer)
+	subrequests := h.Span("subrequests").ChildOf(multi)
+
+	// サブリクエストはクライアントスパンを経由して/singleのサーバースパンにつながる
+	singles := h.Spans().Named("/single").Each()
+	if len(singles) < 3 || len(singles) > 6 {
+		t.Fatalf("got %d /single spans, want 3-6", len(singles))
+	}
+	for _, single := range singles {
+		single.HasKind(trace.SpanKindServer).
+			Parent().HasKind(trace.SpanKindClient).ChildOf(subrequests)
+	}
+
+	h.Metric("example.subrequests").HasCount(1).HasValue(float64(len(singles)))
+	h.Metric("example.sleep.duration").HasUnit("s").HasCount(uint64(len(singles)))
+
+	h.Logs().Containing("handle /multi request").
+		WithAttr("subRequests", int64(len(singles))).
+		Len(1).
+		InSpan(multi)
+}
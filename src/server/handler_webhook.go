@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"otel-test/http/response"
+	"otel-test/server/entity"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// webhookRequest はwebhook登録のリクエストボディ
+// 形式はOpenAPIドキュメントのCreateWebhookRequestで検証済み
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// webhookResponse はwebhookの購読のレスポンス
+// Secretは登録時のみ返す
+type webhookResponse struct {
+	ID        uint      `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func newWebhookResponse(sub *entity.WebhookSubscription) webhookResponse {
+	return webhookResponse{
+		ID:        sub.ID,
+		URL:       sub.URL,
+		Events:    sub.Events(),
+		CreatedAt: sub.CreatedAt,
+		UpdatedAt: sub.UpdatedAt,
+	}
+}
+
+// writeServiceError はサービス層のエラーをレスポンスに変換します
+func writeServiceError(w http.ResponseWriter, span trace.Span, err error, message string) {
+	code := httpStatus(err)
+	switch code {
+	case http.StatusInternalServerError:
+		span.RecordError(err)
+		response.InternalServerError(w, message)
+		return
+	case http.StatusServiceUnavailable:
+		// データベースのエラーの詳細は返さない
+		span.RecordError(err)
+		w.Header().Set("Retry-After", "1")
+		response.Error(w, code, "Service temporarily unavailable")
+		return
+	}
+	response.Error(w, code, err.Error())
+}
+
+// pathID はパスパラメーターをIDとして取得します
+// 形式はOpenAPIドキュメントで検証済み
+func pathID(r *http.Request, name string) uint {
+	id, _ := strconv.ParseUint(r.PathValue(name), 10, 32)
+	return uint(id)
+}
+
+// handleWebhooks はwebhookの一覧取得/登録エンドポイント
+func (s *HTTPServer) handleWebhooks() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			s.listWebhooks(r.Context(), w)
+		case http.MethodPost:
+			s.createWebhook(r.Context(), w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (s *HTTPServer) listWebhooks(ctx context.Context, w http.ResponseWriter) {
+	ctx, span := s.tracer.Start(ctx, "list-webhooks")
+	defer span.End()
+
+	subs, err := s.webhookService.ListSubscriptions(ctx)
+	if err != nil {
+		writeServiceError(w, span, err, "Failed to list webhooks")
+		return
+	}
+
+	res := make([]webhookResponse, 0, len(subs))
+	for i := range subs {
+		res = append(res, newWebhookResponse(&subs[i]))
+	}
+	response.Success(w, map[string]any{"webhooks": res})
+}
+
+func (s *HTTPServer) createWebhook(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ctx, span := s.tracer.Start(ctx, "create-webhook")
+	defer span.End()
+
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		span.RecordError(err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	sub, err := s.webhookService.Subscribe(ctx, req.URL, req.Events)
+	if err != nil {
+		writeServiceError(w, span, err, "Failed to create webhook")
+		return
+	}
+
+	span.SetAttributes(attribute.Int("webhook.subscription_id", int(sub.ID)))
+	res := newWebhookResponse(sub)
+	res.Secret = sub.Secret
+	response.JSON(w, http.StatusCreated, res)
+}
+
+// handleWebhookByID はwebhookの取得/削除エンドポイント
+func (s *HTTPServer) handleWebhookByID() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := s.tracer.Start(r.Context(), "webhook-by-id")
+		defer span.End()
+
+		id := pathID(r, "id")
+		span.SetAttributes(attribute.Int("webhook.subscription_id", int(id)))
+
+		switch r.Method {
+		case http.MethodGet:
+			sub, err := s.webhookService.GetSubscription(ctx, id)
+			if err != nil {
+				writeServiceError(w, span, err, "Failed to get webhook")
+				return
+			}
+			response.Success(w, newWebhookResponse(sub))
+		case http.MethodDelete:
+			if err := s.webhookService.Unsubscribe(ctx, id); err != nil {
+				writeServiceError(w, span, err, "Failed to delete webhook")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleWebhookDeliveries は配信の一覧エンドポイント
+func (s *HTTPServer) handleWebhookDeliveries() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx, span := s.tracer.Start(r.Context(), "list-webhook-deliveries")
+		defer span.End()
+
+		limit := 50
+		if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil {
+			limit = l
+		}
+
+		deliveries, err := s.webhookService.ListDeliveries(ctx, pathID(r, "id"), limit)
+		if err != nil {
+			writeServiceError(w, span, err, "Failed to list deliveries")
+			return
+		}
+		response.Success(w, map[string]any{"deliveries": deliveries})
+	}
+}
+
+// handleWebhookAttempts は配信の試行の一覧エンドポイント
+func (s *HTTPServer) handleWebhookAttempts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx, span := s.tracer.Start(r.Context(), "list-webhook-attempts")
+		defer span.End()
+
+		attempts, err := s.webhookService.ListAttempts(ctx, pathID(r, "id"), pathID(r, "deliveryID"))
+		if err != nil {
+			writeServiceError(w, span, err, "Failed to list attempts")
+			return
+		}
+		response.Success(w, map[string]any{"attempts": attempts})
+	}
+}
+
+// handleWebhookRedeliver はデッドレターの配信を再送するエンドポイント
+func (s *HTTPServer) handleWebhookRedeliver() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx, span := s.tracer.Start(r.Context(), "redeliver-webhook")
+		defer span.End()
+
+		delivery, err := s.webhookService.Redeliver(ctx, pathID(r, "id"), pathID(r, "deliveryID"))
+		if err != nil {
+			writeServiceError(w, span, err, "Failed to redeliver")
+			return
+		}
+		response.JSON(w, http.StatusAccepted, delivery)
+	}
+}
@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"context"
+	"otel-test/database"
+	"otel-test/server/entity"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// AuditRepository は監査ログを操作するリポジトリ
+// 監査ログは追記のみのため、更新・削除のメソッドは持たない
+type AuditRepository struct {
+	db     *database.DB
+	tracer trace.Tracer
+}
+
+func NewAuditRepository(db *database.DB) *AuditRepository {
+	return &AuditRepository{
+		db:     db,
+		tracer: otel.Tracer("audit-repository"),
+	}
+}
+
+// Add は監査ログを追加します
+func (r *AuditRepository) Add(ctx context.Context, log *entity.AuditLog) error {
+	ctx, span := r.tracer.Start(ctx, "AuditRepository.Add")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "add_audit_log"),
+		attribute.String("audit.resource_type", log.ResourceType),
+		attribute.String("audit.action", log.Action),
+	)
+
+	if err := r.db.WithContext(ctx).Create(log).Error; err != nil {
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
+
+// List はリソースの監査ログをIDの昇順（古い順）で返します
+// afterより大きいIDのみを返し、次のページはafterに最後のIDを指定して取得する
+func (r *AuditRepository) List(ctx context.Context, resourceType string, resourceID uint, after uint64, limit int) ([]entity.AuditLog, error) {
+	ctx, span := r.tracer.Start(ctx, "AuditRepository.List")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "list_audit_logs"),
+		attribute.String("audit.resource_type", resourceType),
+		attribute.Int("audit.resource_id", int(resourceID)),
+		attribute.Int("query.limit", limit),
+	)
+
+	var logs []entity.AuditLog
+	err := r.db.WithContext(ctx).
+		Where("resource_type = ? AND resource_id = ? AND id > ?", resourceType, resourceID, after).
+		Order("id").
+		Limit(limit).
+		Find(&logs).Error
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("result.count", len(logs)))
+	return logs, nil
+}
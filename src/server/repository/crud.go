@@ -0,0 +1,176 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"otel-test/database"
+	"otel-test/server/entity"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// CRUDRepository はentity.Modelを埋め込んだエンティティTの汎用の永続化
+// 論理削除とVersionによる楽観的排他制御はUserRepositoryと同じ
+// スパン名は「<型名>Repository.<操作>」、属性は「<型名の小文字>.id」（HogeRepository.Create, hoge.id）
+// GetByID・Listはトランザクション外ではレプリカから読み込む（database.DB.Reader）
+type CRUDRepository[T any, PT entity.ModelPtr[T]] struct {
+	db     *database.DB
+	tracer trace.Tracer
+	name   string // 型名（Hoge）
+	key    string // 属性と操作名に使用する小文字の名前（hoge）
+}
+
+// NewCRUDRepository はTのリポジトリを作成します
+func NewCRUDRepository[T any, PT entity.ModelPtr[T]](db *database.DB) *CRUDRepository[T, PT] {
+	name := reflect.TypeFor[T]().Name()
+	key := strings.ToLower(name)
+	return &CRUDRepository[T, PT]{
+		db:     db,
+		tracer: otel.Tracer(key + "-repository"),
+		name:   name,
+		key:    key,
+	}
+}
+
+// Name はエンティティの型名を返します
+func (r *CRUDRepository[T, PT]) Name() string {
+	return r.name
+}
+
+// start はスパンを開始し、操作名を属性に設定します
+func (r *CRUDRepository[T, PT]) start(ctx context.Context, op, operation string) (context.Context, trace.Span) {
+	ctx, span := r.tracer.Start(ctx, r.name+"Repository."+op)
+	span.SetAttributes(attribute.String("operation", operation+"_"+r.key))
+	return ctx, span
+}
+
+// Create はvを作成します
+// 一意制約違反はdatabase.ErrDuplicateKeyとして返す
+func (r *CRUDRepository[T, PT]) Create(ctx context.Context, v *T) error {
+	ctx, span := r.start(ctx, "Create", "create")
+	defer span.End()
+
+	m := entity.ModelOf[T, PT](v)
+	if m.Version == 0 {
+		m.Version = 1
+	}
+	if err := r.db.WithContext(ctx).Create(v).Error; err != nil {
+		span.RecordError(err)
+		return database.TranslateError(err)
+	}
+
+	span.SetAttributes(attribute.Int(r.key+".id", int(m.ID)))
+	return nil
+}
+
+// GetByID はIDで取得します。存在しない場合はgorm.ErrRecordNotFound
+func (r *CRUDRepository[T, PT]) GetByID(ctx context.Context, id uint) (*T, error) {
+	ctx, span := r.start(ctx, "GetByID", "get")
+	defer span.End()
+
+	span.SetAttributes(attribute.Int(r.key+".id", int(id)))
+
+	var v T
+	if err := r.db.Reader(ctx).First(&v, id).Error; err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &v, nil
+}
+
+// List はIDの昇順で一覧を返します
+func (r *CRUDRepository[T, PT]) List(ctx context.Context, limit, offset int) ([]T, error) {
+	ctx, span := r.start(ctx, "List", "list")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.Int("query.limit", limit),
+		attribute.Int("query.offset", offset),
+	)
+
+	var list []T
+	if err := r.db.Reader(ctx).Order("id").Limit(limit).Offset(offset).Find(&list).Error; err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("result.count", len(list)))
+	return list, nil
+}
+
+// Update はvの全てのフィールドを保存し、Versionを1増やします
+// Versionが保存されている値と異なる場合はdatabase.ErrVersionConflictを返します
+func (r *CRUDRepository[T, PT]) Update(ctx context.Context, v *T) error {
+	ctx, span := r.start(ctx, "Update", "update")
+	defer span.End()
+
+	m := entity.ModelOf[T, PT](v)
+	span.SetAttributes(
+		attribute.Int(r.key+".id", int(m.ID)),
+		attribute.Int(r.key+".version", int(m.Version)),
+	)
+
+	version, updatedAt := m.Version, m.UpdatedAt
+	m.Version++
+	m.UpdatedAt = time.Now()
+	result := r.db.WithContext(ctx).Model(v).
+		Where("version = ?", version).
+		Select("*").Omit("id", "created_at", "deleted_at").
+		Updates(v)
+	if result.Error == nil && result.RowsAffected == 0 {
+		result.Error = r.missing(ctx, m.ID)
+	}
+	if result.Error != nil {
+		m.Version, m.UpdatedAt = version, updatedAt
+		span.RecordError(result.Error)
+		return database.TranslateError(result.Error)
+	}
+	return nil
+}
+
+// Delete は論理削除します
+// versionが0でない場合は保存されている値と一致するときだけ削除し、異なればdatabase.ErrVersionConflictを返します
+// 対象が存在しない場合はgorm.ErrRecordNotFoundを返します
+func (r *CRUDRepository[T, PT]) Delete(ctx context.Context, id, version uint) error {
+	ctx, span := r.start(ctx, "Delete", "delete")
+	defer span.End()
+
+	span.SetAttributes(attribute.Int(r.key+".id", int(id)))
+
+	query := r.db.WithContext(ctx).Where("id = ?", id)
+	if version != 0 {
+		span.SetAttributes(attribute.Int(r.key+".version", int(version)))
+		query = query.Where("version = ?", version)
+	}
+	result := query.Delete(new(T))
+	if result.Error != nil {
+		span.RecordError(result.Error)
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		if version == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return r.missing(ctx, id)
+	}
+	return nil
+}
+
+// missing は条件付きの更新で対象の行がなかった理由を返します
+// 存在すればバージョンの不一致、存在しなければgorm.ErrRecordNotFound
+func (r *CRUDRepository[T, PT]) missing(ctx context.Context, id uint) error {
+	var count int64
+	if err := r.db.WithContext(ctx).Model(new(T)).Where("id = ?", id).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return fmt.Errorf("%s %d: %w", r.key, id, database.ErrVersionConflict)
+}
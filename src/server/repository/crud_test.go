@@ -0,0 +1,52 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"otel-test/database"
+	"otel-test/database/databasetest"
+	"otel-test/o11y/o11ytest"
+	"otel-test/server/entity"
+
+	"gorm.io/gorm"
+)
+
+func TestCRUDRepositoryUpdateVersion(t *testing.T) {
+	h := o11ytest.New(t)
+	r := NewCRUDRepository[entity.Hoge](databasetest.New(t, &entity.Hoge{}))
+	ctx := context.Background()
+
+	hoge := &entity.Hoge{Piyo: "a"}
+	if err := r.Create(ctx, hoge); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同じバージョンを読み込んだ2つのリクエストのうち、後から更新した方は失敗する
+	first, second := *hoge, *hoge
+	first.Huga = 1
+	if err := r.Update(ctx, &first); err != nil {
+		t.Fatal(err)
+	}
+	second.Huga = 2
+	if err := r.Update(ctx, &second); !errors.Is(err, database.ErrVersionConflict) {
+		t.Fatalf("err = %v, want %v", err, database.ErrVersionConflict)
+	}
+	if second.Version != 1 {
+		t.Fatalf("version = %d, want 1 after a failed update", second.Version)
+	}
+	h.Spans().Named("HogeRepository.Update").Len(2).Each()[1].HasAttr("hoge.version", 1).HasError()
+
+	got, err := r.GetByID(ctx, hoge.ID)
+	if err != nil || got.Huga != 1 || got.Version != 2 || !got.CreatedAt.Equal(hoge.CreatedAt) {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+
+	if err := r.Delete(ctx, hoge.ID, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetByID(ctx, hoge.ID); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("err = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+}
@@ -0,0 +1,195 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"otel-test/database"
+	"otel-test/idempotency"
+	"otel-test/server/entity"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm/clause"
+)
+
+// IdempotencyRepository はIdempotency-Keyとレスポンスを保存するリポジトリ
+// idempotency.Storeを実装する
+type IdempotencyRepository struct {
+	db     *database.DB
+	tracer trace.Tracer
+}
+
+func NewIdempotencyRepository(db *database.DB) *IdempotencyRepository {
+	return &IdempotencyRepository{
+		db:     db,
+		tracer: otel.Tracer("idempotency-repository"),
+	}
+}
+
+func (r *IdempotencyRepository) Lock(ctx context.Context, rec idempotency.Record, now time.Time) (*idempotency.Record, error) {
+	ctx, span := r.tracer.Start(ctx, "IdempotencyRepository.Lock")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "lock_idempotency_key"),
+		attribute.String("idempotency.scope", rec.Scope),
+	)
+
+	now = now.UTC()
+	row := &entity.IdempotencyKey{
+		Scope:       rec.Scope,
+		Key:         rec.Key,
+		Fingerprint: rec.Fingerprint,
+		Token:       rec.Token,
+		Status:      entity.IdempotencyProcessing,
+		LockedUntil: rec.LockedUntil.UTC(),
+		ExpiresAt:   rec.ExpiresAt.UTC(),
+	}
+
+	var existing entity.IdempotencyKey
+	acquired := false
+	err := r.db.WithinTx(ctx, func(ctx context.Context) error {
+		// 一時的なエラーで再実行される場合に備えて初期化する
+		acquired = false
+		// 同じキーが同時に送られた場合も一意制約によって1つだけが登録される
+		result := r.db.WithContext(ctx).
+			Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "scope"}, {Name: "idempotency_key"}}, DoNothing: true}).
+			Create(row)
+		if result.Error != nil || result.RowsAffected > 0 {
+			acquired = result.RowsAffected > 0
+			return result.Error
+		}
+
+		// 有効期限が切れたキーと、ロックの期限が切れた処理中のキーは置き換える
+		result = r.db.WithContext(ctx).Model(&entity.IdempotencyKey{}).
+			Where("scope = ? AND idempotency_key = ?", rec.Scope, rec.Key).
+			Where("(expires_at <= ? OR (status = ? AND locked_until <= ?))", now, entity.IdempotencyProcessing, now).
+			Updates(map[string]any{
+				"fingerprint":  row.Fingerprint,
+				"token":        row.Token,
+				"status":       row.Status,
+				"status_code":  0,
+				"header":       "",
+				"body":         nil,
+				"locked_until": row.LockedUntil,
+				"expires_at":   row.ExpiresAt,
+			})
+		if result.Error != nil || result.RowsAffected > 0 {
+			acquired = result.RowsAffected > 0
+			return result.Error
+		}
+
+		return r.db.WithContext(ctx).
+			Where("scope = ? AND idempotency_key = ?", rec.Scope, rec.Key).
+			First(&existing).Error
+	})
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Bool("idempotency.acquired", acquired))
+	if acquired {
+		return nil, nil
+	}
+	return toIdempotencyRecord(existing), nil
+}
+
+func (r *IdempotencyRepository) Complete(ctx context.Context, rec idempotency.Record) error {
+	ctx, span := r.tracer.Start(ctx, "IdempotencyRepository.Complete")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "complete_idempotency_key"),
+		attribute.String("idempotency.scope", rec.Scope),
+		attribute.Int("http.response.status_code", rec.StatusCode),
+	)
+
+	header, err := json.Marshal(rec.Header)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	result := r.db.WithContext(ctx).Model(&entity.IdempotencyKey{}).
+		Where("scope = ? AND idempotency_key = ? AND token = ? AND status = ?", rec.Scope, rec.Key, rec.Token, entity.IdempotencyProcessing).
+		Updates(map[string]any{
+			"status":      entity.IdempotencyCompleted,
+			"status_code": rec.StatusCode,
+			"header":      string(header),
+			"body":        rec.Body,
+		})
+	if result.Error != nil {
+		span.RecordError(result.Error)
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		span.RecordError(idempotency.ErrLockLost)
+		return idempotency.ErrLockLost
+	}
+	return nil
+}
+
+func (r *IdempotencyRepository) Release(ctx context.Context, rec idempotency.Record) error {
+	ctx, span := r.tracer.Start(ctx, "IdempotencyRepository.Release")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "release_idempotency_key"),
+		attribute.String("idempotency.scope", rec.Scope),
+	)
+
+	result := r.db.WithContext(ctx).
+		Where("scope = ? AND idempotency_key = ? AND token = ? AND status = ?", rec.Scope, rec.Key, rec.Token, entity.IdempotencyProcessing).
+		Delete(&entity.IdempotencyKey{})
+	if result.Error != nil {
+		span.RecordError(result.Error)
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		span.RecordError(idempotency.ErrLockLost)
+		return idempotency.ErrLockLost
+	}
+	return nil
+}
+
+func (r *IdempotencyRepository) PurgeExpired(ctx context.Context, before time.Time) (int64, error) {
+	ctx, span := r.tracer.Start(ctx, "IdempotencyRepository.PurgeExpired")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("operation", "purge_idempotency_keys"))
+
+	result := r.db.WithContext(ctx).
+		Where("expires_at <= ?", before.UTC()).
+		Delete(&entity.IdempotencyKey{})
+	if result.Error != nil {
+		span.RecordError(result.Error)
+		return 0, result.Error
+	}
+
+	span.SetAttributes(attribute.Int64("result.count", result.RowsAffected))
+	return result.RowsAffected, nil
+}
+
+func toIdempotencyRecord(row entity.IdempotencyKey) *idempotency.Record {
+	rec := &idempotency.Record{
+		Scope:       row.Scope,
+		Key:         row.Key,
+		Fingerprint: row.Fingerprint,
+		Token:       row.Token,
+		Completed:   row.Status == entity.IdempotencyCompleted,
+		StatusCode:  row.StatusCode,
+		Body:        row.Body,
+		LockedUntil: row.LockedUntil,
+		ExpiresAt:   row.ExpiresAt,
+	}
+	if row.Header != "" {
+		var header http.Header
+		if err := json.Unmarshal([]byte(row.Header), &header); err == nil {
+			rec.Header = header
+		}
+	}
+	return rec
+}
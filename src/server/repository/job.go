@@ -0,0 +1,196 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"otel-test/database"
+	"otel-test/jobs"
+	"otel-test/server/entity"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// JobRepository はジョブのキューを操作するリポジトリ
+// jobs.Storeを実装する
+type JobRepository struct {
+	db     *database.DB
+	tracer trace.Tracer
+}
+
+func NewJobRepository(db *database.DB) *JobRepository {
+	return &JobRepository{
+		db:     db,
+		tracer: otel.Tracer("job-repository"),
+	}
+}
+
+func (r *JobRepository) Enqueue(ctx context.Context, job jobs.Job) (uint64, bool, error) {
+	ctx, span := r.tracer.Start(ctx, "JobRepository.Enqueue")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "enqueue_job"),
+		attribute.String("job.type", job.Type),
+	)
+
+	traceContext, err := json.Marshal(job.TraceContext)
+	if err != nil {
+		span.RecordError(err)
+		return 0, false, err
+	}
+	row := &entity.Job{
+		Type:         job.Type,
+		Payload:      string(job.Payload),
+		Status:       entity.JobQueued,
+		RunAt:        job.RunAt.UTC(),
+		MaxAttempts:  job.MaxAttempts,
+		TraceContext: string(traceContext),
+	}
+	if job.UniqueKey != "" {
+		row.UniqueKey = &job.UniqueKey
+	}
+
+	// UniqueKeyが重複する場合は何もしない
+	result := r.db.WithContext(ctx).
+		Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "unique_key"}}, DoNothing: true}).
+		Create(row)
+	if result.Error != nil {
+		span.RecordError(result.Error)
+		return 0, false, result.Error
+	}
+
+	created := result.RowsAffected > 0
+	span.SetAttributes(attribute.Int64("job.id", int64(row.ID)), attribute.Bool("job.created", created))
+	return row.ID, created, nil
+}
+
+func (r *JobRepository) Claim(ctx context.Context, owner string, now time.Time, limit int, lease time.Duration) ([]jobs.Job, error) {
+	ctx, span := r.tracer.Start(ctx, "JobRepository.Claim")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "claim_jobs"),
+		attribute.Int("query.limit", limit),
+	)
+
+	now = now.UTC()
+	due := func(db *gorm.DB) *gorm.DB {
+		return db.Where("((status = ? AND run_at <= ?) OR (status = ? AND locked_until < ?))",
+			entity.JobQueued, now, entity.JobRunning, now)
+	}
+
+	var rows []entity.Job
+	err := r.db.WithinTx(ctx, func(ctx context.Context) error {
+		var ids []uint64
+		err := r.db.WithContext(ctx).Model(&entity.Job{}).
+			Scopes(due).
+			Order("run_at, id").
+			Limit(limit).
+			Pluck("id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		// 同時に取得した他のワーカーと競合しないよう、条件を再確認して更新する
+		err = r.db.WithContext(ctx).Model(&entity.Job{}).
+			Where("id IN ?", ids).
+			Scopes(due).
+			Updates(map[string]any{
+				"status":       entity.JobRunning,
+				"locked_by":    owner,
+				"locked_until": now.Add(lease),
+				"attempts":     gorm.Expr("attempts + 1"),
+			}).Error
+		if err != nil {
+			return err
+		}
+		return r.db.WithContext(ctx).
+			Where("id IN ? AND locked_by = ?", ids, owner).
+			Order("run_at, id").
+			Find(&rows).Error
+	})
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	result := make([]jobs.Job, 0, len(rows))
+	for _, row := range rows {
+		job := jobs.Job{
+			ID:          row.ID,
+			Type:        row.Type,
+			Payload:     json.RawMessage(row.Payload),
+			RunAt:       row.RunAt,
+			Attempt:     row.Attempts,
+			MaxAttempts: row.MaxAttempts,
+			LockedBy:    row.LockedBy,
+		}
+		if row.UniqueKey != nil {
+			job.UniqueKey = *row.UniqueKey
+		}
+		if row.TraceContext != "" {
+			_ = json.Unmarshal([]byte(row.TraceContext), &job.TraceContext)
+		}
+		result = append(result, job)
+	}
+
+	span.SetAttributes(attribute.Int("result.count", len(result)))
+	return result, nil
+}
+
+func (r *JobRepository) Complete(ctx context.Context, job jobs.Job) error {
+	return r.finish(ctx, "JobRepository.Complete", job, map[string]any{
+		"status":      entity.JobSucceeded,
+		"finished_at": time.Now().UTC(),
+		"last_error":  "",
+	})
+}
+
+func (r *JobRepository) Retry(ctx context.Context, job jobs.Job, runAt time.Time, cause error) error {
+	return r.finish(ctx, "JobRepository.Retry", job, map[string]any{
+		"status":     entity.JobQueued,
+		"run_at":     runAt.UTC(),
+		"last_error": cause.Error(),
+	})
+}
+
+func (r *JobRepository) Fail(ctx context.Context, job jobs.Job, cause error) error {
+	return r.finish(ctx, "JobRepository.Fail", job, map[string]any{
+		"status":      entity.JobDead,
+		"finished_at": time.Now().UTC(),
+		"last_error":  cause.Error(),
+	})
+}
+
+// finish は実行中のジョブのロックを解除して状態を更新します
+// ロックが他のワーカーに移っている場合はjobs.ErrLeaseLostを返す
+func (r *JobRepository) finish(ctx context.Context, name string, job jobs.Job, updates map[string]any) error {
+	ctx, span := r.tracer.Start(ctx, name)
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "update_job"),
+		attribute.Int64("job.id", int64(job.ID)),
+		attribute.String("job.status", updates["status"].(string)),
+	)
+
+	updates["locked_by"] = ""
+	updates["locked_until"] = nil
+	result := r.db.WithContext(ctx).Model(&entity.Job{}).
+		Where("id = ? AND status = ? AND locked_by = ?", job.ID, entity.JobRunning, job.LockedBy).
+		Updates(updates)
+	if result.Error != nil {
+		span.RecordError(result.Error)
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		span.RecordError(jobs.ErrLeaseLost)
+		return jobs.ErrLeaseLost
+	}
+	return nil
+}
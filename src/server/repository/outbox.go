@@ -0,0 +1,176 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"otel-test/database"
+	"otel-test/events"
+	"otel-test/server/entity"
+	"otel-test/tenant"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// OutboxRepository はアウトボックステーブルを操作するリポジトリ
+// events.Storeを実装する。リレーは全てのテナントのイベントを送信する
+type OutboxRepository struct {
+	db     *database.DB
+	tracer trace.Tracer
+}
+
+func NewOutboxRepository(db *database.DB) *OutboxRepository {
+	return &OutboxRepository{
+		db:     db,
+		tracer: otel.Tracer("outbox-repository"),
+	}
+}
+
+// Add はイベントをアウトボックスに追加します
+func (r *OutboxRepository) Add(ctx context.Context, ev events.Event) error {
+	ctx, span := r.tracer.Start(ctx, "OutboxRepository.Add")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "add_outbox_event"),
+		attribute.String("event.type", ev.Type),
+	)
+
+	traceContext, err := json.Marshal(ev.TraceContext)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	row := &entity.OutboxEvent{
+		Type:         ev.Type,
+		AggregateID:  ev.AggregateID,
+		Payload:      string(ev.Payload),
+		TraceContext: string(traceContext),
+		OccurredAt:   ev.OccurredAt,
+	}
+	if err := r.db.WithContext(ctx).Create(row).Error; err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	span.SetAttributes(attribute.Int64("event.id", int64(row.ID)))
+	return nil
+}
+
+func (r *OutboxRepository) Claim(ctx context.Context, owner string, now time.Time, limit, maxAttempts int, lease time.Duration) ([]events.Event, error) {
+	ctx, span := r.tracer.Start(tenant.WithAllTenants(ctx), "OutboxRepository.Claim")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "claim_outbox_events"),
+		attribute.Int("query.limit", limit),
+	)
+
+	now = now.UTC()
+	claimable := func(db *gorm.DB) *gorm.DB {
+		return db.Where("published_at IS NULL AND attempts < ? AND (locked_until IS NULL OR locked_until < ?)", maxAttempts, now)
+	}
+
+	var rows []entity.OutboxEvent
+	err := r.db.WithinTx(ctx, func(ctx context.Context) error {
+		var ids []uint64
+		err := r.db.WithContext(ctx).Model(&entity.OutboxEvent{}).
+			Scopes(claimable).
+			Order("id").
+			Limit(limit).
+			Pluck("id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		// 同時に取得した他のリレーと競合しないよう、条件を再確認して更新する
+		err = r.db.WithContext(ctx).Model(&entity.OutboxEvent{}).
+			Where("id IN ?", ids).
+			Scopes(claimable).
+			Updates(map[string]any{
+				"locked_by":    owner,
+				"locked_until": now.Add(lease),
+			}).Error
+		if err != nil {
+			return err
+		}
+		return r.db.WithContext(ctx).
+			Where("id IN ? AND locked_by = ?", ids, owner).
+			Order("id").
+			Find(&rows).Error
+	})
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	result := make([]events.Event, 0, len(rows))
+	for _, row := range rows {
+		ev := events.Event{
+			ID:          row.ID,
+			Type:        row.Type,
+			AggregateID: row.AggregateID,
+			TenantID:    row.TenantID,
+			Payload:     json.RawMessage(row.Payload),
+			OccurredAt:  row.OccurredAt,
+		}
+		if row.TraceContext != "" {
+			_ = json.Unmarshal([]byte(row.TraceContext), &ev.TraceContext)
+		}
+		result = append(result, ev)
+	}
+
+	span.SetAttributes(attribute.Int("result.count", len(result)))
+	return result, nil
+}
+
+func (r *OutboxRepository) MarkPublished(ctx context.Context, id uint64) error {
+	ctx, span := r.tracer.Start(tenant.WithAllTenants(ctx), "OutboxRepository.MarkPublished")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "mark_outbox_event_published"),
+		attribute.Int64("event.id", int64(id)),
+	)
+
+	err := r.db.WithContext(ctx).Model(&entity.OutboxEvent{}).
+		Where("id = ?", id).
+		Updates(map[string]any{
+			"published_at": time.Now().UTC(),
+			"attempts":     gorm.Expr("attempts + 1"),
+			"locked_by":    "",
+			"locked_until": nil,
+		}).Error
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
+
+func (r *OutboxRepository) MarkFailed(ctx context.Context, id uint64, cause error) error {
+	ctx, span := r.tracer.Start(tenant.WithAllTenants(ctx), "OutboxRepository.MarkFailed")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "mark_outbox_event_failed"),
+		attribute.Int64("event.id", int64(id)),
+	)
+
+	err := r.db.WithContext(ctx).Model(&entity.OutboxEvent{}).
+		Where("id = ?", id).
+		Updates(map[string]any{
+			"attempts":     gorm.Expr("attempts + 1"),
+			"last_error":   cause.Error(),
+			"locked_by":    "",
+			"locked_until": nil,
+		}).Error
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"otel-test/database/databasetest"
+	"otel-test/events"
+	"otel-test/o11y/o11ytest"
+	"otel-test/server/entity"
+	"otel-test/tenant"
+)
+
+func TestOutboxRepositoryClaim(t *testing.T) {
+	o11ytest.New(t)
+	r := NewOutboxRepository(databasetest.New(t, &entity.OutboxEvent{}))
+	ctx := tenant.WithID(context.Background(), "acme")
+	for _, typ := range []string{events.UserCreated, events.UserUpdated, events.UserDeleted} {
+		if err := r.Add(ctx, events.Event{Type: typ, AggregateID: 1, OccurredAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+
+	first, err := r.Claim(ctx, "relay-1", now, 2, 10, time.Minute)
+	if err != nil || len(first) != 2 || first[0].ID != 1 || first[1].ID != 2 {
+		t.Fatalf("first = %+v, %v", first, err)
+	}
+	// ロック中のイベントは他のリレーが取得しない
+	second, err := r.Claim(ctx, "relay-2", now, 10, 10, time.Minute)
+	if err != nil || len(second) != 1 || second[0].ID != 3 {
+		t.Fatalf("second = %+v, %v", second, err)
+	}
+
+	if err := r.MarkPublished(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.MarkFailed(ctx, 3, errors.New("boom")); err != nil {
+		t.Fatal(err)
+	}
+	// 失敗したイベントはすぐに再取得できる
+	retried, err := r.Claim(ctx, "relay-2", now, 10, 10, time.Minute)
+	if err != nil || len(retried) != 1 || retried[0].ID != 3 {
+		t.Fatalf("retried = %+v, %v", retried, err)
+	}
+
+	// ロックの期限が切れたイベントは他のリレーが再取得する
+	expired, err := r.Claim(ctx, "relay-2", now.Add(2*time.Minute), 10, 10, time.Minute)
+	if err != nil || len(expired) != 2 || expired[0].ID != 2 || expired[1].ID != 3 {
+		t.Fatalf("expired = %+v, %v", expired, err)
+	}
+}
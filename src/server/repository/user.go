@@ -2,14 +2,38 @@ package repository
 
 import (
 	"context"
+	"fmt"
 	"otel-test/database"
 	"otel-test/server/entity"
+	"time"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
 )
 
+// UserStore はユーザーの永続化
+// UserRepositoryと、キャッシュでデコレートしたCachedUserRepositoryが実装する
+type UserStore interface {
+	Create(ctx context.Context, user *entity.User) error
+	// CreateBatch は複数のユーザーをまとめて作成する
+	CreateBatch(ctx context.Context, users []*entity.User) error
+	GetByID(ctx context.Context, id uint) (*entity.User, error)
+	GetByEmail(ctx context.Context, email string) (*entity.User, error)
+	// ExistingEmails はemailsのうち既に使われている（論理削除済みを除く）メールアドレスを返す
+	ExistingEmails(ctx context.Context, emails []string) ([]string, error)
+	List(ctx context.Context, limit, offset int) ([]entity.User, error)
+	// ListAfter はafterIDより大きいIDのユーザーをIDの昇順で返す
+	ListAfter(ctx context.Context, afterID uint, limit int) ([]entity.User, error)
+	Update(ctx context.Context, user *entity.User) error
+	Delete(ctx context.Context, id, version uint) error
+	PurgeDeleted(ctx context.Context, before time.Time) (int64, error)
+}
+
+// UserRepository はUserStoreのデータベース実装
+// GetByID・List・ListAfterはトランザクション外ではレプリカから読み込む（database.DB.Reader）
+// CachedUserRepositoryはキャッシュに保存するGetByIDをプライマリから読み込む（database.WithPrimary）
 type UserRepository struct {
 	db     *database.DB
 	tracer trace.Tracer
@@ -33,17 +57,45 @@ func (r *UserRepository) Create(ctx context.Context, user *entity.User) error {
 		attribute.String("user.email", user.Email),
 	)
 
+	if user.Version == 0 {
+		user.Version = 1
+	}
+
 	// GORMでコンテキストを使用（自動的にトレースされる）
+	// 一意制約違反はdatabase.ErrDuplicateKeyとして返す
 	err := r.db.WithContext(ctx).Create(user).Error
 	if err != nil {
 		span.RecordError(err)
-		return err
+		return database.TranslateError(err)
 	}
 
 	span.SetAttributes(attribute.Int("user.id", int(user.ID)))
 	return nil
 }
 
+// CreateBatch は複数のユーザーを1つのINSERTで作成します
+// 一意制約違反はdatabase.ErrDuplicateKeyとして返し、どのユーザーも作成しない
+func (r *UserRepository) CreateBatch(ctx context.Context, users []*entity.User) error {
+	ctx, span := r.tracer.Start(ctx, "UserRepository.CreateBatch")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "create_users"),
+		attribute.Int("batch.size", len(users)),
+	)
+
+	for _, user := range users {
+		if user.Version == 0 {
+			user.Version = 1
+		}
+	}
+	if err := r.db.WithContext(ctx).Create(users).Error; err != nil {
+		span.RecordError(err)
+		return database.TranslateError(err)
+	}
+	return nil
+}
+
 func (r *UserRepository) GetByID(ctx context.Context, id uint) (*entity.User, error) {
 	ctx, span := r.tracer.Start(ctx, "UserRepository.GetByID")
 	defer span.End()
@@ -54,7 +106,7 @@ func (r *UserRepository) GetByID(ctx context.Context, id uint) (*entity.User, er
 	)
 
 	var user entity.User
-	err := r.db.WithContext(ctx).First(&user, id).Error
+	err := r.db.Reader(ctx).First(&user, id).Error
 	if err != nil {
 		span.RecordError(err)
 		return nil, err
@@ -94,7 +146,7 @@ func (r *UserRepository) List(ctx context.Context, limit, offset int) ([]entity.
 	)
 
 	var users []entity.User
-	err := r.db.WithContext(ctx).Limit(limit).Offset(offset).Find(&users).Error
+	err := r.db.Reader(ctx).Limit(limit).Offset(offset).Find(&users).Error
 	if err != nil {
 		span.RecordError(err)
 		return nil, err
@@ -103,3 +155,153 @@ func (r *UserRepository) List(ctx context.Context, limit, offset int) ([]entity.
 	span.SetAttributes(attribute.Int("result.count", len(users)))
 	return users, nil
 }
+
+// ExistingEmails はemailsのうち既に使われているメールアドレスを返します
+// 論理削除済みのユーザーは一意制約の対象外のため含めない
+func (r *UserRepository) ExistingEmails(ctx context.Context, emails []string) ([]string, error) {
+	ctx, span := r.tracer.Start(ctx, "UserRepository.ExistingEmails")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "find_existing_emails"),
+		attribute.Int("query.count", len(emails)),
+	)
+
+	var existing []string
+	if len(emails) == 0 {
+		return existing, nil
+	}
+	err := r.db.WithContext(ctx).Model(&entity.User{}).
+		Where("email IN ?", emails).
+		Pluck("email", &existing).Error
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("result.count", len(existing)))
+	return existing, nil
+}
+
+// ListAfter はafterIDより大きいIDのユーザーをIDの昇順で返します
+// 最後のIDを次のafterIDに指定すると、件数が多くても一定の速度で全件を読める
+func (r *UserRepository) ListAfter(ctx context.Context, afterID uint, limit int) ([]entity.User, error) {
+	ctx, span := r.tracer.Start(ctx, "UserRepository.ListAfter")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "list_users_after"),
+		attribute.Int("query.after_id", int(afterID)),
+		attribute.Int("query.limit", limit),
+	)
+
+	var users []entity.User
+	err := r.db.Reader(ctx).Where("id > ?", afterID).Order("id").Limit(limit).Find(&users).Error
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("result.count", len(users)))
+	return users, nil
+}
+
+// Update はユーザーの名前とメールアドレスを更新し、user.Versionを1増やします
+// user.Versionが保存されている値と異なる場合はdatabase.ErrVersionConflictを返します
+func (r *UserRepository) Update(ctx context.Context, user *entity.User) error {
+	ctx, span := r.tracer.Start(ctx, "UserRepository.Update")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "update_user"),
+		attribute.Int("user.id", int(user.ID)),
+		attribute.Int("user.version", int(user.Version)),
+	)
+
+	now := time.Now()
+	result := r.db.WithContext(ctx).Model(&entity.User{}).
+		Where("id = ? AND version = ?", user.ID, user.Version).
+		Updates(map[string]any{
+			"name":       user.Name,
+			"email":      user.Email,
+			"version":    gorm.Expr("version + 1"),
+			"updated_at": now,
+		})
+	if result.Error != nil {
+		span.RecordError(result.Error)
+		return database.TranslateError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		err := r.missing(ctx, user.ID)
+		span.RecordError(err)
+		return err
+	}
+
+	user.Version++
+	user.UpdatedAt = now
+	return nil
+}
+
+// Delete はユーザーを論理削除します
+// versionが0でない場合は保存されている値と一致するときだけ削除し、異なればdatabase.ErrVersionConflictを返します
+// 対象が存在しない場合はgorm.ErrRecordNotFoundを返します
+func (r *UserRepository) Delete(ctx context.Context, id, version uint) error {
+	ctx, span := r.tracer.Start(ctx, "UserRepository.Delete")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "delete_user"),
+		attribute.Int("user.id", int(id)),
+	)
+
+	query := r.db.WithContext(ctx).Where("id = ?", id)
+	if version != 0 {
+		span.SetAttributes(attribute.Int("user.version", int(version)))
+		query = query.Where("version = ?", version)
+	}
+	result := query.Delete(&entity.User{})
+	if result.Error != nil {
+		span.RecordError(result.Error)
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		if version == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return r.missing(ctx, id)
+	}
+
+	return nil
+}
+
+// missing は条件付きの更新で対象の行がなかった理由を返します
+// ユーザーが存在すればバージョンの不一致、存在しなければgorm.ErrRecordNotFound
+func (r *UserRepository) missing(ctx context.Context, id uint) error {
+	var count int64
+	if err := r.db.WithContext(ctx).Model(&entity.User{}).Where("id = ?", id).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return fmt.Errorf("user %d: %w", id, database.ErrVersionConflict)
+}
+
+// PurgeDeleted はbefore以前に論理削除されたユーザーを物理削除し、削除した件数を返します
+func (r *UserRepository) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	ctx, span := r.tracer.Start(ctx, "UserRepository.PurgeDeleted")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("operation", "purge_deleted_users"))
+
+	result := r.db.WithContext(ctx).Unscoped().
+		Where("deleted_at IS NOT NULL AND deleted_at < ?", before).
+		Delete(&entity.User{})
+	if result.Error != nil {
+		span.RecordError(result.Error)
+		return 0, result.Error
+	}
+
+	span.SetAttributes(attribute.Int64("result.count", result.RowsAffected))
+	return result.RowsAffected, nil
+}
@@ -0,0 +1,211 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"otel-test/cache"
+	"otel-test/database"
+	"otel-test/server/entity"
+	"otel-test/tenant"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// userIDKey はIDで引くユーザーのキャッシュキー（値はユーザーのJSON）
+// 別のテナントのユーザーを返さないよう、キーにはコンテキストのテナントを含める
+func userIDKey(ctx context.Context, id uint) string {
+	return userKeyPrefix(ctx) + "id:" + strconv.FormatUint(uint64(id), 10)
+}
+
+// userEmailKey はメールアドレスで引くユーザーのキャッシュキー（値はユーザーID）
+func userEmailKey(ctx context.Context, email string) string {
+	return userKeyPrefix(ctx) + "email:" + email
+}
+
+func userKeyPrefix(ctx context.Context) string {
+	id, _ := tenant.FromContext(ctx)
+	return "user:" + id + ":"
+}
+
+// CachedUserRepository はGetByID/GetByEmailの結果をキャッシュするUserStoreのデコレーター
+//
+// メールアドレスのキーにはユーザーIDだけを保存し、ユーザー本体はIDのキーで共有する
+// メールアドレスの変更後に古いキーが残っていても、IDで引いたユーザーと一致しない場合は使用しない
+// 存在しないことも保存するため、書き込み時は関連するキーを削除する
+// 保存する値はプライマリから読み込む（遅れているレプリカの古い値や、まだ存在しないことをTTLの間返さないため）
+type CachedUserRepository struct {
+	next   UserStore
+	cache  *cache.Cache
+	tracer trace.Tracer
+}
+
+// NewCachedUserRepository はnextをキャッシュでデコレートします
+func NewCachedUserRepository(next UserStore, c *cache.Cache) *CachedUserRepository {
+	return &CachedUserRepository{
+		next:   next,
+		cache:  c,
+		tracer: otel.Tracer("user-cache"),
+	}
+}
+
+func (r *CachedUserRepository) GetByID(ctx context.Context, id uint) (*entity.User, error) {
+	if database.InTx(ctx) {
+		return r.next.GetByID(ctx, id)
+	}
+
+	ctx, span := r.tracer.Start(ctx, "CachedUserRepository.GetByID")
+	defer span.End()
+
+	span.SetAttributes(attribute.Int("user.id", int(id)))
+
+	data, err := r.cache.Fetch(ctx, userIDKey(ctx, id), func(ctx context.Context) ([]byte, error) {
+		user, err := r.next.GetByID(database.WithPrimary(ctx), id)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(user)
+	})
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	if data == nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	var user entity.User
+	if err := json.Unmarshal(data, &user); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *CachedUserRepository) GetByEmail(ctx context.Context, email string) (*entity.User, error) {
+	if database.InTx(ctx) {
+		return r.next.GetByEmail(ctx, email)
+	}
+
+	ctx, span := r.tracer.Start(ctx, "CachedUserRepository.GetByEmail")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("user.email", email))
+
+	key := userEmailKey(ctx, email)
+	data, err := r.cache.Fetch(ctx, key, func(ctx context.Context) ([]byte, error) {
+		user, err := r.next.GetByEmail(ctx, email)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// 続くGetByIDでもう一度読み込まないよう、ユーザー本体も保存する
+		if data, err := json.Marshal(user); err == nil {
+			r.cache.Set(ctx, userIDKey(ctx, user.ID), data)
+		}
+		return []byte(strconv.FormatUint(uint64(user.ID), 10)), nil
+	})
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	if data == nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	id, err := strconv.ParseUint(string(data), 10, 64)
+	if err == nil {
+		user, err := r.GetByID(ctx, uint(id))
+		if err == nil && user.Email == email {
+			return user, nil
+		}
+	}
+
+	// 古い対応付けは削除してデータベースから読み込む
+	span.SetAttributes(attribute.Bool("cache.stale", true))
+	r.cache.Delete(ctx, key)
+	return r.next.GetByEmail(ctx, email)
+}
+
+func (r *CachedUserRepository) List(ctx context.Context, limit, offset int) ([]entity.User, error) {
+	return r.next.List(ctx, limit, offset)
+}
+
+func (r *CachedUserRepository) Create(ctx context.Context, user *entity.User) error {
+	if err := r.next.Create(ctx, user); err != nil {
+		return err
+	}
+	// 存在しないことを保存したキーも削除する
+	r.invalidate(ctx, userIDKey(ctx, user.ID), userEmailKey(ctx, user.Email))
+	return nil
+}
+
+func (r *CachedUserRepository) CreateBatch(ctx context.Context, users []*entity.User) error {
+	if err := r.next.CreateBatch(ctx, users); err != nil {
+		return err
+	}
+	keys := make([]string, 0, 2*len(users))
+	for _, user := range users {
+		keys = append(keys, userIDKey(ctx, user.ID), userEmailKey(ctx, user.Email))
+	}
+	r.invalidate(ctx, keys...)
+	return nil
+}
+
+func (r *CachedUserRepository) ExistingEmails(ctx context.Context, emails []string) ([]string, error) {
+	return r.next.ExistingEmails(ctx, emails)
+}
+
+func (r *CachedUserRepository) ListAfter(ctx context.Context, afterID uint, limit int) ([]entity.User, error) {
+	return r.next.ListAfter(ctx, afterID, limit)
+}
+
+func (r *CachedUserRepository) Update(ctx context.Context, user *entity.User) error {
+	if err := r.next.Update(ctx, user); err != nil {
+		// 保存されている値が古い可能性があるため、バージョンの不一致でも削除する
+		if errors.Is(err, database.ErrVersionConflict) {
+			r.invalidate(ctx, userIDKey(ctx, user.ID))
+		}
+		return err
+	}
+	r.invalidate(ctx, userIDKey(ctx, user.ID), userEmailKey(ctx, user.Email))
+	return nil
+}
+
+func (r *CachedUserRepository) Delete(ctx context.Context, id, version uint) error {
+	if err := r.next.Delete(ctx, id, version); err != nil {
+		if errors.Is(err, database.ErrVersionConflict) {
+			r.invalidate(ctx, userIDKey(ctx, id))
+		}
+		return err
+	}
+	r.invalidate(ctx, userIDKey(ctx, id))
+	return nil
+}
+
+func (r *CachedUserRepository) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	return r.next.PurgeDeleted(ctx, before)
+}
+
+// invalidate はkeysをキャッシュから削除します
+// トランザクション内の場合は、コミット前に他のリクエストが古い値を読み込んで保存することがあるため
+// コミット後にもう一度削除する
+func (r *CachedUserRepository) invalidate(ctx context.Context, keys ...string) {
+	r.cache.Delete(ctx, keys...)
+	if !database.InTx(ctx) {
+		return
+	}
+	database.OnCommit(ctx, func() {
+		r.cache.Delete(context.WithoutCancel(ctx), keys...)
+	})
+}
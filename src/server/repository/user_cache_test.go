@@ -0,0 +1,233 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"otel-test/cache"
+	"otel-test/database"
+	"otel-test/database/databasetest"
+	"otel-test/o11y/o11ytest"
+	"otel-test/server/entity"
+	"otel-test/tenant"
+
+	"gorm.io/gorm"
+)
+
+func newTestCachedUserRepository(t *testing.T) (*o11ytest.Harness, *database.DB, *CachedUserRepository) {
+	t.Helper()
+	h := o11ytest.New(t)
+	db := databasetest.New(t, &entity.User{})
+	c := cache.New("users", cache.NewLRU("users", 100), cache.Config{TTL: time.Minute, NegativeTTL: time.Minute})
+	return h, db, NewCachedUserRepository(NewUserRepository(db), c)
+}
+
+func TestCachedUserRepositoryGetByID(t *testing.T) {
+	h, _, r := newTestCachedUserRepository(t)
+	ctx := tenant.WithID(context.Background(), "acme")
+
+	user := &entity.User{Name: "Taro", Email: "taro@example.com"}
+	if err := r.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		got, err := r.GetByID(ctx, user.ID)
+		if err != nil || got.Email != user.Email {
+			t.Fatalf("got %+v, %v", got, err)
+		}
+	}
+	// 存在しないことも保存する
+	for range 2 {
+		if _, err := r.GetByID(ctx, 999); !errors.Is(err, gorm.ErrRecordNotFound) {
+			t.Fatalf("err = %v, want %v", err, gorm.ErrRecordNotFound)
+		}
+	}
+
+	h.Spans().Named("UserRepository.GetByID").Len(2)
+	spans := h.Spans().Named("CachedUserRepository.GetByID").Len(5).Each()
+	spans[0].HasAttr("cache.hit", false)
+	spans[1].HasAttr("cache.hit", true)
+	spans[4].HasAttr("cache.hit", true)
+}
+
+func TestCachedUserRepositoryReadsFromPrimary(t *testing.T) {
+	h := o11ytest.New(t)
+	db := databasetest.NewWithReplicas(t, 1, &entity.User{})
+	c := cache.New("users", cache.NewLRU("users", 100), cache.Config{TTL: time.Minute, NegativeTTL: time.Minute})
+	r := NewCachedUserRepository(NewUserRepository(db), c)
+	ctx := tenant.WithID(context.Background(), "acme")
+
+	// テストのレプリカには複製されないため、レプリカから読み込むと見つからない（存在しないことが保存される）
+	user := &entity.User{Name: "Taro", Email: "taro@example.com"}
+	if err := r.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if got, err := r.GetByID(ctx, user.ID); err != nil || got.Version != 1 {
+			t.Fatalf("got %+v, %v", got, err)
+		}
+	}
+
+	// 更新後も古いバージョンを保存しない
+	user.Name = "Jiro"
+	if err := r.Update(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := r.GetByID(ctx, user.ID); err != nil || got.Version != 2 {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+	for _, s := range h.Spans().Named("select users").Each() {
+		s.HasAttr("db.node", database.NodePrimary)
+	}
+}
+
+func TestCachedUserRepositoryGetByEmail(t *testing.T) {
+	h, _, r := newTestCachedUserRepository(t)
+	ctx := tenant.WithID(context.Background(), "acme")
+
+	// 作成前の重複チェックで存在しないことが保存される
+	if _, err := r.GetByEmail(ctx, "taro@example.com"); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("err = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+	user := &entity.User{Name: "Taro", Email: "taro@example.com"}
+	if err := r.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Reset()
+	for range 2 {
+		got, err := r.GetByEmail(ctx, "taro@example.com")
+		if err != nil || got.ID != user.ID {
+			t.Fatalf("got %+v, %v", got, err)
+		}
+	}
+	// ユーザー本体も保存されるため、IDで引いてもデータベースを読まない
+	if _, err := r.GetByID(ctx, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	h.Spans().Named("UserRepository.GetByEmail").Len(1)
+	h.Spans().Named("UserRepository.GetByID").Len(0)
+}
+
+func TestCachedUserRepositoryEmailChange(t *testing.T) {
+	_, _, r := newTestCachedUserRepository(t)
+	ctx := tenant.WithID(context.Background(), "acme")
+
+	user := &entity.User{Name: "Taro", Email: "old@example.com"}
+	if err := r.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetByEmail(ctx, "old@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	user.Email = "new@example.com"
+	if err := r.Update(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	// 古いメールアドレスのキーは残っているが、IDで引いたユーザーと一致しないため使用しない
+	if _, err := r.GetByEmail(ctx, "old@example.com"); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("err = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+	got, err := r.GetByEmail(ctx, "new@example.com")
+	if err != nil || got.ID != user.ID {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+}
+
+func TestCachedUserRepositoryInvalidatesAfterCommit(t *testing.T) {
+	_, db, r := newTestCachedUserRepository(t)
+	ctx := tenant.WithID(context.Background(), "acme")
+
+	user := &entity.User{Name: "Taro", Email: "taro@example.com"}
+	if err := r.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	err := db.WithinTx(ctx, func(txCtx context.Context) error {
+		updated := *user
+		updated.Name = "Jiro"
+		if err := r.Update(txCtx, &updated); err != nil {
+			return err
+		}
+		// コミット前に他のリクエストが古い値を読み込んで保存する
+		got, err := r.GetByID(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		if got.Name != "Taro" {
+			t.Errorf("name before commit = %q, want Taro", got.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := r.GetByID(ctx, user.ID)
+	if err != nil || got.Name != "Jiro" {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+}
+
+func TestCachedUserRepositoryInvalidatesAfterWithinTx(t *testing.T) {
+	_, db, r := newTestCachedUserRepository(t)
+	ctx := tenant.WithID(context.Background(), "acme")
+
+	user := &entity.User{Name: "Taro", Email: "taro@example.com"}
+	if err := r.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	err := db.WithinTx(ctx, func(txCtx context.Context) error {
+		updated := *user
+		updated.Name = "Jiro"
+		if err := r.Update(txCtx, &updated); err != nil {
+			return err
+		}
+		// トランザクション内の読み込みはキャッシュを使用しない
+		if got, err := r.GetByID(txCtx, user.ID); err != nil || got.Name != "Jiro" {
+			t.Errorf("got %+v, %v in transaction", got, err)
+		}
+		// コミット前に他のリクエストが古い値を読み込んで保存する
+		if got, err := r.GetByID(ctx, user.ID); err != nil || got.Name != "Taro" {
+			t.Errorf("got %+v, %v before commit", got, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := r.GetByID(ctx, user.ID)
+	if err != nil || got.Name != "Jiro" {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+}
+
+func TestCachedUserRepositoryTenantIsolation(t *testing.T) {
+	_, _, r := newTestCachedUserRepository(t)
+	acme := tenant.WithID(context.Background(), "acme")
+	globex := tenant.WithID(context.Background(), "globex")
+
+	user := &entity.User{Name: "Taro", Email: "taro@example.com"}
+	if err := r.Create(acme, user); err != nil {
+		t.Fatal(err)
+	}
+	// acmeでキャッシュしたユーザーを別のテナントには返さない
+	if _, err := r.GetByID(acme, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetByEmail(acme, user.Email); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetByID(globex, user.ID); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("err = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+	if _, err := r.GetByEmail(globex, user.Email); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("err = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+}
@@ -0,0 +1,207 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"otel-test/database"
+	"otel-test/database/databasetest"
+	"otel-test/o11y/o11ytest"
+	"otel-test/server/entity"
+	"otel-test/tenant"
+
+	"gorm.io/gorm"
+)
+
+func TestUserRepositoryUpdateVersion(t *testing.T) {
+	h := o11ytest.New(t)
+	r := NewUserRepository(databasetest.New(t, &entity.User{}))
+	ctx := tenant.WithID(context.Background(), "acme")
+
+	user := &entity.User{Name: "Taro", Email: "taro@example.com"}
+	if err := r.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if user.Version != 1 {
+		t.Fatalf("version = %d, want 1", user.Version)
+	}
+
+	// 同じバージョンを読み込んだ2つのリクエストのうち、後から更新した方は失敗する
+	first, second := *user, *user
+	first.Name = "Jiro"
+	if err := r.Update(ctx, &first); err != nil {
+		t.Fatal(err)
+	}
+	if first.Version != 2 {
+		t.Fatalf("version = %d, want 2", first.Version)
+	}
+	second.Name = "Saburo"
+	if err := r.Update(ctx, &second); !errors.Is(err, database.ErrVersionConflict) {
+		t.Fatalf("err = %v, want %v", err, database.ErrVersionConflict)
+	}
+	h.Spans().Named("UserRepository.Update").Len(2).Each()[1].HasAttr("user.version", 1).HasError()
+
+	got, err := r.GetByID(ctx, user.ID)
+	if err != nil || got.Name != "Jiro" || got.Version != 2 {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+
+	missing := entity.User{ID: 999, Name: "Shiro", Email: "shiro@example.com", Version: 1}
+	if err := r.Update(ctx, &missing); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("err = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+}
+
+func TestUserRepositoryDeleteVersion(t *testing.T) {
+	o11ytest.New(t)
+	r := NewUserRepository(databasetest.New(t, &entity.User{}))
+	ctx := tenant.WithID(context.Background(), "acme")
+
+	user := &entity.User{Name: "Taro", Email: "taro@example.com"}
+	if err := r.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Delete(ctx, user.ID, 2); !errors.Is(err, database.ErrVersionConflict) {
+		t.Fatalf("err = %v, want %v", err, database.ErrVersionConflict)
+	}
+	if err := r.Delete(ctx, user.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	// 削除済みのユーザーはバージョンに関係なく存在しない
+	if err := r.Delete(ctx, user.ID, 1); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("err = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+}
+
+func TestUserRepositoryRecreateDeletedEmail(t *testing.T) {
+	o11ytest.New(t)
+	r := NewUserRepository(databasetest.New(t, &entity.User{}))
+	ctx := tenant.WithID(context.Background(), "acme")
+
+	user := &entity.User{Name: "Taro", Email: "taro@example.com"}
+	if err := r.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Create(ctx, &entity.User{Name: "Taro", Email: "taro@example.com"}); !errors.Is(err, database.ErrDuplicateKey) {
+		t.Fatalf("err = %v, want %v", err, database.ErrDuplicateKey)
+	}
+
+	// 論理削除したユーザーのメールアドレスは再び使える
+	if err := r.Delete(ctx, user.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	existing, err := r.ExistingEmails(ctx, []string{"taro@example.com"})
+	if err != nil || len(existing) != 0 {
+		t.Fatalf("existing = %v, %v", existing, err)
+	}
+	recreated := &entity.User{Name: "Taro", Email: "taro@example.com"}
+	if err := r.Create(ctx, recreated); err != nil {
+		t.Fatal(err)
+	}
+	if recreated.ID == user.ID {
+		t.Fatalf("recreated user has the deleted user's id %d", user.ID)
+	}
+}
+
+func TestUserRepositoryReadsFromReplica(t *testing.T) {
+	h := o11ytest.New(t)
+	db := databasetest.NewWithReplicas(t, 1, &entity.User{})
+	r := NewUserRepository(db)
+	ctx := tenant.WithID(context.Background(), "acme")
+
+	user := &entity.User{Name: "Taro", Email: "taro@example.com"}
+	if err := r.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	h.Span("insert users").HasAttr("db.node", database.NodePrimary)
+
+	// テストのレプリカには複製されないため、プライマリで作成したユーザーは見つからない
+	if _, err := r.GetByID(ctx, user.ID); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("err = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+	if users, err := r.List(ctx, 10, 0); err != nil || len(users) != 0 {
+		t.Fatalf("users = %v, err = %v", users, err)
+	}
+	for _, s := range h.Spans().Named("select users").Each() {
+		s.HasAttr("db.node", database.ReplicaNode(0))
+	}
+
+	// 書き込み前の確認などトランザクション内の読み込みはプライマリを使う
+	err := db.WithinTx(ctx, func(ctx context.Context) error {
+		_, err := r.GetByID(ctx, user.ID)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.GetByEmail(ctx, user.Email); err != nil {
+		t.Fatal(err)
+	}
+	// WithPrimaryのコンテキストではトランザクション外でもプライマリを使う
+	if _, err := r.GetByID(database.WithPrimary(ctx), user.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUserRepositoryTenantIsolation(t *testing.T) {
+	h := o11ytest.New(t)
+	r := NewUserRepository(databasetest.New(t, &entity.User{}))
+	acme := tenant.WithID(context.Background(), "acme")
+	globex := tenant.WithID(context.Background(), "globex")
+
+	// 作成時に指定したTenantIDは使わず、コンテキストのテナントになる
+	user := &entity.User{TenantID: "globex", Name: "Taro", Email: "taro@example.com"}
+	if err := r.Create(acme, user); err != nil {
+		t.Fatal(err)
+	}
+	if user.TenantID != "acme" {
+		t.Fatalf("tenant = %q, want acme", user.TenantID)
+	}
+	h.Span("insert users").HasAttr(tenant.AttributeKey, "acme")
+
+	// メールアドレスはテナントごとに一意
+	other := &entity.User{Name: "Taro", Email: "taro@example.com"}
+	if err := r.Create(globex, other); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Create(acme, &entity.User{Name: "Taro", Email: "taro@example.com"}); err == nil {
+		t.Fatal("duplicate email in the same tenant was created")
+	}
+
+	// 別のテナントのユーザーは読み込み・更新・削除できない
+	if _, err := r.GetByID(globex, user.ID); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("GetByID err = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+	if got, err := r.GetByEmail(globex, user.Email); err != nil || got.ID != other.ID {
+		t.Fatalf("GetByEmail = %+v, %v", got, err)
+	}
+	if users, err := r.List(globex, 10, 0); err != nil || len(users) != 1 || users[0].ID != other.ID {
+		t.Fatalf("List = %+v, %v", users, err)
+	}
+	if users, err := r.ListAfter(globex, 0, 10); err != nil || len(users) != 1 || users[0].ID != other.ID {
+		t.Fatalf("ListAfter = %+v, %v", users, err)
+	}
+	stolen := *user
+	stolen.Name = "Stolen"
+	if err := r.Update(globex, &stolen); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("Update err = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+	if err := r.Delete(globex, user.ID, user.Version); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("Delete err = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+	got, err := r.GetByID(acme, user.ID)
+	if err != nil || got.Name != "Taro" || got.Version != 1 {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+	h.Spans().Named("select users").Each()[0].HasAttr(tenant.AttributeKey, "globex")
+
+	// テナントのないコンテキストでは失敗する
+	if _, err := r.GetByID(context.Background(), user.ID); !errors.Is(err, tenant.ErrMissing) {
+		t.Fatalf("err = %v, want %v", err, tenant.ErrMissing)
+	}
+	if err := r.Create(context.Background(), &entity.User{Name: "Jiro", Email: "jiro@example.com"}); !errors.Is(err, tenant.ErrMissing) {
+		t.Fatalf("err = %v, want %v", err, tenant.ErrMissing)
+	}
+}
@@ -0,0 +1,291 @@
+package repository
+
+import (
+	"context"
+	"otel-test/database"
+	"otel-test/server/entity"
+	"otel-test/tenant"
+	"otel-test/webhook"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// WebhookRepository はwebhookの購読と配信を操作するリポジトリ
+type WebhookRepository struct {
+	db     *database.DB
+	tracer trace.Tracer
+}
+
+func NewWebhookRepository(db *database.DB) *WebhookRepository {
+	return &WebhookRepository{
+		db:     db,
+		tracer: otel.Tracer("webhook-repository"),
+	}
+}
+
+func (r *WebhookRepository) CreateSubscription(ctx context.Context, sub *entity.WebhookSubscription) error {
+	ctx, span := r.tracer.Start(ctx, "WebhookRepository.CreateSubscription")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("operation", "create_webhook_subscription"))
+
+	if err := r.db.WithContext(ctx).Create(sub).Error; err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	span.SetAttributes(attribute.Int("webhook.subscription_id", int(sub.ID)))
+	return nil
+}
+
+func (r *WebhookRepository) GetSubscription(ctx context.Context, id uint) (*entity.WebhookSubscription, error) {
+	ctx, span := r.tracer.Start(ctx, "WebhookRepository.GetSubscription")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "get_webhook_subscription"),
+		attribute.Int("webhook.subscription_id", int(id)),
+	)
+
+	var sub entity.WebhookSubscription
+	if err := r.db.WithContext(ctx).First(&sub, id).Error; err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &sub, nil
+}
+
+func (r *WebhookRepository) ListSubscriptions(ctx context.Context) ([]entity.WebhookSubscription, error) {
+	ctx, span := r.tracer.Start(ctx, "WebhookRepository.ListSubscriptions")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("operation", "list_webhook_subscriptions"))
+
+	var subs []entity.WebhookSubscription
+	if err := r.db.WithContext(ctx).Order("id").Find(&subs).Error; err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("result.count", len(subs)))
+	return subs, nil
+}
+
+// DeleteSubscription は購読を論理削除します
+// 対象が存在しない場合はgorm.ErrRecordNotFoundを返します
+func (r *WebhookRepository) DeleteSubscription(ctx context.Context, id uint) error {
+	ctx, span := r.tracer.Start(ctx, "WebhookRepository.DeleteSubscription")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "delete_webhook_subscription"),
+		attribute.Int("webhook.subscription_id", int(id)),
+	)
+
+	result := r.db.WithContext(ctx).Delete(&entity.WebhookSubscription{}, id)
+	if result.Error != nil {
+		span.RecordError(result.Error)
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *WebhookRepository) CreateDeliveries(ctx context.Context, deliveries []entity.WebhookDelivery) error {
+	ctx, span := r.tracer.Start(ctx, "WebhookRepository.CreateDeliveries")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "create_webhook_deliveries"),
+		attribute.Int("webhook.delivery_count", len(deliveries)),
+	)
+
+	if len(deliveries) == 0 {
+		return nil
+	}
+	if err := r.db.WithContext(ctx).Create(&deliveries).Error; err != nil {
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
+
+func (r *WebhookRepository) GetDelivery(ctx context.Context, id uint) (*entity.WebhookDelivery, error) {
+	ctx, span := r.tracer.Start(ctx, "WebhookRepository.GetDelivery")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "get_webhook_delivery"),
+		attribute.Int("webhook.delivery_id", int(id)),
+	)
+
+	var delivery entity.WebhookDelivery
+	if err := r.db.WithContext(ctx).First(&delivery, id).Error; err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+// ClaimDeliveries は全てのテナントの送信時刻を過ぎた配信を古い順に最大limit件取得し、leaseの間ownerがロックします
+// ロックの期限が切れた送信中の配信（停止したインスタンスの配信）も再取得する
+func (r *WebhookRepository) ClaimDeliveries(ctx context.Context, owner string, now time.Time, limit int, lease time.Duration) ([]entity.WebhookDelivery, error) {
+	ctx, span := r.tracer.Start(tenant.WithAllTenants(ctx), "WebhookRepository.ClaimDeliveries")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "claim_webhook_deliveries"),
+		attribute.Int("query.limit", limit),
+	)
+
+	now = now.UTC()
+	due := func(db *gorm.DB) *gorm.DB {
+		return db.Where("((status = ? AND next_attempt_at <= ?) OR (status = ? AND locked_until < ?))",
+			entity.DeliveryPending, now, entity.DeliveryDelivering, now)
+	}
+
+	var deliveries []entity.WebhookDelivery
+	err := r.db.WithinTx(ctx, func(ctx context.Context) error {
+		var ids []uint
+		err := r.db.WithContext(ctx).Model(&entity.WebhookDelivery{}).
+			Scopes(due).
+			Order("next_attempt_at, id").
+			Limit(limit).
+			Pluck("id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		// 同時に取得した他のインスタンスと競合しないよう、条件を再確認して更新する
+		err = r.db.WithContext(ctx).Model(&entity.WebhookDelivery{}).
+			Where("id IN ?", ids).
+			Scopes(due).
+			Updates(map[string]any{
+				"status":       entity.DeliveryDelivering,
+				"locked_by":    owner,
+				"locked_until": now.Add(lease),
+			}).Error
+		if err != nil {
+			return err
+		}
+		return r.db.WithContext(ctx).
+			Where("id IN ? AND locked_by = ?", ids, owner).
+			Order("next_attempt_at, id").
+			Find(&deliveries).Error
+	})
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("result.count", len(deliveries)))
+	return deliveries, nil
+}
+
+func (r *WebhookRepository) ListDeliveries(ctx context.Context, subscriptionID uint, limit int) ([]entity.WebhookDelivery, error) {
+	ctx, span := r.tracer.Start(ctx, "WebhookRepository.ListDeliveries")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "list_webhook_deliveries"),
+		attribute.Int("webhook.subscription_id", int(subscriptionID)),
+		attribute.Int("query.limit", limit),
+	)
+
+	var deliveries []entity.WebhookDelivery
+	err := r.db.WithContext(ctx).
+		Where("subscription_id = ?", subscriptionID).
+		Order("id DESC").
+		Limit(limit).
+		Find(&deliveries).Error
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("result.count", len(deliveries)))
+	return deliveries, nil
+}
+
+func (r *WebhookRepository) ListAttempts(ctx context.Context, deliveryID uint) ([]entity.WebhookAttempt, error) {
+	ctx, span := r.tracer.Start(ctx, "WebhookRepository.ListAttempts")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "list_webhook_attempts"),
+		attribute.Int("webhook.delivery_id", int(deliveryID)),
+	)
+
+	var attempts []entity.WebhookAttempt
+	if err := r.db.WithContext(ctx).Where("delivery_id = ?", deliveryID).Order("attempt").Find(&attempts).Error; err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return attempts, nil
+}
+
+// RecordAttempt は試行の記録と配信の状態の更新を同じトランザクションで保存し、配信のロックを解除します
+// ロックが他のインスタンスに移っている場合は何も保存せずwebhook.ErrLeaseLostを返す
+func (r *WebhookRepository) RecordAttempt(ctx context.Context, delivery *entity.WebhookDelivery, attempt *entity.WebhookAttempt) error {
+	ctx, span := r.tracer.Start(ctx, "WebhookRepository.RecordAttempt")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "record_webhook_attempt"),
+		attribute.Int("webhook.delivery_id", int(delivery.ID)),
+		attribute.Int("webhook.attempt", attempt.Attempt),
+	)
+
+	owner := delivery.LockedBy
+	delivery.LockedBy, delivery.LockedUntil = "", nil
+	err := r.db.WithinTx(ctx, func(ctx context.Context) error {
+		result := r.db.WithContext(ctx).Model(delivery).
+			Where("status = ? AND locked_by = ?", entity.DeliveryDelivering, owner).
+			Select("*").Omit("id", "created_at").
+			Updates(delivery)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return webhook.ErrLeaseLost
+		}
+		return r.db.WithContext(ctx).Create(attempt).Error
+	})
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
+
+// RequeueDeadDelivery はデッドレターの配信を、試行回数をリセットしてnowに配信待ちにします
+// 配信がデッドレターでない場合は更新せずfalseを返す
+func (r *WebhookRepository) RequeueDeadDelivery(ctx context.Context, delivery *entity.WebhookDelivery, now time.Time) (bool, error) {
+	ctx, span := r.tracer.Start(ctx, "WebhookRepository.RequeueDeadDelivery")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("operation", "requeue_webhook_delivery"),
+		attribute.Int("webhook.delivery_id", int(delivery.ID)),
+	)
+
+	// 同時に再送した場合も1回だけ配信待ちにするよう、状態を条件に更新する
+	result := r.db.WithContext(ctx).Model(delivery).
+		Where("status = ?", entity.DeliveryDead).
+		Updates(map[string]any{
+			"status":          entity.DeliveryPending,
+			"attempts":        0,
+			"next_attempt_at": now.UTC(),
+		})
+	if result.Error != nil {
+		span.RecordError(result.Error)
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"otel-test/http/response"
+	"otel-test/server/entity"
+	"otel-test/server/service"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ResourceRoutes はHTTPServerに登録する汎用のリソース（Resource）
+type ResourceRoutes interface {
+	// Path はコレクションのパス（/hoges）
+	Path() string
+	handleCollection() http.HandlerFunc
+	handleItem() http.HandlerFunc
+}
+
+// Resource はCRUDServiceをHTTPで公開するリソース
+//
+//   - <path> のGETで一覧（limit/offset）、POSTで作成（Idempotency-Keyに対応）
+//   - <path>/{id} のGETで取得（ETag/If-None-Match）、PATCHで指定したフィールドの更新、DELETEで削除（If-Match）
+//
+// リクエストはOpenAPIドキュメントの <path>, <path>/{id} で検証するため、ドキュメントに定義が必要
+// ハンドラーのスパン名はユーザーと同じ形式（get-hoges-list, create-hoge, get-hoge-by-id, update-hoge, delete-hoge）
+type Resource[T any, PT entity.ModelPtr[T]] struct {
+	path    string
+	plural  string // 一覧のレスポンスのキー（hoges）
+	key     string // スパン名と属性に使用する名前（hoge）
+	service *service.CRUDService[T, PT]
+	tracer  trace.Tracer
+}
+
+// NewResource はpathでserviceを公開するリソースを作成します
+func NewResource[T any, PT entity.ModelPtr[T]](path string, service *service.CRUDService[T, PT]) *Resource[T, PT] {
+	return &Resource[T, PT]{
+		path:    path,
+		plural:  strings.TrimPrefix(path, "/"),
+		key:     strings.ToLower(service.Name()),
+		service: service,
+		tracer:  otel.Tracer("http-server"),
+	}
+}
+
+// Path はコレクションのパスを返します
+func (res *Resource[T, PT]) Path() string {
+	return res.path
+}
+
+func (res *Resource[T, PT]) handleCollection() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			res.list(r.Context(), w, r)
+		case http.MethodPost:
+			res.create(r.Context(), w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (res *Resource[T, PT]) handleItem() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			res.get(r.Context(), w, r)
+		case http.MethodPatch:
+			res.update(r.Context(), w, r)
+		case http.MethodDelete:
+			res.delete(r.Context(), w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (res *Resource[T, PT]) list(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ctx, span := res.tracer.Start(ctx, "get-"+res.plural+"-list")
+	defer span.End()
+
+	// 形式はOpenAPIドキュメントで検証済み
+	limit := 10
+	offset := 0
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 100 {
+		limit = l
+	}
+	if o, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && o >= 0 {
+		offset = o
+	}
+	span.SetAttributes(
+		attribute.Int("query.limit", limit),
+		attribute.Int("query.offset", offset),
+	)
+
+	list, err := res.service.List(ctx, limit, offset)
+	if err != nil {
+		writeServiceError(w, span, err, "Failed to list "+res.plural)
+		return
+	}
+	if list == nil {
+		list = []T{}
+	}
+
+	span.SetAttributes(attribute.Int("result.count", len(list)))
+	response.Success(w, map[string]any{
+		res.plural: list,
+		"count":    len(list),
+		"limit":    limit,
+		"offset":   offset,
+	})
+}
+
+func (res *Resource[T, PT]) create(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ctx, span := res.tracer.Start(ctx, "create-"+res.key)
+	defer span.End()
+
+	var v T
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		span.RecordError(err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	created, err := res.service.Create(ctx, &v)
+	if err != nil {
+		// 検証エラーなどのクライアントエラーもスパンに記録する
+		if httpStatus(err) < http.StatusInternalServerError {
+			span.RecordError(err)
+		}
+		writeServiceError(w, span, err, "Failed to create "+res.key)
+		return
+	}
+
+	m := entity.ModelOf[T, PT](created)
+	span.SetAttributes(attribute.Int(res.key+".created_id", int(m.ID)))
+	w.Header().Set("ETag", versionETag(m.Version))
+	response.JSON(w, http.StatusCreated, created)
+}
+
+func (res *Resource[T, PT]) get(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ctx, span := res.tracer.Start(ctx, "get-"+res.key+"-by-id")
+	defer span.End()
+
+	id := pathID(r, "id")
+	span.SetAttributes(attribute.Int(res.key+".id", int(id)))
+
+	v, err := res.service.Get(ctx, id)
+	if err != nil {
+		writeServiceError(w, span, err, "Failed to get "+res.key)
+		return
+	}
+
+	m := entity.ModelOf[T, PT](v)
+	etag := versionETag(m.Version)
+	span.SetAttributes(attribute.Int(res.key+".version", int(m.Version)))
+	w.Header().Set("ETag", etag)
+	if notModified(r.Header.Get("If-None-Match"), etag) {
+		span.SetAttributes(attribute.Bool("http.not_modified", true))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	response.Success(w, v)
+}
+
+// update はリクエストボディで指定したフィールドだけを更新します
+// If-Matchを指定した場合は、ETagが一致するときだけ更新する
+func (res *Resource[T, PT]) update(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ctx, span := res.tracer.Start(ctx, "update-"+res.key)
+	defer span.End()
+
+	id := pathID(r, "id")
+	span.SetAttributes(attribute.Int(res.key+".id", int(id)))
+
+	version, err := ifMatchVersion(r.Header.Get("If-Match"))
+	if err != nil {
+		writeServiceError(w, span, err, "Failed to update "+res.key)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		span.RecordError(err)
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	// 現在の値にリクエストボディのフィールドを上書きする（JSONが不正な場合はErrInvalidArgument）
+	v, err := res.service.Update(ctx, id, version, func(v *T) error {
+		return json.Unmarshal(body, v)
+	})
+	if err != nil {
+		writeServiceError(w, span, err, "Failed to update "+res.key)
+		return
+	}
+
+	m := entity.ModelOf[T, PT](v)
+	span.SetAttributes(attribute.Int(res.key+".version", int(m.Version)))
+	w.Header().Set("ETag", versionETag(m.Version))
+	response.Success(w, v)
+}
+
+// delete は削除します
+// If-Matchを指定した場合は、ETagが一致するときだけ削除する
+func (res *Resource[T, PT]) delete(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ctx, span := res.tracer.Start(ctx, "delete-"+res.key)
+	defer span.End()
+
+	id := pathID(r, "id")
+	span.SetAttributes(attribute.Int(res.key+".id", int(id)))
+
+	version, err := ifMatchVersion(r.Header.Get("If-Match"))
+	if err != nil {
+		writeServiceError(w, span, err, "Failed to delete "+res.key)
+		return
+	}
+
+	if err := res.service.Delete(ctx, id, version); err != nil {
+		writeServiceError(w, span, err, "Failed to delete "+res.key)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
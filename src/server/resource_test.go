@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"otel-test/o11y/o11ytest"
+	"otel-test/server/entity"
+)
+
+func TestResourceCRUD(t *testing.T) {
+	h, ts := newTestServer(t)
+
+	// 共通フィールドはクライアントの値を使わず、Piyoは検証フックで正規化する
+	res := doJSON(t, http.MethodPost, "/hoges", ts.URL+"/hoges", map[string]any{"piyo": " a ", "huga": 1})
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+	var created entity.Hoge
+	decode(t, res, &created)
+	if created.ID == 0 || created.Version != 1 || created.Piyo != "a" || created.Huga != 1 {
+		t.Fatalf("unexpected hoge: %+v", created)
+	}
+	h.Spans().HasTree(
+		o11ytest.T("/hoges",
+			o11ytest.T("create-hoge",
+				o11ytest.T("HogeService.Create",
+					o11ytest.T("HogeRepository.Create", o11ytest.T("insert hoges")),
+				),
+			),
+		),
+	)
+	h.Span("HogeRepository.Create").HasAttr("operation", "create_hoge").HasAttr("hoge.id", int(created.ID))
+	url := fmt.Sprintf("%s/hoges/%d", ts.URL, created.ID)
+
+	res = doJSON(t, http.MethodPost, "/hoges", ts.URL+"/hoges", map[string]any{"piyo": "b"})
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+
+	var list struct {
+		Hoges []entity.Hoge `json:"hoges"`
+		Count int           `json:"count"`
+	}
+	decode(t, doJSON(t, http.MethodGet, "/hoges", ts.URL+"/hoges?limit=1&offset=1", nil), &list)
+	if list.Count != 1 || list.Hoges[0].Piyo != "b" {
+		t.Fatalf("unexpected list: %+v", list)
+	}
+
+	res = doJSONWithHeader(t, http.MethodGet, "/hoges/{id}", url, http.Header{"If-None-Match": {`"1"`}}, nil)
+	if res.StatusCode != http.StatusNotModified {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusNotModified)
+	}
+
+	// 指定したフィールドだけを更新する
+	h.Reset()
+	res = doJSONWithHeader(t, http.MethodPatch, "/hoges/{id}", url, http.Header{"If-Match": {`"1"`}}, map[string]any{"huga": 2})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+	var updated entity.Hoge
+	decode(t, res, &updated)
+	if updated.Piyo != "a" || updated.Huga != 2 || updated.Version != 2 || res.Header.Get("ETag") != `"2"` {
+		t.Fatalf("unexpected hoge: %+v, ETag %q", updated, res.Header.Get("ETag"))
+	}
+	h.Spans().HasTree(
+		o11ytest.T("/hoges/{id}",
+			o11ytest.T("update-hoge",
+				o11ytest.T("HogeService.Update",
+					o11ytest.T("DB.WithinTx",
+						o11ytest.T("HogeRepository.GetByID", o11ytest.T("select hoges")),
+						o11ytest.T("HogeRepository.Update", o11ytest.T("update hoges")),
+					),
+				),
+			),
+		),
+	)
+
+	// 古いETagでの更新・削除は失敗する
+	h.Reset()
+	res = doJSONWithHeader(t, http.MethodPatch, "/hoges/{id}", url, http.Header{"If-Match": {`"1"`}}, map[string]any{"huga": 3})
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusPreconditionFailed)
+	}
+	h.Span("HogeService.Update").HasAttr("hoge.version_mismatch", true).NoError()
+	res = doJSONWithHeader(t, http.MethodDelete, "/hoges/{id}", url, http.Header{"If-Match": {`"1"`}}, nil)
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusPreconditionFailed)
+	}
+
+	res = doJSONWithHeader(t, http.MethodDelete, "/hoges/{id}", url, http.Header{"If-Match": {`"2"`}}, nil)
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusNoContent)
+	}
+	res = doJSON(t, http.MethodGet, "/hoges/{id}", url, nil)
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestResourceValidation(t *testing.T) {
+	h, ts := newTestServer(t)
+
+	// スキーマに一致しても検証フックで拒否した場合は400
+	res := doJSON(t, http.MethodPost, "/hoges", ts.URL+"/hoges", map[string]any{"piyo": "  "})
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+	h.Span("create-hoge").HasError()
+	h.Spans().Named("HogeRepository.Create").Len(0)
+
+	res = doJSON(t, http.MethodPost, "/hoges", ts.URL+"/hoges", map[string]any{"piyo": "a", "huga": -1})
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusUnprocessableEntity)
+	}
+
+	res = doJSON(t, http.MethodPatch, "/hoges/{id}", ts.URL+"/hoges/1", map[string]any{"huga": 1})
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+}
@@ -3,9 +3,16 @@ package server
 import (
 	"context"
 	"net/http"
+	"otel-test/audit"
 	"otel-test/env"
+	"otel-test/http/compress"
 	"otel-test/http/middleware"
+	"otel-test/http/openapi"
+	"otel-test/idempotency"
+	"otel-test/o11y"
 	"otel-test/server/service"
+	"otel-test/shutdown"
+	"otel-test/tenant"
 
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
@@ -19,40 +26,143 @@ type Server interface {
 
 // HTTPServer はHTTPサーバーの実装（依存性注入対応版）
 type HTTPServer struct {
-	server      *http.Server
-	mode        env.Mode
-	userService *service.UserService // 追加: UserServiceの依存性
-	tracer      trace.Tracer         // 追加: カスタムトレーサー
+	server         *http.Server
+	handler        *MyHandler
+	mode           env.Mode
+	userService    *service.UserService    // 追加: UserServiceの依存性
+	webhookService *service.WebhookService // webhookの購読と配信
+	tracer         trace.Tracer            // 追加: カスタムトレーサー
+	readiness      *shutdown.Readiness     // Graceful Shutdown時にNot Readyにする
+	inFlight       *shutdown.Tracker       // 実行中のリクエスト数
+	work           *work                   // /single, /multi のサンプル処理
+	openapi        *openapi.Document       // リクエストの検証に使用するOpenAPIドキュメント
+	idempotency    *idempotency.Middleware // POSTのIdempotency-Keyの処理
+	resources      []ResourceRoutes        // 汎用のCRUDで公開するリソース
+	tenants        *tenant.Resolver        // リクエストのテナントの解決
+	compression    *compress.Middleware    // リクエストボディの展開とレスポンスの圧縮
+	audit          *audit.Resolver         // 監査ログに記録する変更したユーザーの取得
 }
 
 // Dependencies はサーバーが必要とする依存性をまとめた構造体
 type Dependencies struct {
 	UserService *service.UserService
+	// WebhookService はnilの場合、/webhooksを登録しない
+	WebhookService *service.WebhookService
+	// Readiness はnilの場合、常にReadyとして扱う
+	Readiness *shutdown.Readiness
+	// InFlight はnilの場合、実行中のリクエストを追跡しない
+	InFlight *shutdown.Tracker
+	// Idempotency はnilの場合、Idempotency-Keyを処理しない
+	Idempotency *idempotency.Middleware
+	// SingleURL は/multiがサブリクエストを送る/singleのURL（空の場合はlocalhost:8080）
+	SingleURL string
+	// Resources は汎用のCRUDで公開するリソース（NewResource）
+	Resources []ResourceRoutes
+	// Tenants はnilの場合、全てのリクエストをテナントdefaultとして扱う
+	Tenants *tenant.Resolver
+	// Compression はnilの場合、レスポンスを圧縮せず、圧縮したリクエストボディも展開しない
+	Compression *compress.Middleware
+	// Audit はnilの場合、監査ログの変更したユーザーを全てanonymousとして記録する
+	Audit *audit.Resolver
 }
 
 // NewServer は新しいサーバーインスタンスを作成します（依存性注入対応）
-func NewServer(mode env.Mode, deps *Dependencies) Server {
-	return &HTTPServer{
-		mode:        mode,
-		userService: deps.UserService,
-		tracer:      otel.Tracer("http-server"),
+func NewServer(mode env.Mode, deps *Dependencies) *HTTPServer {
+	s := &HTTPServer{
+		mode:           mode,
+		userService:    deps.UserService,
+		webhookService: deps.WebhookService,
+		tracer:         otel.Tracer("http-server"),
+		readiness:      deps.Readiness,
+		inFlight:       deps.InFlight,
+		work:           newWork(deps.SingleURL),
+		openapi:        openapi.MustLoad(),
+		idempotency:    deps.Idempotency,
+		resources:      deps.Resources,
+		tenants:        deps.Tenants,
+		compression:    deps.Compression,
+		audit:          deps.Audit,
 	}
+	if s.tenants == nil {
+		s.tenants = tenant.NewResolver(tenant.Config{Default: "default"})
+	}
+	if s.audit == nil {
+		s.audit = audit.NewResolver(audit.Config{})
+	}
+	s.handler = s.routes()
+	return s
 }
 
-func (s *HTTPServer) Start(ctx context.Context) error {
-	// ハンドラーの設定
-	mh := newHandler(s.mode)
-	mh.handleHTTP("/single", handlerSingle())
-	mh.handleHTTP("/multi", handlerMulti())
+// routes はハンドラーを設定します
+func (s *HTTPServer) routes() *MyHandler {
+	middlewares := []func(http.HandlerFunc) http.HandlerFunc{
+		// デバッグログはユーザーのヘッダーと同じく信頼するプロキシからのリクエストでのみ有効にする
+		o11y.DebugLogMiddleware(func(r *http.Request) bool { return s.audit.Trusted(r.RemoteAddr) }),
+		// アクセスログにもtenant.idを付与するため、AccessLogより先に解決する
+		middleware.ResolveTenant(s.tenants),
+		middleware.AccessLog,
+	}
+	if s.compression != nil {
+		// アクセスログには圧縮後のサイズを出力する
+		middlewares = append(middlewares, s.compression.Handle)
+	}
+	middlewares = append(middlewares, middleware.AuditMetadata(s.audit))
+	if s.inFlight != nil {
+		middlewares = append(middlewares, middleware.TrackInFlight(s.inFlight))
+	}
+	mh := newHandler(s.mode, middlewares...)
+	mh.handleHTTP("/single", handlerSingle(s.work))
+	mh.handleHTTP("/multi", handlerMulti(s.work))
 
-	mh.handleHTTP("/users", s.handleUsers())
-	mh.handleHTTP("/users/{id}", s.handleUserByID())
+	// OpenAPIドキュメントに基づいてリクエストを検証する
+	validate := s.openapi.Middleware
+	// 検証に失敗したリクエストではIdempotency-Keyを消費しない
+	idempotent := func(route string) func(http.HandlerFunc) http.HandlerFunc {
+		if s.idempotency == nil {
+			return func(next http.HandlerFunc) http.HandlerFunc { return next }
+		}
+		return s.idempotency.Route(route)
+	}
+	// ユーザーとwebhookはテナントで分離するため、テナントが決まらないリクエストは受け付けない
+	requireTenant := middleware.RequireTenant
+	mh.handleHTTP("/users", s.handleUsers(), requireTenant, validate("/users"), idempotent("/users"))
+	mh.handleHTTP("/users:import", s.handleUsersImport(), requireTenant, validate("/users:import"))
+	mh.handleHTTP("/users:export", s.handleUsersExport(), requireTenant, validate("/users:export"))
+	mh.handleHTTP("/users/{id}", s.handleUserByID(), requireTenant, validate("/users/{id}"))
+	mh.handleHTTP("/users/{id}/audit", s.handleUserAudit(), requireTenant, validate("/users/{id}/audit"))
+	if s.webhookService != nil {
+		mh.handleHTTP("/webhooks", s.handleWebhooks(), requireTenant, validate("/webhooks"))
+		mh.handleHTTP("/webhooks/{id}", s.handleWebhookByID(), requireTenant, validate("/webhooks/{id}"))
+		mh.handleHTTP("/webhooks/{id}/deliveries", s.handleWebhookDeliveries(), requireTenant, validate("/webhooks/{id}/deliveries"))
+		mh.handleHTTP("/webhooks/{id}/deliveries/{deliveryID}/attempts", s.handleWebhookAttempts(), requireTenant, validate("/webhooks/{id}/deliveries/{deliveryID}/attempts"))
+		mh.handleHTTP("/webhooks/{id}/deliveries/{deliveryID}/redeliver", s.handleWebhookRedeliver(), requireTenant, validate("/webhooks/{id}/deliveries/{deliveryID}/redeliver"))
+	}
+	for _, res := range s.resources {
+		path := res.Path()
+		mh.handleHTTP(path, res.handleCollection(), validate(path), idempotent(path))
+		mh.handleHTTP(path+"/{id}", res.handleItem(), validate(path+"/{id}"))
+	}
 	mh.handleHTTP("/health", s.handleHealth())
+	mh.handleHTTP("/ready", s.handleReady())
+	mh.handleHTTP("/openapi.json", s.openapi.ServeHTTP)
+	return mh
+}
+
+// Handler はルーティング済みのハンドラーを返します
+func (s *HTTPServer) Handler() http.Handler {
+	return s.handler.mux
+}
+
+// Routes は登録されているルートの一覧を返します
+func (s *HTTPServer) Routes() []string {
+	return append([]string(nil), s.handler.routes...)
+}
 
+func (s *HTTPServer) Start(ctx context.Context) error {
 	// HTTPサーバーの作成
 	s.server = &http.Server{
 		Addr:    ":8080",
-		Handler: mh.mux,
+		Handler: s.handler.mux,
 	}
 
 	// サーバーの起動
@@ -73,9 +183,11 @@ func (s *HTTPServer) Shutdown(ctx context.Context) error {
 type MyHandler struct {
 	mux         *http.ServeMux
 	wrapHandler func(http.HandlerFunc, string) http.Handler
+	middlewares []func(http.HandlerFunc) http.HandlerFunc // 全ルートに適用するミドルウェア
+	routes      []string                                  // 登録済みのルート
 }
 
-func newHandler(mode env.Mode) *MyHandler {
+func newHandler(mode env.Mode, middlewares ...func(http.HandlerFunc) http.HandlerFunc) *MyHandler {
 	var wrapper func(http.HandlerFunc, string) http.Handler
 	switch mode {
 	case env.GCPOtel:
@@ -90,10 +202,13 @@ func newHandler(mode env.Mode) *MyHandler {
 	return &MyHandler{
 		mux:         http.NewServeMux(),
 		wrapHandler: wrapper,
+		middlewares: middlewares,
 	}
 }
 
 func (mh *MyHandler) handleHTTP(route string, handleFn http.HandlerFunc, middlewares ...func(http.HandlerFunc) http.HandlerFunc) {
-	handler := middleware.ComposeMiddlewares(handleFn, middlewares...)
+	mws := append([]func(http.HandlerFunc) http.HandlerFunc{}, mh.middlewares...)
+	handler := middleware.ComposeMiddlewares(handleFn, append(mws, middlewares...)...)
 	mh.mux.Handle(route, mh.wrapHandler(handler, route))
+	mh.routes = append(mh.routes, route)
 }
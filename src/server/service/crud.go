@@ -0,0 +1,206 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"otel-test/database"
+	"otel-test/server/entity"
+	"otel-test/server/repository"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// CRUDHooks はCRUDServiceが作成・更新の前に呼び出す処理
+type CRUDHooks[T any] struct {
+	// Validate は作成・更新する値を検証します（値の正規化もできる）
+	// ドメインエラーでラップしていないエラーはErrInvalidArgumentとして扱う
+	Validate func(ctx context.Context, v *T) error
+}
+
+// CRUDService はentity.Modelを埋め込んだエンティティTの汎用のサービス
+// リポジトリのエラーをドメインエラーに変換する。スパン名は「<型名>Service.<操作>」（HogeService.Create）
+type CRUDService[T any, PT entity.ModelPtr[T]] struct {
+	db     *database.DB
+	repo   *repository.CRUDRepository[T, PT]
+	hooks  CRUDHooks[T]
+	tracer trace.Tracer
+	name   string // 型名（Hoge）
+	key    string // 属性とエラーメッセージに使用する小文字の名前（hoge）
+}
+
+// NewCRUDService は新しいCRUDServiceを作成します
+func NewCRUDService[T any, PT entity.ModelPtr[T]](db *database.DB, repo *repository.CRUDRepository[T, PT], hooks CRUDHooks[T]) *CRUDService[T, PT] {
+	key := strings.ToLower(repo.Name())
+	return &CRUDService[T, PT]{
+		db:     db,
+		repo:   repo,
+		hooks:  hooks,
+		tracer: otel.Tracer(key + "-service"),
+		name:   repo.Name(),
+		key:    key,
+	}
+}
+
+// Name はエンティティの型名を返します
+func (s *CRUDService[T, PT]) Name() string {
+	return s.name
+}
+
+func (s *CRUDService[T, PT]) start(ctx context.Context, op string) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, s.name+"Service."+op)
+}
+
+// validate はフックで値を検証します
+func (s *CRUDService[T, PT]) validate(ctx context.Context, v *T) error {
+	if s.hooks.Validate == nil {
+		return nil
+	}
+	err := s.hooks.Validate(ctx, v)
+	if err == nil || isDomainError(err) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrInvalidArgument, err)
+}
+
+// isDomainError はerrがドメインエラーかを返します
+func isDomainError(err error) bool {
+	for _, target := range []error{ErrNotFound, ErrAlreadyExists, ErrInvalidArgument, ErrPreconditionFailed, ErrUnavailable} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// translate はリポジトリのエラーをドメインエラーに変換します
+func (s *CRUDService[T, PT]) translate(span trace.Span, id uint, err error) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		span.SetAttributes(attribute.Bool(s.key+".not_found", true))
+		return fmt.Errorf("%s %d: %w", s.key, id, ErrNotFound)
+	case errors.Is(err, database.ErrVersionConflict):
+		span.SetAttributes(attribute.Bool(s.key+".version_mismatch", true))
+		return fmt.Errorf("%s %d was modified: %w", s.key, id, ErrPreconditionFailed)
+	case errors.Is(err, database.ErrDuplicateKey):
+		span.SetAttributes(attribute.Bool(s.key+".already_exists", true))
+		return fmt.Errorf("%s: %w", s.key, ErrAlreadyExists)
+	case isDomainError(err):
+		return err
+	}
+	span.RecordError(err)
+	return fmt.Errorf("failed to access %s: %w", s.key, err)
+}
+
+// Create はvを作成します
+// ID・Version・作成日時などの共通フィールドはクライアントの値を使わない
+func (s *CRUDService[T, PT]) Create(ctx context.Context, v *T) (*T, error) {
+	ctx, span := s.start(ctx, "Create")
+	defer span.End()
+
+	*entity.ModelOf[T, PT](v) = entity.Model{}
+	if err := s.validate(ctx, v); err != nil {
+		return nil, err
+	}
+	if err := s.repo.Create(ctx, v); err != nil {
+		return nil, s.translate(span, 0, err)
+	}
+
+	span.SetAttributes(attribute.Int(s.key+".created_id", int(entity.ModelOf[T, PT](v).ID)))
+	return v, nil
+}
+
+// Get はIDで取得します
+func (s *CRUDService[T, PT]) Get(ctx context.Context, id uint) (*T, error) {
+	ctx, span := s.start(ctx, "Get")
+	defer span.End()
+
+	span.SetAttributes(attribute.Int(s.key+".id", int(id)))
+
+	v, err := s.repo.GetByID(ctx, id)
+	if err != nil {
+		return nil, s.translate(span, id, err)
+	}
+	return v, nil
+}
+
+// List は一覧を返します
+func (s *CRUDService[T, PT]) List(ctx context.Context, limit, offset int) ([]T, error) {
+	ctx, span := s.start(ctx, "List")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.Int("query.limit", limit),
+		attribute.Int("query.offset", offset),
+	)
+
+	list, err := s.repo.List(ctx, limit, offset)
+	if err != nil {
+		return nil, s.translate(span, 0, err)
+	}
+
+	span.SetAttributes(attribute.Int("result.count", len(list)))
+	return list, nil
+}
+
+// Update は現在の値にapplyで変更を適用して保存します
+// applyで共通フィールドを変更しても無視する。applyのエラーはErrInvalidArgumentとして扱う
+// versionが0でない場合は現在のバージョンと一致するときだけ更新し、異なればErrPreconditionFailedを返します
+func (s *CRUDService[T, PT]) Update(ctx context.Context, id, version uint, apply func(v *T) error) (*T, error) {
+	ctx, span := s.start(ctx, "Update")
+	defer span.End()
+
+	span.SetAttributes(attribute.Int(s.key+".id", int(id)))
+	if version != 0 {
+		span.SetAttributes(attribute.Int(s.key+".version.expected", int(version)))
+	}
+
+	var v *T
+	err := s.db.WithinTx(ctx, func(ctx context.Context) error {
+		var err error
+		v, err = s.repo.GetByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		m := entity.ModelOf[T, PT](v)
+		if version != 0 && m.Version != version {
+			return fmt.Errorf("%s %d has version %d: %w", s.key, id, m.Version, database.ErrVersionConflict)
+		}
+		saved := *m
+		if err := apply(v); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidArgument, err)
+		}
+		*m = saved
+		if err := s.validate(ctx, v); err != nil {
+			return err
+		}
+		return s.repo.Update(ctx, v)
+	})
+	if err != nil {
+		return nil, s.translate(span, id, err)
+	}
+
+	span.SetAttributes(attribute.Int(s.key+".version", int(entity.ModelOf[T, PT](v).Version)))
+	return v, nil
+}
+
+// Delete は論理削除します
+// versionが0でない場合は現在のバージョンと一致するときだけ削除し、異なればErrPreconditionFailedを返します
+func (s *CRUDService[T, PT]) Delete(ctx context.Context, id, version uint) error {
+	ctx, span := s.start(ctx, "Delete")
+	defer span.End()
+
+	span.SetAttributes(attribute.Int(s.key+".id", int(id)))
+	if version != 0 {
+		span.SetAttributes(attribute.Int(s.key+".version.expected", int(version)))
+	}
+
+	if err := s.repo.Delete(ctx, id, version); err != nil {
+		return s.translate(span, id, err)
+	}
+	return nil
+}
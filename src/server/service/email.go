@@ -0,0 +1,31 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// normalizeEmail は保存・比較用にメールアドレスを正規化します
+//
+//   - 前後の空白を取り除く
+//   - 国際化ドメイン名はPunycode（ASCII）に変換する
+//   - 全体を小文字にする
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	at := strings.LastIndex(email, "@")
+	if at <= 0 || at == len(email)-1 {
+		return "", fmt.Errorf("invalid email: %w", ErrInvalidArgument)
+	}
+	local, domain := email[:at], email[at+1:]
+	if strings.ContainsAny(local, " \t\r\n") {
+		return "", fmt.Errorf("invalid email: %w", ErrInvalidArgument)
+	}
+
+	domain, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", fmt.Errorf("invalid email domain: %w", ErrInvalidArgument)
+	}
+	return strings.ToLower(local + "@" + domain), nil
+}
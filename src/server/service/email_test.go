@@ -0,0 +1,32 @@
+package service
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"taro@example.com", "taro@example.com"},
+		{"  Taro@Example.COM \n", "taro@example.com"},
+		{"taro@bücher.example", "taro@xn--bcher-kva.example"},
+		{"taro@BÜCHER.example", "taro@xn--bcher-kva.example"},
+		{"taro@xn--bcher-kva.example", "taro@xn--bcher-kva.example"},
+		{`"a@b"@example.com`, `"a@b"@example.com`},
+	}
+	for _, tt := range tests {
+		got, err := normalizeEmail(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeEmail(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "taro", "@example.com", "taro@", "ta ro@example.com", "taro@exa mple.com"} {
+		if _, err := normalizeEmail(in); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("normalizeEmail(%q) error = %v, want %v", in, err, ErrInvalidArgument)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package service
+
+import (
+	"errors"
+
+	"otel-test/database"
+)
+
+// ドメインエラー
+// トランスポート（HTTP/gRPC）はerrors.Isでこれらを判定してステータスコードに変換する
+var (
+	// ErrNotFound は対象のリソースが存在しない
+	ErrNotFound = errors.New("not found")
+	// ErrAlreadyExists は一意であるべき値が既に使われている
+	ErrAlreadyExists = errors.New("already exists")
+	// ErrInvalidArgument は入力値が不正
+	ErrInvalidArgument = errors.New("invalid argument")
+	// ErrPreconditionFailed はリソースのバージョンがクライアントの期待した値と異なる
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// ErrUnavailable はデータベースに一時的に接続できない（時間をおいて再試行すれば成功しうる）
+	ErrUnavailable = database.ErrUnavailable
+)
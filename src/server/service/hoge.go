@@ -0,0 +1,29 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"otel-test/database"
+	"otel-test/server/entity"
+	"otel-test/server/repository"
+	"strings"
+)
+
+// NewHogeService はHogeのCRUDServiceを作成します
+func NewHogeService(db *database.DB) *CRUDService[entity.Hoge, *entity.Hoge] {
+	return NewCRUDService(db, repository.NewCRUDRepository[entity.Hoge](db), CRUDHooks[entity.Hoge]{
+		Validate: validateHoge,
+	})
+}
+
+// validateHoge はPiyoの前後の空白を除き、空でないこととHugaが0以上であることを確認します
+func validateHoge(_ context.Context, hoge *entity.Hoge) error {
+	hoge.Piyo = strings.TrimSpace(hoge.Piyo)
+	if hoge.Piyo == "" {
+		return errors.New("piyo is required")
+	}
+	if hoge.Huga < 0 {
+		return errors.New("huga must not be negative")
+	}
+	return nil
+}
@@ -2,26 +2,95 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"otel-test/audit"
+	"otel-test/database"
+	"otel-test/events"
 	"otel-test/server/entity"
 	"otel-test/server/repository"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
 )
 
 type UserService struct {
-	userRepo *repository.UserRepository
+	db       *database.DB
+	userRepo repository.UserStore
+	outbox   *repository.OutboxRepository // ドメインイベントの書き込み先
+	audits   *repository.AuditRepository  // 監査ログの書き込み先
 	tracer   trace.Tracer
+
+	importRows metric.Int64Counter
 }
 
-func NewUserService(userRepo *repository.UserRepository) *UserService {
+// NewUserService は新しいUserServiceを作成します
+// ユーザーの変更とドメインイベント、監査ログはdb.WithinTxで1つのトランザクションにまとめて書き込む
+func NewUserService(db *database.DB, userRepo repository.UserStore, outbox *repository.OutboxRepository, audits *repository.AuditRepository) *UserService {
+	importRows, _ := otel.Meter("user-service").Int64Counter("users.import.rows",
+		metric.WithDescription("Number of rows processed by bulk user import by outcome"),
+		metric.WithUnit("{row}"),
+	)
 	return &UserService{
-		userRepo: userRepo,
-		tracer:   otel.Tracer("user-service"),
+		db:         db,
+		userRepo:   userRepo,
+		outbox:     outbox,
+		audits:     audits,
+		tracer:     otel.Tracer("user-service"),
+		importRows: importRows,
+	}
+}
+
+// recordEvent はctxのトランザクション内でドメインイベントをアウトボックスに書き込みます
+func (s *UserService) recordEvent(ctx context.Context, eventType string, id uint, payload any) error {
+	ev, err := events.New(ctx, eventType, id, payload)
+	if err != nil {
+		return err
+	}
+	return s.outbox.Add(ctx, ev)
+}
+
+// recordAudit はctxのトランザクション内で監査ログを書き込みます
+// 作成時のbefore、削除時のafterはnil
+func (s *UserService) recordAudit(ctx context.Context, action string, id uint, before, after *entity.User) error {
+	changes, err := audit.Diff(before, after)
+	if err != nil {
+		return err
 	}
+	md := audit.FromContext(ctx)
+	log := &entity.AuditLog{
+		ResourceType: entity.AuditResourceUser,
+		ResourceID:   id,
+		Action:       action,
+		Actor:        md.Actor,
+		RequestID:    md.RequestID,
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		log.TraceID = sc.TraceID().String()
+	}
+	if log.Before, err = marshalAudit(before); err != nil {
+		return err
+	}
+	if log.After, err = marshalAudit(after); err != nil {
+		return err
+	}
+	if log.Changes, err = marshalAudit(&changes); err != nil {
+		return err
+	}
+	return s.audits.Add(ctx, log)
+}
+
+// marshalAudit はvをJSONに変換します。nilの場合は空文字列
+func marshalAudit[T any](v *T) (string, error) {
+	if v == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(v)
+	return string(data), err
 }
 
 func (s *UserService) CreateUser(ctx context.Context, name, email string) (*entity.User, error) {
@@ -33,22 +102,37 @@ func (s *UserService) CreateUser(ctx context.Context, name, email string) (*enti
 		attribute.String("user.email", email),
 	)
 
-	// 既存ユーザーチェック
-	existingUser, err := s.userRepo.GetByEmail(ctx, email)
-	if err == nil && existingUser != nil {
-		span.SetAttributes(attribute.Bool("user.already_exists", true))
-		return nil, fmt.Errorf("user with email %s already exists", email)
+	if name == "" || email == "" {
+		return nil, fmt.Errorf("name and email are required: %w", ErrInvalidArgument)
+	}
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return nil, err
 	}
 
 	// 新規ユーザー作成
+	// 重複は事前に確認せず、データベースの一意制約で検出する（同時に作成しても競合しない）
 	user := &entity.User{
 		Name:  name,
 		Email: email,
 	}
 
-	if err := s.userRepo.Create(ctx, user); err != nil {
+	err = s.db.WithinTx(ctx, func(ctx context.Context) error {
+		if err := s.userRepo.Create(ctx, user); err != nil {
+			return err
+		}
+		if err := s.recordAudit(ctx, audit.ActionCreate, user.ID, nil, user); err != nil {
+			return err
+		}
+		return s.recordEvent(ctx, events.UserCreated, user.ID, user)
+	})
+	if err != nil {
+		if errors.Is(err, database.ErrDuplicateKey) {
+			span.SetAttributes(attribute.Bool("user.already_exists", true))
+			return nil, fmt.Errorf("user email: %w", ErrAlreadyExists)
+		}
 		span.RecordError(err)
-		return nil, err
+		return nil, fmt.Errorf("failed to create user: %w", err)
 	}
 
 	span.SetAttributes(attribute.Int("user.created_id", int(user.ID)))
@@ -63,14 +147,15 @@ func (s *UserService) GetUserByID(ctx context.Context, id uint) (*entity.User, e
 
 	user, err := s.userRepo.GetByID(ctx, id)
 	if err != nil {
-		if err == gorm.ErrRecordNotFound {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
 			span.SetAttributes(attribute.Bool("user.not_found", true))
-			return nil, nil // ユーザーが見つからない場合はnilを返す
+			return nil, fmt.Errorf("user %d: %w", id, ErrNotFound)
 		}
 		span.RecordError(err)
 		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
 
+	span.SetAttributes(attribute.Int("user.version", int(user.Version)))
 	return user, nil
 }
 
@@ -92,3 +177,138 @@ func (s *UserService) ListUsers(ctx context.Context, limit, offset int) ([]entit
 	span.SetAttributes(attribute.Int("result.count", len(users)))
 	return users, nil
 }
+
+// UpdateUser はユーザーを更新します
+// nilのフィールドは更新しません
+// versionが0でない場合は現在のバージョンと一致するときだけ更新し、異なればErrPreconditionFailedを返します
+func (s *UserService) UpdateUser(ctx context.Context, id, version uint, name, email *string) (*entity.User, error) {
+	ctx, span := s.tracer.Start(ctx, "UserService.UpdateUser")
+	defer span.End()
+
+	span.SetAttributes(attribute.Int("user.id", int(id)))
+	if version != 0 {
+		span.SetAttributes(attribute.Int("user.version.expected", int(version)))
+	}
+
+	if (name != nil && *name == "") || (email != nil && *email == "") {
+		return nil, fmt.Errorf("name and email must not be empty: %w", ErrInvalidArgument)
+	}
+	if email != nil {
+		normalized, err := normalizeEmail(*email)
+		if err != nil {
+			return nil, err
+		}
+		span.SetAttributes(attribute.String("user.email", normalized))
+		email = &normalized
+	}
+
+	// キャッシュの古い値で更新しないよう、トランザクション内で読み込む
+	var user *entity.User
+	err := s.db.WithinTx(ctx, func(ctx context.Context) error {
+		var err error
+		user, err = s.userRepo.GetByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		span.SetAttributes(attribute.Int("user.version", int(user.Version)))
+		if version != 0 && user.Version != version {
+			return fmt.Errorf("user %d has version %d: %w", id, user.Version, database.ErrVersionConflict)
+		}
+		before := *user
+
+		if email != nil {
+			user.Email = *email
+		}
+		if name != nil {
+			user.Name = *name
+		}
+		// 読み込んでから更新するまでの間に他のリクエストが更新した場合もバージョンの不一致になる
+		if err := s.userRepo.Update(ctx, user); err != nil {
+			return err
+		}
+		if err := s.recordAudit(ctx, audit.ActionUpdate, user.ID, &before, user); err != nil {
+			return err
+		}
+		return s.recordEvent(ctx, events.UserUpdated, user.ID, user)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			span.SetAttributes(attribute.Bool("user.not_found", true))
+			return nil, fmt.Errorf("user %d: %w", id, ErrNotFound)
+		case errors.Is(err, database.ErrVersionConflict):
+			span.SetAttributes(attribute.Bool("user.version_mismatch", true))
+			return nil, fmt.Errorf("user %d was modified: %w", id, ErrPreconditionFailed)
+		case errors.Is(err, database.ErrDuplicateKey):
+			span.SetAttributes(attribute.Bool("user.already_exists", true))
+			return nil, fmt.Errorf("user email: %w", ErrAlreadyExists)
+		}
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to update user: %w", err)
+	}
+
+	span.SetAttributes(attribute.Int("user.version", int(user.Version)))
+	return user, nil
+}
+
+// DeleteUser はユーザーを削除します
+// versionが0でない場合は現在のバージョンと一致するときだけ削除し、異なればErrPreconditionFailedを返します
+func (s *UserService) DeleteUser(ctx context.Context, id, version uint) error {
+	ctx, span := s.tracer.Start(ctx, "UserService.DeleteUser")
+	defer span.End()
+
+	span.SetAttributes(attribute.Int("user.id", int(id)))
+	if version != 0 {
+		span.SetAttributes(attribute.Int("user.version.expected", int(version)))
+	}
+
+	err := s.db.WithinTx(ctx, func(ctx context.Context) error {
+		// 監査ログに削除前の値を記録するため、トランザクション内で読み込む
+		before, err := s.userRepo.GetByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err := s.userRepo.Delete(ctx, id, version); err != nil {
+			return err
+		}
+		if err := s.recordAudit(ctx, audit.ActionDelete, id, before, nil); err != nil {
+			return err
+		}
+		return s.recordEvent(ctx, events.UserDeleted, id, map[string]uint{"id": id})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			span.SetAttributes(attribute.Bool("user.not_found", true))
+			return fmt.Errorf("user %d: %w", id, ErrNotFound)
+		case errors.Is(err, database.ErrVersionConflict):
+			span.SetAttributes(attribute.Bool("user.version_mismatch", true))
+			return fmt.Errorf("user %d was modified: %w", id, ErrPreconditionFailed)
+		}
+		span.RecordError(err)
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+
+	return nil
+}
+
+// ListUserAudit はユーザーの監査ログを古い順に返します
+// afterより大きいIDの監査ログのみを返す。削除済みのユーザーの監査ログも返す
+func (s *UserService) ListUserAudit(ctx context.Context, id uint, after uint64, limit int) ([]entity.AuditLog, error) {
+	ctx, span := s.tracer.Start(ctx, "UserService.ListUserAudit")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.Int("user.id", int(id)),
+		attribute.Int("query.limit", limit),
+	)
+
+	logs, err := s.audits.List(ctx, entity.AuditResourceUser, id, after, limit)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to list audit logs: %w", err)
+	}
+
+	span.SetAttributes(attribute.Int("result.count", len(logs)))
+	return logs, nil
+}
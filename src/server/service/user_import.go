@@ -0,0 +1,292 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"otel-test/audit"
+	"otel-test/database"
+	"otel-test/events"
+	"otel-test/server/entity"
+	"slices"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// defaultImportBatchSize は一括登録で1つのトランザクションにまとめる行数
+	defaultImportBatchSize = 500
+	// maxImportErrors は結果に含める失敗した行の最大数
+	maxImportErrors = 1000
+	// exportPageSize は一括取得で1回に読み込むユーザー数
+	exportPageSize = 500
+	// maxNameLength はユーザー名とメールアドレスの最大長（entity.Userのカラムのサイズ）
+	maxNameLength = 255
+)
+
+// ImportRow は一括登録する1行
+type ImportRow struct {
+	// Line は入力の行番号（1始まり）
+	Line  int
+	Name  string
+	Email string
+	// Err は行の形式が不正な場合のエラー。設定されている場合は登録せずに失敗として報告する
+	Err error
+}
+
+// ImportOptions は一括登録のオプション
+type ImportOptions struct {
+	// DryRun は検証のみを行い、登録しない
+	DryRun bool
+	// BatchSize は1つのトランザクションにまとめる行数 (default: 500)
+	BatchSize int
+}
+
+// ImportError は一括登録に失敗した行
+type ImportError struct {
+	Line    int    `json:"line"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// ImportResult は一括登録の結果
+type ImportResult struct {
+	DryRun bool `json:"dry_run"`
+	// Total は読み込んだ行数
+	Total int `json:"total"`
+	// Imported は登録した行数（DryRunの場合は登録できる行数）
+	Imported int `json:"imported"`
+	Failed   int `json:"failed"`
+	// Errors は失敗した行（行番号順、最大1000件）
+	Errors          []ImportError `json:"errors"`
+	ErrorsTruncated bool          `json:"errors_truncated,omitempty"`
+	// Error は入力の読み込みを中断した理由。それまでに読み込んだ行は登録済み
+	Error string `json:"error,omitempty"`
+}
+
+func (r *ImportResult) fail(line int, field, message string) {
+	r.Failed++
+	if len(r.Errors) >= maxImportErrors {
+		r.ErrorsTruncated = true
+		return
+	}
+	r.Errors = append(r.Errors, ImportError{Line: line, Field: field, Message: message})
+}
+
+// ImportUsers はrowsのユーザーを一括登録します
+// 行ごとに検証し、有効な行をBatchSizeごとに1つのトランザクションで登録する
+// 不正な行、既に使われているメールアドレス、入力内で重複したメールアドレスの行は登録せずに結果で報告する
+// rowsがエラーを返した場合はそこで読み込みを中断し、それまでの行を登録してResult.Errorに理由を設定する
+// エラーを返した場合も、それまでのバッチはコミット済み
+func (s *UserService) ImportUsers(ctx context.Context, rows iter.Seq2[ImportRow, error], opts ImportOptions) (*ImportResult, error) {
+	ctx, span := s.tracer.Start(ctx, "UserService.ImportUsers")
+	defer span.End()
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultImportBatchSize
+	}
+	span.SetAttributes(
+		attribute.Bool("import.dry_run", opts.DryRun),
+		attribute.Int("import.batch_size", opts.BatchSize),
+	)
+
+	res := &ImportResult{DryRun: opts.DryRun, Errors: []ImportError{}}
+	seen := map[string]int{} // メールアドレスと最初に現れた行
+	batch := make([]ImportRow, 0, opts.BatchSize)
+	for row, err := range rows {
+		if err != nil {
+			span.RecordError(err)
+			res.Error = err.Error()
+			break
+		}
+		res.Total++
+		if !validateImportRow(res, &row) {
+			s.recordImportRows(ctx, opts.DryRun, "failed", 1)
+			continue
+		}
+		if line, ok := seen[row.Email]; ok {
+			res.fail(row.Line, "email", fmt.Sprintf("duplicates line %d", line))
+			s.recordImportRows(ctx, opts.DryRun, "failed", 1)
+			continue
+		}
+		seen[row.Email] = row.Line
+
+		batch = append(batch, row)
+		if len(batch) == opts.BatchSize {
+			if err := s.flushImportBatch(ctx, span, res, batch); err != nil {
+				return res, err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := s.flushImportBatch(ctx, span, res, batch); err != nil {
+		return res, err
+	}
+	// 既に使われているメールアドレスはバッチごとに確認するため、行番号の順に並べ替える
+	slices.SortStableFunc(res.Errors, func(a, b ImportError) int { return a.Line - b.Line })
+
+	span.SetAttributes(
+		attribute.Int("import.total", res.Total),
+		attribute.Int("import.imported", res.Imported),
+		attribute.Int("import.failed", res.Failed),
+	)
+	return res, nil
+}
+
+// validateImportRow は行を検証し、メールアドレスを正規化します
+// 不正な場合はresに失敗を記録してfalseを返す
+func validateImportRow(res *ImportResult, row *ImportRow) bool {
+	switch {
+	case row.Err != nil:
+		res.fail(row.Line, "", row.Err.Error())
+	case row.Name == "":
+		res.fail(row.Line, "name", "is required")
+	case len(row.Name) > maxNameLength:
+		res.fail(row.Line, "name", fmt.Sprintf("must be at most %d characters", maxNameLength))
+	case row.Email == "":
+		res.fail(row.Line, "email", "is required")
+	default:
+		email, err := normalizeEmail(row.Email)
+		if err != nil || len(email) > maxNameLength {
+			res.fail(row.Line, "email", "must be a valid email address")
+			return false
+		}
+		row.Email = email
+		return true
+	}
+	return false
+}
+
+// flushImportBatch は既に使われているメールアドレスの行を除いて、batchを登録します
+func (s *UserService) flushImportBatch(ctx context.Context, span trace.Span, res *ImportResult, batch []ImportRow) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	emails := make([]string, len(batch))
+	for i, row := range batch {
+		emails[i] = row.Email
+	}
+	existing, err := s.userRepo.ExistingEmails(ctx, emails)
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to import users: %w", err)
+	}
+	exists := make(map[string]bool, len(existing))
+	for _, email := range existing {
+		exists[email] = true
+	}
+
+	failed := res.Failed
+	rows := make([]ImportRow, 0, len(batch))
+	for _, row := range batch {
+		if exists[row.Email] {
+			res.fail(row.Line, "email", "already exists")
+			continue
+		}
+		rows = append(rows, row)
+	}
+
+	imported := len(rows)
+	if !res.DryRun && len(rows) > 0 {
+		err := s.importBatch(ctx, rows)
+		if errors.Is(err, database.ErrDuplicateKey) {
+			// 確認してから登録するまでの間に同じメールアドレスが登録された場合は、1行ずつ登録して失敗した行を特定する
+			imported = 0
+			for _, row := range rows {
+				err := s.importBatch(ctx, []ImportRow{row})
+				if errors.Is(err, database.ErrDuplicateKey) {
+					res.fail(row.Line, "email", "already exists")
+					continue
+				}
+				if err != nil {
+					span.RecordError(err)
+					return fmt.Errorf("failed to import users: %w", err)
+				}
+				imported++
+			}
+		} else if err != nil {
+			span.RecordError(err)
+			return fmt.Errorf("failed to import users: %w", err)
+		}
+	}
+	res.Imported += imported
+
+	s.recordImportRows(ctx, res.DryRun, "imported", imported)
+	s.recordImportRows(ctx, res.DryRun, "failed", res.Failed-failed)
+	span.AddEvent("import.batch", trace.WithAttributes(
+		attribute.Int("batch.size", len(batch)),
+		attribute.Int("import.total", res.Total),
+		attribute.Int("import.imported", res.Imported),
+		attribute.Int("import.failed", res.Failed),
+	))
+	return nil
+}
+
+// importBatch はrowsのユーザーを1つのトランザクションで登録し、監査ログとドメインイベントを書き込みます
+func (s *UserService) importBatch(ctx context.Context, rows []ImportRow) error {
+	users := make([]*entity.User, len(rows))
+	for i, row := range rows {
+		users[i] = &entity.User{Name: row.Name, Email: row.Email}
+	}
+	return s.db.WithinTx(ctx, func(ctx context.Context) error {
+		if err := s.userRepo.CreateBatch(ctx, users); err != nil {
+			return err
+		}
+		for _, user := range users {
+			if err := s.recordAudit(ctx, audit.ActionCreate, user.ID, nil, user); err != nil {
+				return err
+			}
+			if err := s.recordEvent(ctx, events.UserCreated, user.ID, user); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// recordImportRows は一括登録の行数をメトリクスに記録します
+func (s *UserService) recordImportRows(ctx context.Context, dryRun bool, outcome string, n int) {
+	if n == 0 {
+		return
+	}
+	s.importRows.Add(ctx, int64(n), metric.WithAttributes(
+		attribute.Bool("import.dry_run", dryRun),
+		attribute.String("import.outcome", outcome),
+	))
+}
+
+// ExportUsers は全てのユーザーをIDの昇順で返します
+// ページごとに読み込むため、件数が多くてもメモリに全て載せない
+func (s *UserService) ExportUsers(ctx context.Context) iter.Seq2[*entity.User, error] {
+	return func(yield func(*entity.User, error) bool) {
+		ctx, span := s.tracer.Start(ctx, "UserService.ExportUsers")
+		defer span.End()
+
+		count := 0
+		defer func() { span.SetAttributes(attribute.Int("export.count", count)) }()
+
+		var after uint
+		for {
+			users, err := s.userRepo.ListAfter(ctx, after, exportPageSize)
+			if err != nil {
+				span.RecordError(err)
+				yield(nil, fmt.Errorf("failed to export users: %w", err))
+				return
+			}
+			for i := range users {
+				count++
+				if !yield(&users[i], nil) {
+					return
+				}
+			}
+			if len(users) < exportPageSize {
+				return
+			}
+			after = users[len(users)-1].ID
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"testing"
+
+	"otel-test/database/databasetest"
+	"otel-test/o11y/o11ytest"
+	"otel-test/server/entity"
+	"otel-test/server/repository"
+	"otel-test/tenant"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func newImportTestService(t *testing.T) (*o11ytest.Harness, *UserService) {
+	t.Helper()
+	h := o11ytest.New(t)
+	db := databasetest.New(t, &entity.User{}, &entity.OutboxEvent{}, &entity.AuditLog{})
+	return h, NewUserService(db, repository.NewUserRepository(db), repository.NewOutboxRepository(db), repository.NewAuditRepository(db))
+}
+
+// importRows はrowsを返し、errがnilでなければ最後に返すイテレーター
+func importRows(rows []ImportRow, err error) iter.Seq2[ImportRow, error] {
+	return func(yield func(ImportRow, error) bool) {
+		for _, row := range rows {
+			if !yield(row, nil) {
+				return
+			}
+		}
+		if err != nil {
+			yield(ImportRow{}, err)
+		}
+	}
+}
+
+func TestImportUsers(t *testing.T) {
+	h, s := newImportTestService(t)
+	ctx := tenant.WithID(context.Background(), "acme")
+	if _, err := s.CreateUser(ctx, "Existing", "existing@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []ImportRow{
+		{Line: 2, Name: "Taro", Email: "Taro@Example.com"},
+		{Line: 3, Name: "", Email: "noname@example.com"},
+		{Line: 4, Name: "Jiro", Email: "invalid"},
+		{Line: 5, Name: "Taro2", Email: "taro@example.com"},
+		{Line: 6, Name: "Existing", Email: "existing@example.com"},
+		{Line: 7, Err: errors.New("wrong number of fields")},
+	}
+	for i := range 5 {
+		rows = append(rows, ImportRow{Line: 8 + i, Name: fmt.Sprint("user", i), Email: fmt.Sprintf("user%d@example.com", i)})
+	}
+
+	res, err := s.ImportUsers(ctx, importRows(rows, nil), ImportOptions{BatchSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Total != 11 || res.Imported != 6 || res.Failed != 5 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	want := []ImportError{
+		{Line: 3, Field: "name", Message: "is required"},
+		{Line: 4, Field: "email", Message: "must be a valid email address"},
+		{Line: 5, Field: "email", Message: "duplicates line 2"},
+		{Line: 6, Field: "email", Message: "already exists"},
+		{Line: 7, Message: "wrong number of fields"},
+	}
+	if fmt.Sprint(res.Errors) != fmt.Sprint(want) {
+		t.Fatalf("errors = %+v, want %+v", res.Errors, want)
+	}
+
+	users, err := s.ListUsers(ctx, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 7 || users[1].Email != "taro@example.com" || users[1].Version != 1 {
+		t.Fatalf("unexpected users: %+v", users)
+	}
+	// 作成したユーザーごとに監査ログを記録する
+	if logs, err := s.ListUserAudit(ctx, users[1].ID, 0, 10); err != nil || len(logs) != 1 || logs[0].Action != "create" {
+		t.Fatalf("audit logs = %+v, %v", logs, err)
+	}
+
+	h.Span("UserService.ImportUsers").
+		HasAttr("import.imported", 6).
+		HasAttr("import.failed", 5).
+		HasEvent("import.batch")
+	h.Spans().Named("UserRepository.CreateBatch").Len(3)
+	dryRun := attribute.Bool("import.dry_run", false)
+	h.Metric("users.import.rows").WithAttrs(dryRun, attribute.String("import.outcome", "imported")).HasValue(6)
+	h.Metric("users.import.rows").WithAttrs(dryRun, attribute.String("import.outcome", "failed")).HasValue(5)
+}
+
+func TestImportUsersDryRun(t *testing.T) {
+	h, s := newImportTestService(t)
+	ctx := tenant.WithID(context.Background(), "acme")
+
+	rows := []ImportRow{{Line: 1, Name: "Taro", Email: "taro@example.com"}}
+	res, err := s.ImportUsers(ctx, importRows(rows, nil), ImportOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.DryRun || res.Imported != 1 || res.Failed != 0 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	if users, _ := s.ListUsers(ctx, 10, 0); len(users) != 0 {
+		t.Fatalf("users = %+v, want none", users)
+	}
+	h.Spans().Named("UserRepository.CreateBatch").Len(0)
+	h.Metric("users.import.rows").WithAttrs(attribute.Bool("import.dry_run", true)).HasValue(1)
+}
+
+func TestImportUsersAborted(t *testing.T) {
+	_, s := newImportTestService(t)
+	ctx := tenant.WithID(context.Background(), "acme")
+
+	// 読み込みを中断するまでの行は登録する
+	rows := []ImportRow{{Line: 1, Name: "Taro", Email: "taro@example.com"}}
+	res, err := s.ImportUsers(ctx, importRows(rows, errors.New("unexpected EOF")), ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Imported != 1 || res.Error != "unexpected EOF" {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+}
+
+func TestExportUsers(t *testing.T) {
+	_, s := newImportTestService(t)
+	ctx := tenant.WithID(context.Background(), "acme")
+
+	rows := make([]ImportRow, exportPageSize+2)
+	for i := range rows {
+		rows[i] = ImportRow{Line: i + 1, Name: fmt.Sprint("user", i), Email: fmt.Sprintf("user%d@example.com", i)}
+	}
+	if _, err := s.ImportUsers(ctx, importRows(rows, nil), ImportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var last uint
+	count := 0
+	for user, err := range s.ExportUsers(ctx) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.ID <= last {
+			t.Fatalf("id %d after %d", user.ID, last)
+		}
+		last = user.ID
+		count++
+	}
+	if count != len(rows) {
+		t.Fatalf("exported %d, want %d", count, len(rows))
+	}
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"otel-test/jobs"
+	"otel-test/o11y"
+	"otel-test/tenant"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ユーザーに関するジョブの種類
+const (
+	JobPurgeDeletedUsers = "users.purge_deleted"
+)
+
+// PurgeDeletedUsers は論理削除からretention以上経過したユーザーを物理削除します
+// コンテキストにテナントがない場合は全てのテナントのユーザーが対象
+func (s *UserService) PurgeDeletedUsers(ctx context.Context, retention time.Duration) (int64, error) {
+	ctx = tenant.WithAllTenants(ctx)
+	ctx, span := s.tracer.Start(ctx, "UserService.PurgeDeletedUsers")
+	defer span.End()
+
+	before := time.Now().Add(-retention)
+	span.SetAttributes(attribute.String("user.deleted_before", before.UTC().Format(time.RFC3339)))
+
+	n, err := s.userRepo.PurgeDeleted(ctx, before)
+	if err != nil {
+		span.RecordError(err)
+		return 0, fmt.Errorf("failed to purge deleted users: %w", err)
+	}
+
+	span.SetAttributes(attribute.Int64("user.purged", n))
+	return n, nil
+}
+
+// PurgeDeletedUsersJob はPurgeDeletedUsersを実行するジョブのハンドラーを返します
+func (s *UserService) PurgeDeletedUsersJob(retention time.Duration) jobs.Handler {
+	return func(ctx context.Context, _ jobs.Job) error {
+		n, err := s.PurgeDeletedUsers(ctx, retention)
+		if err != nil {
+			return err
+		}
+		o11y.Logger("jobs").InfoContext(ctx, "purged deleted users", slog.Int64("count", n))
+		return nil
+	}
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"otel-test/database/databasetest"
+	"otel-test/server/entity"
+	"otel-test/server/repository"
+	"otel-test/tenant"
+
+	"gorm.io/gorm"
+)
+
+func TestPurgeDeletedUsers(t *testing.T) {
+	db := databasetest.New(t, &entity.User{}, &entity.OutboxEvent{}, &entity.AuditLog{})
+	s := NewUserService(db, repository.NewUserRepository(db), repository.NewOutboxRepository(db), repository.NewAuditRepository(db))
+
+	now := time.Now()
+	users := []entity.User{
+		{Name: "active", Email: "active@example.com"},
+		{Name: "old", Email: "old@example.com", DeletedAt: gorm.DeletedAt{Time: now.Add(-48 * time.Hour), Valid: true}},
+		{Name: "recent", Email: "recent@example.com", DeletedAt: gorm.DeletedAt{Time: now.Add(-time.Hour), Valid: true}},
+	}
+	// 全てのテナントが対象になることを確認するため、テナントを分けて作成する
+	for i := range users {
+		ctx := tenant.WithID(context.Background(), []string{"acme", "globex"}[i%2])
+		if err := db.WithContext(ctx).Create(&users[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := s.PurgeDeletedUsers(context.Background(), 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("purged = %d, want 1", n)
+	}
+
+	var remaining []string
+	if err := db.WithContext(tenant.WithAllTenants(context.Background())).Unscoped().Model(&entity.User{}).Order("id").Pluck("name", &remaining).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 2 || remaining[0] != "active" || remaining[1] != "recent" {
+		t.Fatalf("remaining = %v", remaining)
+	}
+}
@@ -0,0 +1,494 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"otel-test/events"
+	"otel-test/o11y"
+	"otel-test/server/entity"
+	"otel-test/server/repository"
+	"otel-test/tenant"
+	"otel-test/webhook"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// 配信の結果（メトリクスとスパンの属性）
+const (
+	resultSuccess = "success"
+	resultRetry   = "retry"
+	resultDead    = "dead"
+)
+
+// errSubscriptionGone は配信先の購読が削除されている
+var errSubscriptionGone = errors.New("subscription deleted")
+
+// WebhookConfig はwebhookの配信設定
+type WebhookConfig struct {
+	// MaxAttempts は配信ごとの最大試行回数（超えた配信はデッドレターになる）
+	MaxAttempts int
+	// Backoff は失敗時の再送間隔
+	Backoff webhook.Backoff
+	// Timeout は1回の送信のタイムアウト
+	Timeout time.Duration
+	// Interval は配信待ちを確認する間隔
+	Interval time.Duration
+	// BatchSize は1回の確認で送信する最大数
+	BatchSize int
+	// Lease は取得した配信をロックする時間（1バッチの送信にかかる時間より長くする）
+	Lease time.Duration
+}
+
+// WebhookService はwebhookの購読の管理と非同期の配信を行う
+// 複数のインスタンスで実行しても、ロックした配信だけを送信するため同じ配信を同時に送信しない
+type WebhookService struct {
+	repo       *repository.WebhookRepository
+	config     WebhookConfig
+	owner      string
+	client     *http.Client
+	tracer     trace.Tracer
+	deliveries metric.Int64Counter
+	duration   metric.Float64Histogram
+	now        func() time.Time
+}
+
+// NewWebhookService は新しいWebhookServiceを作成します
+func NewWebhookService(repo *repository.WebhookRepository, config WebhookConfig) *WebhookService {
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 8
+	}
+	if config.Backoff.Base <= 0 {
+		config.Backoff.Base = time.Second
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.Interval <= 0 {
+		config.Interval = time.Second
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 50
+	}
+	if config.Lease <= 0 {
+		config.Lease = 5 * time.Minute
+	}
+
+	meter := otel.Meter("webhook-service")
+	deliveries, _ := meter.Int64Counter("webhook.deliveries",
+		metric.WithDescription("Number of webhook delivery attempts"),
+		metric.WithUnit("{attempt}"),
+	)
+	duration, _ := meter.Float64Histogram("webhook.delivery.duration",
+		metric.WithDescription("Duration of webhook delivery attempts"),
+		metric.WithUnit("s"),
+	)
+
+	return &WebhookService{
+		repo:       repo,
+		config:     config,
+		owner:      dispatcherID(),
+		client:     &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)},
+		tracer:     otel.Tracer("webhook-service"),
+		deliveries: deliveries,
+		duration:   duration,
+		now:        time.Now,
+	}
+}
+
+// Subscribe はwebhookの送信先を登録します
+// eventTypesが空の場合はすべてのイベントを送信する（"user.*"のようなパターンも指定できる）
+func (s *WebhookService) Subscribe(ctx context.Context, rawURL string, eventTypes []string) (*entity.WebhookSubscription, error) {
+	ctx, span := s.tracer.Start(ctx, "WebhookService.Subscribe")
+	defer span.End()
+
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url must be an absolute http(s) URL: %w", ErrInvalidArgument)
+	}
+	for _, t := range eventTypes {
+		if _, err := path.Match(t, ""); err != nil || t == "" || strings.Contains(t, ",") {
+			return nil, fmt.Errorf("invalid event type %q: %w", t, ErrInvalidArgument)
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	sub := &entity.WebhookSubscription{
+		URL:        rawURL,
+		EventTypes: strings.Join(eventTypes, ","),
+		Secret:     "whsec_" + hex.EncodeToString(secret),
+	}
+	if err := s.repo.CreateSubscription(ctx, sub); err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to create subscription: %w", err)
+	}
+
+	span.SetAttributes(attribute.Int("webhook.subscription_id", int(sub.ID)))
+	return sub, nil
+}
+
+func (s *WebhookService) GetSubscription(ctx context.Context, id uint) (*entity.WebhookSubscription, error) {
+	ctx, span := s.tracer.Start(ctx, "WebhookService.GetSubscription")
+	defer span.End()
+
+	span.SetAttributes(attribute.Int("webhook.subscription_id", int(id)))
+
+	sub, err := s.repo.GetSubscription(ctx, id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("webhook %d: %w", id, ErrNotFound)
+		}
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to get subscription: %w", err)
+	}
+	return sub, nil
+}
+
+func (s *WebhookService) ListSubscriptions(ctx context.Context) ([]entity.WebhookSubscription, error) {
+	ctx, span := s.tracer.Start(ctx, "WebhookService.ListSubscriptions")
+	defer span.End()
+
+	subs, err := s.repo.ListSubscriptions(ctx)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to list subscriptions: %w", err)
+	}
+	return subs, nil
+}
+
+// Unsubscribe は購読を削除します
+// 配信待ちの配信は送信時にデッドレターになる
+func (s *WebhookService) Unsubscribe(ctx context.Context, id uint) error {
+	ctx, span := s.tracer.Start(ctx, "WebhookService.Unsubscribe")
+	defer span.End()
+
+	span.SetAttributes(attribute.Int("webhook.subscription_id", int(id)))
+
+	if err := s.repo.DeleteSubscription(ctx, id); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("webhook %d: %w", id, ErrNotFound)
+		}
+		span.RecordError(err)
+		return fmt.Errorf("failed to delete subscription: %w", err)
+	}
+	return nil
+}
+
+// ListDeliveries は購読の配信を新しい順に返します
+func (s *WebhookService) ListDeliveries(ctx context.Context, subscriptionID uint, limit int) ([]entity.WebhookDelivery, error) {
+	ctx, span := s.tracer.Start(ctx, "WebhookService.ListDeliveries")
+	defer span.End()
+
+	if _, err := s.GetSubscription(ctx, subscriptionID); err != nil {
+		return nil, err
+	}
+	deliveries, err := s.repo.ListDeliveries(ctx, subscriptionID, limit)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to list deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// ListAttempts は配信の試行の記録を返します
+func (s *WebhookService) ListAttempts(ctx context.Context, subscriptionID, deliveryID uint) ([]entity.WebhookAttempt, error) {
+	ctx, span := s.tracer.Start(ctx, "WebhookService.ListAttempts")
+	defer span.End()
+
+	if _, err := s.getDelivery(ctx, subscriptionID, deliveryID); err != nil {
+		return nil, err
+	}
+	attempts, err := s.repo.ListAttempts(ctx, deliveryID)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to list attempts: %w", err)
+	}
+	return attempts, nil
+}
+
+// Redeliver はデッドレターになった配信を再び配信待ちにします
+// 試行回数はリセットする。デッドレターでない配信はErrPreconditionFailedを返す
+func (s *WebhookService) Redeliver(ctx context.Context, subscriptionID, deliveryID uint) (*entity.WebhookDelivery, error) {
+	ctx, span := s.tracer.Start(ctx, "WebhookService.Redeliver")
+	defer span.End()
+
+	delivery, err := s.getDelivery(ctx, subscriptionID, deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.String("webhook.delivery_status", delivery.Status))
+
+	requeued, err := s.repo.RequeueDeadDelivery(ctx, delivery, s.now())
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to requeue delivery: %w", err)
+	}
+	if !requeued {
+		return nil, fmt.Errorf("delivery %d is not dead: %w", deliveryID, ErrPreconditionFailed)
+	}
+	return s.getDelivery(ctx, subscriptionID, deliveryID)
+}
+
+func (s *WebhookService) getDelivery(ctx context.Context, subscriptionID, deliveryID uint) (*entity.WebhookDelivery, error) {
+	delivery, err := s.repo.GetDelivery(ctx, deliveryID)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && delivery.SubscriptionID != subscriptionID) {
+		return nil, fmt.Errorf("delivery %d: %w", deliveryID, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get delivery: %w", err)
+	}
+	return delivery, nil
+}
+
+// Enqueue はイベントと同じテナントの購読のうち、イベントに一致する購読ごとに配信を作成します
+// テナントのないイベントは配信しない。events.Busのハンドラーとして登録する
+func (s *WebhookService) Enqueue(ctx context.Context, ev events.Event) error {
+	if ev.TenantID == "" {
+		return nil
+	}
+	ctx = tenant.WithID(ctx, ev.TenantID)
+	ctx, span := s.tracer.Start(ctx, "WebhookService.Enqueue", trace.WithAttributes(ev.Attributes()...))
+	defer span.End()
+
+	subs, err := s.repo.ListSubscriptions(ctx)
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to list subscriptions: %w", err)
+	}
+
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	traceContext, err := json.Marshal(ev.TraceContext)
+	if err != nil {
+		return err
+	}
+
+	var deliveries []entity.WebhookDelivery
+	for _, sub := range subs {
+		if !matchEvent(sub.Events(), ev.Type) {
+			continue
+		}
+		deliveries = append(deliveries, entity.WebhookDelivery{
+			SubscriptionID: sub.ID,
+			EventID:        ev.ID,
+			EventType:      ev.Type,
+			Payload:        string(payload),
+			TraceContext:   string(traceContext),
+			Status:         entity.DeliveryPending,
+			NextAttemptAt:  s.now(),
+		})
+	}
+
+	span.SetAttributes(attribute.Int("webhook.delivery_count", len(deliveries)))
+	if err := s.repo.CreateDeliveries(ctx, deliveries); err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to create deliveries: %w", err)
+	}
+	return nil
+}
+
+// matchEvent はイベントの種類がフィルターに一致するかを返します
+func matchEvent(filters []string, eventType string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	for _, f := range filters {
+		if ok, _ := path.Match(f, eventType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Run はctxが終了するまで一定間隔で配信待ちを送信します
+func (s *WebhookService) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.Dispatch(ctx); err != nil && ctx.Err() == nil {
+			o11y.Logger("webhook").ErrorContext(ctx, "failed to dispatch webhooks", slog.Any("error", err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Dispatch は送信時刻を過ぎた配信を1バッチ分送信し、成功した件数を返します
+func (s *WebhookService) Dispatch(ctx context.Context) (int, error) {
+	due, err := s.repo.ClaimDeliveries(ctx, s.owner, s.now(), s.config.BatchSize, s.config.Lease)
+	if err != nil {
+		return 0, fmt.Errorf("failed to claim due deliveries: %w", err)
+	}
+
+	var succeeded int
+	for i := range due {
+		if ctx.Err() != nil {
+			return succeeded, ctx.Err()
+		}
+		if s.deliver(ctx, &due[i]) == resultSuccess {
+			succeeded++
+		}
+	}
+	return succeeded, nil
+}
+
+// deliver は配信を1回試行し、結果を記録します
+func (s *WebhookService) deliver(ctx context.Context, delivery *entity.WebhookDelivery) string {
+	attempt := delivery.Attempts + 1
+
+	// 購読の取得と配信の更新は配信のテナントで行う
+	ctx = tenant.WithID(ctx, delivery.TenantID)
+
+	// 配信のスパンは独立したトレースとし、イベントを発生させたリクエストへはリンクで関連付ける
+	ev := events.Event{ID: delivery.EventID, Type: delivery.EventType}
+	_ = json.Unmarshal([]byte(delivery.TraceContext), &ev.TraceContext)
+	ctx, span := s.tracer.Start(ctx, "webhook deliver "+delivery.EventType,
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithLinks(ev.Link()),
+		trace.WithAttributes(
+			attribute.Int("webhook.subscription_id", int(delivery.SubscriptionID)),
+			attribute.Int("webhook.delivery_id", int(delivery.ID)),
+			attribute.Int("webhook.attempt", attempt),
+			attribute.String("event.type", delivery.EventType),
+		),
+	)
+	defer span.End()
+
+	start := s.now()
+	statusCode, err := s.send(ctx, delivery)
+	elapsed := s.now().Sub(start)
+
+	result := resultSuccess
+	delivery.Attempts = attempt
+	delivery.LastStatusCode = statusCode
+	delivery.LastError = ""
+	switch {
+	case err == nil:
+		delivery.Status = entity.DeliverySucceeded
+		deliveredAt := s.now()
+		delivery.DeliveredAt = &deliveredAt
+	case attempt >= s.config.MaxAttempts || errors.Is(err, errSubscriptionGone):
+		result = resultDead
+		delivery.Status = entity.DeliveryDead
+		delivery.LastError = err.Error()
+	default:
+		result = resultRetry
+		delivery.Status = entity.DeliveryPending
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = s.now().Add(s.config.Backoff.Delay(attempt))
+		span.SetAttributes(attribute.String("webhook.next_attempt_at", delivery.NextAttemptAt.Format(time.RFC3339)))
+	}
+
+	span.SetAttributes(attribute.String("webhook.result", result))
+	if statusCode != 0 {
+		span.SetAttributes(attribute.Int("http.response.status_code", statusCode))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "webhook delivery failed")
+	}
+
+	record := &entity.WebhookAttempt{
+		DeliveryID: delivery.ID,
+		Attempt:    attempt,
+		StatusCode: statusCode,
+		DurationMS: elapsed.Milliseconds(),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if err := s.repo.RecordAttempt(ctx, delivery, record); err != nil {
+		span.RecordError(err)
+		o11y.Logger("webhook").ErrorContext(ctx, "failed to record webhook attempt", slog.Any("error", err))
+	}
+
+	attrs := metric.WithAttributes(
+		attribute.String("event.type", delivery.EventType),
+		attribute.String("webhook.result", result),
+	)
+	s.deliveries.Add(ctx, 1, attrs)
+	s.duration.Record(ctx, elapsed.Seconds(), attrs)
+
+	if result == resultDead {
+		o11y.Logger("webhook").WarnContext(ctx, "webhook delivery moved to dead letter",
+			slog.Int("webhook.delivery_id", int(delivery.ID)),
+			slog.Int("webhook.attempt", attempt),
+			slog.String("error", delivery.LastError),
+		)
+	}
+	return result
+}
+
+// send は署名付きのリクエストを送信し、ステータスコードを返します
+func (s *WebhookService) send(ctx context.Context, delivery *entity.WebhookDelivery) (int, error) {
+	sub, err := s.repo.GetSubscription(ctx, delivery.SubscriptionID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, errSubscriptionGone
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.config.Timeout)
+	defer cancel()
+
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhook.SignatureHeader, webhook.Sign(sub.Secret, s.now(), body))
+	req.Header.Set(webhook.EventTypeHeader, delivery.EventType)
+	req.Header.Set(webhook.DeliveryHeader, strconv.FormatUint(uint64(delivery.ID), 10))
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 1<<20))
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// dispatcherID は配信するインスタンスを識別する文字列を返します
+func dispatcherID() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
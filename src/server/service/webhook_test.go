@@ -0,0 +1,465 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"otel-test/database/databasetest"
+	"otel-test/events"
+	"otel-test/o11y/o11ytest"
+	"otel-test/server/entity"
+	"otel-test/server/repository"
+	"otel-test/tenant"
+	"otel-test/webhook"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// receiver はwebhookを受信するテスト用のサーバー
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	secret   string
+	statuses []int // 順番に返すステータスコード（尽きたら200）
+	received []http.Header
+	bodies   [][]byte
+	sigErrs  []error
+}
+
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	t.Helper()
+	r := &receiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.received = append(r.received, req.Header.Clone())
+		r.bodies = append(r.bodies, body)
+		r.sigErrs = append(r.sigErrs, webhook.Verify(r.secret, req.Header.Get(webhook.SignatureHeader), body, 5*time.Minute, time.Now()))
+
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.received)
+}
+
+// acme はテスト用のテナントacmeのコンテキスト
+var acme = tenant.WithID(context.Background(), "acme")
+
+// clock はテスト用の時計
+type clock struct{ now time.Time }
+
+func (c *clock) Now() time.Time          { return c.now }
+func (c *clock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestWebhookService(t *testing.T, config WebhookConfig) (*o11ytest.Harness, *WebhookService, *clock) {
+	t.Helper()
+	h := o11ytest.New(t)
+	db := databasetest.New(t, &entity.WebhookSubscription{}, &entity.WebhookDelivery{}, &entity.WebhookAttempt{})
+	s := NewWebhookService(repository.NewWebhookRepository(db), config)
+	c := &clock{now: time.Now()}
+	s.now = c.Now
+	return h, s, c
+}
+
+// subscribe はreceiverを購読として登録します
+func subscribe(t *testing.T, s *WebhookService, r *receiver, eventTypes ...string) *entity.WebhookSubscription {
+	t.Helper()
+	sub, err := s.Subscribe(acme, r.URL, eventTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.secret = sub.Secret
+	return sub
+}
+
+// newEvent はテナントacmeのリクエストのスパン内で発生したイベントを作成します
+func newEvent(t *testing.T, id uint64, eventType string) (events.Event, trace.SpanContext) {
+	t.Helper()
+	ctx, span := otel.Tracer("test").Start(acme, "POST /users")
+	defer span.End()
+	ev, err := events.New(ctx, eventType, 1, map[string]string{"name": "Taro"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev.ID = id
+	return ev, span.SpanContext()
+}
+
+func TestWebhookDeliverySigned(t *testing.T) {
+	h, s, _ := newTestWebhookService(t, WebhookConfig{})
+	r := newReceiver(t)
+	sub := subscribe(t, s, r)
+
+	ev, origin := newEvent(t, 7, events.UserCreated)
+	if err := s.Enqueue(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+	n, err := s.Dispatch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || r.count() != 1 {
+		t.Fatalf("dispatched = %d, received = %d", n, r.count())
+	}
+
+	if r.sigErrs[0] != nil {
+		t.Fatalf("signature verification failed: %v", r.sigErrs[0])
+	}
+	if got := r.received[0].Get(webhook.EventTypeHeader); got != events.UserCreated {
+		t.Fatalf("event type header = %q", got)
+	}
+	var got events.Event
+	if err := json.Unmarshal(r.bodies[0], &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != 7 || got.Type != events.UserCreated || got.TraceContext["traceparent"] == "" {
+		t.Fatalf("unexpected payload: %s", r.bodies[0])
+	}
+
+	deliveries, err := s.ListDeliveries(acme, sub.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Status != entity.DeliverySucceeded || deliveries[0].Attempts != 1 {
+		t.Fatalf("unexpected deliveries: %+v", deliveries)
+	}
+
+	h.Span("webhook deliver user.created").
+		IsRoot().
+		HasKind(trace.SpanKindProducer).
+		HasAttr("webhook.result", "success").
+		HasAttr("http.response.status_code", http.StatusOK).
+		HasLinkTo(origin).
+		NoError()
+	// 受信側にはdeliverスパンのトレースコンテキストが伝播する
+	h.Span("HTTP POST").ChildOf(h.Span("webhook deliver user.created"))
+	h.Metric("webhook.deliveries").
+		WithAttrs(attribute.String("event.type", events.UserCreated), attribute.String("webhook.result", "success")).
+		HasValue(1)
+	h.Metric("webhook.delivery.duration").HasCount(1).HasUnit("s")
+}
+
+func TestWebhookRetryWithBackoff(t *testing.T) {
+	h, s, c := newTestWebhookService(t, WebhookConfig{
+		MaxAttempts: 5,
+		Backoff:     webhook.Backoff{Base: time.Minute, Max: time.Hour},
+	})
+	r := newReceiver(t, http.StatusInternalServerError, http.StatusServiceUnavailable)
+	sub := subscribe(t, s, r)
+
+	ev, _ := newEvent(t, 1, events.UserUpdated)
+	if err := s.Enqueue(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+
+	dispatch := func() int {
+		t.Helper()
+		n, err := s.Dispatch(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// 1回目: 500 → 1分後に再送
+	if dispatch() != 0 || r.count() != 1 {
+		t.Fatalf("received = %d, want 1", r.count())
+	}
+	// バックオフ中は送信しない
+	c.Advance(59 * time.Second)
+	if dispatch(); r.count() != 1 {
+		t.Fatalf("received = %d during backoff, want 1", r.count())
+	}
+	// 2回目: 503 → 2分後に再送
+	c.Advance(time.Second)
+	if dispatch(); r.count() != 2 {
+		t.Fatalf("received = %d, want 2", r.count())
+	}
+	c.Advance(time.Minute)
+	if dispatch(); r.count() != 2 {
+		t.Fatalf("received = %d during backoff, want 2", r.count())
+	}
+	// 3回目: 成功
+	c.Advance(time.Minute)
+	if dispatch() != 1 || r.count() != 3 {
+		t.Fatalf("received = %d, want 3", r.count())
+	}
+
+	// 再送でも配信IDは変わらない
+	id := r.received[0].Get(webhook.DeliveryHeader)
+	for _, header := range r.received {
+		if header.Get(webhook.DeliveryHeader) != id {
+			t.Fatalf("delivery id changed: %q != %q", header.Get(webhook.DeliveryHeader), id)
+		}
+	}
+
+	deliveries, _ := s.ListDeliveries(acme, sub.ID, 10)
+	attempts, err := s.ListAttempts(acme, sub.ID, deliveries[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 3 || attempts[0].StatusCode != 500 || attempts[1].StatusCode != 503 || attempts[2].StatusCode != 200 {
+		t.Fatalf("unexpected attempts: %+v", attempts)
+	}
+
+	retries := h.Spans().Named("webhook deliver user.updated").Len(3).Each()
+	retries[0].HasAttr("webhook.result", "retry").HasAttr("webhook.attempt", 1).HasError()
+	retries[1].HasAttr("webhook.result", "retry").HasAttr("webhook.attempt", 2).HasError()
+	retries[2].HasAttr("webhook.result", "success").HasAttr("webhook.attempt", 3).NoError()
+	h.Metric("webhook.deliveries").
+		WithAttrs(attribute.String("event.type", events.UserUpdated), attribute.String("webhook.result", "retry")).
+		HasValue(2)
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	h, s, c := newTestWebhookService(t, WebhookConfig{
+		MaxAttempts: 2,
+		Backoff:     webhook.Backoff{Base: time.Second},
+	})
+	r := newReceiver(t, http.StatusInternalServerError, http.StatusInternalServerError)
+	sub := subscribe(t, s, r)
+
+	ev, _ := newEvent(t, 1, events.UserDeleted)
+	if err := s.Enqueue(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if _, err := s.Dispatch(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		c.Advance(time.Minute)
+	}
+
+	if r.count() != 2 {
+		t.Fatalf("received = %d, want 2", r.count())
+	}
+	deliveries, _ := s.ListDeliveries(acme, sub.ID, 10)
+	if deliveries[0].Status != entity.DeliveryDead || deliveries[0].LastStatusCode != 500 {
+		t.Fatalf("unexpected delivery: %+v", deliveries[0])
+	}
+	h.Metric("webhook.deliveries").
+		WithAttrs(attribute.String("event.type", events.UserDeleted), attribute.String("webhook.result", "dead")).
+		HasValue(1)
+	h.Logs().Containing("dead letter").Len(1)
+
+	// デッドレターは試行回数をリセットして再送できる
+	redelivered, err := s.Redeliver(acme, sub.ID, deliveries[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redelivered.Status != entity.DeliveryPending || redelivered.Attempts != 0 {
+		t.Fatalf("redelivered = %+v", redelivered)
+	}
+	if n, _ := s.Dispatch(context.Background()); n != 1 || r.count() != 3 {
+		t.Fatalf("dispatched = %d, received = %d", n, r.count())
+	}
+}
+
+func TestWebhookRedeliverRequiresDeadLetter(t *testing.T) {
+	_, s, c := newTestWebhookService(t, WebhookConfig{Backoff: webhook.Backoff{Base: time.Minute}})
+	r := newReceiver(t, http.StatusInternalServerError)
+	sub := subscribe(t, s, r)
+
+	ev, _ := newEvent(t, 1, events.UserCreated)
+	if err := s.Enqueue(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, _ := s.ListDeliveries(acme, sub.ID, 10)
+	id := deliveries[0].ID
+
+	// 再送待ちの配信は試行回数をリセットしない
+	if _, err := s.Dispatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Redeliver(acme, sub.ID, id); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("err = %v, want %v", err, ErrPreconditionFailed)
+	}
+	if delivery, _ := s.repo.GetDelivery(acme, id); delivery.Status != entity.DeliveryPending || delivery.Attempts != 1 {
+		t.Fatalf("delivery = %+v", delivery)
+	}
+
+	// 送信済みの配信は再送しない
+	c.Advance(time.Minute)
+	if n, _ := s.Dispatch(context.Background()); n != 1 {
+		t.Fatalf("dispatched = %d, want 1", n)
+	}
+	if _, err := s.Redeliver(acme, sub.ID, id); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("err = %v, want %v", err, ErrPreconditionFailed)
+	}
+	if n, _ := s.Dispatch(context.Background()); n != 0 || r.count() != 2 {
+		t.Fatalf("dispatched = %d, received = %d", n, r.count())
+	}
+
+	// 別の購読の配信は存在しないものとして扱う
+	if _, err := s.Redeliver(acme, sub.ID+1, id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("err = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestWebhookDispatchSkipsClaimedDeliveries(t *testing.T) {
+	_, s, c := newTestWebhookService(t, WebhookConfig{Lease: time.Minute})
+	r := newReceiver(t)
+	sub := subscribe(t, s, r)
+
+	ev, _ := newEvent(t, 1, events.UserCreated)
+	if err := s.Enqueue(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+	// 別のインスタンスが取得した配信は送信しない
+	claimed, err := s.repo.ClaimDeliveries(context.Background(), "other", c.Now(), 10, time.Minute)
+	if err != nil || len(claimed) != 1 || claimed[0].Status != entity.DeliveryDelivering {
+		t.Fatalf("claimed = %+v, %v", claimed, err)
+	}
+	if n, _ := s.Dispatch(context.Background()); n != 0 || r.count() != 0 {
+		t.Fatalf("dispatched = %d, received = %d", n, r.count())
+	}
+
+	// ロックの期限が切れた配信は再取得して送信する
+	c.Advance(2 * time.Minute)
+	if n, _ := s.Dispatch(context.Background()); n != 1 || r.count() != 1 {
+		t.Fatalf("dispatched = %d, received = %d", n, r.count())
+	}
+
+	// ロックを失ったインスタンスの結果は保存しない
+	stale := claimed[0]
+	stale.Status = entity.DeliveryDead
+	err = s.repo.RecordAttempt(acme, &stale, &entity.WebhookAttempt{DeliveryID: stale.ID, Attempt: 1})
+	if !errors.Is(err, webhook.ErrLeaseLost) {
+		t.Fatalf("err = %v, want %v", err, webhook.ErrLeaseLost)
+	}
+	deliveries, _ := s.ListDeliveries(acme, sub.ID, 10)
+	attempts, _ := s.ListAttempts(acme, sub.ID, deliveries[0].ID)
+	if deliveries[0].Status != entity.DeliverySucceeded || deliveries[0].Attempts != 1 || len(attempts) != 1 {
+		t.Fatalf("delivery = %+v, attempts = %d", deliveries[0], len(attempts))
+	}
+}
+
+func TestWebhookEventFilter(t *testing.T) {
+	_, s, _ := newTestWebhookService(t, WebhookConfig{})
+	all := newReceiver(t)
+	subscribe(t, s, all)
+	created := newReceiver(t)
+	subscribe(t, s, created, events.UserCreated)
+	pattern := newReceiver(t)
+	subscribe(t, s, pattern, "user.*")
+	other := newReceiver(t)
+	subscribe(t, s, other, "order.created")
+
+	for i, typ := range []string{events.UserCreated, events.UserUpdated} {
+		ev, _ := newEvent(t, uint64(i+1), typ)
+		if err := s.Enqueue(context.Background(), ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Dispatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tt := range map[string]struct {
+		r    *receiver
+		want int
+	}{
+		"all":     {all, 2},
+		"created": {created, 1},
+		"pattern": {pattern, 2},
+		"other":   {other, 0},
+	} {
+		if got := tt.r.count(); got != tt.want {
+			t.Errorf("%s received %d, want %d", name, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookUnsubscribedDeliveryIsDead(t *testing.T) {
+	_, s, _ := newTestWebhookService(t, WebhookConfig{})
+	r := newReceiver(t)
+	sub := subscribe(t, s, r)
+
+	ev, _ := newEvent(t, 1, events.UserCreated)
+	if err := s.Enqueue(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, _ := s.ListDeliveries(acme, sub.ID, 10)
+	if err := s.Unsubscribe(acme, sub.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Dispatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.count() != 0 {
+		t.Fatalf("received = %d, want 0", r.count())
+	}
+	delivery, err := s.repo.GetDelivery(acme, deliveries[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivery.Status != entity.DeliveryDead {
+		t.Fatalf("status = %q, want %q", delivery.Status, entity.DeliveryDead)
+	}
+}
+
+func TestWebhookTenantIsolation(t *testing.T) {
+	_, s, _ := newTestWebhookService(t, WebhookConfig{})
+	acmeReceiver := newReceiver(t)
+	subscribe(t, s, acmeReceiver)
+	globex := tenant.WithID(context.Background(), "globex")
+	globexReceiver := newReceiver(t)
+	globexSub, err := s.Subscribe(globex, globexReceiver.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	globexReceiver.secret = globexSub.Secret
+
+	// 別のテナントの購読は参照できない
+	if _, err := s.GetSubscription(acme, globexSub.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("err = %v, want %v", err, ErrNotFound)
+	}
+
+	ev, err := events.New(globex, events.UserCreated, 1, map[string]string{"email": "taro@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev.ID = 1
+	if err := s.Enqueue(context.Background(), ev); err != nil {
+		t.Fatal(err)
+	}
+	// テナントのないイベントはどの購読にも配信しない
+	if err := s.Enqueue(context.Background(), events.Event{ID: 2, Type: events.UserCreated}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Dispatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if acmeReceiver.count() != 0 || globexReceiver.count() != 1 {
+		t.Fatalf("acme received %d, globex received %d", acmeReceiver.count(), globexReceiver.count())
+	}
+	var got events.Event
+	if err := json.Unmarshal(globexReceiver.bodies[0], &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.TenantID != "globex" || globexReceiver.sigErrs[0] != nil {
+		t.Fatalf("unexpected payload: %s (%v)", globexReceiver.bodies[0], globexReceiver.sigErrs[0])
+	}
+}
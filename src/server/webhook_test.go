@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"otel-test/events"
+	"otel-test/server/entity"
+	"otel-test/server/service"
+)
+
+func TestHandleWebhooksLifecycle(t *testing.T) {
+	h, ts := newTestServer(t)
+
+	res := doJSON(t, http.MethodPost, "/webhooks", ts.URL+"/webhooks", map[string]any{
+		"url":    "https://example.com/hooks",
+		"events": []string{"user.created", "user.*"},
+	})
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+	var created webhookResponse
+	decode(t, res, &created)
+	if created.ID == 0 || !strings.HasPrefix(created.Secret, "whsec_") || len(created.Events) != 2 {
+		t.Fatalf("unexpected webhook: %+v", created)
+	}
+	h.Span("create-webhook").HasAttr("webhook.subscription_id", int(created.ID)).NoError()
+
+	byID := fmt.Sprintf("%s/webhooks/%d", ts.URL, created.ID)
+
+	// シークレットは登録時のみ返す
+	res = doJSON(t, http.MethodGet, "/webhooks/{id}", byID, nil)
+	var got webhookResponse
+	decode(t, res, &got)
+	if res.StatusCode != http.StatusOK || got.Secret != "" || got.URL != "https://example.com/hooks" {
+		t.Fatalf("status = %d, webhook = %+v", res.StatusCode, got)
+	}
+
+	res = doJSON(t, http.MethodGet, "/webhooks", ts.URL+"/webhooks", nil)
+	var list struct {
+		Webhooks []webhookResponse `json:"webhooks"`
+	}
+	decode(t, res, &list)
+	if len(list.Webhooks) != 1 || list.Webhooks[0].Secret != "" {
+		t.Fatalf("unexpected list: %+v", list)
+	}
+
+	res = doJSON(t, http.MethodGet, "/webhooks/{id}/deliveries", byID+"/deliveries", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	if res := doJSON(t, http.MethodDelete, "/webhooks/{id}", byID, nil); res.StatusCode != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusNoContent)
+	}
+	if res := doJSON(t, http.MethodGet, "/webhooks/{id}", byID, nil); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+	if res := doJSON(t, http.MethodGet, "/webhooks/{id}/deliveries", byID+"/deliveries", nil); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestHandleWebhookRedeliver(t *testing.T) {
+	// 1回の失敗でデッドレターにする
+	_, ts, webhooks := newTestServerWithWebhooks(t, service.WebhookConfig{MaxAttempts: 1})
+	var received int
+	fail := true
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received++
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(receiver.Close)
+
+	res := doJSON(t, http.MethodPost, "/webhooks", ts.URL+"/webhooks", map[string]any{"url": receiver.URL})
+	var created webhookResponse
+	decode(t, res, &created)
+	if err := webhooks.Enqueue(context.Background(), events.Event{ID: 1, Type: events.UserCreated, TenantID: "default"}); err != nil {
+		t.Fatal(err)
+	}
+
+	byID := fmt.Sprintf("%s/webhooks/%d", ts.URL, created.ID)
+	var list struct {
+		Deliveries []entity.WebhookDelivery `json:"deliveries"`
+	}
+	decode(t, doJSON(t, http.MethodGet, "/webhooks/{id}/deliveries", byID+"/deliveries", nil), &list)
+	if len(list.Deliveries) != 1 {
+		t.Fatalf("deliveries = %+v", list.Deliveries)
+	}
+	redeliver := fmt.Sprintf("%s/deliveries/%d/redeliver", byID, list.Deliveries[0].ID)
+	const route = "/webhooks/{id}/deliveries/{deliveryID}/redeliver"
+
+	// 配信待ちの配信は再送できない
+	if res := doJSON(t, http.MethodPost, route, redeliver, nil); res.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusPreconditionFailed)
+	}
+
+	if _, err := webhooks.Dispatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	res = doJSON(t, http.MethodPost, route, redeliver, nil)
+	var delivery entity.WebhookDelivery
+	decode(t, res, &delivery)
+	if res.StatusCode != http.StatusAccepted || delivery.Status != entity.DeliveryPending || delivery.Attempts != 0 {
+		t.Fatalf("status = %d, delivery = %+v", res.StatusCode, delivery)
+	}
+
+	fail = false
+	if n, err := webhooks.Dispatch(context.Background()); err != nil || n != 1 || received != 2 {
+		t.Fatalf("dispatched = %d, received = %d, err = %v", n, received, err)
+	}
+	// 送信済みの配信は再送できない
+	if res := doJSON(t, http.MethodPost, route, redeliver, nil); res.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusPreconditionFailed)
+	}
+	if res := doJSON(t, http.MethodPost, route, byID+"/deliveries/999/redeliver", nil); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestHandleWebhooksValidation(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	tests := []struct {
+		name string
+		body map[string]any
+		want int
+	}{
+		{"missing url", map[string]any{"events": []string{"user.created"}}, http.StatusUnprocessableEntity},
+		{"relative url", map[string]any{"url": "/hooks"}, http.StatusUnprocessableEntity},
+		{"invalid event", map[string]any{"url": "https://example.com", "events": []string{"User Created"}}, http.StatusUnprocessableEntity},
+		{"unknown field", map[string]any{"url": "https://example.com", "secret": "x"}, http.StatusUnprocessableEntity},
+		{"unsupported scheme", map[string]any{"url": "ftp://example.com"}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := doJSON(t, http.MethodPost, "/webhooks", ts.URL+"/webhooks", tt.body)
+			if res.StatusCode != tt.want {
+				t.Fatalf("status = %d, want %d", res.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleWebhooksTenantIsolation(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	res := doJSONWithHeader(t, http.MethodPost, "/webhooks", ts.URL+"/webhooks", http.Header{"X-Tenant-Id": {"acme"}}, map[string]any{
+		"url": "https://example.com/hooks",
+	})
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+	var created webhookResponse
+	decode(t, res, &created)
+
+	// 別のテナントの購読は一覧にも含まれず、存在しないものとして扱う
+	globex := http.Header{"X-Tenant-Id": {"globex"}}
+	res = doJSONWithHeader(t, http.MethodGet, "/webhooks", ts.URL+"/webhooks", globex, nil)
+	var list struct {
+		Webhooks []webhookResponse `json:"webhooks"`
+	}
+	decode(t, res, &list)
+	if len(list.Webhooks) != 0 {
+		t.Fatalf("unexpected list: %+v", list)
+	}
+	byID := fmt.Sprintf("%s/webhooks/%d", ts.URL, created.ID)
+	if res := doJSONWithHeader(t, http.MethodDelete, "/webhooks/{id}", byID, globex, nil); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+
+	res = doJSONWithHeader(t, http.MethodGet, "/webhooks", ts.URL+"/webhooks", http.Header{"X-Tenant-Id": {"Not_A_Tenant"}}, nil)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
@@ -8,23 +8,39 @@ import (
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // あんま関係なさそう
 
 const scopeName = "test/work"
 
-var (
-	meter                = otel.Meter(scopeName)
-	tracer               = otel.Tracer(scopeName)
+// defaultSingleURL はサブリクエストの送信先のデフォルト
+const defaultSingleURL = "http://localhost:8080/single"
+
+// work は/singleと/multiのサンプル処理
+// テストでプロバイダーを差し替えられるよう、サーバー作成時にトレーサーとメーターを取得する
+type work struct {
+	tracer               trace.Tracer
 	sleepHistogram       metric.Float64Histogram
 	subRequestsHistogram metric.Int64Histogram
-)
+	singleURL            string
+}
+
+func newWork(singleURL string) *work {
+	if singleURL == "" {
+		singleURL = defaultSingleURL
+	}
+	meter := otel.Meter(scopeName)
+
+	w := &work{
+		tracer:    otel.Tracer(scopeName),
+		singleURL: singleURL,
+	}
 
-func init() {
 	var err error
 	// [START opentelemetry_instrumentation_sleep_histogram_init]
-	sleepHistogram, err = meter.Float64Histogram("example.sleep.duration",
+	w.sleepHistogram, err = meter.Float64Histogram("example.sleep.duration",
 		metric.WithDescription("Sample histogram to measure time spent in sleeping"),
 		metric.WithExplicitBucketBoundaries(0.05, 0.075, 0.1, 0.125, 0.150, 0.2),
 		metric.WithUnit("s"))
@@ -33,38 +49,39 @@ func init() {
 	}
 	// [END opentelemetry_instrumentation_sleep_histogram_init]
 
-	subRequestsHistogram, err = meter.Int64Histogram("example.subrequests",
+	w.subRequestsHistogram, err = meter.Int64Histogram("example.subrequests",
 		metric.WithDescription("Sample histogram to measure the number of subrequests made"),
 		metric.WithExplicitBucketBoundaries(1, 2, 3, 4, 5, 6, 7, 8, 9, 10),
 		metric.WithUnit("{request}"))
 	if err != nil {
 		panic(err)
 	}
+	return w
 }
 
-func randomSleep(r *http.Request) time.Duration {
+func (w *work) randomSleep(r *http.Request) time.Duration {
 	// simulate the work by sleeping 100 to 200 ms
 	sleepTime := time.Duration(100+rand.Intn(100)) * time.Millisecond
 	time.Sleep(sleepTime)
 
 	hostValue := attribute.String("host.value", r.Host)
 	// custom histogram metric to record time slept in seconds
-	sleepHistogram.Record(r.Context(), sleepTime.Seconds(), metric.WithAttributes(hostValue))
+	w.sleepHistogram.Record(r.Context(), sleepTime.Seconds(), metric.WithAttributes(hostValue))
 	return sleepTime
 }
 
-func computeSubrequests(r *http.Request, subRequests int) error {
+func (w *work) computeSubrequests(r *http.Request, subRequests int) error {
 	// Add custom span representing the work done for the subrequests
-	ctx, span := tracer.Start(r.Context(), "subrequests")
+	ctx, span := w.tracer.Start(r.Context(), "subrequests")
 	defer span.End()
 
 	// Make specified number of http requests to the /single endpoint.
 	for i := 0; i < subRequests; i++ {
-		if err := callSingle(ctx); err != nil {
+		if err := callSingle(ctx, w.singleURL); err != nil {
 			return err
 		}
 	}
 	// record number of sub-requests made
-	subRequestsHistogram.Record(ctx, int64(subRequests))
+	w.subRequestsHistogram.Record(ctx, int64(subRequests))
 	return nil
 }
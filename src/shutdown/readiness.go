@@ -0,0 +1,25 @@
+package shutdown
+
+import "sync/atomic"
+
+// Readiness はトラフィックを受け付けられるかどうかを保持する
+type Readiness struct {
+	ready atomic.Bool
+}
+
+// NewReadiness はReady状態のReadinessを作成します
+func NewReadiness() *Readiness {
+	r := &Readiness{}
+	r.ready.Store(true)
+	return r
+}
+
+// SetReady はReady状態を変更します
+func (r *Readiness) SetReady(ready bool) {
+	r.ready.Store(ready)
+}
+
+// IsReady はReady状態かどうかを返します
+func (r *Readiness) IsReady() bool {
+	return r.ready.Load()
+}
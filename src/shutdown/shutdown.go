@@ -0,0 +1,106 @@
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"otel-test/o11y"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Phase はシャットダウンの1段階を表す
+type Phase struct {
+	Name string
+	// Timeout はフェーズのタイムアウト（0の場合は全体のタイムアウトのみ適用）
+	Timeout time.Duration
+	Run     func(ctx context.Context) error
+	// Untraced はスパンを記録しない（ログのみ）
+	// テレメトリのフラッシュとその後のフェーズのスパンはエクスポートされないため、記録しても失われる
+	Untraced bool
+}
+
+// Run はフェーズを順番に実行する
+// 各フェーズはログとスパンに記録され、失敗しても後続のフェーズは実行される
+func Run(ctx context.Context, timeout time.Duration, phases []Phase) error {
+	shutdownCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var shutdownErrors []error
+	for i, phase := range phases {
+		if err := runPhase(shutdownCtx, i, phase); err != nil {
+			shutdownErrors = append(shutdownErrors, fmt.Errorf("%s: %w", phase.Name, err))
+		}
+	}
+
+	if len(shutdownErrors) > 0 {
+		return errors.Join(shutdownErrors...)
+	}
+	return nil
+}
+
+func runPhase(ctx context.Context, index int, phase Phase) error {
+	logger := o11y.Logger("shutdown")
+
+	// テレメトリのフラッシュより前のフェーズがエクスポートされるよう、フェーズごとに独立したスパンにする
+	var span trace.Span = noop.Span{}
+	if !phase.Untraced {
+		ctx, span = otel.Tracer("shutdown").Start(ctx, "shutdown."+phase.Name)
+		defer span.End()
+	}
+
+	span.SetAttributes(
+		attribute.String("shutdown.phase", phase.Name),
+		attribute.Int("shutdown.phase.index", index),
+		attribute.String("shutdown.phase.timeout", phase.Timeout.String()),
+	)
+
+	if phase.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, phase.Timeout)
+		defer cancel()
+	}
+
+	logger.InfoContext(ctx, "shutdown phase started", slog.String("phase", phase.Name))
+	start := time.Now()
+
+	err := phase.Run(ctx)
+	elapsed := time.Since(start)
+	span.SetAttributes(attribute.Int64("shutdown.phase.duration_ms", elapsed.Milliseconds()))
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		logger.ErrorContext(ctx, "shutdown phase failed",
+			slog.String("phase", phase.Name),
+			slog.Duration("duration", elapsed),
+			slog.Any("error", err))
+		return err
+	}
+
+	logger.InfoContext(ctx, "shutdown phase completed",
+		slog.String("phase", phase.Name),
+		slog.Duration("duration", elapsed))
+	return nil
+}
+
+// Sleep はpre-stop用にコンテキストが終わるまで最大d待機する
+func Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
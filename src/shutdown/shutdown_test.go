@@ -0,0 +1,126 @@
+package shutdown_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"otel-test/o11y/o11ytest"
+	"otel-test/shutdown"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+func TestRunPhaseOrder(t *testing.T) {
+	h := o11ytest.New(t)
+	readiness := shutdown.NewReadiness()
+
+	var order []string
+	phase := func(name string, err error) shutdown.Phase {
+		return shutdown.Phase{Name: name, Run: func(context.Context) error {
+			order = append(order, name)
+			return err
+		}}
+	}
+	boom := errors.New("boom")
+	phases := []shutdown.Phase{
+		{Name: "readiness", Run: func(context.Context) error {
+			order = append(order, "readiness")
+			readiness.SetReady(false)
+			return nil
+		}},
+		{Name: "http", Run: func(context.Context) error {
+			// 先に実行したフェーズでNot Readyになっている
+			if readiness.IsReady() {
+				t.Error("still ready after readiness phase")
+			}
+			order = append(order, "http")
+			return nil
+		}},
+		phase("jobs", boom),
+		phase("database", nil),
+	}
+
+	err := shutdown.Run(context.Background(), time.Second, phases)
+	// 失敗したフェーズがあっても後続のフェーズは実行する
+	if want := []string{"readiness", "http", "jobs", "database"}; !slices.Equal(order, want) {
+		t.Fatalf("order = %v, want %v", order, want)
+	}
+	if !errors.Is(err, boom) || err.Error() != "jobs: boom" {
+		t.Fatalf("err = %v, want jobs: boom", err)
+	}
+
+	h.Span("shutdown.readiness").HasAttr("shutdown.phase.index", 0).NoError()
+	h.Span("shutdown.jobs").HasAttr("shutdown.phase.index", 2).HasError().HasStatus(codes.Error)
+	// フェーズごとに独立したスパンにする
+	h.Span("shutdown.database").IsRoot()
+	h.Logs().Containing("shutdown phase failed").WithAttr("phase", "jobs").Len(1)
+	h.Logs().Containing("shutdown phase completed").Len(3)
+}
+
+func TestRunPhaseTimeout(t *testing.T) {
+	o11ytest.New(t)
+	waitDone := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	var nextErr error
+	start := time.Now()
+	err := shutdown.Run(context.Background(), time.Second, []shutdown.Phase{
+		{Name: "inflight", Timeout: 20 * time.Millisecond, Run: waitDone},
+		// フェーズのタイムアウトは後続のフェーズに影響しない
+		{Name: "database", Run: func(ctx context.Context) error {
+			nextErr = ctx.Err()
+			return nil
+		}},
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) >= time.Second {
+		t.Fatalf("err = %v after %v", err, time.Since(start))
+	}
+	if nextErr != nil {
+		t.Fatalf("next phase ctx.Err() = %v", nextErr)
+	}
+
+	// 全体のタイムアウトを過ぎた後のフェーズは終了したコンテキストで実行する
+	nextErr = nil
+	err = shutdown.Run(context.Background(), 20*time.Millisecond, []shutdown.Phase{
+		{Name: "inflight", Run: waitDone},
+		{Name: "database", Run: func(ctx context.Context) error {
+			nextErr = ctx.Err()
+			return nil
+		}},
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(nextErr, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, next phase ctx.Err() = %v", err, nextErr)
+	}
+}
+
+func TestRunUntracedPhase(t *testing.T) {
+	h := o11ytest.New(t)
+	err := shutdown.Run(context.Background(), time.Second, []shutdown.Phase{
+		{Name: "background", Run: func(context.Context) error { return nil }},
+		{Name: "telemetry", Untraced: true, Run: func(context.Context) error { return errors.New("flush failed") }},
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	// テレメトリのフラッシュ後に終了するスパンは作成せず、ログにのみ記録する
+	h.Spans().Len(1)
+	h.Span("shutdown.background")
+	h.Logs().Containing("shutdown phase failed").WithAttr("phase", "telemetry").Len(1)
+}
+
+func TestSleep(t *testing.T) {
+	if err := shutdown.Sleep(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := shutdown.Sleep(ctx, time.Minute); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,60 @@
+package shutdown
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// waitInterval は実行中の処理の完了を確認する間隔
+const waitInterval = 50 * time.Millisecond
+
+// Tracker は実行中の処理数を数え、完了を待機できるようにする
+// リクエストやバックグラウンド処理の追跡に使用する
+type Tracker struct {
+	count atomic.Int64
+}
+
+// NewTracker は新しいTrackerを作成します
+func NewTracker() *Tracker {
+	return &Tracker{}
+}
+
+// Add は実行中の処理を1つ追加し、完了時に呼び出す関数を返します
+func (t *Tracker) Add() (done func()) {
+	t.count.Add(1)
+	var once atomic.Bool
+	return func() {
+		if once.CompareAndSwap(false, true) {
+			t.count.Add(-1)
+		}
+	}
+}
+
+// Go はfnをgoroutineで実行し、完了まで追跡します
+func (t *Tracker) Go(fn func()) {
+	done := t.Add()
+	go func() {
+		defer done()
+		fn()
+	}()
+}
+
+// Count は実行中の処理数を返します
+func (t *Tracker) Count() int64 {
+	return t.count.Load()
+}
+
+// Wait は実行中の処理がなくなるかコンテキストが終わるまで待機します
+func (t *Tracker) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(waitInterval)
+	defer ticker.Stop()
+	for t.Count() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
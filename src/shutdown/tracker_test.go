@@ -0,0 +1,70 @@
+package shutdown_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"otel-test/shutdown"
+)
+
+func TestTrackerWait(t *testing.T) {
+	tracker := shutdown.NewTracker()
+	done := tracker.Add()
+	release := make(chan struct{})
+	tracker.Go(func() { <-release })
+	if got := tracker.Count(); got != 2 {
+		t.Fatalf("Count = %d, want 2", got)
+	}
+
+	// 完了関数は複数回呼び出しても1回だけ数える
+	done()
+	done()
+	if got := tracker.Count(); got != 1 {
+		t.Fatalf("Count = %d, want 1", got)
+	}
+
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- tracker.Wait(context.Background()) }()
+	select {
+	case err := <-waitErr:
+		t.Fatalf("Wait returned %v while work is in flight", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case err := <-waitErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait did not return after work finished")
+	}
+	if got := tracker.Count(); got != 0 {
+		t.Fatalf("Count = %d, want 0", got)
+	}
+}
+
+func TestTrackerWaitTimeout(t *testing.T) {
+	tracker := shutdown.NewTracker()
+	defer tracker.Add()()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := tracker.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	r := shutdown.NewReadiness()
+	if !r.IsReady() {
+		t.Fatal("new Readiness is not ready")
+	}
+	r.SetReady(false)
+	if r.IsReady() {
+		t.Fatal("still ready after SetReady(false)")
+	}
+}
@@ -0,0 +1,222 @@
+// Package tenant はリクエストのテナントの解決と、コンテキストによるテナントの受け渡しを提供します
+package tenant
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"otel-test/o11y"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// AttributeKey はスパン・ログ・メトリクスのテナントIDの属性
+const AttributeKey = "tenant.id"
+
+var (
+	// ErrMissing はテナントが指定されていない
+	ErrMissing = errors.New("tenant is not specified")
+	// ErrInvalid はテナントIDの形式が不正、または指定方法によってテナントが異なる
+	ErrInvalid = errors.New("invalid tenant")
+)
+
+// maxIDLength はテナントIDの最大長（DNSのラベルと同じ）
+const maxIDLength = 63
+
+// Valid はテナントIDが英小文字・数字・ハイフンで構成された63文字以内の文字列かを返します
+// サブドメインとしても使用できるよう、先頭と末尾のハイフンは認めない
+func Valid(id string) bool {
+	if id == "" || len(id) > maxIDLength || id[0] == '-' || id[len(id)-1] == '-' {
+		return false
+	}
+	for _, c := range id {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+type idKey struct{}
+
+// allTenantsKey は全てのテナントを対象にする処理のコンテキストのキー
+type allTenantsKey struct{}
+
+// WithID はテナントIDを設定したコンテキストを返します
+// テナントIDはコンテキストで作成したスパン・ログの属性tenant.idにもなる
+// メトリクスには付与しない（付与する場合はWithMetricAttribute）
+func WithID(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, idKey{}, id)
+	return o11y.ContextWithTraceAttributes(ctx, attribute.String(AttributeKey, id))
+}
+
+// WithMetricAttribute はコンテキストのテナントIDをメトリクスの属性tenant.idにも付与したコンテキストを返します
+// テナントの種類が限られている場合（Resolver.Bounded）にだけ使う
+func WithMetricAttribute(ctx context.Context) context.Context {
+	id, ok := FromContext(ctx)
+	if !ok {
+		return ctx
+	}
+	return o11y.ContextWithAttributes(ctx, attribute.String(AttributeKey, id))
+}
+
+// FromContext はコンテキストのテナントIDを返します
+func FromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(idKey{}).(string)
+	return id, ok && id != ""
+}
+
+// WithAllTenants は全てのテナントを対象にする処理（期限切れのデータの削除ジョブなど）のコンテキストを返します
+// テナントIDを設定したコンテキストでは、そのテナントが優先される
+func WithAllTenants(ctx context.Context) context.Context {
+	return context.WithValue(ctx, allTenantsKey{}, true)
+}
+
+// AllTenants はWithAllTenantsで全てのテナントを対象にしたコンテキストかを返します
+func AllTenants(ctx context.Context) bool {
+	all, _ := ctx.Value(allTenantsKey{}).(bool)
+	return all
+}
+
+// Config はリクエストのテナントを決める設定
+type Config struct {
+	// Header はテナントIDを指定するヘッダー（空の場合は使用しない）
+	Header string
+	// Domain はサブドメインをテナントIDとして扱うドメイン（空の場合は使用しない）
+	Domain string
+	// Claim はBearerトークンのテナントIDのクレーム（空の場合は使用しない）
+	Claim string
+	// Default はテナントを指定しないリクエストのテナント（空の場合はErrMissing）
+	Default string
+	// Allowed は受け付けるテナントID（空の場合は形式が正しければ受け付ける）
+	// Defaultは指定しなくても受け付ける
+	Allowed []string
+}
+
+// Resolver はリクエストのテナントを決める
+type Resolver struct {
+	config  Config
+	allowed map[string]bool
+}
+
+// NewResolver は新しいResolverを作成します
+func NewResolver(config Config) *Resolver {
+	config.Domain = strings.TrimPrefix(strings.ToLower(config.Domain), ".")
+	r := &Resolver{config: config}
+	if len(config.Allowed) > 0 {
+		r.allowed = map[string]bool{config.Default: true}
+		for _, id := range config.Allowed {
+			r.allowed[id] = true
+		}
+	}
+	return r
+}
+
+// Bounded はリクエストで決まるテナントの種類が限られているかを返します
+// Allowedを指定した場合と、リクエストでテナントを指定できない（全てDefault）場合
+// 限られていない場合、リクエストで指定された値をそのままメトリクスの属性にすると種類が際限なく増える
+func (r *Resolver) Bounded() bool {
+	return r.allowed != nil || (r.config.Header == "" && r.config.Domain == "" && r.config.Claim == "")
+}
+
+// Resolve はリクエストのテナントIDを返します
+//
+//   - Authorizationヘッダーのトークンのクレーム、ホストのサブドメイン、ヘッダーから取得する
+//   - 複数の方法で指定した場合は全て同じテナントでなければErrInvalid
+//   - どれも指定していない場合はデフォルトのテナント、デフォルトがない場合はErrMissing
+//   - Allowedにないテナントの場合はErrInvalid
+//
+// トークンの署名は検証しない。IAPやAPI Gatewayなど、前段で検証したトークンだけが届く構成を前提とする
+func (r *Resolver) Resolve(host string, get func(name string) string) (string, error) {
+	var id, source string
+	use := func(s, v string) error {
+		if v == "" {
+			return nil
+		}
+		if !Valid(v) {
+			return fmt.Errorf("%s %q: %w", s, v, ErrInvalid)
+		}
+		if id != "" && id != v {
+			return fmt.Errorf("%s %q does not match %s %q: %w", s, v, source, id, ErrInvalid)
+		}
+		id, source = v, s
+		return nil
+	}
+
+	if r.config.Claim != "" {
+		claim, err := r.claim(get("Authorization"))
+		if err != nil {
+			return "", err
+		}
+		if err := use("token claim "+r.config.Claim, claim); err != nil {
+			return "", err
+		}
+	}
+	if r.config.Domain != "" {
+		if err := use("subdomain", r.subdomain(host)); err != nil {
+			return "", err
+		}
+	}
+	if r.config.Header != "" {
+		if err := use("header "+r.config.Header, strings.TrimSpace(get(r.config.Header))); err != nil {
+			return "", err
+		}
+	}
+
+	if id == "" {
+		if r.config.Default == "" {
+			return "", ErrMissing
+		}
+		return r.config.Default, nil
+	}
+	if r.allowed != nil && !r.allowed[id] {
+		return "", fmt.Errorf("%s %q is not allowed: %w", source, id, ErrInvalid)
+	}
+	return id, nil
+}
+
+// subdomain はhostがacme.<Domain>の場合にacmeを返します
+func (r *Resolver) subdomain(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	sub, ok := strings.CutSuffix(host, "."+r.config.Domain)
+	if !ok || strings.Contains(sub, ".") {
+		return ""
+	}
+	return sub
+}
+
+// claim はAuthorization: Bearer <JWT>のペイロードのクレームを返します
+// Bearerトークンでない場合は空、JWTとして読めない場合はErrInvalid
+func (r *Resolver) claim(authorization string) (string, error) {
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return "", nil
+	}
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("bearer token is not a JWT: %w", ErrInvalid)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("bearer token payload: %w", errors.Join(ErrInvalid, err))
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("bearer token payload: %w", errors.Join(ErrInvalid, err))
+	}
+	switch v := claims[r.config.Claim].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	default:
+		return "", fmt.Errorf("token claim %s is not a string: %w", r.config.Claim, ErrInvalid)
+	}
+}
@@ -0,0 +1,131 @@
+package tenant
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"otel-test/o11y/o11ytest"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// bearer はペイロードがpayloadのJWT（署名は検証しないためダミー）のAuthorizationヘッダーを返します
+func bearer(payload string) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	return "Bearer " + enc([]byte(`{"alg":"none"}`)) + "." + enc([]byte(payload)) + ".sig"
+}
+
+func TestResolve(t *testing.T) {
+	r := NewResolver(Config{Header: "X-Tenant-ID", Domain: "example.com", Claim: "tenant_id", Default: "default"})
+
+	tests := []struct {
+		name    string
+		host    string
+		headers map[string]string
+		want    string
+		wantErr error
+	}{
+		{name: "default", host: "api.internal:8080", want: "default"},
+		{name: "header", headers: map[string]string{"X-Tenant-ID": "acme"}, want: "acme"},
+		{name: "subdomain", host: "acme.example.com:443", want: "acme"},
+		{name: "claim", headers: map[string]string{"Authorization": bearer(`{"tenant_id":"acme"}`)}, want: "acme"},
+		{name: "claim without tenant", headers: map[string]string{"Authorization": bearer(`{"sub":"taro"}`)}, want: "default"},
+		{name: "all sources agree", host: "acme.example.com", headers: map[string]string{
+			"X-Tenant-ID":   "acme",
+			"Authorization": bearer(`{"tenant_id":"acme"}`),
+		}, want: "acme"},
+		// トークンのテナント以外をヘッダーで指定することはできない
+		{name: "header does not match claim", headers: map[string]string{
+			"X-Tenant-ID":   "globex",
+			"Authorization": bearer(`{"tenant_id":"acme"}`),
+		}, wantErr: ErrInvalid},
+		{name: "header does not match subdomain", host: "acme.example.com", headers: map[string]string{"X-Tenant-ID": "globex"}, wantErr: ErrInvalid},
+		{name: "invalid header", headers: map[string]string{"X-Tenant-ID": "Acme_Corp"}, wantErr: ErrInvalid},
+		{name: "nested subdomain is ignored", host: "a.acme.example.com", want: "default"},
+		{name: "other domain is ignored", host: "acme.example.org", want: "default"},
+		{name: "malformed token", headers: map[string]string{"Authorization": "Bearer abc"}, wantErr: ErrInvalid},
+		{name: "non-string claim", headers: map[string]string{"Authorization": bearer(`{"tenant_id":1}`)}, wantErr: ErrInvalid},
+		{name: "basic auth is ignored", headers: map[string]string{"Authorization": "Basic dGFybzpwYXNz"}, want: "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.Resolve(tt.host, func(name string) string { return tt.headers[name] })
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Resolve() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveWithoutDefault(t *testing.T) {
+	r := NewResolver(Config{Header: "X-Tenant-ID"})
+	if _, err := r.Resolve("localhost", func(string) string { return "" }); !errors.Is(err, ErrMissing) {
+		t.Fatalf("err = %v, want %v", err, ErrMissing)
+	}
+}
+
+func TestResolveAllowed(t *testing.T) {
+	r := NewResolver(Config{Header: "X-Tenant-ID", Default: "default", Allowed: []string{"acme"}})
+	for header, wantErr := range map[string]error{"": nil, "acme": nil, "globex": ErrInvalid} {
+		if _, err := r.Resolve("localhost", func(string) string { return header }); !errors.Is(err, wantErr) {
+			t.Errorf("Resolve(%q) err = %v, want %v", header, err, wantErr)
+		}
+	}
+}
+
+func TestBounded(t *testing.T) {
+	for name, tt := range map[string]struct {
+		config Config
+		want   bool
+	}{
+		"default only": {Config{Default: "default"}, true},
+		"header":       {Config{Header: "X-Tenant-ID", Default: "default"}, false},
+		"claim":        {Config{Claim: "tenant_id"}, false},
+		"allowed":      {Config{Header: "X-Tenant-ID", Allowed: []string{"acme"}}, true},
+	} {
+		if got := NewResolver(tt.config).Bounded(); got != tt.want {
+			t.Errorf("%s: Bounded() = %v, want %v", name, got, tt.want)
+		}
+	}
+}
+
+func TestWithIDMetricAttribute(t *testing.T) {
+	h := o11ytest.New(t)
+	counter, _ := otel.Meter("test").Int64Counter("test.requests")
+	attr := attribute.String(AttributeKey, "acme")
+
+	// WithIDだけではメトリクスにテナントを付与しない
+	ctx, span := otel.Tracer("test").Start(WithID(context.Background(), "acme"), "request")
+	counter.Add(ctx, 1)
+	span.End()
+	h.Span("request").HasAttr(AttributeKey, "acme")
+	h.Metric("test.requests").WithAttrs(attr).HasPoints(0)
+
+	counter.Add(WithMetricAttribute(ctx), 1)
+	h.Metric("test.requests").WithAttrs(attr).HasValue(1)
+}
+
+func TestValid(t *testing.T) {
+	for id, want := range map[string]bool{
+		"acme":                  true,
+		"acme-2":                true,
+		"0":                     true,
+		"":                      false,
+		"-acme":                 false,
+		"acme-":                 false,
+		"Acme":                  false,
+		"acme.example":          false,
+		strings.Repeat("a", 64): false,
+	} {
+		if got := Valid(id); got != want {
+			t.Errorf("Valid(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
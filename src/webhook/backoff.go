@@ -0,0 +1,30 @@
+package webhook
+
+import "time"
+
+// Backoff は指数バックオフの設定
+type Backoff struct {
+	// Base は1回目の失敗後の待機時間
+	Base time.Duration
+	// Max は待機時間の上限
+	Max time.Duration
+}
+
+// Delay はattempt回目の失敗後に待機する時間を返します（attemptは1から）
+// Base * 2^(attempt-1) をMaxで打ち切る
+func (b Backoff) Delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	d := b.Base
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if b.Max > 0 && d >= b.Max {
+			return b.Max
+		}
+	}
+	if b.Max > 0 && d > b.Max {
+		return b.Max
+	}
+	return d
+}
@@ -0,0 +1,84 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 送信時に付与するヘッダー
+const (
+	// SignatureHeader は署名ヘッダー（t=<unix秒>,v1=<HMAC-SHA256>）
+	SignatureHeader = "X-Webhook-Signature"
+	// EventTypeHeader はイベントの種類
+	EventTypeHeader = "X-Webhook-Event"
+	// DeliveryHeader は配信ID（再送時も同じ値）
+	DeliveryHeader = "X-Webhook-Delivery"
+)
+
+// ErrLeaseLost はロックの期限が切れ、配信が別のインスタンスに再取得された
+var ErrLeaseLost = errors.New("webhook: delivery lease lost")
+
+// 署名の検証エラー
+var (
+	ErrInvalidSignatureHeader = errors.New("webhook: invalid signature header")
+	ErrSignatureMismatch      = errors.New("webhook: signature mismatch")
+	ErrTimestampOutOfRange    = errors.New("webhook: timestamp out of tolerance")
+)
+
+// Sign はタイムスタンプとボディのHMAC-SHA256署名ヘッダーを作成します
+// 署名対象は "<unix秒>.<ボディ>"
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", t, computeMAC(secret, t, body))
+}
+
+// Verify は署名ヘッダーを検証します
+// タイムスタンプがnowからtolerance以上ずれている場合はリプレイとみなす（toleranceが0の場合は確認しない）
+func Verify(secret, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	var t string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return ErrInvalidSignatureHeader
+		}
+		switch k {
+		case "t":
+			t = v
+		case "v1":
+			signatures = append(signatures, v)
+		}
+	}
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrInvalidSignatureHeader
+	}
+
+	if tolerance > 0 {
+		if d := now.Sub(time.Unix(unix, 0)); d > tolerance || d < -tolerance {
+			return ErrTimestampOutOfRange
+		}
+	}
+
+	expected := computeMAC(secret, t, body)
+	for _, sig := range signatures {
+		if hmac.Equal([]byte(sig), []byte(expected)) {
+			return nil
+		}
+	}
+	return ErrSignatureMismatch
+}
+
+func computeMAC(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,49 @@
+package webhook
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"type":"user.created"}`)
+	header := Sign("secret", now, body)
+
+	tests := []struct {
+		name    string
+		secret  string
+		header  string
+		body    []byte
+		now     time.Time
+		wantErr error
+	}{
+		{"valid", "secret", header, body, now, nil},
+		{"within tolerance", "secret", header, body, now.Add(4 * time.Minute), nil},
+		{"wrong secret", "other", header, body, now, ErrSignatureMismatch},
+		{"tampered body", "secret", header, []byte(`{"type":"user.deleted"}`), now, ErrSignatureMismatch},
+		{"replayed", "secret", header, body, now.Add(10 * time.Minute), ErrTimestampOutOfRange},
+		{"missing signature", "secret", "t=1700000000", body, now, ErrInvalidSignatureHeader},
+		{"malformed", "secret", "garbage", body, now, ErrInvalidSignatureHeader},
+		{"rotated secret", "secret", header + ",v1=deadbeef", body, now, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.secret, tt.header, tt.body, 5*time.Minute, tt.now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Base: time.Second, Max: 10 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, w := range want {
+		if got := b.Delay(i + 1); got != w {
+			t.Errorf("Delay(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+}